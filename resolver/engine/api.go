@@ -0,0 +1,452 @@
+package engine
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"iter"
+	"math/big"
+	"sort"
+	"strings"
+)
+
+// The Go API for embedding the engine.
+//
+// A program is loaded with Consult and queried with Query, which produces the solutions as
+// Bindings from the names of the query variables to Go values.  Go functions can be registered
+// as predicates with RegisterDet and RegisterNondet.
+//
+// A Store must not be used by more than one goroutine at a time: loading, querying, converting
+// terms and the callbacks of foreign predicates all share its state without locking.  Programs
+// that query from several goroutines use a Store for each, or serialize their calls to it.
+//
+// Terms are converted to Go values as follows, and Go values to terms in the opposite direction:
+//
+//   atom                  string
+//   string                string (a Go string converts to an atom)
+//   integer               int64, or *big.Int if it does not fit (any Go integer type converts)
+//   float                 float64 (float32 converts too)
+//   proper list           []any ([]string and []int64 convert to lists too)
+//   compound term         Compound
+//   unbound variable      Var
+//   Key-Value pairs       map[string]any converts to a list of pairs, ordered by key
+//
+// Maps convert one way only: ToGo never returns a map, so a list of pairs comes back as an []any
+// of Compound{"-", ...}.  Likewise true and false convert to bool from Go but come back as
+// strings.  Unbound variables in a solution are named after the first query variable they are
+// bound to, or _G1, _G2, ... if they are fresh.  Where a cyclic term refers back to itself it
+// converts to "...", as it is written.
+
+type Bindings map[string]any
+
+type Compound struct {
+	Functor string
+	Args    []any
+}
+
+// A Var is an unbound variable.  A Var that has been produced by the engine converts back to the
+// same variable.
+
+type Var struct {
+	Name string
+	slot *Varslot
+}
+
+// Load a program.  Queries in the program are run for their first solution.  Returns all the
+// errors in the program, joined, or the *Halt if the program halts.
+
+func (st *Store) Consult(r io.Reader) error {
+	rs, ok := r.(io.RuneScanner)
+	if !ok {
+		rs = bufio.NewReader(r)
+	}
+	var errs []error
+	err := st.Load("user", rs, Callbacks{
+		QuerySuccess: func(names []*Atom, vars []Varslot) bool { return true },
+		QueryFailure: func() {},
+		QueryError: func(err error) {
+			errs = append(errs, err)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	return errors.Join(errs...)
+}
+
+// Run a query, given as the text of a goal with or without a leading `?-` and the terminating
+// period, and return an iterator over its solutions.  The iteration ends after the last
+// solution, after an error, which is yielded, or when the context is done, in which case the
+// context's error is yielded if the query was between solutions and resource_error otherwise.
+// The query has the limits of the store.  The bindings do not include the anonymous variables.
+
+func (st *Store) Query(ctx context.Context, text string) iter.Seq2[Bindings, error] {
+	return func(yield func(Bindings, error) bool) {
+		goals, names, err := st.parseQuery(text)
+		if err != nil {
+			yield(nil, err)
+			return
+		}
+		q := st.NewQuery(goals, names)
+		q.SetContext(ctx)
+		defer q.Close()
+		for {
+			if err := ctx.Err(); err != nil {
+				yield(nil, err)
+				return
+			}
+			found, err := q.Next()
+			if err != nil {
+				yield(nil, err)
+				return
+			}
+			if !found || !yield(q.bindings(), nil) {
+				return
+			}
+		}
+	}
+}
+
+func (st *Store) parseQuery(text string) ([]RuleTerm, []*Atom, error) {
+	text = strings.TrimSpace(text)
+	if !strings.HasSuffix(text, ".") {
+		text += " ."
+	}
+	p := newReader(st, "query", strings.NewReader(text))
+	t, err := p.readClause()
+	if err != nil {
+		return nil, nil, err
+	}
+	if t == nil {
+		return nil, nil, fmt.Errorf("Empty query")
+	}
+	if s, ok := t.(*RuleStruct); ok && s.functor.name == "?-" && len(s.subterms) == 1 {
+		t = s.subterms[0]
+	}
+	if tok := p.peek(); tok.kind != tokEOF {
+		return nil, nil, fmt.Errorf("More than one query: %s", text)
+	}
+	return flattenConjunction(t), p.varNames(), nil
+}
+
+func (q *Query) bindings() Bindings {
+	c := newGoConverter()
+	for i, n := range q.names {
+		if n != nil {
+			if v, ok := deref(&q.vars[i]).(*Varslot); ok {
+				if _, found := c.varNames[v]; !found {
+					c.varNames[v] = n.name
+				}
+			}
+		}
+	}
+	b := make(Bindings)
+	for i, n := range q.names {
+		if n != nil {
+			b[n.name] = c.toGo(&q.vars[i])
+		}
+	}
+	return b
+}
+
+// Convert a term to a Go value.
+
+func ToGo(t ValueTerm) any {
+	return newGoConverter().toGo(t)
+}
+
+type goConverter struct {
+	varNames map[*Varslot]string
+
+	// The structures on the path to the term being converted, see cyclic.go.
+	path map[structKey]bool
+}
+
+func newGoConverter() *goConverter {
+	return &goConverter{varNames: make(map[*Varslot]string), path: make(map[structKey]bool)}
+}
+
+func (c *goConverter) toGo(t ValueTerm) any {
+	switch x := deref(t).(type) {
+	case *Varslot:
+		name, found := c.varNames[x]
+		if !found {
+			name = fmt.Sprintf("_G%d", len(c.varNames)+1)
+			c.varNames[x] = name
+		}
+		return Var{Name: name, slot: x}
+	case *Atom:
+		if x.name == "[]" {
+			return []any{}
+		}
+		return x.name
+	case *Number:
+		if x.big != nil {
+			return new(big.Int).Set(x.big)
+		}
+		return x.value
+	case *Float:
+		return x.value
+	case *String:
+		return x.value
+	case *ValueStruct:
+		if len(x.env) > 0 {
+			key := structKey{x.s, &x.env[0]}
+			if c.path[key] {
+				return "..."
+			}
+			c.path[key] = true
+			defer delete(c.path, key)
+		}
+		if elements, ok := c.listToGo(x); ok {
+			return elements
+		}
+		args := make([]any, len(x.s.subterms))
+		for i, s := range x.s.subterms {
+			args[i] = c.toGo(bind(s, x.env))
+		}
+		return Compound{Functor: x.s.functor.name, Args: args}
+	default:
+		panic("Unknown term type")
+	}
+}
+
+// A cyclic list is not a proper list.
+
+func (c *goConverter) listToGo(s *ValueStruct) ([]any, bool) {
+	elements := []any{}
+	cells := make(map[structKey]bool)
+	var t ValueTerm = s
+	for {
+		switch x := deref(t).(type) {
+		case *Atom:
+			if x.name == "[]" {
+				return elements, true
+			}
+			return nil, false
+		case *ValueStruct:
+			if !isListFunctor(x.s.functor, len(x.s.subterms)) {
+				return nil, false
+			}
+			if len(x.env) > 0 {
+				key := structKey{x.s, &x.env[0]}
+				if cells[key] {
+					return nil, false
+				}
+				cells[key] = true
+			}
+			elements = append(elements, c.toGo(bind(x.s.subterms[0], x.env)))
+			t = bind(x.s.subterms[1], x.env)
+		default:
+			return nil, false
+		}
+	}
+}
+
+// Convert a Go value to a term.  A Var that was not produced by the engine becomes a fresh
+// variable, with the same variable for every occurrence of the name in the value.
+
+func (st *Store) ToTerm(v any) (ValueTerm, error) {
+	return st.toTerm(v, make(map[string]*Varslot))
+}
+
+func (st *Store) toTerm(v any, vars map[string]*Varslot) (ValueTerm, error) {
+	switch x := v.(type) {
+	case ValueTerm:
+		return x, nil
+	case string:
+		return st.NewAtom(x), nil
+	case bool:
+		if x {
+			return st.trueAtom, nil
+		}
+		return st.NewAtom("false"), nil
+	case int:
+		return st.NewNumber(int64(x)), nil
+	case int8:
+		return st.NewNumber(int64(x)), nil
+	case int16:
+		return st.NewNumber(int64(x)), nil
+	case int32:
+		return st.NewNumber(int64(x)), nil
+	case int64:
+		return st.NewNumber(x), nil
+	case uint8:
+		return st.NewNumber(int64(x)), nil
+	case uint16:
+		return st.NewNumber(int64(x)), nil
+	case uint32:
+		return st.NewNumber(int64(x)), nil
+	case uint:
+		return st.NewBigNumber(new(big.Int).SetUint64(uint64(x))), nil
+	case uint64:
+		return st.NewBigNumber(new(big.Int).SetUint64(x)), nil
+	case *big.Int:
+		return st.NewBigNumber(new(big.Int).Set(x)), nil
+	case float32:
+		return st.NewFloat(float64(x)), nil
+	case float64:
+		return st.NewFloat(x), nil
+	case Var:
+		if x.slot != nil {
+			return x.slot, nil
+		}
+		slot, found := vars[x.Name]
+		if !found || x.Name == "_" {
+			slot = &Varslot{}
+			vars[x.Name] = slot
+		}
+		return slot, nil
+	case Compound:
+		if len(x.Args) == 0 {
+			return st.NewAtom(x.Functor), nil
+		}
+		args, err := st.toTerms(x.Args, vars)
+		if err != nil {
+			return nil, err
+		}
+		return newValueStruct(st.NewAtom(x.Functor), args), nil
+	case []any:
+		elements, err := st.toTerms(x, vars)
+		if err != nil {
+			return nil, err
+		}
+		return st.newList(elements, st.nilAtom), nil
+	case []string:
+		elements := make([]ValueTerm, len(x))
+		for i, s := range x {
+			elements[i] = st.NewAtom(s)
+		}
+		return st.newList(elements, st.nilAtom), nil
+	case []int64:
+		elements := make([]ValueTerm, len(x))
+		for i, n := range x {
+			elements[i] = st.NewNumber(n)
+		}
+		return st.newList(elements, st.nilAtom), nil
+	case map[string]any:
+		keys := make([]string, 0, len(x))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		pairs := make([]ValueTerm, len(keys))
+		minus := st.NewAtom("-")
+		for i, k := range keys {
+			val, err := st.toTerm(x[k], vars)
+			if err != nil {
+				return nil, err
+			}
+			pairs[i] = newValueStruct(minus, []ValueTerm{st.NewAtom(k), val})
+		}
+		return st.newList(pairs, st.nilAtom), nil
+	default:
+		return nil, fmt.Errorf("Cannot convert %T to a term", v)
+	}
+}
+
+func (st *Store) toTerms(vs []any, vars map[string]*Varslot) ([]ValueTerm, error) {
+	ts := make([]ValueTerm, len(vs))
+	for i, v := range vs {
+		t, err := st.toTerm(v, vars)
+		if err != nil {
+			return nil, err
+		}
+		ts[i] = t
+	}
+	return ts, nil
+}
+
+// Foreign predicates.  A foreign predicate is called with its arguments converted to Go values
+// and produces solutions as slices of Go values, one for each argument.  Each value in a solution
+// is converted to a term and unified with the argument, except that nil leaves the argument
+// alone.  An error is raised in the engine as
+// error(system_error(Message), context(Name/Arity, _)).
+//
+// A foreign predicate is a built-in: it takes precedence over clauses for the same predicate.
+
+// Register a deterministic predicate.  The function returns a solution, or nil if there is none.
+
+func (st *Store) RegisterDet(name string, arity int, f func(args []any) ([]any, error)) {
+	st.addBuiltin(name, arity, func(m *machine, args []ValueTerm) bool {
+		solution, err := f(argsToGo(args))
+		if err != nil {
+			m.st.foreignError(err)
+		}
+		return solution != nil && m.unifySolution(args, solution)
+	})
+}
+
+// Register a nondeterministic predicate.  The function returns a sequence of solutions, which is
+// consumed as the engine backtracks into the predicate and abandoned if the predicate is cut.
+
+func (st *Store) RegisterNondet(name string, arity int, f func(args []any) iter.Seq[[]any]) {
+	st.addBuiltin(name, arity, func(m *machine, args []ValueTerm) bool {
+		next, stop := iter.Pull(f(argsToGo(args)))
+		cp := m.choicepoint(m.cont)
+		cp.actuals = args
+		cp.foreign = &foreignCall{key: m.st.current, next: next, stop: stop}
+		m.chps = append(m.chps, cp)
+		return m.retryForeign(len(m.chps) - 1)
+	})
+}
+
+type foreignCall struct {
+	key  predicateKey
+	next func() ([]any, bool)
+	stop func()
+}
+
+// Unify the arguments with the next solution of the foreign call in the choicepoint at `top`,
+// which is the top of the stack.  The choicepoint is removed when there are no more solutions.
+
+func (m *machine) retryForeign(top int) bool {
+	cp := m.chps[top]
+	m.st.current = cp.foreign.key
+	for {
+		solution, ok := cp.foreign.next()
+		if !ok {
+			m.cutTo(top)
+			return false
+		}
+		if m.unifySolution(cp.actuals, solution) {
+			return true
+		}
+		m.undoTrail(cp.trailMark)
+	}
+}
+
+func (m *machine) unifySolution(args []ValueTerm, solution []any) bool {
+	if len(solution) != len(args) {
+		m.st.foreignError(fmt.Errorf("Solution has %d values, expected %d", len(solution), len(args)))
+	}
+	vars := make(map[string]*Varslot)
+	for i, v := range solution {
+		if v == nil {
+			continue
+		}
+		t, err := m.st.toTerm(v, vars)
+		if err != nil {
+			m.st.foreignError(err)
+		}
+		if !m.unify(args[i], t) {
+			return false
+		}
+	}
+	return true
+}
+
+func argsToGo(args []ValueTerm) []any {
+	c := newGoConverter()
+	values := make([]any, len(args))
+	for i, a := range args {
+		values[i] = c.toGo(a)
+	}
+	return values
+}
+
+func (st *Store) foreignError(err error) {
+	st.raise(newValueStruct(st.NewAtom("system_error"), []ValueTerm{st.NewAtom(err.Error())}))
+}
@@ -0,0 +1,190 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"iter"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func collect(t *testing.T, st *Store, query string) []Bindings {
+	t.Helper()
+	solutions := []Bindings{}
+	for b, err := range st.Query(context.Background(), query) {
+		if err != nil {
+			t.Fatalf("%s: %v", query, err)
+		}
+		for k, v := range b {
+			b[k] = withoutSlots(v)
+		}
+		solutions = append(solutions, b)
+	}
+	return solutions
+}
+
+// Vars are compared by name.
+
+func withoutSlots(v any) any {
+	switch x := v.(type) {
+	case Var:
+		return Var{Name: x.Name}
+	case Compound:
+		return Compound{x.Functor, withoutSlots(x.Args).([]any)}
+	case []any:
+		values := make([]any, len(x))
+		for i, e := range x {
+			values[i] = withoutSlots(e)
+		}
+		return values
+	}
+	return v
+}
+
+func expectSolutions(t *testing.T, st *Store, query string, expected []Bindings) {
+	t.Helper()
+	if got := collect(t, st, query); !reflect.DeepEqual(got, expected) {
+		t.Fatalf("%s: got %#v, expected %#v", query, got, expected)
+	}
+}
+
+func TestConsultAndQuery(t *testing.T) {
+	st := NewStore()
+	if err := st.Consult(strings.NewReader(family + `
+grandfather(X, Y) :- father(X, Z), father(Z, Y).
+`)); err != nil {
+		t.Fatal(err)
+	}
+	expectSolutions(t, st, "grandfather(X, Y)", []Bindings{
+		{"X": "haakon", "Y": "harald"},
+		{"X": "olav", "Y": "haakon_magnus"},
+		{"X": "harald", "Y": "ingrid_alexandra"},
+	})
+	expectSolutions(t, st, "?- father(olav, X).", []Bindings{{"X": "harald"}})
+	expectSolutions(t, st, "father(nobody, _)", []Bindings{})
+	expectSolutions(t, st, "X = f(1, [a, B], B, Y), Y = B", []Bindings{{
+		"X": Compound{"f", []any{int64(1), []any{"a", Var{Name: "B"}}, Var{Name: "B"}, Var{Name: "B"}}},
+		"B": Var{Name: "B"},
+		"Y": Var{Name: "B"},
+	}})
+}
+
+func TestQueryErrors(t *testing.T) {
+	st := NewStore()
+	if err := st.Consult(strings.NewReader("p(1).\np(.\n?- X is foo.\n")); err == nil ||
+		!strings.Contains(err.Error(), "user:2:3: syntax error") ||
+		!strings.Contains(err.Error(), "user:3: error(type_error(evaluable,foo/0),context((is)/2,_A))") {
+		t.Fatalf("Unexpected consult error: %v", err)
+	}
+	for _, query := range []string{"p(", "X is 1/0"} {
+		count := 0
+		for _, err := range st.Query(context.Background(), query) {
+			if err == nil {
+				t.Fatalf("%s: expected an error", query)
+			}
+			count++
+		}
+		if count != 1 {
+			t.Fatalf("%s: expected one error, got %d", query, count)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, err := range st.Query(ctx, "p(X)") {
+		if !errors.Is(err, context.Canceled) {
+			t.Fatalf("Expected cancellation, got %v", err)
+		}
+	}
+}
+
+func TestQueryBreak(t *testing.T) {
+	st := NewStore()
+	for b := range st.Query(context.Background(), "member(X, [1, 2, 3])") {
+		if b["X"] != int64(1) {
+			t.Fatalf("Unexpected %v", b)
+		}
+		break
+	}
+	expectSolutions(t, st, "member(X, [a])", []Bindings{{"X": "a"}})
+}
+
+func TestConversion(t *testing.T) {
+	st := NewStore()
+	for _, test := range []struct {
+		value    any
+		expected string
+	}{
+		{"hello", "hello"},
+		{42, "42"},
+		{int64(-7), "-7"},
+		{true, "true"},
+		{[]any{"a", 1, []any{}}, "[a,1,[]]"},
+		{[]string{"x", "y"}, "[x,y]"},
+		{map[string]any{"b": 2, "a": "one"}, "[a-one,b-2]"},
+		{Compound{"point", []any{1, 2}}, "point(1,2)"},
+		{Compound{"f", []any{Var{Name: "X"}, Var{Name: "X"}}}, "f(_A,_A)"},
+		{2.5, "2.5"},
+		{uint64(1 << 63), "9223372036854775808"},
+	} {
+		term, err := st.ToTerm(test.value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := []*Atom{st.NewAtom("T")}
+		vars := []Varslot{{val: term}}
+		if got := st.FormatBindings(names, vars)[0]; got != "T = "+test.expected {
+			t.Errorf("%v: got %s, expected %s", test.value, got, test.expected)
+		}
+	}
+	if _, err := st.ToTerm(1.5i); err == nil {
+		t.Error("Expected an error for a complex number")
+	}
+	term, _ := st.ToTerm([]any{"a", Compound{"f", []any{int64(1)}}})
+	if got := ToGo(term); !reflect.DeepEqual(got, []any{"a", Compound{"f", []any{int64(1)}}}) {
+		t.Errorf("Round trip: got %#v", got)
+	}
+	expectSolutions(t, st, "X = f(X, a), L = [b|L]", []Bindings{{
+		"X": Compound{"f", []any{"...", "a"}},
+		"L": Compound{".", []any{"b", "..."}},
+	}})
+}
+
+func TestForeignPredicates(t *testing.T) {
+	st := NewStore()
+	st.RegisterDet("upcase", 2, func(args []any) ([]any, error) {
+		s, ok := args[0].(string)
+		if !ok {
+			return nil, fmt.Errorf("not an atom: %v", args[0])
+		}
+		return []any{nil, strings.ToUpper(s)}, nil
+	})
+	st.RegisterNondet("between", 3, func(args []any) iter.Seq[[]any] {
+		return func(yield func([]any) bool) {
+			lo, hi := args[0].(int64), args[1].(int64)
+			for i := lo; i <= hi; i++ {
+				if !yield([]any{nil, nil, i}) {
+					return
+				}
+			}
+		}
+	})
+	expectSolutions(t, st, "upcase(abc, X)", []Bindings{{"X": "ABC"}})
+	expectSolutions(t, st, "upcase(abc, 'ABC')", []Bindings{{}})
+	expectSolutions(t, st, "upcase(abc, abc)", []Bindings{})
+	expectSolutions(t, st, "between(1, 3, X)", []Bindings{{"X": int64(1)}, {"X": int64(2)}, {"X": int64(3)}})
+	expectSolutions(t, st, "between(1, 3, 2)", []Bindings{{}})
+	expectSolutions(t, st, "between(1, 1000000, X), X > 2, !", []Bindings{{"X": int64(3)}})
+	expectSolutions(t, st, "findall(X-Y, (between(1, 2, X), between(X, 2, Y)), L)", []Bindings{{
+		"L": []any{Compound{"-", []any{int64(1), int64(1)}}, Compound{"-", []any{int64(1), int64(2)}},
+			Compound{"-", []any{int64(2), int64(2)}}},
+		"X": Var{Name: "X"},
+		"Y": Var{Name: "Y"},
+	}})
+	for _, err := range st.Query(context.Background(), "upcase(1, X)") {
+		if err == nil || err.Error() != "error(system_error('not an atom: 1'),context(upcase/2,_A))" {
+			t.Fatalf("Unexpected error %v", err)
+		}
+	}
+}
@@ -0,0 +1,635 @@
+package engine
+
+import (
+	"math"
+	"math/big"
+	"math/bits"
+)
+
+// Arithmetic evaluation for is/2 and the arithmetic comparisons.
+//
+// Numbers are integers of unbounded size and IEEE floats.  Integer arithmetic is done on int64
+// while the results fit and on big.Int when they do not, so it never overflows; an operation on
+// an integer and a float converts the integer to a float.  `/` on integers gives an integer if
+// the division is exact and a float otherwise, `//` truncates towards zero.  A float operation
+// whose result would be infinite is a float_overflow evaluation error, and one whose result is
+// not a number is undefined.
+//
+// The functions are described by their integer and float cases.  A function that has no integer
+// case converts integer arguments to floats, and one that has no float case requires integers.
+
+type unaryFunction struct {
+	ints   func(st *Store, x *Number) ValueTerm
+	floats func(st *Store, x float64) ValueTerm
+}
+
+type binaryFunction struct {
+	ints   func(st *Store, x, y *Number) ValueTerm
+	floats func(st *Store, x, y float64) ValueTerm
+}
+
+// The evaluated term, a *Number or a *Float.
+
+func (st *Store) evaluate(t ValueTerm) ValueTerm {
+	switch x := deref(t).(type) {
+	case *Number:
+		return x
+	case *Float:
+		return x
+	case *Varslot:
+		st.instantiationError()
+	case *Atom:
+		if c, ok := arithConstants[x.name]; ok {
+			return c
+		}
+		st.typeError("evaluable", st.indicator(x, 0))
+	case *String:
+		// A string of one character is its code, as in "a" + 0
+		if r := []rune(x.value); len(r) == 1 {
+			return st.NewNumber(int64(r[0]))
+		}
+		st.typeError("evaluable", x)
+	case *ValueStruct:
+		args := bind_terms(x.s.subterms, x.env)
+		switch len(args) {
+		case 1:
+			if f, ok := unaryFunctions[x.s.functor.name]; ok {
+				return st.apply1(f, st.evaluate(args[0]))
+			}
+		case 2:
+			if f, ok := binaryFunctions[x.s.functor.name]; ok {
+				return st.apply2(f, st.evaluate(args[0]), st.evaluate(args[1]))
+			}
+			if isListFunctor(x.s.functor, 2) && isNil(deref(args[1])) {
+				// [X] evaluates X, so that "a" is a code where the flag double_quotes is codes
+				return st.evaluate(args[0])
+			}
+		}
+		st.typeError("evaluable", st.indicator(x.s.functor, len(args)))
+	}
+	panic("Unknown term type")
+}
+
+func (st *Store) apply1(f unaryFunction, x ValueTerm) ValueTerm {
+	if n, ok := x.(*Number); ok && f.ints != nil {
+		return f.ints(st, n)
+	}
+	if f.floats == nil {
+		st.typeError("integer", x)
+	}
+	return f.floats(st, toFloat(st, x))
+}
+
+func (st *Store) apply2(f binaryFunction, x, y ValueTerm) ValueTerm {
+	n1, ok1 := x.(*Number)
+	n2, ok2 := y.(*Number)
+	if ok1 && ok2 && f.ints != nil {
+		return f.ints(st, n1, n2)
+	}
+	if f.floats == nil {
+		if !ok1 {
+			st.typeError("integer", x)
+		}
+		st.typeError("integer", y)
+	}
+	return f.floats(st, toFloat(st, x), toFloat(st, y))
+}
+
+// The value of an evaluated term as a float.
+
+func toFloat(st *Store, x ValueTerm) float64 {
+	switch n := x.(type) {
+	case *Float:
+		return n.value
+	case *Number:
+		if n.big == nil {
+			return float64(n.value)
+		}
+		f, _ := new(big.Float).SetInt(n.big).Float64()
+		if math.IsInf(f, 0) {
+			st.evaluationError("float_overflow")
+		}
+		return f
+	}
+	panic("Not a number")
+}
+
+// A float result, which must be finite.
+
+func (st *Store) newFloat(x float64) ValueTerm {
+	if math.IsInf(x, 0) {
+		st.evaluationError("float_overflow")
+	}
+	if math.IsNaN(x) {
+		st.evaluationError("undefined")
+	}
+	return st.NewFloat(x)
+}
+
+// Evaluate two terms and compare their values, for the arithmetic comparisons.
+
+func (st *Store) compareArith(x, y ValueTerm) int {
+	return compareNumbers(st.evaluate(x), st.evaluate(y))
+}
+
+// Compare two evaluated numbers by value.  Integers and floats are compared exactly.
+
+func compareNumbers(x, y ValueTerm) int {
+	n1, ok1 := x.(*Number)
+	n2, ok2 := y.(*Number)
+	switch {
+	case ok1 && ok2:
+		if n1.big == nil && n2.big == nil {
+			return cmpInt64(n1.value, n2.value)
+		}
+		return n1.bigValue().Cmp(n2.bigValue())
+	case !ok1 && !ok2:
+		f1, f2 := x.(*Float).value, y.(*Float).value
+		switch {
+		case f1 < f2:
+			return -1
+		case f1 > f2:
+			return 1
+		default:
+			return 0
+		}
+	default:
+		return exactFloat(x).Cmp(exactFloat(y))
+	}
+}
+
+func cmpInt64(x, y int64) int {
+	switch {
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	default:
+		return 0
+	}
+}
+
+func exactFloat(x ValueTerm) *big.Float {
+	if n, ok := x.(*Number); ok {
+		return new(big.Float).SetInt(n.bigValue())
+	}
+	return big.NewFloat(x.(*Float).value)
+}
+
+func isZero(n *Number) bool {
+	return n.big == nil && n.value == 0
+}
+
+func sign(n *Number) int {
+	if n.big != nil {
+		return n.big.Sign()
+	}
+	return cmpInt64(n.value, 0)
+}
+
+// An integer operation with a fast case for int64 operands, which reports whether the result
+// fits, and a case for big.Int operands.
+
+func intOp(x, y *Number, small func(a, b int64) (int64, bool), large func(z, a, b *big.Int) *big.Int) *Number {
+	if x.big == nil && y.big == nil {
+		if r, ok := small(x.value, y.value); ok {
+			return &Number{value: r}
+		}
+	}
+	return newInteger(large(new(big.Int), x.bigValue(), y.bigValue()))
+}
+
+func intAdd(x, y *Number) *Number {
+	return intOp(x, y, func(a, b int64) (int64, bool) {
+		r := a + b
+		return r, (r > a) == (b > 0)
+	}, (*big.Int).Add)
+}
+
+func intSub(x, y *Number) *Number {
+	return intOp(x, y, func(a, b int64) (int64, bool) {
+		r := a - b
+		return r, (r < a) == (b > 0)
+	}, (*big.Int).Sub)
+}
+
+func intMul(x, y *Number) *Number {
+	return intOp(x, y, func(a, b int64) (int64, bool) {
+		hi, lo := bits.Mul64(uint64(abs64(a)), uint64(abs64(b)))
+		if hi != 0 || lo > math.MaxInt64 || a == math.MinInt64 || b == math.MinInt64 {
+			return 0, false
+		}
+		if (a < 0) != (b < 0) {
+			return -int64(lo), true
+		}
+		return int64(lo), true
+	}, (*big.Int).Mul)
+}
+
+func abs64(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func (st *Store) checkDivisor(y *Number) {
+	if isZero(y) {
+		st.evaluationError("zero_divisor")
+	}
+}
+
+// Integer division truncating towards zero.
+
+func (st *Store) intDiv(x, y *Number) *Number {
+	st.checkDivisor(y)
+	return intOp(x, y, func(a, b int64) (int64, bool) {
+		return a / b, a != math.MinInt64 || b != -1
+	}, (*big.Int).Quo)
+}
+
+func (st *Store) intRem(x, y *Number) *Number {
+	st.checkDivisor(y)
+	return intOp(x, y, func(a, b int64) (int64, bool) {
+		if b == -1 {
+			return 0, true
+		}
+		return a % b, true
+	}, (*big.Int).Rem)
+}
+
+// The remainder with the sign of the divisor.
+
+func (st *Store) intMod(x, y *Number) *Number {
+	m := st.intRem(x, y)
+	if !isZero(m) && sign(m) != sign(y) {
+		m = intAdd(m, y)
+	}
+	return m
+}
+
+// The largest integer that arithmetic will create, in bits, so that a mistaken 2 ** 2 ** 40 is an
+// error rather than a hang.
+
+const maxIntegerBits = 1 << 24
+
+func (st *Store) checkIntegerSize(bits int64) {
+	if bits > maxIntegerBits {
+		st.raise(newValueStruct(st.NewAtom("resource_error"), []ValueTerm{st.NewAtom("memory")}))
+	}
+}
+
+func (st *Store) power(x, y *Number) ValueTerm {
+	if sign(y) < 0 {
+		if x.big == nil && (x.value == 1 || x.value == -1) {
+			if x.value == -1 && y.bigValue().Bit(0) == 1 {
+				return x
+			}
+			return st.NewNumber(1)
+		}
+		st.checkDivisor(x)
+		st.typeError("float", x)
+	}
+	if x.big == nil && x.value >= -1 && x.value <= 1 {
+		if isZero(y) || x.value == -1 && y.bigValue().Bit(0) == 0 {
+			return st.NewNumber(1)
+		}
+		return x
+	}
+	// |x| >= 2, so the result has at least y bits
+	if y.big != nil || y.value > maxIntegerBits {
+		st.checkIntegerSize(math.MaxInt64)
+	}
+	st.checkIntegerSize(int64(x.bigValue().BitLen()-1) * y.value)
+	return newInteger(new(big.Int).Exp(x.bigValue(), y.bigValue(), nil))
+}
+
+func (st *Store) shift(x, y *Number, left bool) ValueTerm {
+	if sign(y) < 0 {
+		y, left = intSub(&Number{}, y), !left
+	}
+	if left {
+		if isZero(x) {
+			return x
+		}
+		if y.big != nil || y.value > maxIntegerBits {
+			st.checkIntegerSize(math.MaxInt64)
+		}
+		st.checkIntegerSize(int64(x.bigValue().BitLen()) + y.value)
+		return newInteger(new(big.Int).Lsh(x.bigValue(), uint(y.value)))
+	}
+	if y.big != nil || y.value > int64(x.bigValue().BitLen()) {
+		// All the bits are shifted out
+		if sign(x) < 0 {
+			return st.NewNumber(-1)
+		}
+		return st.NewNumber(0)
+	}
+	if x.big == nil {
+		return st.NewNumber(x.value >> y.value)
+	}
+	return newInteger(new(big.Int).Rsh(x.big, uint(y.value)))
+}
+
+// The integer of a float that has no fraction.
+
+func (st *Store) floatToInteger(f float64) ValueTerm {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		st.evaluationError("undefined")
+	}
+	if f >= math.MinInt64 && f < math.MaxInt64 {
+		return st.NewNumber(int64(f))
+	}
+	n, _ := big.NewFloat(f).Int(nil)
+	return newInteger(n)
+}
+
+var arithConstants = map[string]ValueTerm{
+	"max_tagged_integer": &Number{value: math.MaxInt64},
+	"min_tagged_integer": &Number{value: math.MinInt64},
+	"pi":                 &Float{value: math.Pi},
+	"e":                  &Float{value: math.E},
+	"epsilon":            &Float{value: math.Nextafter(1, 2) - 1},
+	"max_float":          &Float{value: math.MaxFloat64},
+}
+
+func floatFunction(f func(x float64) float64) func(st *Store, x float64) ValueTerm {
+	return func(st *Store, x float64) ValueTerm {
+		return st.newFloat(f(x))
+	}
+}
+
+// A float function that is undefined outside a domain.
+
+func partialFunction(f func(x float64) float64, defined func(x float64) bool) func(st *Store, x float64) ValueTerm {
+	return func(st *Store, x float64) ValueTerm {
+		if !defined(x) {
+			st.evaluationError("undefined")
+		}
+		return st.newFloat(f(x))
+	}
+}
+
+// A float to integer conversion.
+
+func roundingFunction(f func(x float64) float64) unaryFunction {
+	return unaryFunction{
+		ints: func(st *Store, x *Number) ValueTerm {
+			return x
+		},
+		floats: func(st *Store, x float64) ValueTerm {
+			return st.floatToInteger(f(x))
+		},
+	}
+}
+
+var unaryFunctions = map[string]unaryFunction{
+	"-": {
+		ints: func(st *Store, x *Number) ValueTerm {
+			return intSub(&Number{}, x)
+		},
+		floats: func(st *Store, x float64) ValueTerm {
+			return st.NewFloat(-x)
+		},
+	},
+	"+": {
+		ints: func(st *Store, x *Number) ValueTerm {
+			return x
+		},
+		floats: func(st *Store, x float64) ValueTerm {
+			return st.NewFloat(x)
+		},
+	},
+	"abs": {
+		ints: func(st *Store, x *Number) ValueTerm {
+			if sign(x) < 0 {
+				return intSub(&Number{}, x)
+			}
+			return x
+		},
+		floats: floatFunction(math.Abs),
+	},
+	"sign": {
+		ints: func(st *Store, x *Number) ValueTerm {
+			return st.NewNumber(int64(sign(x)))
+		},
+		floats: func(st *Store, x float64) ValueTerm {
+			switch {
+			case x < 0:
+				return st.NewFloat(-1)
+			case x > 0:
+				return st.NewFloat(1)
+			default:
+				return st.NewFloat(0)
+			}
+		},
+	},
+	"\\": {
+		ints: func(st *Store, x *Number) ValueTerm {
+			if x.big == nil {
+				return st.NewNumber(^x.value)
+			}
+			return newInteger(new(big.Int).Not(x.big))
+		},
+	},
+	"msb": {
+		ints: func(st *Store, x *Number) ValueTerm {
+			if sign(x) <= 0 {
+				st.typeError("not_less_than_one", x)
+			}
+			return st.NewNumber(int64(x.bigValue().BitLen() - 1))
+		},
+	},
+	"float": {
+		floats: floatFunction(func(x float64) float64 { return x }),
+	},
+	"integer":  roundingFunction(math.Round),
+	"round":    roundingFunction(math.Round),
+	"truncate": roundingFunction(math.Trunc),
+	"ceiling":  roundingFunction(math.Ceil),
+	"floor":    roundingFunction(math.Floor),
+	"float_integer_part": {
+		floats: floatFunction(math.Trunc),
+	},
+	"float_fractional_part": {
+		floats: floatFunction(func(x float64) float64 { return x - math.Trunc(x) }),
+	},
+	"sqrt": {
+		floats: partialFunction(math.Sqrt, func(x float64) bool { return x >= 0 }),
+	},
+	"exp": {
+		floats: floatFunction(math.Exp),
+	},
+	"log": {
+		floats: partialFunction(math.Log, func(x float64) bool { return x > 0 }),
+	},
+	"log2": {
+		floats: partialFunction(math.Log2, func(x float64) bool { return x > 0 }),
+	},
+	"sin": {
+		floats: floatFunction(math.Sin),
+	},
+	"cos": {
+		floats: floatFunction(math.Cos),
+	},
+	"tan": {
+		floats: floatFunction(math.Tan),
+	},
+	"asin": {
+		floats: partialFunction(math.Asin, func(x float64) bool { return x >= -1 && x <= 1 }),
+	},
+	"acos": {
+		floats: partialFunction(math.Acos, func(x float64) bool { return x >= -1 && x <= 1 }),
+	},
+	"atan": {
+		floats: floatFunction(math.Atan),
+	},
+}
+
+var binaryFunctions = map[string]binaryFunction{
+	"+": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return intAdd(x, y)
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(x + y)
+		},
+	},
+	"-": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return intSub(x, y)
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(x - y)
+		},
+	},
+	"*": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return intMul(x, y)
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(x * y)
+		},
+	},
+	"/": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			if isZero(st.intRem(x, y)) {
+				return st.intDiv(x, y)
+			}
+			return st.newFloat(toFloat(st, x) / toFloat(st, y))
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			if y == 0 {
+				st.evaluationError("zero_divisor")
+			}
+			return st.newFloat(x / y)
+		},
+	},
+	"//": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return st.intDiv(x, y)
+		},
+	},
+	"rem": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return st.intRem(x, y)
+		},
+	},
+	"mod": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return st.intMod(x, y)
+		},
+	},
+	"div": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			// Division rounding towards negative infinity
+			return st.intDiv(intSub(x, st.intMod(x, y)), y)
+		},
+	},
+	"min": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			if compareNumbers(x, y) <= 0 {
+				return x
+			}
+			return y
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.NewFloat(math.Min(x, y))
+		},
+	},
+	"max": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			if compareNumbers(x, y) >= 0 {
+				return x
+			}
+			return y
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.NewFloat(math.Max(x, y))
+		},
+	},
+	"gcd": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return newInteger(new(big.Int).GCD(nil, nil, x.bigValue(), y.bigValue()))
+		},
+	},
+	"**": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			if sign(y) < 0 {
+				return st.newFloat(math.Pow(toFloat(st, x), toFloat(st, y)))
+			}
+			return st.power(x, y)
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(math.Pow(x, y))
+		},
+	},
+	"^": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return st.power(x, y)
+		},
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(math.Pow(x, y))
+		},
+	},
+	"atan2": {
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(math.Atan2(x, y))
+		},
+	},
+	"atan": {
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.newFloat(math.Atan2(x, y))
+		},
+	},
+	"copysign": {
+		floats: func(st *Store, x, y float64) ValueTerm {
+			return st.NewFloat(math.Copysign(x, y))
+		},
+	},
+	">>": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return st.shift(x, y, false)
+		},
+	},
+	"<<": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return st.shift(x, y, true)
+		},
+	},
+	"/\\": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return intOp(x, y, func(a, b int64) (int64, bool) { return a & b, true }, (*big.Int).And)
+		},
+	},
+	"\\/": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return intOp(x, y, func(a, b int64) (int64, bool) { return a | b, true }, (*big.Int).Or)
+		},
+	},
+	"xor": {
+		ints: func(st *Store, x, y *Number) ValueTerm {
+			return intOp(x, y, func(a, b int64) (int64, bool) { return a ^ b, true }, (*big.Int).Xor)
+		},
+	},
+}
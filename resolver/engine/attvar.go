@@ -0,0 +1,168 @@
+package engine
+
+// Attributed variables, and the coroutining predicates built on them.
+//
+// A variable can carry attributes, each a value stored under the name of a module.  put_attr/3,
+// get_attr/3 and del_attr/2 manage them, and attvar/1 tests whether a variable has any.  When an
+// attributed variable is bound to a value, or to another attributed variable, the hook of each
+// of its attributes is called after the unification as
+//
+//   Module:attr_unify_hook(Value, Other)
+//
+// where Value is the value of the attribute and Other is what the variable was bound to.  If a
+// hook fails then so does the unification.  The hooks of the library's attributes are handled
+// in system.pl, those of other modules are the clauses of attr_unify_hook/2 in the module.
+//
+// The attributes of a varslot are set when it is created and never change.  Putting an
+// attribute on a variable links its canonical varslot to a new varslot with the new attributes,
+// which is a binding that is trailed and undone on backtracking like any other, see machine.go.
+// The link does not run any hooks.  Unifying a plain variable with an attributed one links the
+// plain one to the attributed one, which does not run the hooks either.
+//
+// Binding an attributed variable records a wakeup on the machine.  Before the machine solves
+// the next goal it pushes the hooks of the pending wakeups on the continuation, so that the hooks
+// of the bindings made by head unification run before the body of the clause.  Undoing a binding
+// discards its wakeup.
+//
+// copy_term/2, findall/3 and assert copy an attributed variable as a plain variable.
+//
+// freeze(X, G) delays G until X is bound, dif(X, Y) delays until X and Y can no longer become
+// equal and fails if they become equal, and when(Condition, G) delays G until the condition,
+// which is nonvar(X), ground(X), ?=(X, Y), or a conjunction or disjunction of them, is true.
+// They are defined in system.pl, with unifiable/3, which computes the bindings that would make
+// two terms equal.
+
+type attribute struct {
+	module *Atom
+	value  ValueTerm
+	next   *attribute
+}
+
+// The attribute of the module, or nil.
+
+func (a *attribute) lookup(module *Atom) *attribute {
+	for ; a != nil; a = a.next {
+		if a.module == module {
+			return a
+		}
+	}
+	return nil
+}
+
+// The attributes without that of the module, sharing the tail after it.
+
+func (a *attribute) without(module *Atom) *attribute {
+	if a == nil {
+		return nil
+	}
+	if a.module == module {
+		return a.next
+	}
+	return &attribute{a.module, a.value, a.next.without(module)}
+}
+
+// A binding of an attributed variable whose hooks have not been run.  `mark` is the height of
+// the trail before the binding.
+
+type wakeup struct {
+	v     *Varslot
+	value ValueTerm
+	mark  int
+}
+
+// Give the unbound canonical varslot `v` the attributes, by linking it to a new varslot.
+
+func (m *machine) setAttributes(v *Varslot, attrs *attribute) {
+	assert(v.next == nil && v.val == nil)
+	v.next = &Varslot{attrs: attrs}
+	m.trail = append(m.trail, v)
+	m.allocated++
+}
+
+// Push the hooks of the pending wakeups on the continuation.  They are called like call/1, so
+// a cut in a hook is local to it.
+
+func (m *machine) wake() {
+	st := m.st
+	var goals []RuleTerm
+	var env rib
+	for _, w := range m.wakeups {
+		for a := w.v.attrs; a != nil; a = a.next {
+			goals = append(goals, &Local{len(env)})
+			env = append(env, Varslot{val: newValueStruct(st.attrHookAtom,
+				[]ValueTerm{a.module, a.value, w.value})})
+		}
+	}
+	m.wakeups = m.wakeups[:0]
+	m.cont = &frame{goals: goals, env: env, cutB: len(m.chps), module: m.module, next: m.cont}
+}
+
+// The unbound canonical varslot of `t` and the module atom, for the attribute built-ins.  If
+// `t` is bound then this returns nil.
+
+func (st *Store) attributeArgs(t ValueTerm, module ValueTerm) (*Varslot, *Atom) {
+	var name *Atom
+	switch x := deref(module).(type) {
+	case *Varslot:
+		st.instantiationError()
+	case *Atom:
+		name = x
+	default:
+		st.typeError("atom", x)
+	}
+	v, _ := deref(t).(*Varslot)
+	return v, name
+}
+
+func (st *Store) initAttvarBuiltins() {
+	st.addBuiltin("attvar", 1, func(m *machine, args []ValueTerm) bool {
+		v, isVar := deref(args[0]).(*Varslot)
+		return isVar && v.attrs != nil
+	})
+	st.addBuiltin("put_attr", 3, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		v, module := st.attributeArgs(args[0], args[1])
+		if v == nil {
+			st.raise(newValueStruct(st.NewAtom("uninstantiation_error"), []ValueTerm{deref(args[0])}))
+		}
+		m.setAttributes(v, &attribute{module, args[2], v.attrs.without(module)})
+		return true
+	})
+	st.addBuiltin("get_attr", 3, func(m *machine, args []ValueTerm) bool {
+		v, module := m.st.attributeArgs(args[0], args[1])
+		if v == nil {
+			return false
+		}
+		a := v.attrs.lookup(module)
+		return a != nil && m.unify(args[2], a.value)
+	})
+	st.addBuiltin("del_attr", 2, func(m *machine, args []ValueTerm) bool {
+		v, module := m.st.attributeArgs(args[0], args[1])
+		if v != nil && v.attrs.lookup(module) != nil {
+			m.setAttributes(v, v.attrs.without(module))
+		}
+		return true
+	})
+
+	// unifiable(X, Y, Unifier) unifies Unifier with a list of V = T, the bindings that unifying
+	// X and Y would make, and fails if they do not unify.  No hooks are run.
+	st.addBuiltin("unifiable", 3, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		mark := len(m.trail)
+		if !m.unify(args[0], args[1]) {
+			m.undoTrail(mark)
+			return false
+		}
+		equals := st.NewAtom("=")
+		var bindings []ValueTerm
+		for _, v := range m.trail[mark:] {
+			val := v.val
+			if val == nil {
+				val = v.next
+			}
+			bindings = append(bindings, newValueStruct(equals, []ValueTerm{v, val}))
+		}
+		m.undoTrail(mark)
+		return m.unify(args[2], st.newList(bindings, st.nilAtom))
+	})
+}
@@ -0,0 +1,184 @@
+package engine
+
+// Built-in predicates that are implemented in Go.
+//
+// A built-in is deterministic: it is passed the machine and the bound arguments of the goal and
+// returns true if it succeeds and false if it fails.  Bindings it makes go through `unify` and
+// are recorded on the trail like any other bindings.  Control constructs such as `!` and
+// `call/N` manipulate the continuations and are handled directly in the evaluator, see
+// engine.go and control.go.
+//
+// The table of built-ins is checked before the database of rules, so a built-in cannot be
+// redefined by a program.
+
+type builtin func(m *machine, args []ValueTerm) bool
+
+type predicateKey struct {
+	functor *Atom
+	arity   int
+}
+
+func (st *Store) addBuiltin(name string, arity int, b builtin) {
+	functor := st.NewAtom(name)
+	functorMap, ok := st.builtins[functor]
+	if !ok {
+		functorMap = make(map[int]builtin)
+		st.builtins[functor] = functorMap
+	}
+	functorMap[arity] = b
+}
+
+func (st *Store) lookupBuiltin(functor *Atom, arity int) builtin {
+	if functorMap, ok := st.builtins[functor]; ok {
+		return functorMap[arity]
+	}
+	return nil
+}
+
+func (st *Store) initBuiltins() {
+	st.initOpBuiltins()
+	st.initLoadBuiltins()
+	st.initDatabaseBuiltins()
+	st.initSolutionsBuiltins()
+	st.initFlagBuiltins()
+	st.initExceptionBuiltins()
+	st.initTablingBuiltins()
+	st.initCyclicBuiltins()
+	st.initTraceBuiltins()
+	st.initTextBuiltins()
+	st.initFormatBuiltins()
+	st.initGrammarBuiltins()
+	st.initAttvarBuiltins()
+	st.initModuleBuiltins()
+	st.initStreamBuiltins()
+	st.initPersistentBuiltins()
+	st.addBuiltin("=", 2, func(m *machine, args []ValueTerm) bool {
+		return m.unify(args[0], args[1])
+	})
+	st.addBuiltin("\\=", 2, func(m *machine, args []ValueTerm) bool {
+		mark := len(m.trail)
+		res := m.unify(args[0], args[1])
+		m.undoTrail(mark)
+		return !res
+	})
+	st.addBuiltin("is", 2, func(m *machine, args []ValueTerm) bool {
+		return m.unify(args[0], m.st.evaluate(args[1]))
+	})
+	st.addBuiltin("=:=", 2, func(m *machine, args []ValueTerm) bool {
+		return m.st.compareArith(args[0], args[1]) == 0
+	})
+	st.addBuiltin("=\\=", 2, func(m *machine, args []ValueTerm) bool {
+		return m.st.compareArith(args[0], args[1]) != 0
+	})
+	st.addBuiltin("<", 2, func(m *machine, args []ValueTerm) bool {
+		return m.st.compareArith(args[0], args[1]) < 0
+	})
+	st.addBuiltin("=<", 2, func(m *machine, args []ValueTerm) bool {
+		return m.st.compareArith(args[0], args[1]) <= 0
+	})
+	st.addBuiltin(">", 2, func(m *machine, args []ValueTerm) bool {
+		return m.st.compareArith(args[0], args[1]) > 0
+	})
+	st.addBuiltin(">=", 2, func(m *machine, args []ValueTerm) bool {
+		return m.st.compareArith(args[0], args[1]) >= 0
+	})
+	st.addBuiltin("compare", 3, func(m *machine, args []ValueTerm) bool {
+		c := compareValues(args[1], args[2])
+		switch {
+		case c < 0:
+			return m.unify(args[0], m.st.NewAtom("<"))
+		case c > 0:
+			return m.unify(args[0], m.st.NewAtom(">"))
+		default:
+			return m.unify(args[0], m.st.NewAtom("="))
+		}
+	})
+	st.addBuiltin("==", 2, func(m *machine, args []ValueTerm) bool {
+		return compareValues(args[0], args[1]) == 0
+	})
+	st.addBuiltin("\\==", 2, func(m *machine, args []ValueTerm) bool {
+		return compareValues(args[0], args[1]) != 0
+	})
+	st.addBuiltin("=@=", 2, func(m *machine, args []ValueTerm) bool {
+		return isVariant(args[0], args[1])
+	})
+	st.addBuiltin("\\=@=", 2, func(m *machine, args []ValueTerm) bool {
+		return !isVariant(args[0], args[1])
+	})
+	st.addBuiltin("@<", 2, func(m *machine, args []ValueTerm) bool {
+		return compareValues(args[0], args[1]) < 0
+	})
+	st.addBuiltin("@=<", 2, func(m *machine, args []ValueTerm) bool {
+		return compareValues(args[0], args[1]) <= 0
+	})
+	st.addBuiltin("@>", 2, func(m *machine, args []ValueTerm) bool {
+		return compareValues(args[0], args[1]) > 0
+	})
+	st.addBuiltin("@>=", 2, func(m *machine, args []ValueTerm) bool {
+		return compareValues(args[0], args[1]) >= 0
+	})
+
+	// Type checking
+	st.addBuiltin("var", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*Varslot)
+		return ok
+	})
+	st.addBuiltin("nonvar", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*Varslot)
+		return !ok
+	})
+	st.addBuiltin("atom", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*Atom)
+		return ok
+	})
+	st.addBuiltin("number", 1, func(m *machine, args []ValueTerm) bool {
+		switch deref(args[0]).(type) {
+		case *Number, *Float:
+			return true
+		default:
+			return false
+		}
+	})
+	st.addBuiltin("integer", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*Number)
+		return ok
+	})
+	st.addBuiltin("float", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*Float)
+		return ok
+	})
+	st.addBuiltin("string", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*String)
+		return ok
+	})
+	st.addBuiltin("atomic", 1, func(m *machine, args []ValueTerm) bool {
+		switch deref(args[0]).(type) {
+		case *Atom, *Number, *Float, *String:
+			return true
+		default:
+			return false
+		}
+	})
+	st.addBuiltin("compound", 1, func(m *machine, args []ValueTerm) bool {
+		_, ok := deref(args[0]).(*ValueStruct)
+		return ok
+	})
+	st.addBuiltin("callable", 1, func(m *machine, args []ValueTerm) bool {
+		switch deref(args[0]).(type) {
+		case *Atom, *ValueStruct:
+			return true
+		default:
+			return false
+		}
+	})
+	st.addBuiltin("is_list", 1, func(m *machine, args []ValueTerm) bool {
+		t := deref(args[0])
+		for {
+			s, ok := t.(*ValueStruct)
+			if !ok || !isListFunctor(s.s.functor, len(s.s.subterms)) {
+				return t == m.st.nilAtom
+			}
+			t = deref(bind(s.s.subterms[1], s.env))
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package engine
+
+import (
+	"reflect"
+	"strings"
+)
+
+// The standard order of terms: Var < Number < Atom < String < Compound.  Variables are ordered
+// by address, which is stable for the lifetime of a variable.  Numbers are ordered by value, and
+// a float before an integer of the same value.  Atoms and strings are ordered alphabetically.  Compound terms are ordered by arity, then by name, then by the
+// arguments from left to right.  Cyclic terms are compared as far as they differ, see cyclic.go.
+
+func compareValues(t1 ValueTerm, t2 ValueTerm) int {
+	var g pairGuard
+	return compareGuarded(t1, t2, &g)
+}
+
+func compareGuarded(t1 ValueTerm, t2 ValueTerm, g *pairGuard) int {
+	for {
+		if g.seenBefore(t1, t2) {
+			return 0
+		}
+		t1, t2 = deref(t1), deref(t2)
+		r1, r2 := orderRank(t1), orderRank(t2)
+		if r1 != r2 {
+			return r1 - r2
+		}
+		switch x := t1.(type) {
+		case *Varslot:
+			p1, p2 := reflect.ValueOf(x).Pointer(), reflect.ValueOf(t2).Pointer()
+			switch {
+			case p1 < p2:
+				return -1
+			case p1 > p2:
+				return 1
+			default:
+				return 0
+			}
+		case *Number, *Float:
+			if c := compareNumbers(x, t2); c != 0 {
+				return c
+			}
+			_, f1 := x.(*Float)
+			_, f2 := t2.(*Float)
+			switch {
+			case f1 && !f2:
+				return -1
+			case !f1 && f2:
+				return 1
+			default:
+				return 0
+			}
+		case *Atom:
+			return strings.Compare(x.name, t2.(*Atom).name)
+		case *String:
+			return strings.Compare(x.value, t2.(*String).value)
+		case *ValueStruct:
+			y := t2.(*ValueStruct)
+			if len(x.s.subterms) != len(y.s.subterms) {
+				return len(x.s.subterms) - len(y.s.subterms)
+			}
+			if c := strings.Compare(x.s.functor.name, y.s.functor.name); c != 0 {
+				return c
+			}
+			n := len(x.s.subterms)
+			if n == 0 {
+				return 0
+			}
+			for i := 0; i < n-1; i++ {
+				if c := compareGuarded(bind(x.s.subterms[i], x.env), bind(y.s.subterms[i], y.env), g); c != 0 {
+					return c
+				}
+			}
+			// Iterate on the last argument, as for unification
+			t1, t2 = bind(x.s.subterms[n-1], x.env), bind(y.s.subterms[n-1], y.env)
+		default:
+			panic("Unknown term type")
+		}
+	}
+}
+
+func orderRank(t ValueTerm) int {
+	switch t.(type) {
+	case *Varslot:
+		return 0
+	case *Number, *Float:
+		return 1
+	case *Atom:
+		return 2
+	case *String:
+		return 3
+	case *ValueStruct:
+		return 4
+	default:
+		panic("Unknown term type")
+	}
+}
+
+// Two terms are variants if they are equal up to a consistent renaming of their variables.
+
+func isVariant(t1 ValueTerm, t2 ValueTerm) bool {
+	var g pairGuard
+	return variant(t1, t2, map[*Varslot]*Varslot{}, map[*Varslot]*Varslot{}, &g)
+}
+
+func variant(t1 ValueTerm, t2 ValueTerm, left map[*Varslot]*Varslot, right map[*Varslot]*Varslot,
+	g *pairGuard) bool {
+	for {
+		if g.seenBefore(t1, t2) {
+			return true
+		}
+		t1, t2 = deref(t1), deref(t2)
+		switch x := t1.(type) {
+		case *Varslot:
+			y, ok := t2.(*Varslot)
+			if !ok {
+				return false
+			}
+			if lx, found := left[x]; found {
+				return lx == y
+			}
+			if _, found := right[y]; found {
+				return false
+			}
+			left[x], right[y] = y, x
+			return true
+		case *ValueStruct:
+			y, ok := t2.(*ValueStruct)
+			if !ok || x.s.functor != y.s.functor || len(x.s.subterms) != len(y.s.subterms) {
+				return false
+			}
+			n := len(x.s.subterms)
+			if n == 0 {
+				return true
+			}
+			for i := 0; i < n-1; i++ {
+				if !variant(bind(x.s.subterms[i], x.env), bind(y.s.subterms[i], y.env), left, right, g) {
+					return false
+				}
+			}
+			t1, t2 = bind(x.s.subterms[n-1], x.env), bind(y.s.subterms[n-1], y.env)
+		default:
+			return compareValues(t1, t2) == 0
+		}
+	}
+}
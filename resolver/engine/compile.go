@@ -0,0 +1,476 @@
+package engine
+
+// Compiled clauses.  A clause is compiled to instructions in the style of the Warren Abstract
+// Machine, which are run by the virtual machine in vm.go.  The instructions work on registers:
+// the arguments of a call are passed in the argument registers A0..An-1, and the variables of a
+// clause that live only within one chunk, the head with the first goal or a later goal, are kept
+// in temporary registers above the argument registers.  The other variables are permanent and
+// are kept in the environment of the clause, a rib.
+//
+//   allocate        create the environment
+//   deallocate      drop the environment before the last call
+//
+// The head has one `get` instruction for each argument and one `unify` instruction for each
+// argument of a structure, in depth-first order:
+//
+//   get_variable    the first occurrence of a variable: the variable is set to the argument
+//   get_value       a later occurrence: the argument is unified with the variable
+//   get_constant    the argument is unified with an atom, a number or a ground structure
+//   get_structure   if the argument is a structure with the functor then the instructions for its
+//                   arguments are run against its arguments (read mode); if it is a variable then
+//                   it is bound to a new structure whose arguments the instructions set (write
+//                   mode)
+//   unify_...       the same for an argument of a structure
+//   unify_void      a variable that occurs only once in the clause, which matches anything
+//
+// A goal of the body puts its arguments in the argument registers and calls the predicate:
+//
+//   put_variable    the argument is a fresh variable, which is also put in a temporary register;
+//                   a permanent variable is passed as its slot in the environment, with
+//                   put_value, since the slot is fresh when the clause is entered
+//   put_value       the argument is a variable
+//   put_void        the argument is a fresh variable that occurs only once in the clause
+//   put_constant    the argument is an atom, a number or a ground structure
+//   put_structure   the argument is a new structure, whose arguments the `set` instructions that
+//                   follow set, like the `unify` instructions in write mode
+//   call            call the predicate, continuing with the next instruction
+//   execute         call the predicate as the last goal, continuing with the continuation of the
+//                   clause
+//   proceed         continue with the continuation of the clause
+//   cut, true, fail the goals !, true and fail
+//   solve           solve a control construct or a variable goal, see control.go, whose
+//                   variables are all permanent so that it can be bound to the environment
+//
+// The instructions for a term are nested as deep as the term, and running them recurses, so a
+// clause with a term nested deeper than compileDepth, such as a long list, is not compiled
+// instruction by instruction but to:
+//
+//   get_arguments   the arguments are unified with the formals bound to the environment
+//   solve           the body as a conjunction
+//
+// Structures that are built by the instructions are copied to the heap of the machine, rather
+// than shared with the clause as the interpreter does, so that a clause needs no rib for its
+// temporary variables.  Ground structures are built once, when the clause is compiled.  The
+// choice of a clause, with try, retry and trust, is described in vm.go.
+//
+// A clause is compiled when it is first tried.  Setting `interpret` on the store runs the clauses
+// with the interpreter in engine.go instead, binding the formals and the goals to a rib and
+// unifying, so the benchmarks measure what the compilation gains.
+
+type opcode uint8
+
+const (
+	getVariable opcode = iota
+	getValue
+	getConstant
+	getStructure
+	unifyVariable
+	unifyValue
+	unifyConstant
+	unifyStructure
+	unifyVoid
+	putVariable
+	putValue
+	putConstant
+	putStructure
+	putVoid
+	setVariable
+	setValue
+	setConstant
+	setStructure
+	setVoid
+	allocate
+	deallocate
+	call
+	execute
+	proceed
+	cut
+	succeed
+	fail
+	solve
+	getArguments
+)
+
+func (op opcode) String() string {
+	return [...]string{"get_variable", "get_value", "get_constant", "get_structure",
+		"unify_variable", "unify_value", "unify_constant", "unify_structure", "unify_void",
+		"put_variable", "put_value", "put_constant", "put_structure", "put_void",
+		"set_variable", "set_value", "set_constant", "set_structure", "set_void",
+		"allocate", "deallocate", "call", "execute", "proceed", "cut", "true", "fail",
+		"solve", "get_arguments"}[op]
+}
+
+type instruction struct {
+	op opcode
+
+	// The argument register of a get or put instruction
+	arg int
+
+	// The variable of a variable or value instruction: a slot in the environment if `permanent`
+	// is set, and a register otherwise
+	slot      int
+	permanent bool
+
+	// The atom, number or ground structure of a constant instruction
+	constant ValueTerm
+
+	// The skeleton of a structure instruction, whose subterms are the locals 0..n-1 so that it
+	// can be bound to the cells of its arguments, and the number of instructions for them.  For
+	// get_arguments, the head of the clause.
+	s    *RuleStruct
+	skip int
+
+	// The predicate of a call or execute instruction
+	functor *Atom
+	arity   int
+
+	// The goal of a solve instruction, whose locals are slots in the environment
+	goal RuleTerm
+}
+
+type clauseCode struct {
+	code []instruction
+
+	// The index of the first instruction of the body
+	body int
+
+	// The number of registers that the clause uses, and the size of its environment
+	registers int
+	permanent int
+}
+
+// The code of the rule, which is compiled the first time.
+
+func (st *Store) clauseCode(r *rule) *clauseCode {
+	if r.code == nil {
+		r.code = st.compile(r)
+	}
+	return r.code
+}
+
+// The kinds of goals in a body.
+
+const (
+	callGoal = iota
+	solveGoal
+	cutGoal
+	trueGoal
+	failGoal
+)
+
+func (st *Store) goalKind(g RuleTerm) int {
+	switch x := g.(type) {
+	case *Atom:
+		switch x {
+		case st.cutAtom:
+			return cutGoal
+		case st.trueAtom:
+			return trueGoal
+		case st.failAtom:
+			return failGoal
+		}
+		return callGoal
+	case *RuleStruct:
+		if st.isControl(x) {
+			return solveGoal
+		}
+		return callGoal
+	}
+	// A variable, or a goal that is not callable, which raises an error when it is solved
+	return solveGoal
+}
+
+// True if the structure is one of the control constructs of solveControl.
+
+func (st *Store) isControl(s *RuleStruct) bool {
+	switch len(s.subterms) {
+	case 1:
+		switch s.functor {
+		case st.notAtom, st.cutToAtom, st.softCutAtom, st.catchExitAtom:
+			return true
+		}
+	case 2:
+		switch s.functor {
+		case st.commaAtom, st.semicolonAtom, st.ifAtom, st.softIfAtom, st.colonAtom:
+			return true
+		}
+	}
+	return false
+}
+
+func isGround(t RuleTerm) bool {
+	switch x := t.(type) {
+	case *Local:
+		return false
+	case *RuleStruct:
+		for _, s := range x.subterms {
+			if !isGround(s) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// True if a term is nested deeper than compileDepth.  This does not recurse, since the terms
+// may be too deep for that.
+
+func tooDeep(ts []RuleTerm) bool {
+	type nested struct {
+		t     RuleTerm
+		depth int
+	}
+	stack := make([]nested, 0, len(ts))
+	for _, t := range ts {
+		stack = append(stack, nested{t, 1})
+	}
+	for len(stack) > 0 {
+		n := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if s, ok := n.t.(*RuleStruct); ok {
+			if n.depth > compileDepth {
+				return true
+			}
+			for _, t := range s.subterms {
+				stack = append(stack, nested{t, n.depth + 1})
+			}
+		}
+	}
+	return false
+}
+
+type compiler struct {
+	st   *Store
+	code *clauseCode
+
+	// By local: the number of its occurrences, whether it is permanent, its slot in the
+	// environment or its register, and whether an instruction has set it
+	occurrences []int
+	permanent   []bool
+	slots       []int
+	seen        []bool
+}
+
+// The depth of nesting of the terms of a clause beyond which it is not compiled instruction by
+// instruction.
+
+const compileDepth = 1 << 10
+
+func (st *Store) compile(r *rule) *clauseCode {
+	if tooDeep(r.formals) || tooDeep(r.body) {
+		c := &clauseCode{body: 1, registers: len(r.formals), permanent: r.locals,
+			code: []instruction{{op: getArguments, s: &RuleStruct{r.functor, r.formals}}}}
+		if len(r.body) > 0 {
+			c.code = append(c.code, instruction{op: solve, goal: st.makeConjunction(r.body)})
+		}
+		c.code = append(c.code, instruction{op: proceed})
+		return c
+	}
+	cc := &compiler{st: st, code: &clauseCode{}, occurrences: make([]int, r.locals),
+		permanent: make([]bool, r.locals), slots: make([]int, r.locals), seen: make([]bool, r.locals)}
+	c := cc.code
+
+	// The chunks in which each local occurs: the head is in the chunk of the first goal that
+	// calls a predicate, and every later such goal starts a new chunk.  A local that occurs in
+	// more than one chunk, or in a goal that is solved, is permanent.
+	chunks := make([]int, r.locals)
+	for i := range chunks {
+		chunks[i] = -1
+	}
+	var scan func(t RuleTerm, chunk int, solved bool)
+	scan = func(t RuleTerm, chunk int, solved bool) {
+		switch x := t.(type) {
+		case *Local:
+			cc.occurrences[x.slot]++
+			if solved || chunks[x.slot] >= 0 && chunks[x.slot] != chunk {
+				cc.permanent[x.slot] = true
+			}
+			chunks[x.slot] = chunk
+		case *RuleStruct:
+			for _, s := range x.subterms {
+				scan(s, chunk, solved)
+			}
+		}
+	}
+	maxArity := len(r.formals)
+	for _, t := range r.formals {
+		scan(t, 0, false)
+	}
+	chunk := -1
+	for _, g := range r.body {
+		switch st.goalKind(g) {
+		case callGoal:
+			chunk++
+			if s, ok := g.(*RuleStruct); ok {
+				maxArity = max(maxArity, len(s.subterms))
+			}
+			scan(g, max(chunk, 0), false)
+		case solveGoal:
+			chunk++
+			scan(g, max(chunk, 0), true)
+		}
+	}
+
+	// Permanent variables are numbered in the environment and temporary ones in the registers
+	// above the argument registers
+	c.registers = maxArity
+	for i := range cc.slots {
+		if cc.permanent[i] {
+			cc.slots[i] = c.permanent
+			c.permanent++
+		} else if cc.occurrences[i] > 1 {
+			cc.slots[i] = c.registers
+			c.registers++
+		}
+	}
+	if c.permanent > 0 {
+		c.code = append(c.code, instruction{op: allocate})
+	}
+	for i, t := range r.formals {
+		cc.term(t, getVariable, i)
+	}
+	c.body = len(c.code)
+
+	// The last goal that calls a predicate is executed if no goal follows it
+	for i, g := range r.body {
+		switch st.goalKind(g) {
+		case cutGoal:
+			c.code = append(c.code, instruction{op: cut})
+		case trueGoal:
+			c.code = append(c.code, instruction{op: succeed})
+		case failGoal:
+			c.code = append(c.code, instruction{op: fail})
+		case solveGoal:
+			c.code = append(c.code, instruction{op: solve, goal: renumber(g, cc.slots)})
+		case callGoal:
+			var functor *Atom
+			var args []RuleTerm
+			switch x := g.(type) {
+			case *Atom:
+				functor = x
+			case *RuleStruct:
+				functor, args = x.functor, x.subterms
+			}
+			for j, t := range args {
+				cc.put(t, j)
+			}
+			if i < len(r.body)-1 {
+				c.code = append(c.code, instruction{op: call, functor: functor, arity: len(args)})
+				continue
+			}
+			if c.permanent > 0 {
+				c.code = append(c.code, instruction{op: deallocate})
+			}
+			c.code = append(c.code, instruction{op: execute, functor: functor, arity: len(args)})
+			return c
+		}
+	}
+	if c.permanent > 0 {
+		c.code = append(c.code, instruction{op: deallocate})
+	}
+	c.code = append(c.code, instruction{op: proceed})
+	return c
+}
+
+// The instructions for a term in the head, or for an argument of a structure.  `mode` is
+// getVariable for an argument of the head, unifyVariable for an argument of a structure in the
+// head and setVariable for one in the body, and the instructions of each mode are in the same
+// order.
+
+func (cc *compiler) term(t RuleTerm, mode opcode, arg int) {
+	c := cc.code
+	offset := mode - getVariable
+	switch x := t.(type) {
+	case *Local:
+		switch {
+		case cc.occurrences[x.slot] == 1:
+			// An argument that is a singleton needs no instruction
+			if mode != getVariable {
+				c.code = append(c.code, instruction{op: mode + unifyVoid - unifyVariable})
+			}
+		case !cc.seen[x.slot]:
+			c.code = append(c.code, cc.variable(getVariable+offset, x, arg))
+		default:
+			c.code = append(c.code, cc.variable(getValue+offset, x, arg))
+		}
+		cc.seen[x.slot] = true
+	case *RuleStruct:
+		if isGround(x) {
+			c.code = append(c.code, instruction{op: getConstant + offset, arg: arg, constant: bind(x, nil)})
+			return
+		}
+		at := len(c.code)
+		c.code = append(c.code, instruction{op: getStructure + offset, arg: arg, s: skeleton(x)})
+		if mode == getVariable {
+			mode = unifyVariable
+		}
+		for _, s := range x.subterms {
+			cc.term(s, mode, 0)
+		}
+		c.code[at].skip = len(c.code) - at - 1
+	default:
+		c.code = append(c.code, instruction{op: getConstant + offset, arg: arg, constant: t.(ValueTerm)})
+	}
+}
+
+// The put instructions for an argument of a goal.
+
+func (cc *compiler) put(t RuleTerm, arg int) {
+	c := cc.code
+	switch x := t.(type) {
+	case *Local:
+		in := cc.variable(putValue, x, arg)
+		switch {
+		case cc.permanent[x.slot]:
+		case cc.occurrences[x.slot] == 1:
+			in.op = putVoid
+		case !cc.seen[x.slot]:
+			in.op = putVariable
+		}
+		cc.seen[x.slot] = true
+		c.code = append(c.code, in)
+	case *RuleStruct:
+		if isGround(x) {
+			c.code = append(c.code, instruction{op: putConstant, arg: arg, constant: bind(x, nil)})
+			return
+		}
+		at := len(c.code)
+		c.code = append(c.code, instruction{op: putStructure, arg: arg, s: skeleton(x)})
+		for _, s := range x.subterms {
+			cc.term(s, setVariable, 0)
+		}
+		c.code[at].skip = len(c.code) - at - 1
+	default:
+		c.code = append(c.code, instruction{op: putConstant, arg: arg, constant: t.(ValueTerm)})
+	}
+}
+
+func (cc *compiler) variable(op opcode, l *Local, arg int) instruction {
+	return instruction{op: op, arg: arg, slot: cc.slots[l.slot], permanent: cc.permanent[l.slot]}
+}
+
+// A structure with the functor of `s` whose subterms are the locals 0..n-1.
+
+func skeleton(s *RuleStruct) *RuleStruct {
+	subterms := make([]RuleTerm, len(s.subterms))
+	for i := range subterms {
+		subterms[i] = &Local{i}
+	}
+	return &RuleStruct{s.functor, subterms}
+}
+
+// A copy of the goal with its locals numbered by their slots in the environment.
+
+func renumber(t RuleTerm, slots []int) RuleTerm {
+	switch x := t.(type) {
+	case *Local:
+		return &Local{slots[x.slot]}
+	case *RuleStruct:
+		subterms := make([]RuleTerm, len(x.subterms))
+		for i, s := range x.subterms {
+			subterms[i] = renumber(s, slots)
+		}
+		return &RuleStruct{x.functor, subterms}
+	}
+	return t
+}
@@ -0,0 +1,127 @@
+package engine
+
+// Control constructs: conjunction, disjunction, if-then-else, soft-cut, negation, catch/3 and
+// module qualification.
+//
+// These are solved by manipulating the continuation and the choicepoints directly, with the
+// arguments of the construct solved as goals in the rib of the construct:
+//
+//   (A, B)            A is solved with B pushed on the continuation.
+//   (A ; B)           A choicepoint that resumes with B is pushed, and A is solved.
+//   (C -> T ; E)      A choicepoint that resumes with E is pushed, and C is solved with
+//                     '$cut'(H), T pushed on the continuation, where H is the height of the stack
+//                     below the choicepoint.  The first solution of C thus removes the choicepoint
+//                     for E and any choicepoints left by C.
+//   (C *-> T ; E)     As above, but '$softcut'(H) only disables the choicepoint for E, so that
+//                     backtracking into C can produce more solutions for T.
+//   (C -> T)          As (C -> T ; fail).
+//   (C *-> T)         As (C, T).
+//   \+ G              A choicepoint that resumes with the continuation is pushed and G is solved
+//                     with '$cut'(H), fail as its continuation.
+//   catch(G, C, R)    A catch choicepoint that holds C and R is pushed and G is solved with
+//                     '$catch_exit'(H) pushed on the continuation.  The choicepoint just fails
+//                     when it is backtracked into.  '$catch_exit' marks the catch as exited by
+//                     binding a variable, which is undone if G is backtracked into, or removes
+//                     the choicepoint if G left no choicepoints.  An exception is caught by the
+//                     catches that have not exited, see errors.go.
+//   M:G               G is solved with M as the context module, see module.go.
+//
+// Cut is transparent to conjunction, disjunction, the then and else branches, and M:G: a cut in
+// them cuts the clause the construct is in.  The condition of if-then-else and the goal of negation
+// are opaque, a cut in them is local to them, and so is the goal of catch/3.
+
+type catchFrame struct {
+	catcher  ValueTerm
+	recovery ValueTerm
+
+	// Bound when the goal has exited.
+	exited *Varslot
+}
+
+// Returns (true, result) if `s` is a control construct, and (false, _) otherwise.
+
+func (m *machine) solveControl(s *RuleStruct, env rib, cutB int) (isControl bool, result bool) {
+	st := m.st
+	switch len(s.subterms) {
+	case 1:
+		switch s.functor {
+		case st.notAtom:
+			h := len(m.chps)
+			m.chps = append(m.chps, m.choicepoint(m.cont))
+			m.cont = &frame{goals: []RuleTerm{m.cutToGoal(h), st.failAtom}, env: env, cutB: cutB,
+				module: m.module}
+			return true, m.solve(s.subterms[0], env, h+1)
+		case st.cutToAtom:
+			m.cutTo(int(s.subterms[0].(*Number).value))
+			return true, true
+		case st.softCutAtom:
+			// The choicepoint is left in place, because the condition may have choicepoints
+			// above it, but it is made to fail.
+			h := int(s.subterms[0].(*Number).value)
+			m.chps[h].cont = &frame{goals: []RuleTerm{st.failAtom}, module: m.module}
+			return true, true
+		case st.catchExitAtom:
+			h := int(s.subterms[0].(*Number).value)
+			if h == len(m.chps)-1 {
+				m.cutTo(h)
+			} else {
+				m.bindVar(m.chps[h].catch.exited, st.trueAtom)
+			}
+			return true, true
+		}
+	case 2:
+		switch s.functor {
+		case st.commaAtom:
+			m.cont = &frame{goals: s.subterms[1:], env: env, cutB: cutB, module: m.module, next: m.cont}
+			return true, m.solve(s.subterms[0], env, cutB)
+		case st.semicolonAtom:
+			h := len(m.chps)
+			if cond, ok := s.subterms[0].(*RuleStruct); ok && len(cond.subterms) == 2 &&
+				(cond.functor == st.ifAtom || cond.functor == st.softIfAtom) {
+				elseFrame := &frame{goals: s.subterms[1:], env: env, cutB: cutB, module: m.module,
+					next: m.cont}
+				m.chps = append(m.chps, m.choicepoint(elseFrame))
+				commit := m.cutToGoal(h)
+				if cond.functor == st.softIfAtom {
+					commit = st.NewStruct(st.softCutAtom, []RuleTerm{st.NewNumber(int64(h))})
+				}
+				m.cont = &frame{goals: []RuleTerm{commit, cond.subterms[1]}, env: env, cutB: cutB,
+					module: m.module, next: m.cont}
+				return true, m.solve(cond.subterms[0], env, h+1)
+			}
+			alternative := &frame{goals: s.subterms[1:], env: env, cutB: cutB, module: m.module,
+				next: m.cont}
+			m.chps = append(m.chps, m.choicepoint(alternative))
+			return true, m.solve(s.subterms[0], env, cutB)
+		case st.ifAtom:
+			h := len(m.chps)
+			m.cont = &frame{goals: []RuleTerm{m.cutToGoal(h), s.subterms[1]}, env: env, cutB: cutB,
+				module: m.module, next: m.cont}
+			return true, m.solve(s.subterms[0], env, h)
+		case st.softIfAtom:
+			m.cont = &frame{goals: s.subterms[1:], env: env, cutB: cutB, module: m.module, next: m.cont}
+			return true, m.solve(s.subterms[0], env, len(m.chps))
+		case st.colonAtom:
+			md, goal := st.stripModule(m.module, &ValueStruct{env: env, s: s})
+			m.module = md
+			return true, m.solveValue(goal, cutB)
+		}
+	}
+	return false, false
+}
+
+func (m *machine) cutToGoal(h int) RuleTerm {
+	return m.st.NewStruct(m.st.cutToAtom, []RuleTerm{m.st.NewNumber(int64(h))})
+}
+
+// catch(Goal, Catcher, Recovery), called with its actuals.
+
+func (m *machine) solveCatch(actuals []ValueTerm, cutB int) bool {
+	h := len(m.chps)
+	cp := m.choicepoint(m.cont)
+	cp.catch = &catchFrame{catcher: actuals[1], recovery: actuals[2], exited: &Varslot{}}
+	m.chps = append(m.chps, cp)
+	exit := m.st.NewStruct(m.st.catchExitAtom, []RuleTerm{m.st.NewNumber(int64(h))})
+	m.cont = &frame{goals: []RuleTerm{exit}, cutB: cutB, module: m.module, next: m.cont}
+	return m.solveValue(actuals[0], h+1)
+}
@@ -0,0 +1,163 @@
+package engine
+
+// Cyclic terms and the occurs check.
+//
+// Unification does not check whether a variable occurs in the value it is bound to, unless the
+// occurs_check flag is true or error or the unification is done by unify_with_occurs_check/2, so
+// `X = f(X)` makes X a cyclic term, a rational tree.  The cycles always go through the varslots
+// of bound variables, because a value can only refer to itself through a variable.
+//
+// Traversals that may meet a cyclic term guard against it in one of two ways.  Those that only
+// need to visit every part of a term once, like the occurs check, remember the bound varslots
+// they pass through and do not enter one again.  Those that traverse two terms at once, like
+// unification and comparison, remember the pairs of varslots and treat a pair that they meet
+// again as equal, which is right because the pair is either still being compared or compared
+// equal.  Terms are rarely cyclic, so the guards only start remembering after many steps; a
+// cycle is then found when it comes around again.  Writing and copying terms must find the
+// cycles exactly, and they keep track of the structures on the path from the root.
+
+type occursCheck int
+
+const (
+	occursCheckFalse occursCheck = iota
+	occursCheckTrue
+	occursCheckError
+)
+
+// A structure is identified by its rule form and its rib.  Only structures that have a rib can
+// be part of a cycle.
+
+type structKey struct {
+	s   *RuleStruct
+	env *Varslot
+}
+
+// The number of steps a traversal takes before it starts looking for cycles.
+
+const cycleSteps = 1 << 12
+
+// A guard for traversals of one term.
+
+type varGuard struct {
+	steps int
+	seen  map[*Varslot]bool
+}
+
+// True if the traversal has passed through `t` before, which is only found out for varslots
+// after the first cycleSteps steps.
+
+func (g *varGuard) seenBefore(t ValueTerm) bool {
+	g.steps++
+	v, ok := t.(*Varslot)
+	if g.steps < cycleSteps || !ok {
+		return false
+	}
+	if g.seen == nil {
+		g.seen = make(map[*Varslot]bool)
+	}
+	if g.seen[v] {
+		return true
+	}
+	g.seen[v] = true
+	return false
+}
+
+// A guard for traversals of two terms at once.
+
+type pairGuard struct {
+	steps int
+	seen  map[[2]*Varslot]bool
+}
+
+func (g *pairGuard) seenBefore(t1 ValueTerm, t2 ValueTerm) bool {
+	g.steps++
+	if g.steps < cycleSteps {
+		return false
+	}
+	v1, ok1 := t1.(*Varslot)
+	v2, ok2 := t2.(*Varslot)
+	if !ok1 || !ok2 {
+		return false
+	}
+	if g.seen == nil {
+		g.seen = make(map[[2]*Varslot]bool)
+	}
+	key := [2]*Varslot{v1, v2}
+	if g.seen[key] {
+		return true
+	}
+	g.seen[key] = true
+	return false
+}
+
+// True if the unbound varslot `v` occurs in `t`.
+
+func occurs(v *Varslot, t ValueTerm) bool {
+	var g varGuard
+	return occursIn(v, t, &g)
+}
+
+func occursIn(v *Varslot, t ValueTerm, g *varGuard) bool {
+	for {
+		if g.seenBefore(t) {
+			return false
+		}
+		switch x := deref(t).(type) {
+		case *Varslot:
+			return x == v
+		case *ValueStruct:
+			n := len(x.s.subterms)
+			if n == 0 {
+				return false
+			}
+			for i := 0; i < n-1; i++ {
+				if occursIn(v, bind(x.s.subterms[i], x.env), g) {
+					return true
+				}
+			}
+			t = bind(x.s.subterms[n-1], x.env)
+		default:
+			return false
+		}
+	}
+}
+
+// True if `t` is not cyclic.  `path` holds the bound varslots on the path to `t` and `done` the
+// ones whose values are known to be acyclic.
+
+func isAcyclic(t ValueTerm, path map[*Varslot]bool, done map[*Varslot]bool) bool {
+	if v, ok := t.(*Varslot); ok {
+		val, canon := v.resolve()
+		if canon != nil || done[v] {
+			return true
+		}
+		if path[v] {
+			return false
+		}
+		path[v] = true
+		acyclic := isAcyclic(val, path, done)
+		delete(path, v)
+		done[v] = acyclic
+		return acyclic
+	}
+	if s, ok := t.(*ValueStruct); ok {
+		for _, a := range s.s.subterms {
+			if !isAcyclic(bind(a, s.env), path, done) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (st *Store) initCyclicBuiltins() {
+	st.addBuiltin("unify_with_occurs_check", 2, func(m *machine, args []ValueTerm) bool {
+		return m.unifyWith(args[0], args[1], occursCheckTrue)
+	})
+	st.addBuiltin("acyclic_term", 1, func(m *machine, args []ValueTerm) bool {
+		return isAcyclic(args[0], map[*Varslot]bool{}, map[*Varslot]bool{})
+	})
+	st.addBuiltin("cyclic_term", 1, func(m *machine, args []ValueTerm) bool {
+		return !isAcyclic(args[0], map[*Varslot]bool{}, map[*Varslot]bool{})
+	})
+}
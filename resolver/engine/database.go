@@ -0,0 +1,438 @@
+package engine
+
+// The dynamic database: assert/1, asserta/1, assertz/1, retract/1, abolish/1 and clause/2.
+//
+// The database follows the logical update view: a call sees the clauses of its predicate as they
+// were when it was called, regardless of later changes.  This falls out of the representation,
+// because a call holds on to the slice of clauses that it got from the predicate and the slices
+// in the database are never modified in place.  Adding a clause at the end appends to the slice,
+// which does not disturb the shorter slices held by earlier calls, and all other changes make a
+// new slice.  The same goes for the slices in the indexes, see index.go.
+//
+// Clauses are asserted by converting the clause term back into rule form, with a fresh local
+// for each distinct variable in the term.  Retracting works in the other direction: '$clause'
+// produces a copy of each clause of the predicate that unifies, together with a reference to it,
+// and '$erase' removes it from the database by reference.
+
+func (st *Store) initDatabaseBuiltins() {
+	st.addBuiltin("assert", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.assertClause(m.module, args[0], false)
+		return true
+	})
+	st.addBuiltin("assertz", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.assertClause(m.module, args[0], false)
+		return true
+	})
+	st.addBuiltin("asserta", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.assertClause(m.module, args[0], true)
+		return true
+	})
+	st.addBuiltin("abolish", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		md, pi := st.stripModule(m.module, args[0])
+		functor, arity := st.predicateIndicator(pi)
+		if st.isStatic(md, functor, arity) {
+			st.permissionError("modify", "static_procedure", pi)
+		}
+		if functorMap, ok := md.rules[functor]; ok {
+			if p := functorMap[arity]; p != nil && p.persistent != nil {
+				p.persistent.abolish()
+			}
+			delete(functorMap, arity)
+		}
+		st.invalidateTables()
+		return true
+	})
+	st.addBuiltin("dynamic", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.declareDynamic(m.module, args[0])
+		return true
+	})
+
+	// '$clause'(Head, Body, Ref) unifies Head and Body with a fresh copy of each clause of the
+	// predicate of Head in turn, and Ref with a reference to the clause.  Only the clauses that
+	// the index and mayMatch let through are copied.  Built-ins have no clauses.
+	st.addBuiltin("$clause", 3, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		md, h := st.stripModule(m.module, args[0])
+		functor, arity := st.callableHead(h)
+		p := st.lookupPredicate(md, functor, arity)
+		if p == nil {
+			return false
+		}
+		var actuals []ValueTerm
+		if s, ok := h.(*ValueStruct); ok {
+			actuals = bind_terms(s.s.subterms, s.env)
+		}
+		cp := m.choicepoint(m.cont)
+		cp.scan = &clauseScan{key: st.current, head: h, body: args[1], ref: args[2],
+			keys: actualKeys(actuals), clauses: p.candidates(actuals)}
+		m.chps = append(m.chps, cp)
+		return m.retryClause(len(m.chps) - 1)
+	})
+
+	// '$erase'(Head, Ref) removes the clause with the reference from the predicate of Head, and
+	// fails if it has already been removed.
+	st.addBuiltin("$erase", 2, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		md, h := st.stripModule(m.module, args[0])
+		functor, arity := st.callableHead(h)
+		ref := deref(args[1]).(*Number).value
+		var actuals []ValueTerm
+		if s, ok := h.(*ValueStruct); ok {
+			actuals = bind_terms(s.s.subterms, s.env)
+		}
+		if p := st.lookupPredicate(md, functor, arity); p != nil && p.remove(ref, actuals) {
+			st.invalidateTables()
+			return true
+		}
+		return false
+	})
+}
+
+// Add a clause, Head or Head :- Body, to the module, or to Module if the clause or its head is
+// Module:Term.
+
+func (st *Store) assertClause(md *module, clause ValueTerm, first bool) {
+	md, head := st.stripModule(md, clause)
+	body := ValueTerm(st.trueAtom)
+	if s, ok := head.(*ValueStruct); ok && s.s.functor.name == ":-" && len(s.s.subterms) == 2 {
+		head, body = deref(bind(s.s.subterms[0], s.env)), deref(bind(s.s.subterms[1], s.env))
+	}
+	md, head = st.stripModule(md, head)
+	functor, arity := st.callableHead(head)
+	if st.isStatic(md, functor, arity) {
+		st.permissionError("modify", "static_procedure", st.indicator(functor, arity))
+	}
+	if _, ok := body.(*Varslot); !ok && !isCallable(body) {
+		st.typeError("callable", body)
+	}
+
+	c := &ruleConverter{locals: make(map[*Varslot]*Local)}
+	var formals []RuleTerm
+	if s, ok := head.(*ValueStruct); ok {
+		formals = c.convertTerms(s.s.subterms, s.env)
+	}
+	goals := flattenConjunction(c.convert(body))
+	if len(c.bindings) > 0 {
+		st.typeError("acyclic_term", clause)
+	}
+	if len(goals) == 1 && goals[0] == RuleTerm(st.trueAtom) {
+		goals = []RuleTerm{}
+	}
+	for _, g := range goals {
+		switch g.(type) {
+		case *Number, *Float, *String:
+			st.typeError("callable", body)
+		}
+	}
+
+	r := &rule{module: md, locals: c.count(), arity: arity, functor: functor, formals: formals, body: goals}
+	if first {
+		st.addRuleFirst(r)
+	} else {
+		st.addRule(r)
+	}
+}
+
+// The functor and arity of a clause head, raising an error if it is not callable.
+
+func (st *Store) callableHead(head ValueTerm) (*Atom, int) {
+	switch h := deref(head).(type) {
+	case *Varslot:
+		st.instantiationError()
+	case *Atom:
+		return h, 0
+	case *ValueStruct:
+		return h.s.functor, len(h.s.subterms)
+	default:
+		st.typeError("callable", h)
+	}
+	panic("Unreachable")
+}
+
+// The functor and arity of a predicate indicator Name/Arity.
+
+func (st *Store) predicateIndicator(pi ValueTerm) (*Atom, int) {
+	s, ok := deref(pi).(*ValueStruct)
+	if _, isVar := deref(pi).(*Varslot); isVar {
+		st.instantiationError()
+	}
+	if !ok || s.s.functor.name != "/" || len(s.s.subterms) != 2 {
+		st.typeError("predicate_indicator", deref(pi))
+	}
+	name, arity := deref(bind(s.s.subterms[0], s.env)), deref(bind(s.s.subterms[1], s.env))
+	if _, isVar := name.(*Varslot); isVar {
+		st.instantiationError()
+	}
+	if _, isVar := arity.(*Varslot); isVar {
+		st.instantiationError()
+	}
+	functor, ok := name.(*Atom)
+	if !ok {
+		st.typeError("atom", name)
+	}
+	n, ok := arity.(*Number)
+	if !ok {
+		st.typeError("integer", arity)
+	}
+	if sign(n) < 0 {
+		st.domainError("not_less_than_zero", arity)
+	}
+	if n.big != nil {
+		st.representationError("max_arity")
+	}
+	return functor, int(n.value)
+}
+
+// dynamic(PI) where PI is a predicate indicator, a conjunction of them, or a list of them.  The
+// predicates are created with no clauses in the module, or in Module for Module:PI.
+
+func (st *Store) declareDynamic(md *module, t ValueTerm) {
+	st.forEachIndicator(md, t, func(md *module, functor *Atom, arity int) {
+		if st.isStatic(md, functor, arity) {
+			st.permissionError("modify", "static_procedure", st.indicator(functor, arity))
+		}
+		md.predicate(functor, arity)
+	})
+}
+
+// Call `f` with the module, functor and arity of every predicate indicator in `t`, which is a
+// predicate indicator, a conjunction of them, or a list of them, any of which may be qualified
+// with a module.
+
+func (st *Store) forEachIndicator(md *module, t ValueTerm, f func(md *module, functor *Atom, arity int)) {
+	md, t = st.stripModule(md, t)
+	if s, ok := t.(*ValueStruct); ok && len(s.s.subterms) == 2 &&
+		(s.s.functor.name == "," || isListFunctor(s.s.functor, 2)) {
+		st.forEachIndicator(md, bind(s.s.subterms[0], s.env), f)
+		st.forEachIndicator(md, bind(s.s.subterms[1], s.env), f)
+		return
+	}
+	if t == ValueTerm(st.nilAtom) {
+		return
+	}
+	functor, arity := st.predicateIndicator(t)
+	f(md, functor, arity)
+}
+
+// Built-ins and control constructs cannot be changed, and neither can the library, except from
+// within the module `system`.
+
+func (st *Store) isStatic(md *module, functor *Atom, arity int) bool {
+	if st.lookupBuiltin(functor, arity) != nil {
+		return true
+	}
+	if md != st.systemModule && st.systemModule.lookup(functor, arity) != nil {
+		return true
+	}
+	switch {
+	case arity == 0:
+		return functor == st.cutAtom || functor == st.trueAtom || functor == st.failAtom
+	case functor == st.callAtom:
+		return true
+	case arity == 1:
+		return functor == st.notAtom || functor == st.cutToAtom || functor == st.softCutAtom ||
+			functor == st.catchExitAtom
+	case arity == 2:
+		return functor == st.commaAtom || functor == st.semicolonAtom || functor == st.ifAtom ||
+			functor == st.softIfAtom || functor == st.colonAtom
+	case arity == 3:
+		return functor == st.catchAtom
+	}
+	return false
+}
+
+func isCallable(t ValueTerm) bool {
+	switch deref(t).(type) {
+	case *Atom, *ValueStruct:
+		return true
+	}
+	return false
+}
+
+// The body of a clause as a single term.
+
+func (st *Store) makeConjunction(goals []RuleTerm) RuleTerm {
+	if len(goals) == 0 {
+		return st.trueAtom
+	}
+	conj := goals[len(goals)-1]
+	for i := len(goals) - 2; i >= 0; i-- {
+		conj = st.NewStruct(st.NewAtom(","), []RuleTerm{goals[i], conj})
+	}
+	return conj
+}
+
+// Conversion of values to rule terms.  Every distinct unbound variable becomes a local.
+//
+// A cyclic term cannot be represented by a rule term alone, because rule terms are trees, so a
+// structure that is met again on the path from the root also becomes a local, and the binding of
+// the local to the structure is recorded in `bindings`.  Looking for cycles is costly, so the
+// converter only does that when the path is deep, unless `exact` is true.
+
+type ruleConverter struct {
+	locals map[*Varslot]*Local
+
+	// The depth of the path, and the structures on it once it is deep.
+	depth int
+	path  map[structKey]bool
+	exact bool
+
+	// The locals for cyclic structures, and their bindings.
+	cycles   map[structKey]*Local
+	bindings []localBinding
+}
+
+type localBinding struct {
+	slot int
+	t    RuleTerm
+}
+
+// The number of locals.
+
+func (c *ruleConverter) count() int {
+	return len(c.locals) + len(c.cycles)
+}
+
+// Convert a term.  The last argument of a structure is converted in the loop rather than by
+// recursion, so that long lists do not require deep recursion: `hole` is where the conversion
+// of the term goes, and `open` holds the structures on the path whose conversion is finished
+// when the loop ends.
+
+func (c *ruleConverter) convert(t ValueTerm) RuleTerm {
+	var result RuleTerm
+	hole := &result
+	var open []openStruct
+	depth := c.depth
+	for {
+		x, ok := deref(t).(*ValueStruct)
+		if !ok {
+			*hole = c.convertAtomic(t)
+			break
+		}
+		if (c.exact || c.depth > cycleSteps) && len(x.env) > 0 {
+			key := structKey{x.s, &x.env[0]}
+			if l, ok := c.cycles[key]; ok {
+				*hole = l
+				break
+			}
+			if c.path == nil {
+				c.path = make(map[structKey]bool)
+				c.cycles = make(map[structKey]*Local)
+			}
+			if c.path[key] {
+				l := &Local{c.count()}
+				c.cycles[key] = l
+				*hole = l
+				break
+			}
+			c.path[key] = true
+			open = append(open, openStruct{key, hole})
+		}
+		c.depth++
+		n := len(x.s.subterms)
+		s := &RuleStruct{x.s.functor, make([]RuleTerm, n)}
+		*hole = s
+		if n == 0 {
+			break
+		}
+		for i, t := range x.s.subterms[:n-1] {
+			s.subterms[i] = c.convert(bind(t, x.env))
+		}
+		hole = &s.subterms[n-1]
+		t = bind(x.s.subterms[n-1], x.env)
+	}
+	for i := len(open) - 1; i >= 0; i-- {
+		o := open[i]
+		delete(c.path, o.key)
+		if l, ok := c.cycles[o.key]; ok {
+			c.bindings = append(c.bindings, localBinding{l.slot, *o.hole})
+			*o.hole = l
+		}
+	}
+	c.depth = depth
+	return result
+}
+
+// A structure on the path that is being converted, and where its conversion goes.
+
+type openStruct struct {
+	key  structKey
+	hole *RuleTerm
+}
+
+func (c *ruleConverter) convertAtomic(t ValueTerm) RuleTerm {
+	switch x := deref(t).(type) {
+	case *Varslot:
+		if l, ok := c.locals[x]; ok {
+			return l
+		}
+		l := &Local{c.count()}
+		c.locals[x] = l
+		return l
+	case *Atom:
+		return x
+	case *Number:
+		return x
+	case *Float:
+		return x
+	case *String:
+		return x
+	default:
+		panic("Unknown value")
+	}
+}
+
+func (c *ruleConverter) convertTerms(ts []RuleTerm, env rib) []RuleTerm {
+	converted := make([]RuleTerm, len(ts))
+	for i, t := range ts {
+		converted[i] = c.convert(bind(t, env))
+	}
+	return converted
+}
+
+// The state of '$clause' in its choicepoint: the clauses that are left to try and the keys of the
+// arguments of the head, see index.go.
+
+type clauseScan struct {
+	key             predicateKey
+	head, body, ref ValueTerm
+	keys            []interface{}
+	clauses         []*rule
+}
+
+// Unify the head, body and reference of the '$clause' in the choicepoint at `top`, which is the
+// top of the stack, with the next clause that unifies.  The choicepoint is removed when no clause
+// is left that may match.
+
+func (m *machine) retryClause(top int) bool {
+	st := m.st
+	scan := m.chps[top].scan
+	st.current = scan.key
+	for len(scan.clauses) > 0 {
+		r := scan.clauses[0]
+		scan.clauses = scan.clauses[1:]
+		if !mayMatch(scan.keys, r) {
+			continue
+		}
+		for len(scan.clauses) > 0 && !mayMatch(scan.keys, scan.clauses[0]) {
+			scan.clauses = scan.clauses[1:]
+		}
+		if len(scan.clauses) == 0 {
+			m.cutTo(top)
+		}
+		env := make(rib, r.locals)
+		var head ValueTerm = r.functor
+		if r.arity > 0 {
+			head = &ValueStruct{env: env, s: &RuleStruct{r.functor, r.formals}}
+		}
+		mark := len(m.trail)
+		if m.unify(scan.head, head) && m.unify(scan.body, bind(st.makeConjunction(r.body), env)) &&
+			m.unify(scan.ref, st.NewNumber(r.id)) {
+			return true
+		}
+		m.undoTrail(mark)
+	}
+	m.cutTo(top)
+	return false
+}
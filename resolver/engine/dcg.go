@@ -0,0 +1,182 @@
+package engine
+
+// Definite clause grammars.  A grammar rule `Head --> Body` is translated to a clause when it is
+// consulted, by adding two arguments to every non-terminal: the list to parse and the list that
+// remains after it.  `p --> q, [a], r.` becomes
+//
+//   p(S0, S) :- q(S0, S1), S1 = [a|S2], r(S2, S).
+//
+// In the body, a list is a sequence of terminals, a string is the list of its codes, {G} is the
+// goal G, which consumes nothing, and !, (A, B), (A ; B), (A -> B), \+ A and call(G, ...) have
+// their usual meanings.  A variable is a phrase that is called with phrase/3.  The head may be
+// followed by a list of terminals, the pushback, that is put back at the front of the remaining
+// list after the body has been parsed: `p, [a] --> q.` becomes p(S0, S) :- q(S0, S1), S = [a|S1].
+//
+// phrase(Body, List) and phrase(Body, List, Rest) parse List with a grammar body, translating
+// the body when they are called.
+
+type dcgTranslator struct {
+	st *Store
+
+	// Makes a fresh variable for the lists between the parts of the body
+	fresh func() RuleTerm
+
+	// The first part of the rule that is not valid, if not nil
+	invalid RuleTerm
+}
+
+// The clause for the grammar rule `head --> body`, or nil and the culprit if the rule is not
+// valid.
+
+func (st *Store) translateGrammarRule(head, body RuleTerm, fresh func() RuleTerm) (RuleTerm, RuleTerm) {
+	d := &dcgTranslator{st: st, fresh: fresh}
+	s0, s := fresh(), fresh()
+	var pushback RuleTerm
+	if h, ok := head.(*RuleStruct); ok && h.functor == st.commaAtom && len(h.subterms) == 2 {
+		head, pushback = h.subterms[0], h.subterms[1]
+	}
+	var clauseBody RuleTerm
+	if pushback == nil {
+		clauseBody = d.body(body, s0, s)
+	} else {
+		mid := fresh()
+		clauseBody = d.conjunction(d.body(body, s0, mid), d.terminals(pushback, s, mid))
+	}
+	clauseHead := d.nonTerminal(head, s0, s)
+	if d.invalid != nil {
+		return nil, d.invalid
+	}
+	return st.NewStruct(st.NewAtom(":-"), []RuleTerm{clauseHead, clauseBody}), nil
+}
+
+// The goal that parses `b` from s0, leaving s.
+
+func (d *dcgTranslator) body(b RuleTerm, s0, s RuleTerm) RuleTerm {
+	st := d.st
+	switch x := b.(type) {
+	case *Local:
+		return st.NewStruct(st.NewAtom("phrase"), []RuleTerm{x, s0, s})
+	case *Atom:
+		switch {
+		case x == st.nilAtom:
+			return d.unify(s0, s)
+		case x == st.cutAtom:
+			return d.conjunction(x, d.unify(s0, s))
+		}
+		return d.nonTerminal(x, s0, s)
+	case *String:
+		return d.terminals(x, s0, s)
+	case *RuleStruct:
+		args := x.subterms
+		switch {
+		case isListFunctor(x.functor, len(args)):
+			return d.terminals(x, s0, s)
+		case x.functor == st.commaAtom && len(args) == 2:
+			mid := d.fresh()
+			return d.conjunction(d.body(args[0], s0, mid), d.body(args[1], mid, s))
+		case (x.functor == st.semicolonAtom || x.functor.name == "|") && len(args) == 2:
+			return st.NewStruct(st.semicolonAtom, []RuleTerm{d.body(args[0], s0, s), d.body(args[1], s0, s)})
+		case x.functor == st.ifAtom && len(args) == 2:
+			mid := d.fresh()
+			return st.NewStruct(st.ifAtom, []RuleTerm{d.body(args[0], s0, mid), d.body(args[1], mid, s)})
+		case x.functor == st.notAtom && len(args) == 1:
+			return d.conjunction(st.NewStruct(st.notAtom, []RuleTerm{d.body(args[0], s0, d.fresh())}),
+				d.unify(s0, s))
+		case x.functor.name == "{}" && len(args) == 1:
+			return d.conjunction(args[0], d.unify(s0, s))
+		case x.functor == st.callAtom && len(args) > 0:
+			return st.NewStruct(st.callAtom, append(append([]RuleTerm{}, args...), s0, s))
+		}
+		return d.nonTerminal(x, s0, s)
+	}
+	d.reject(b)
+	return b
+}
+
+// A non-terminal with the two lists added to its arguments.
+
+func (d *dcgTranslator) nonTerminal(t RuleTerm, s0, s RuleTerm) RuleTerm {
+	switch x := t.(type) {
+	case *Atom:
+		return d.st.NewStruct(x, []RuleTerm{s0, s})
+	case *RuleStruct:
+		return d.st.NewStruct(x.functor, append(append([]RuleTerm{}, x.subterms...), s0, s))
+	}
+	d.reject(t)
+	return t
+}
+
+// The goal s0 = Terminals ++ s, for a list or a string of terminals.
+
+func (d *dcgTranslator) terminals(t RuleTerm, s0, s RuleTerm) RuleTerm {
+	st := d.st
+	var elements []RuleTerm
+	if str, ok := t.(*String); ok {
+		for _, r := range str.value {
+			elements = append(elements, st.NewNumber(int64(r)))
+		}
+	} else {
+		for {
+			l, ok := t.(*RuleStruct)
+			if !ok || !isListFunctor(l.functor, len(l.subterms)) {
+				break
+			}
+			elements = append(elements, l.subterms[0])
+			t = l.subterms[1]
+		}
+		if t != RuleTerm(st.nilAtom) {
+			d.reject(t)
+		}
+	}
+	list := s
+	for i := len(elements) - 1; i >= 0; i-- {
+		list = st.NewStruct(st.dotAtom, []RuleTerm{elements[i], list})
+	}
+	return d.unify(s0, list)
+}
+
+func (d *dcgTranslator) unify(a, b RuleTerm) RuleTerm {
+	return d.st.NewStruct(d.st.NewAtom("="), []RuleTerm{a, b})
+}
+
+func (d *dcgTranslator) conjunction(a, b RuleTerm) RuleTerm {
+	return d.st.NewStruct(d.st.commaAtom, []RuleTerm{a, b})
+}
+
+func (d *dcgTranslator) reject(t RuleTerm) {
+	if d.invalid == nil {
+		d.invalid = t
+	}
+}
+
+func (st *Store) initGrammarBuiltins() {
+	// '$dcg_body'(Body, S0, S, Goal, Arity) unifies Goal with the goal that parses Body from S0,
+	// leaving S.  Errors are raised in the name of phrase/Arity, which called it.
+	st.addBuiltin("$dcg_body", 5, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		st.current = predicateKey{st.NewAtom("phrase"), int(deref(args[4]).(*Number).value)}
+		if _, isVar := deref(args[0]).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		c := &ruleConverter{locals: make(map[*Varslot]*Local)}
+		body := c.convert(args[0])
+		n := c.count()
+		fresh := func() RuleTerm {
+			n++
+			return &Local{n - 1}
+		}
+		s0, s := fresh(), fresh()
+		d := &dcgTranslator{st: st, fresh: fresh}
+		goal := d.body(body, s0, s)
+		if d.invalid != nil {
+			st.typeError("callable", args[0])
+		}
+		// The locals of the body are the variables it was converted from
+		env := make(rib, n)
+		for v, l := range c.locals {
+			env[l.slot].next = v
+		}
+		return m.unify(args[1], bind(s0, env)) && m.unify(args[2], bind(s, env)) &&
+			m.unify(args[3], bind(goal, env))
+	})
+}
@@ -1,8 +1,8 @@
 // Unification-based resolution engine (a la Prolog)
 //
-// Most of this is pretty straightforward, and currently there's a quasi-CPS evaluation
-// strategy in place where the success continuation is passed explicitly and the
-// failure continuation uses the regular call stack.
+// Most of this is pretty straightforward.  Evaluation is performed by a machine with explicit
+// data structures for the continuations (see machine.go), driven by a loop, so the Go stack
+// does not grow with the depth of the resolution.
 //
 // One tricky bit is how variables are managed.  Consider a rule:
 //
@@ -16,13 +16,6 @@
 // invoked and fresh variables are created and referenced from the clone.)  See
 // values.go for more.
 
-// TODO:
-// - some built-in predicates, notably `is`
-// - the obvious first step is to insert an explicit failure continuation
-// - another obvious step is to introduce "cut", possibly "fail"
-// - the continuations can later be reified and the engine recoded as a state machine with
-//   explicit data structures
-
 package engine
 
 func assert(b bool) {
@@ -31,129 +24,368 @@ func assert(b bool) {
 	}
 }
 
-// Evaluation is quasi-CPS-based for now, this is not very efficient but is semantically clean.
-// If unification succeeds locally then the success continuation is invoked, and if there are
-// no effects to undo then that invocation can be a tail call.  If there are effects then the
-// invocation is a non-tail call - the failure continuation is encoded in the call stack.  If
-// the success continuation returns false then we undo the effects.
+// Unification binds variables through the machine, which records the bindings on the trail.
+// It does not undo partial bindings on failure, the caller unwinds the trail.  Whether it checks
+// that a variable does not occur in its value depends on the occurs_check flag, see cyclic.go.
 
-func unify(val1 ValueTerm, val2 ValueTerm, onSuccess func() bool) bool {
-	var var1, var2 *Varslot
-	// TODO: As an optimization we want the varslots in the rib to be updated to point to the
-	// canonical var here so that we don't have to search as many steps later.
-	if ub1, ok := val1.(*Varslot); ok {
-		val1, var1 = ub1.resolve()
-	}
-	if ub2, ok := val2.(*Varslot); ok {
-		val2, var2 = ub2.resolve()
-	}
-	if var1 != nil {
-		if var2 != nil {
-			if var1 != var2 {
-				assert(var1.next == nil && var2.next == nil)
-				assert(var1.val == nil && var2.val == nil)
-				// Arbitrarily make the second point to the first
-				var2.next = var1
-				if !onSuccess() {
-					var2.next = nil
-					return false
+func (m *machine) unify(val1 ValueTerm, val2 ValueTerm) bool {
+	return m.unifyWith(val1, val2, m.st.occursCheck)
+}
+
+func (m *machine) unifyWith(val1 ValueTerm, val2 ValueTerm, check occursCheck) bool {
+	u := unifier{m: m, check: check}
+	return u.unify(val1, val2)
+}
+
+type unifier struct {
+	m     *machine
+	check occursCheck
+	guard pairGuard
+}
+
+func (u *unifier) unify(val1 ValueTerm, val2 ValueTerm) bool {
+	m := u.m
+	for {
+		if u.guard.seenBefore(val1, val2) {
+			return true
+		}
+		var var1, var2 *Varslot
+		// TODO: As an optimization we want the varslots in the rib to be updated to point to
+		// the canonical var here so that we don't have to search as many steps later.
+		if ub1, ok := val1.(*Varslot); ok {
+			val1, var1 = ub1.resolve()
+		}
+		if ub2, ok := val2.(*Varslot); ok {
+			val2, var2 = ub2.resolve()
+		}
+		if var1 != nil {
+			if var2 != nil {
+				if var1 != var2 {
+					// Make the second point to the first, unless only the first has attributes,
+					// so that the hooks do not run when a plain variable is unified with an
+					// attributed one
+					if var2.attrs != nil && var1.attrs == nil {
+						m.linkVar(var1, var2)
+					} else {
+						m.linkVar(var2, var1)
+					}
 				}
 				return true
 			}
+			return u.bind(var1, val2)
 		}
-		assert(var1.next == nil && var1.val == nil)
-		var1.val = val2
-		if !onSuccess() {
-			var1.val = nil
-			return false
+		if var2 != nil {
+			return u.bind(var2, val1)
 		}
-		return true
-	}
-	if var2 != nil {
-		assert(var2.next == nil && var2.val == nil)
-		var2.val = val1
-		if !onSuccess() {
-			var2.val = nil
+		switch v1 := val1.(type) {
+		case *ValueStruct:
+			s2, ok := val2.(*ValueStruct)
+			if !ok || v1.s.functor != s2.s.functor || len(v1.s.subterms) != len(s2.s.subterms) {
+				return false
+			}
+			// Iterate rather than recurse on the last subterm, so that long lists do not
+			// require deep recursion.
+			n := len(v1.s.subterms)
+			if n == 0 {
+				return true
+			}
+			for i := 0; i < n-1; i++ {
+				if !u.unify(bind(v1.s.subterms[i], v1.env), bind(s2.s.subterms[i], s2.env)) {
+					return false
+				}
+			}
+			val1 = bind(v1.s.subterms[n-1], v1.env)
+			val2 = bind(s2.s.subterms[n-1], s2.env)
+		case *Atom:
+			a2, ok := val2.(*Atom)
+			return ok && v1 == a2
+		case *Number:
+			n2, ok := val2.(*Number)
+			return ok && compareNumbers(v1, n2) == 0
+		case *Float:
+			f2, ok := val2.(*Float)
+			return ok && v1.value == f2.value
+		case *String:
+			s2, ok := val2.(*String)
+			return ok && v1.value == s2.value
+		default:
 			return false
 		}
-		return true
 	}
-	if s1, ok := val1.(*ValueStruct); ok {
-		if s2, ok := val2.(*ValueStruct); ok {
-			if s1.s.functor != s2.s.functor || len(s1.s.subterms) != len(s2.s.subterms) {
-				return false
-			}
-			return unify_terms(bind_terms(s1.s.subterms, s1.env), bind_terms(s2.s.subterms, s2.env), onSuccess)
+}
+
+// Bind the unbound varslot `v` to the value `val`, which is not a variable.
+
+func (u *unifier) bind(v *Varslot, val ValueTerm) bool {
+	if u.check != occursCheckFalse && occurs(v, val) {
+		if u.check == occursCheckError {
+			st := u.m.st
+			st.raise(newValueStruct(st.NewAtom("occurs_check"), []ValueTerm{v, val}))
 		}
 		return false
 	}
-	if a1, ok := val1.(*Atom); ok {
-		if a2, ok := val2.(*Atom); ok {
-			if a1 == a2 {
-				return onSuccess()
-			}
+	u.m.bindVar(v, val)
+	return true
+}
+
+func (m *machine) unifyTerms(s1 []ValueTerm, s2 []ValueTerm) bool {
+	for i := range s1 {
+		if !m.unify(s1[i], s2[i]) {
+			return false
 		}
-		return false
 	}
-	if n1, ok := val1.(*Number); ok {
-		if n2, ok := val2.(*Number); ok {
-			if n1.value == n2.value {
-				return onSuccess()
-			}
+	return true
+}
+
+// Solve the goal `t`, bound in `env`, whose continuation is already in m.cont.  `cutB` is the
+// height of the choicepoint stack that `!` in the goal cuts back to.  Returns false if the goal
+// failed, in which case the machine must backtrack.
+
+func (m *machine) solve(t RuleTerm, env rib, cutB int) bool {
+	switch x := t.(type) {
+	case *Atom:
+		return m.call(x, nil, cutB)
+	case *RuleStruct:
+		if isControl, ok := m.solveControl(x, env, cutB); isControl {
+			return ok
 		}
-		return false
+		return m.call(x.functor, bind_terms(x.subterms, env), cutB)
+	case *Local:
+		// A variable goal G is call(G), and call/1 is opaque to cut
+		m.st.current = predicateKey{m.st.callAtom, 1}
+		return m.solveValue(bind(x, env), len(m.chps))
+	default:
+		m.st.current = predicateKey{m.st.callAtom, 1}
+		m.st.typeError("callable", bind(t, env))
+		panic("Unreachable")
 	}
-	return false
 }
 
-func unify_terms(s1 []ValueTerm, s2 []ValueTerm, onSuccess func() bool) bool {
-	if len(s1) == 0 {
-		return onSuccess()
+func (m *machine) solveValue(goal ValueTerm, cutB int) bool {
+	switch g := deref(goal).(type) {
+	case *Atom:
+		return m.call(g, nil, cutB)
+	case *ValueStruct:
+		return m.solve(g.s, g.env, cutB)
+	case *Varslot:
+		m.st.instantiationError()
+	default:
+		m.st.typeError("callable", g)
 	}
-	return unify(s1[0], s2[0], func /* onSuccess */ () bool {
-		return unify_terms(s1[1:], s2[1:], onSuccess)
-	})
+	panic("Unreachable")
 }
 
-func (st *Store) evaluateConjunct(e rib, ts []RuleTerm, onSuccess func() bool) bool {
-	if len(ts) == 0 {
-		return onSuccess()
+func (m *machine) call(functor *Atom, actuals []ValueTerm, cutB int) bool {
+	m.checkLimits(functor, len(actuals))
+	return m.dispatch(functor, actuals, cutB)
+}
+
+// Call a goal whose inference has been counted.
+
+func (m *machine) dispatch(functor *Atom, actuals []ValueTerm, cutB int) bool {
+	st := m.st
+	switch {
+	case functor == st.cutAtom && len(actuals) == 0:
+		m.cutTo(cutB)
+		return true
+	case functor == st.trueAtom && len(actuals) == 0:
+		return true
+	case functor == st.failAtom && len(actuals) == 0:
+		return false
+	case functor == st.callAtom && len(actuals) > 0:
+		// The cut barrier for the called goal is the height of the stack on entry to call/N
+		st.current = predicateKey{functor, len(actuals)}
+		return m.solveValue(addArguments(actuals[0], actuals[1:]), len(m.chps))
+	case functor == st.catchAtom && len(actuals) == 3:
+		st.current = predicateKey{functor, len(actuals)}
+		return m.solveCatch(actuals, cutB)
 	}
-	switch t := ts[0].(type) {
-	case *Number, *Atom, *Local:
-		return onSuccess()
-	case *RuleStruct:
-		candidates := st.lookupRule(t.functor, len(t.subterms))
-		return st.evaluateDisjunct(bind_terms(t.subterms, e), candidates, func /* onSuccess */ () bool {
-			return st.evaluateConjunct(e, ts[1:], onSuccess)
-		})
-	default:
-		panic("Unknown term type")
+	if st.debugger.active() {
+		return m.traceCall(functor, actuals)
 	}
+	return m.callPredicate(functor, actuals)
 }
 
-func (st *Store) evaluateDisjunct(actuals []ValueTerm, disjuncts []*rule, onSuccess func() bool) bool {
-	for _, r := range disjuncts {
+// Call a built-in or a predicate in the database.
+
+func (m *machine) callPredicate(functor *Atom, actuals []ValueTerm) bool {
+	st := m.st
+	if b := st.lookupBuiltin(functor, len(actuals)); b != nil {
+		st.current = predicateKey{functor, len(actuals)}
+		return b(m, actuals)
+	}
+	p := st.lookupPredicate(m.module, functor, len(actuals))
+	if p == nil {
+		if st.flag("unknown").name == "fail" {
+			return false
+		}
+		st.current = predicateKey{functor, len(actuals)}
+		st.existenceError("procedure", st.qualifiedIndicator(m.module, functor, len(actuals)))
+	}
+	if p.tabled {
+		return m.callTabled(functor, actuals, p)
+	}
+	return m.tryClauses(actuals, p.candidates(actuals), m.cont, len(m.chps))
+}
+
+// Try the clauses in turn until the head of one unifies with the actuals, and then continue with
+// its body.  If there are clauses left that may match then the choicepoint at index `cutB`
+// records them; it is created if the stack is not that high yet, and it is removed when the last
+// clause that may match is tried.  Cutting in the body cuts back to `cutB`, discarding that
+// choicepoint.  See index.go, and vm.go for the clauses that are run by the virtual machine.
+
+func (m *machine) tryClauses(actuals []ValueTerm, clauses []*rule, cont *frame, cutB int) bool {
+	if !m.st.interpret {
+		return m.tryCompiled(actuals, clauses, cont, cutB)
+	}
+	if len(m.chps) == 0 {
+		// There are no choicepoints so nothing will ever be undone, see machine.go
+		m.trail = m.trail[:0]
+	}
+	mark, allocMark := len(m.trail), m.allocated
+	// The keys are computed before unification binds the actuals
+	keys := actualKeys(actuals)
+	for i, r := range clauses {
 		assert(len(actuals) == r.arity)
+		if !mayMatch(keys, r) {
+			continue
+		}
 		newRib := make(rib, r.locals)
-		res := unify_terms(actuals, bind_terms(r.formals, newRib), func /* onSuccess */ () bool {
-			return st.evaluateConjunct(newRib, r.body, onSuccess)
-		})
-		if res {
-			return true
+		m.allocated = allocMark + int64(r.locals) + 1
+		if !m.unifyTerms(actuals, bind_terms(r.formals, newRib)) {
+			m.undoTrail(mark)
+			continue
+		}
+		next := i + 1
+		for next < len(clauses) && !mayMatch(keys, clauses[next]) {
+			next++
+		}
+		if next < len(clauses) {
+			if len(m.chps) == cutB {
+				m.chps = append(m.chps, choicepoint{trailMark: mark, allocMark: allocMark, cont: cont,
+					module: m.module, actuals: actuals})
+			}
+			m.chps[cutB].clauses = clauses[next:]
+		} else {
+			m.cutTo(cutB)
 		}
+		if len(r.body) > 0 {
+			m.cont = &frame{goals: r.body, env: newRib, cutB: cutB, module: m.clauseModule(r), next: cont}
+		} else {
+			m.cont = cont
+		}
+		return true
 	}
+	m.cutTo(cutB)
 	return false
 }
 
+// A Query is an evaluation of a conjunction of goals that can be paused after each solution
+// and resumed to find the next one.  The variables of the query are in a rib that is indexed
+// like the names.
+
+type Query struct {
+	m     *machine
+	names []*Atom
+	vars  rib
+	done  bool
+
+	// The state of the tracer when the query was made, which is restored when it is closed, so
+	// that tracing turned on by trace/0 or a spy point ends with the query and the names of the
+	// variables in its events are forgotten, see trace.go.
+	tracing  bool
+	skip     int64
+	varNames map[*Varslot]string
+}
+
+func (st *Store) NewQuery(query []RuleTerm, names []*Atom) *Query {
+	return st.newQuery(st.userModule, query, names)
+}
+
+// A query that runs in the module.
+
+func (st *Store) newQuery(md *module, query []RuleTerm, names []*Atom) *Query {
+	vars := make(rib, len(names))
+	d := &st.debugger
+	q := &Query{m: st.newMachine(md, query, vars), names: names, vars: vars,
+		tracing: d.tracing, skip: d.skip, varNames: d.varNames}
+	d.varNames = nil
+	return q
+}
+
+// Find the next solution, returning false if there are no more.  If a built-in raises an error
+// or halts then the evaluation is abandoned, the bindings are undone, and the error or *Halt is
+// returned.
+
+func (q *Query) Next() (found bool, err error) {
+	if q.done {
+		return false, nil
+	}
+	defer func() {
+		if x := recover(); x != nil {
+			switch e := x.(type) {
+			case *Exception:
+				// The ball may refer to variables that are unbound by Close
+				err = &Exception{copyTerm(e.term)}
+			case *Halt:
+				err = e
+			default:
+				panic(x)
+			}
+			q.Close()
+			found = false
+		}
+	}()
+	if !q.m.run() {
+		q.Close()
+		return false, nil
+	}
+	return true, nil
+}
+
+func (q *Query) Names() []*Atom {
+	return q.names
+}
+
+// The variables of the query, which are valid until the next call to Next or Close.
+
+func (q *Query) Vars() []Varslot {
+	return q.vars
+}
+
+// Abandon the query, undoing its bindings.
+
+func (q *Query) Close() {
+	if q.done {
+		return
+	}
+	q.m.reset()
+	q.done = true
+	q.m.st.debugger.restore(q.tracing, q.skip, q.varNames)
+}
+
 func (st *Store) EvaluateQuery(query []RuleTerm, names []*Atom,
 	processQuerySuccess func(names []*Atom, vars []Varslot) bool,
-	processQueryFailure func()) {
-	vars := make(rib, len(names))
-	result := st.evaluateConjunct(vars, query, func /* onSuccess */ () bool {
-		return processQuerySuccess(names, vars)
-	})
-	if !result {
-		processQueryFailure()
+	processQueryFailure func()) error {
+	return st.evaluateQuery(st.userModule, query, names, processQuerySuccess, processQueryFailure)
+}
+
+func (st *Store) evaluateQuery(md *module, query []RuleTerm, names []*Atom,
+	processQuerySuccess func(names []*Atom, vars []Varslot) bool,
+	processQueryFailure func()) error {
+	q := st.newQuery(md, query, names)
+	for {
+		found, err := q.Next()
+		if err != nil {
+			return err
+		}
+		if !found {
+			processQueryFailure()
+			return nil
+		}
+		if processQuerySuccess(names, q.Vars()) {
+			q.Close()
+			return nil
+		}
 	}
 }
@@ -0,0 +1,2036 @@
+package engine
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Run the program and return the output for each query, where every solution of a query is
+// reported and the search is then continued by failing into it.
+
+func runProgram(t *testing.T, program string) string {
+	var out strings.Builder
+	st := NewStore()
+	st.Load("test", strings.NewReader(program), recordOutput(st, &out))
+	return out.String()
+}
+
+// Errors raised by built-ins are recorded as their error terms, without the location.
+
+func recordOutput(st *Store, out *strings.Builder) Callbacks {
+	return Callbacks{
+		QuerySuccess: func(names []*Atom, vars []Varslot) bool {
+			for _, b := range st.FormatBindings(names, vars) {
+				out.WriteString(b + " ")
+			}
+			out.WriteString("yes\n")
+			return false
+		},
+		QueryFailure: func() {
+			out.WriteString("no\n")
+		},
+		QueryError: func(err error) {
+			var exn *Exception
+			if errors.As(err, &exn) {
+				err = exn
+			}
+			out.WriteString("error: " + err.Error() + "\n")
+		},
+	}
+}
+
+func expectOutput(t *testing.T, program string, expected string) {
+	t.Helper()
+	if got := runProgram(t, program); got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+const family = `
+father(haakon, olav).
+father(olav, harald).
+father(harald, haakon_magnus).
+father(haakon_magnus, ingrid_alexandra).
+`
+
+func TestControl(t *testing.T) {
+	expectOutput(t, family+`
+?- true.
+?- fail.
+?- father(X, harald), true.
+?- father(X, harald), fail.
+`, "yes\nno\nno\nX = olav yes\nno\nno\n")
+}
+
+func TestCutInClause(t *testing.T) {
+	expectOutput(t, family+`
+first(X) :- father(X, Y), !.
+?- first(X).
+?- father(X, Y), !.
+`, "X = haakon yes\nno\nX = haakon Y = olav yes\nno\n")
+}
+
+func TestCutDiscardsLaterClauses(t *testing.T) {
+	expectOutput(t, `
+color(red).
+color(green).
+pick(X) :- color(X), !.
+pick(X) :- same(X, blue).
+same(X, X) :- true.
+max(X, Y, Z) :- le(X, Y), !, same(Z, Y).
+max(X, Y, Z) :- same(Z, X).
+le(a, b).
+le(a, c).
+le(b, c).
+?- pick(X).
+?- max(a, b, Z).
+?- max(c, b, Z).
+`, "X = red yes\nno\nZ = b yes\nno\nZ = c yes\nno\n")
+}
+
+func TestCutInNestedRules(t *testing.T) {
+	// The cut in inner/1 only prunes the choices of inner/1, not those of outer/2
+	expectOutput(t, family+`
+inner(X) :- father(X, Y), !.
+outer(X, Y) :- father(X, Y), inner(Y).
+?- outer(X, Y).
+`, "X = haakon Y = olav yes\nX = olav Y = harald yes\n"+
+		"X = harald Y = haakon_magnus yes\nno\n")
+}
+
+func TestCutInRecursiveRules(t *testing.T) {
+	// The cut in each recursive invocation of ancestor/2 prunes only that invocation
+	expectOutput(t, family+`
+ancestor(X, Y) :- father(X, Y), !.
+ancestor(X, Y) :- father(X, Z), ancestor(Z, Y).
+?- ancestor(haakon, ingrid_alexandra).
+?- ancestor(haakon, Y).
+oldest(X, X) :- father(Y, X), !, fail.
+oldest(X, X) :- true.
+?- oldest(haakon, X).
+?- oldest(olav, X).
+`, "yes\nno\nY = olav yes\nno\nX = haakon yes\nno\nno\n")
+}
+
+func TestCall(t *testing.T) {
+	expectOutput(t, family+`
+grandfather(X, Y) :- father(X, Z), father(Z, Y).
+apply(G, X) :- call(G, X).
+same(X, X) :- true.
+?- call(father(haakon), X).
+?- apply(grandfather(X), harald).
+?- same(G, fail), call(G).
+?- same(G, father(X, harald)), G.
+`, "X = olav yes\nno\nX = haakon yes\nno\nno\n"+
+		"G = father(olav,harald) X = olav yes\nno\n")
+}
+
+func TestCallIsOpaqueToCut(t *testing.T) {
+	expectOutput(t, family+`
+opaque(X) :- father(X, Y), call(!).
+transparent(X) :- father(X, Y), !.
+?- opaque(X).
+?- transparent(X).
+`, "X = haakon yes\nX = olav yes\nX = harald yes\n"+
+		"X = haakon_magnus yes\nno\nX = haakon yes\nno\n")
+}
+
+func TestArithmetic(t *testing.T) {
+	expectOutput(t, `
+?- X is 1 + 2 * 3 - 4.
+?- X is (1 + 2) * 3, Y is X // 2, Z is X mod 2.
+?- X is 7 mod -2, Y is -7 rem 2, Z is -7 // 2.
+?- X is min(3, 4) + max(3, 4) + abs(-5) + 2 ** 10.
+?- X is 5 - 3 - 1, Y is 2 ^ 3 ^ 2.
+?- 3 is 1 + 2.
+?- 4 is 1 + 2.
+`, "X = 3 yes\nno\n"+
+		"X = 9 Y = 4 Z = 1 yes\nno\n"+
+		"X = -1 Y = -1 Z = -3 yes\nno\n"+
+		"X = 1036 yes\nno\n"+
+		"X = 1 Y = 512 yes\nno\n"+
+		"yes\nno\n"+
+		"no\n")
+}
+
+func TestArithmeticComparison(t *testing.T) {
+	expectOutput(t, `
+?- 1 + 2 =:= 3, 1 =\= 2, 1 < 2, 2 =< 2, 3 > 2, 3 >= 3.
+?- 2 < 1.
+?- 1 =:= 2.
+count(N, N) :- true.
+count(N, M) :- N < 3, K is N+1, count(K, M).
+?- count(0, X).
+`, "yes\nno\nno\nno\n"+
+		"X = 0 yes\nX = 1 yes\nX = 2 yes\nX = 3 yes\nno\n")
+}
+
+func TestArithmeticErrors(t *testing.T) {
+	expectOutput(t, `
+?- X is Y + 1.
+?- X is foo + 1.
+?- X is 1 // 0.
+?- X < 1.
+?- X is 1.0e308 * 10.
+?- X is 1 / 0.0.
+?- X is sqrt(-1).
+?- X is 1.5 // 2.
+?- X is 2 ** (2 ** 40).
+`, "error: error(instantiation_error,context((is)/2,_A))\n"+
+		"error: error(type_error(evaluable,foo/0),context((is)/2,_A))\n"+
+		"error: error(evaluation_error(zero_divisor),context((is)/2,_A))\n"+
+		"error: error(instantiation_error,context((<)/2,_A))\n"+
+		"error: error(evaluation_error(float_overflow),context((is)/2,_A))\n"+
+		"error: error(evaluation_error(zero_divisor),context((is)/2,_A))\n"+
+		"error: error(evaluation_error(undefined),context((is)/2,_A))\n"+
+		"error: error(type_error(integer,1.5),context((is)/2,_A))\n"+
+		"error: error(resource_error(memory),context((is)/2,_A))\n")
+}
+
+const expressions = `
+expr(V) --> term(T), expr_rest(T, V).
+expr_rest(Acc, V) --> ws, "+", !, term(T), { A is Acc + T }, expr_rest(A, V).
+expr_rest(Acc, V) --> ws, "-", !, term(T), { A is Acc - T }, expr_rest(A, V).
+expr_rest(V, V) --> ws.
+term(V) --> factor(F), term_rest(F, V).
+term_rest(Acc, V) --> ws, "*", !, factor(F), { A is Acc * F }, term_rest(A, V).
+term_rest(Acc, V) --> ws, "/", !, factor(F), { A is Acc / F }, term_rest(A, V).
+term_rest(V, V) --> [].
+factor(V) --> ws, "(", !, expr(V), ws, ")".
+factor(V) --> ws, "-", !, factor(F), { V is -F }.
+factor(V) --> ws, digits(Ds), { Ds \== [], number_codes(V, Ds) }.
+digits([D|Ds]) --> digit(D), !, digits(Ds).
+digits([]) --> [].
+digit(D) --> [D], { D >= 48, D =< 57 }.
+ws --> [C], { C =:= 32 }, !, ws.
+ws --> [].
+calc(Text, V) :- string_codes(Text, Cs), phrase(expr(V), Cs).
+`
+
+func TestGrammars(t *testing.T) {
+	expectOutput(t, expressions+`
+?- calc("1+2*3", V).
+?- calc(" (1 + 2) * 3 - -4 / 2 ", V).
+?- calc("2*(3+4)*5", V).
+?- calc("7/2", V).
+?- calc("1+", V).
+?- calc("(1", V).
+?- string_codes("12+3 rest", Cs), phrase(expr(V), Cs, Rest), atom_codes(R, Rest).
+`, "V = 7 yes\nno\n"+
+		"V = 11 yes\nno\n"+
+		"V = 70 yes\nno\n"+
+		"V = 3.5 yes\nno\n"+
+		"no\n"+
+		"no\n"+
+		"Cs = [49,50,43,51,32,114,101,115,116] V = 15 Rest = [114,101,115,116] R = rest yes\nno\n")
+
+	expectOutput(t, `
+greeting --> [hello], name.
+name --> [world].
+name --> [prolog].
+ab --> [].
+ab --> [a], ab, [b].
+peek(X), [X] --> [X].
+digit(D) --> [D], { member(D, [0, 1]) }.
+pair(P) --> call(item, X), call(item, Y), { P = X-Y }.
+item(X, [X|S], S).
+not_a --> \+ [a], [_].
+opt --> ([a] -> [] ; [b]).
+?- phrase(greeting, [hello, X]).
+?- phrase(ab, [a, a, b, b]), \+ phrase(ab, [a, b, b]).
+?- phrase(peek(X), [a, b], R).
+?- phrase(pair(P), [1, 2]).
+?- phrase(not_a, [b]), \+ phrase(not_a, [a]).
+?- phrase(opt, [a]), phrase(opt, [b]), \+ phrase(opt, [a, b]).
+?- phrase(([x], "yz"), [x, 121, 122]).
+?- G = digit(D), phrase((G, G), L).
+?- phrase(X, [a]).
+?- phrase(1, [a], _).
+bad --> 1.
+`, "X = world yes\nX = prolog yes\nno\n"+
+		"yes\nno\n"+
+		"X = a R = [a,b] yes\nno\n"+
+		"P = 1-2 yes\nno\n"+
+		"yes\nno\n"+
+		"yes\nno\n"+
+		"yes\nno\n"+
+		"G = digit(0) D = 0 L = [0,0] yes\nG = digit(1) D = 1 L = [1,1] yes\nno\n"+
+		"error: error(instantiation_error,context(phrase/2,_A))\n"+
+		"error: error(type_error(callable,1),context(phrase/3,_A))\n"+
+		"error: test:23: Invalid grammar rule: 1\n")
+}
+
+func TestBignums(t *testing.T) {
+	expectOutput(t, `
+?- X is 9223372036854775807 + 1.
+?- X is 2 ** 100, Y is X // 3, Z is X mod 7.
+?- X is -(2 ** 64) + 2 ** 64 + 5, integer(X).
+?- X = 123456789012345678901234567890, X > 1, X @> 1.0e29.
+?- X is 100000000000000000000 * 100000000000000000000 / 100000000000000000000.
+?- X is 1 << 70 >> 68, Y is -1 << 64 >> 65, Z is (2 ** 80 - 1) /\ 255.
+?- X is msb(2 ** 90), Y is gcd(2 ** 90, 6 ** 20).
+?- X is 2 ** 64 + 0.5.
+`, "X = 9223372036854775808 yes\nno\n"+
+		"X = 1267650600228229401496703205376 Y = 422550200076076467165567735125 Z = 2 yes\nno\n"+
+		"X = 5 yes\nno\n"+
+		"X = 123456789012345678901234567890 yes\nno\n"+
+		"X = 100000000000000000000 yes\nno\n"+
+		"X = 4 Y = -1 Z = 255 yes\nno\n"+
+		"X = 90 Y = 1048576 yes\nno\n"+
+		"X = 1.8446744073709552e19 yes\nno\n")
+}
+
+func TestFloats(t *testing.T) {
+	expectOutput(t, `
+?- X is 7 / 2, Y is 6 / 2, Z is 1.5 * 2.
+?- X is 2.0e3 + 1, Y is -0.25, Z is 1.0e22.
+?- X is sqrt(16), Y is 2 ** -1, Z is 2 ** 0.5 * 2 ** 0.5.
+?- X is truncate(-3.7), Y is round(2.5), Z is ceiling(2.1), W is floor(-2.1).
+?- X is float(1) + float_fractional_part(2.75), Y is integer(1.0e20).
+?- 1 =:= 1.0, 1 \== 1.0, 1.0 @< 1, 2 @> 1.5.
+?- 1 = 1.0.
+?- X is max(1, 2.5), Y is min(3, 2.0), Z is abs(-2.5), W is sign(-2.5).
+?- float(1.5), \+ float(1), number(1.5), atomic(1.5), \+ integer(1.5).
+p(1.5, float).
+p(1, integer).
+?- p(1.5, X), p(1, Y).
+`, "X = 3.5 Y = 3 Z = 3.0 yes\nno\n"+
+		"X = 2001.0 Y = -0.25 Z = 1.0e22 yes\nno\n"+
+		"X = 4.0 Y = 0.5 Z = 2.0000000000000004 yes\nno\n"+
+		"X = -3 Y = 3 Z = 3 W = -3 yes\nno\n"+
+		"X = 1.75 Y = 100000000000000000000 yes\nno\n"+
+		"yes\nno\n"+
+		"no\n"+
+		"X = 2.5 Y = 2.0 Z = 2.5 W = -1.0 yes\nno\n"+
+		"yes\nno\n"+
+		"X = float Y = integer yes\nno\n")
+}
+
+func TestStrings(t *testing.T) {
+	expectOutput(t, `
+?- X = "hello world", string(X), \+ atom(X), atomic(X).
+?- "abc" = abc.
+?- "abc" == "abc", "abc" @< "abd", abc @< "abc", "abc" @< f(x).
+?- msort([f(x), "b", b, 1.0, 2, "a", a, X], L).
+?- atom_string(A, "xyz"), atom_string(abc, S).
+?- string_concat(S1, S2, "ab").
+?- X = "", string_length(X, N).
+?- set_prolog_flag(double_quotes, codes).
+?- X = "ab".
+?- set_prolog_flag(double_quotes, chars).
+?- X = "ab".
+?- set_prolog_flag(double_quotes, atom).
+?- X = "ab", atom(X).
+`, "X = \"hello world\" yes\nno\n"+
+		"no\n"+
+		"yes\nno\n"+
+		"L = [X,1.0,2,a,b,\"a\",\"b\",f(x)] yes\nno\n"+
+		"A = xyz S = \"abc\" yes\nno\n"+
+		"S1 = \"\" S2 = \"ab\" yes\nS1 = \"a\" S2 = \"b\" yes\nS1 = \"ab\" S2 = \"\" yes\nno\n"+
+		"X = \"\" N = 0 yes\nno\n"+
+		"yes\nno\n"+
+		"X = [97,98] yes\nno\n"+
+		"yes\nno\n"+
+		"X = [a,b] yes\nno\n"+
+		"yes\nno\n"+
+		"X = ab yes\nno\n")
+}
+
+func TestTextBuiltins(t *testing.T) {
+	expectOutput(t, `
+?- atom_codes(abc, L), atom_codes(A, [120, 121]).
+?- atom_chars(X, [h, i]), atom_chars(hi, L).
+?- atom_length(hello, N), atom_length('', M), atom_length(42, K).
+?- atom_length(X, 3).
+?- atom_length(abc, foo).
+?- sub_atom(hello, 1, 3, A, S).
+?- sub_atom(abcab, B, 2, A, ab).
+?- sub_atom(abc, B, L, 0, S).
+?- atom_concat(abc, def, X), atom_concat(X, 1, Y).
+?- atom_concat(X, Y, ab).
+?- atom_concat(X, c, abc).
+?- number_codes(X, "  42"), number_codes(Y, "-1.5e3"), number_codes(12, L).
+?- number_codes(X, "4x").
+?- atom_number('3.25', X), atom_number(A, 7).
+?- atom_number(foo, X).
+?- number_string(N, "123456789012345678901234567890").
+?- char_code(C, 97), char_code(b, X).
+?- atom_codes(X, []), atom_length([], N).
+?- atom_length(f(x), L).
+?- string_length(f(x), L).
+?- atom_codes(X, f(x)).
+?- atom_codes(X, [0'a|b]).
+`, "L = [97,98,99] A = xy yes\nno\n"+
+		"X = hi L = [h,i] yes\nno\n"+
+		"N = 5 M = 0 K = 2 yes\nno\n"+
+		"error: error(instantiation_error,context(atom_length/2,_A))\n"+
+		"error: error(type_error(integer,foo),context(atom_length/2,_A))\n"+
+		"A = 1 S = ell yes\nno\n"+
+		"B = 0 A = 3 yes\nB = 3 A = 0 yes\nno\n"+
+		"B = 0 L = 3 S = abc yes\nB = 1 L = 2 S = bc yes\nB = 2 L = 1 S = c yes\nB = 3 L = 0 S = '' yes\nno\n"+
+		"X = abcdef Y = abcdef1 yes\nno\n"+
+		"X = '' Y = ab yes\nX = a Y = b yes\nX = ab Y = '' yes\nno\n"+
+		"X = ab yes\nno\n"+
+		"X = 42 Y = -1500.0 L = [49,50] yes\nno\n"+
+		"error: error(syntax_error(illegal_number),context(number_codes/2,_A))\n"+
+		"X = 3.25 A = '7' yes\nno\n"+
+		"no\n"+
+		"N = 123456789012345678901234567890 yes\nno\n"+
+		"C = a X = 98 yes\nno\n"+
+		"X = '' N = 2 yes\nno\n"+
+		"error: error(type_error(atom,f(x)),context(atom_length/2,_A))\n"+
+		"error: error(type_error(string,f(x)),context(string_length/2,_A))\n"+
+		"error: error(type_error(list,f(x)),context(atom_codes/2,_A))\n"+
+		"error: error(type_error(list,b),context(atom_codes/2,_A))\n")
+}
+
+func TestFormat(t *testing.T) {
+	expectOutput(t, `
+?- format(atom(A), "~w and ~a: ~q~n", [f(x), abc, "str"]).
+?- format(atom(A), "~d ~2d ~D ~2D", [42, 314, 1234567, -1234567]).
+?- format(atom(A), "~2f ~e ~4g ~0f", [3.14159, 1.5, 0.5, 2]).
+?- format(atom(A), "~s~c~3c ~8r ~16R ~~ ~i~w", ["ab", 99, 100, 64, 255, skipped, last]).
+?- format(atom(A), "~w~t~8|~w~t~6+~w", [ab, cd, ef]).
+?- format(atom(A), "~t~w~8|~`+"`"+`*t~w~t~8+", [right, mid]).
+?- format(atom(A), "~w", hello).
+?- format(atom(A), "~*c", [3, 120]).
+?- format(atom(A), "~w ~w", [a]).
+?- format(atom(A), "~w", [a, b]).
+?- format(atom(A), "~d", [a]).
+?- format(atom(A), "~z", [a]).
+`, "A = 'f(x) and abc: \"str\"\\n' yes\nno\n"+
+		"A = '42 3.14 1,234,567 -12,345.67' yes\nno\n"+
+		"A = '3.14 1.500000e+00 0.5 2' yes\nno\n"+
+		"A = 'abcddd 100 FF ~ last' yes\nno\n"+
+		"A = 'ab      cd    ef' yes\nno\n"+
+		"A = '   right**mid   ' yes\nno\n"+
+		"A = hello yes\nno\n"+
+		"A = xxx yes\nno\n"+
+		"error: error(format('not enough arguments'),context(format/3,_A))\n"+
+		"error: error(format('too many arguments'),context(format/3,_A))\n"+
+		"error: error(format('integer expected, found a'),context(format/3,_A))\n"+
+		"error: error(format('unknown directive ~z'),context(format/3,_A))\n")
+}
+
+// Run the program with the input and return what it writes and the output for each query.
+
+func runWithStreams(program string, input string) string {
+	var out strings.Builder
+	st := NewStore()
+	st.SetInput(strings.NewReader(input))
+	st.SetOutput(&out)
+	st.Load("test", strings.NewReader(program), recordOutput(st, &out))
+	return out.String()
+}
+
+func TestWrite(t *testing.T) {
+	got := runWithStreams(`
+:- writeq('håkon magnus'), nl.
+:- writeq([a, 'B', "str", [], '{}', ',', '|', 'a\\b', f(;)]), nl.
+:- writeq(1+2*3), nl, writeq((1+2)*3), nl, writeq(1-(2-3)), nl, writeq(1-2-3), nl.
+:- writeq(-(1)), nl, writeq(-(-(1))), nl, writeq(- a), nl, writeq(1 - -1), nl, writeq(-(1^2)), nl.
+:- writeq((a:-b,c;d->e)), nl, writeq(f((a,b))), nl, writeq(\+ (a,b)), nl, writeq(- (+)), nl.
+:- writeq(1 rem 2), nl, writeq({a,b}), nl, writeq('$VAR'(1)+'$VAR'(27)), nl.
+:- write_canonical([a+b, 'x y', "s", '$VAR'(1)]), nl.
+:- print(f('A')), nl, write('a b'+"s"), nl.
+:- write_term([1+2, 'x y'], [quoted(true), ignore_ops(true)]), nl.
+:- format("~w ~q ~p~n", ['a b', 'a b', 'a b']).
+?- catch(write_term(x, [foo(true)]), error(E, _), true).
+`, "")
+	expected := "'håkon magnus'\n" +
+		"[a,'B',\"str\",[],{},',','|','a\\\\b',f(;)]\n" +
+		"1+2*3\n(1+2)*3\n1-(2-3)\n1-2-3\n" +
+		"- 1\n- - 1\n-a\n1- -1\n- 1^2\n" +
+		"a:-b,c;d->e\nf((a,b))\n\\+ (a,b)\n- (+)\n" +
+		"1 rem 2\n{a,b}\nB+B1\n" +
+		"[+(a,b),'x y',\"s\",'$VAR'(1)]\n" +
+		"f('A')\na b+s\n" +
+		"[+(1,2),'x y']\n" +
+		"a b 'a b' 'a b'\n" +
+		"E = domain_error(write_option,foo(true)) yes\nno\n"
+	if got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestRead(t *testing.T) {
+	expected := "X = foo(bar,_A) Y = 'a b'+1 yes\nno\n" +
+		"T = f(_A,_B,_C,_A) V = ['X'=_A,'Y'=_C] Vs = [_A,_B,_C] yes\nno\n" +
+		"E = syntax_error('operator expected, found g') yes\nno\n" +
+		"T = end_of_file yes\nno\n"
+	got := runWithStreams(`
+?- read(X), read(Y).
+?- read_term(T, [variable_names(V), variables(Vs)]).
+?- catch(read(_), error(E, _), true).
+?- read(T).
+`, "foo(bar, Baz).\n'a b' + 1 .\nf(X, _, Y, X).\nf(x) g.\n")
+	if got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestStreams(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "terms")
+	got := runWithStreams(`
+:- open('`+file+`', write, S), writeq(S, f('A b', "s", x+y)), write(S, '.'), nl(S),
+   format(S, "g(~q).~n", [[1,2]]), close(S).
+:- open('`+file+`', append, S), set_output(S), write('h.'), nl, close(S).
+?- open('`+file+`', read, S), read(S, A), read(S, B), read(S, C), read(S, D), close(S).
+?- open('`+file+`', read, S), set_input(S), read(A), close(S), current_input(I).
+?- current_output(O).
+?- catch(open('`+file+`', read, s), error(E, _), true).
+?- catch(open('`+file+`', update, _), error(E, _), true).
+?- catch(open(_, read, _), error(E, _), true).
+?- catch(open('`+file+`.missing', read, _), error(E, _), true).
+?- catch(write(user_input, x), error(E, _), true).
+?- catch(read(user_output, _), error(E, _), true).
+?- catch(close(foo), error(E, _), true).
+?- catch(nl(f(x)), error(E, _), true).
+?- open('`+file+`', read, S), close(S), catch(read(S, _), error(E, _), true).
+?- open('`+file+`.a', write, S1), close(S1), open('`+file+`.b', write, S2),
+   catch(write(S1, oops), error(E, _), true), close(S2).
+`, "")
+	expected := "S = '$stream'(5) A = f('A b',\"s\",x+y) B = g([1,2]) C = h D = end_of_file yes\nno\n" +
+		"S = '$stream'(6) A = f('A b',\"s\",x+y) I = user_input yes\nno\n" +
+		"O = user_output yes\nno\n" +
+		"E = uninstantiation_error(s) yes\nno\n" +
+		"E = domain_error(io_mode,update) yes\nno\n" +
+		"E = instantiation_error yes\nno\n" +
+		"E = existence_error(source_sink,'" + file + ".missing') yes\nno\n" +
+		"E = permission_error(output,stream,user_input) yes\nno\n" +
+		"E = permission_error(input,stream,user_output) yes\nno\n" +
+		"E = existence_error(stream,foo) yes\nno\n" +
+		"E = domain_error(stream_or_alias,f(x)) yes\nno\n" +
+		"S = '$stream'(7) E = existence_error(stream,'$stream'(7)) yes\nno\n" +
+		"S1 = '$stream'(8) S2 = '$stream'(9) E = existence_error(stream,'$stream'(8)) yes\nno\n"
+	if got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestDeepRecursion(t *testing.T) {
+	// A million-step recursion runs in bounded Go stack, the last call does not grow the
+	// continuation, and the trail is not retained when there are no choicepoints.
+	expectOutput(t, `
+count(0).
+count(N) :- N > 0, M is N-1, count(M).
+?- count(1000000).
+len(L, N) :- len(L, 0, N).
+len(nil, N, N) :- true.
+len(cons(X, L), K, N) :- K1 is K+1, len(L, K1, N).
+mklist(0, nil) :- true.
+mklist(N, cons(N, L)) :- N > 0, M is N-1, mklist(M, L).
+check(N) :- mklist(N, L), len(L, K), !, K =:= N.
+?- check(500000).
+loop(N) :- ( N > 0 -> M is N-1, loop(M) ; true ).
+?- loop(1000000).
+`, "yes\nno\nyes\nno\nyes\nno\n")
+	// Long lists are copied, and a clause with one is run, without deep recursion.  The Go
+	// stack is made small so that recursion on the tail of the lists would overflow it.
+	defer debug.SetMaxStack(debug.SetMaxStack(4 << 20))
+	expectOutput(t, `
+?- \+ \+ (length(L, 100000), findall(L, true, _)).
+?- \+ \+ (length(L, 100000), copy_term(L, _)).
+?- \+ \+ (length(L, 100000), assertz(big(L))).
+?- \+ \+ (big(L), length(L, 100000)).
+`, "yes\nno\nyes\nno\nyes\nno\nyes\nno\n")
+}
+
+func TestListSyntax(t *testing.T) {
+	expectOutput(t, `
+?- X = [a, b, c].
+?- [H|T] = [a, b, c].
+?- X = [a, b|T].
+?- X = '.'(a, '.'(b, [])).
+?- X = [[1, 2], [], [f(x)|y]].
+?- [] = '[]'.
+`, "X = [a,b,c] yes\nno\n"+
+		"H = a T = [b,c] yes\nno\n"+
+		"X = [a,b|T] yes\nno\n"+
+		"X = [a,b] yes\nno\n"+
+		"X = [[1,2],[],[f(x)|y]] yes\nno\n"+
+		"yes\nno\n")
+}
+
+func TestListLibrary(t *testing.T) {
+	expectOutput(t, `
+?- append(X, Y, [1, 2]).
+?- append([a], [b, c], X).
+?- member(X, [a, b]).
+?- length([a, b, c], N).
+?- length(L, 2).
+?- length(L, N), N >= 2, !.
+?- reverse([1, 2, 3], R).
+?- nth0(1, [a, b, c], E).
+?- nth0(I, [a, b], E).
+?- nth0(5, [a, b], E).
+?- msort([c, 2, f(x), b, 1, a, 2, X], S).
+`, "X = [] Y = [1,2] yes\nX = [1] Y = [2] yes\nX = [1,2] Y = [] yes\nno\n"+
+		"X = [a,b,c] yes\nno\n"+
+		"X = a yes\nX = b yes\nno\n"+
+		"N = 3 yes\nno\n"+
+		"L = [_A,_B] yes\nno\n"+
+		"L = [_A,_B] N = 2 yes\nno\n"+
+		"R = [3,2,1] yes\nno\n"+
+		"E = b yes\nno\n"+
+		"I = 0 E = a yes\nI = 1 E = b yes\nno\n"+
+		"no\n"+
+		"S = [X,1,2,2,a,b,c,f(x)] yes\nno\n")
+}
+
+func TestStandardOrder(t *testing.T) {
+	expectOutput(t, `
+?- compare(O, 1, a).
+?- compare(O, f(b), f(a)).
+?- compare(O, g(a), f(a, b)).
+?- X == X, X \== Y, a @< b, f(a) @> a, 1 @=< 1, X @< 1.
+`, "O = < yes\nno\nO = > yes\nno\nO = < yes\nno\n"+
+		"yes\nno\n")
+}
+
+func TestOperators(t *testing.T) {
+	expectOutput(t, `
+?- X = a + b * c.
+?- X = (a + b) * c.
+?- X = a - b - c, Y = a ^ b ^ c.
+?- X = - 1, Y = -1, Z = - a, W = -(-(1)).
+?- X = (a :- b, c ; d -> e), Y = [-, +].
+?- X = f(a, (b, c)), Y = \+ a.
+?- X is 2 + 3 * 4 - 10 // 2.
+`, "X = a+b*c yes\nno\n"+
+		"X = (a+b)*c yes\nno\n"+
+		"X = a-b-c Y = a^b^c yes\nno\n"+
+		"X = - 1 Y = -1 Z = -a W = - - 1 yes\nno\n"+
+		"X = (a:-b,c;d->e) Y = [-,+] yes\nno\n"+
+		"X = f(a,(b,c)) Y = (\\+a) yes\nno\n"+
+		"X = 9 yes\nno\n")
+}
+
+func TestUserOperators(t *testing.T) {
+	expectOutput(t, `
+:- op(700, xfx, ===>).
+:- op(200, xfy, [and, or]).
+:- op(100, fy, ~).
+:- op(100, xf, ++).
+a ===> b.
+?- X ===> Y.
+?- X = (p and ~ q or r), Y = (3 ++).
+?- current_op(P, T, ===>).
+:- op(0, xfx, ===>).
+?- current_op(P, T, ===>).
+?- op(1201, xfx, foo).
+?- op(700, xfx, ',').
+`, "X = a Y = b yes\nno\n"+
+		"X = p and~q or r Y = 3++ yes\nno\n"+
+		"P = 700 T = xfx yes\nno\n"+
+		"no\n"+
+		"error: error(domain_error(operator_priority,1201),context(op/3,_A))\n"+
+		"error: error(permission_error(modify,operator,','),context(op/3,_A))\n")
+}
+
+func TestFormatBindings(t *testing.T) {
+	expectOutput(t, `
+?- X = Y.
+?- X = f(Y, Z, _), Z = Y.
+?- length(L, 3), L = [A|_].
+?- X = 'B', Y = '', Z = 'a\tb', S = "line\n".
+?- X = (a :- b, c), Y = f((a, b)), Z = - (1).
+?- throw(f(X, Y, X)).
+`, "X = Y yes\nno\n"+
+		"X = f(Y,Y,_A) Y = Z yes\nno\n"+
+		"L = [A,_A,_B] yes\nno\n"+
+		"X = 'B' Y = '' Z = 'a\\tb' S = \"line\\n\" yes\nno\n"+
+		"X = (a:-b,c) Y = f((a,b)) Z = - 1 yes\nno\n"+
+		"error: f(_A,_B,_A)\n")
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	expectOutput(t, `
+p(1).
+p(2 3).
+p(3).
+?- p(X.
+?- p(X).
+q(X) :- .
+?- X is foo + 1.
+?- X = 'a\z'.
+?- X = 1.
+?- X = 'a\x41'.
+?- Y = 2.
+`, "error: test:3:5: syntax error: expected , or ) in arguments, found 3\n"+
+		"error: test:5:7: syntax error: expected , or ) in arguments, found end of clause\n"+
+		"X = 1 yes\nX = 3 yes\nno\n"+
+		"error: test:7:9: syntax error: unexpected end of clause\n"+
+		"error: error(type_error(evaluable,foo/0),context((is)/2,_A))\n"+
+		"error: test:9:11: syntax error: undefined escape sequence \\z\n"+
+		"X = 1 yes\nno\n"+
+		"error: test:11:13: syntax error: escape sequence must end with a backslash\n"+
+		"Y = 2 yes\nno\n")
+}
+
+func TestTokenizer(t *testing.T) {
+	got := runWithStreams("% A comment\r\n"+
+		"navn(håkon, ærlig). % another\r\n"+
+		"navn(ørjan, 'Åse').\r"+
+		":- navn(X, Y), writeq(X-Y), nl, fail ; true.\n"+
+		":- writeq(['it''s', 'a\\n\\x41\\\\101\\\\u00e5', \"tab\\there\"]), nl.\n"+
+		":- writeq('long \\\nline'), nl.\n"+
+		":- X = [0'a, 0' , 0''', 0'\\n, 0x1F, 0o17, 0b101, -0xff], writeq(X), nl.\n"+
+		"?- Åse = 1, Ægir = 0x.\n"+
+		"?- X = f(a,\n        b c).\n"+
+		"?- X = 'a\\qb'.\n", "")
+	expected := "håkon-ærlig\nørjan-'Åse'\n" +
+		"['it\\'s','a\\nAAå',\"tab\\there\"]\n" +
+		"'long line'\n" +
+		"[97,32,39,10,31,15,5,-255]\n" +
+		"error: test:9:21: syntax error: operator expected, found x\n" +
+		"error: test:11:11: syntax error: expected , or ) in arguments, found c\n" +
+		"error: test:12:11: syntax error: undefined escape sequence \\q\n"
+	if got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestErrorLocation(t *testing.T) {
+	var out strings.Builder
+	st := NewStore()
+	st.Load("prog.pl", strings.NewReader("p(1).\n\n?- X is\n  a.\n:- fail.\n"), Callbacks{
+		QuerySuccess: func(names []*Atom, vars []Varslot) bool { return false },
+		QueryFailure: func() {},
+		QueryError: func(err error) {
+			out.WriteString(err.Error() + "\n")
+		},
+	})
+	expected := "prog.pl:3: error(type_error(evaluable,a/0),context((is)/2,_A))\n" +
+		"prog.pl:5: Directive failed: fail\n"
+	if out.String() != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", out.String(), expected)
+	}
+}
+
+func TestConsult(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "a.pl"), []byte("a(1).\n?- a(X).\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "b.pl"), []byte("b(2).\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	a, b, missing := filepath.Join(dir, "a.pl"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	expectOutput(t, `
+?- consult('`+a+`'), a(X).
+?- ['`+b+`'], b(X).
+?- consult('`+missing+`').
+`, "X = 1 yes\nno\nX = 1 yes\nno\nX = 2 yes\nno\n"+
+		"error: error(existence_error(source_sink,'"+missing+"'),context(consult/1,_A))\n")
+}
+
+func TestRelativeFiles(t *testing.T) {
+	// The files are found relative to the file that loads them, not to the working directory
+	dir := filepath.Join(t.TempDir(), "mods")
+	files := map[string]string{
+		"main.pl":  ":- use_module(a).\n:- consult('sub/b').\n?- hello(X), world(Y).\n",
+		"a.pl":     ":- module(a, [hello/1]).\nhello(a).\n",
+		"sub/b.pl": ":- consult(c).\n",
+		"sub/c.pl": "world(c).\n",
+	}
+	for name, text := range files {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	main := filepath.Join(dir, "main")
+	expectOutput(t, `
+?- consult('`+main+`').
+?- catch(consult(c), error(E, _), true).
+`, "X = a Y = c yes\nno\n"+
+		"yes\nno\n"+
+		"E = existence_error(source_sink,c) yes\nno\n")
+}
+
+func TestReconsult(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "r.pl")
+	st := NewStore()
+	if err := st.OpenDatabase(filepath.Join(dir, "r.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer st.CloseDatabase()
+	var out strings.Builder
+	for _, text := range []string{
+		":- persistent emp/1.\nemp(a).\nr(1).\nr(2).\n",
+		":- persistent emp/1.\nemp(a).\nr(3).\n",
+	} {
+		if err := os.WriteFile(file, []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+		st.Load("test", strings.NewReader("?- consult('"+file+"'), findall(X, r(X), L), findall(E, emp(E), Es).\n"),
+			recordOutput(st, &out))
+	}
+	expected := "L = [1,2] Es = [a] yes\nno\nL = [3] Es = [a] yes\nno\n"
+	if got := out.String(); got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestModules(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"a.pl": ":- module(a, [run_a/1]).\nhelper(X, a(X)).\nrun_a(Y) :- helper(1, Y).\n",
+		"b.pl": ":- module(b, [run_b/1, double//1]).\nhelper(X, b(X)).\nrun_b(Y) :- helper(2, Y).\n" +
+			"double(X) --> [X, X].\n",
+		"c.pl": ":- module(c, [run_a/1]).\nrun_a(c).\n",
+	}
+	for name, text := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(text), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, c := filepath.Join(dir, "a"), filepath.Join(dir, "b"), filepath.Join(dir, "c")
+	expectOutput(t, `
+:- use_module('`+a+`').
+:- use_module('`+b+`').
+helper(X, user(X)).
+?- run_a(X).
+?- run_b(X).
+?- helper(3, X).
+?- a:helper(3, X).
+?- call(b:helper, 4, X).
+?- phrase(double(x), L).
+?- use_module('`+a+`'), run_a(X).
+:- use_module('`+c+`').
+?- catch(use_module('`+c+`'), error(E, _), true).
+?- catch(b:missing, error(E, _), true).
+?- assert(a:counter(1)), a:counter(X), \+ catch(counter(_), _, fail).
+?- retract(a:counter(X)).
+?- catch(assert(append(a, b, c)), error(E, _), true).
+?- catch(module(d, []), error(E, _), true).
+?- current_module(b).
+`, "X = a(1) yes\nno\n"+
+		"X = b(2) yes\nno\n"+
+		"X = user(3) yes\nno\n"+
+		"X = a(3) yes\nno\n"+
+		"X = b(4) yes\nno\n"+
+		"L = [x,x] yes\nno\n"+
+		"X = a(1) yes\nno\n"+
+		"error: "+c+".pl: No permission to import run_a/1 from c, it is imported from a\n"+
+		"E = permission_error(import,procedure,c:run_a/1) yes\nno\n"+
+		"E = existence_error(procedure,b:missing/0) yes\nno\n"+
+		"X = 1 yes\nno\n"+
+		"X = 1 yes\nno\n"+
+		"E = permission_error(modify,static_procedure,append/3) yes\nno\n"+
+		"E = permission_error(create,module,d) yes\nno\n"+
+		"yes\nno\n")
+}
+
+func TestHalt(t *testing.T) {
+	st := NewStore()
+	err := st.Load("test", strings.NewReader("p.\n:- halt(2).\n:- p.\n"), Callbacks{})
+	if halt, ok := err.(*Halt); !ok || halt.Code != 2 {
+		t.Fatalf("Expected halt(2), got %v", err)
+	}
+}
+
+func TestLoadWithoutCallbacks(t *testing.T) {
+	// Errors are ignored when there is no callback for them
+	st := NewStore()
+	err := st.Load("test", strings.NewReader("p(1.\n:- X is foo + 1.\n:- fail.\n?- p(X).\np(2).\n"), Callbacks{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	st.Load("test", strings.NewReader("?- p(X).\n"), recordOutput(st, &out))
+	if got := out.String(); got != "X = 2 yes\nno\n" {
+		t.Fatalf("Unexpected output:\n%s", got)
+	}
+}
+
+func TestAssert(t *testing.T) {
+	expectOutput(t, `
+:- dynamic(counter/1).
+?- counter(X).
+?- assert(counter(0)), counter(X).
+?- asserta(p(2)), asserta(p(1)), assertz(p(3)), p(X).
+?- assert((double(X, Y) :- Y is X * 2)), double(4, Y).
+?- assert(r(X, X)), r(a, Y).
+?- assert(foo), foo.
+?- assert(_).
+?- assert(3).
+?- assert((q :- 3)).
+?- assert(atom(_)).
+`, "no\n"+
+		"X = 0 yes\nno\n"+
+		"X = 1 yes\nX = 2 yes\nX = 3 yes\nno\n"+
+		"Y = 8 yes\nno\n"+
+		"Y = a yes\nno\n"+
+		"yes\nno\n"+
+		"error: error(instantiation_error,context(assert/1,_A))\n"+
+		"error: error(type_error(callable,3),context(assert/1,_A))\n"+
+		"error: error(type_error(callable,3),context(assert/1,_A))\n"+
+		"error: error(permission_error(modify,static_procedure,atom/1),context(assert/1,_A))\n")
+}
+
+func TestRetract(t *testing.T) {
+	expectOutput(t, `
+p(1).
+p(2).
+p(3).
+q(X) :- p(X), X > 1.
+?- retract(p(2)).
+?- p(X).
+?- retract((q(X) :- B)).
+?- q(X).
+?- retract(p(X)).
+?- p(X).
+?- abolish(p/1), p(X).
+?- abolish(foo).
+`, "yes\nno\n"+
+		"X = 1 yes\nX = 3 yes\nno\n"+
+		"B = (p(X),X>1) yes\nno\n"+
+		"no\n"+
+		"X = 1 yes\nX = 3 yes\nno\n"+
+		"no\n"+
+		"error: error(existence_error(procedure,p/1),context(p/1,_A))\n"+
+		"error: error(type_error(predicate_indicator,foo),context(abolish/1,_A))\n")
+}
+
+// Retracting from an indexed predicate keeps the index up to date.
+
+func TestRetractIndexed(t *testing.T) {
+	expectOutput(t, `
+f(1). f(2). f(3). f(4). f(5). f(6). f(7). f(8). f(9).
+f(X) :- X == v.
+?- f(5).
+?- retract(f(5)), f(5).
+?- f(v).
+?- f(X), X > 7.
+?- retract((f(X) :- X == v)), f(v).
+?- clause(f(9), B).
+?- findall(X, f(X), L).
+`, "yes\nno\n"+
+		"no\n"+
+		"yes\nno\n"+
+		"X = 8 yes\nX = 9 yes\nno\n"+
+		"no\n"+
+		"B = true yes\nno\n"+
+		"L = [1,2,3,4,6,7,8,9] yes\nno\n")
+}
+
+// A running call sees the clauses as they were when it was called.
+
+func TestLogicalUpdateView(t *testing.T) {
+	expectOutput(t, `
+p(1).
+p(2).
+?- p(X), assertz(p(3)).
+?- p(X).
+?- retract(p(3)), fail.
+?- p(X), retractall(p(_)).
+?- p(X).
+`, "X = 1 yes\nX = 2 yes\nno\n"+
+		"X = 1 yes\nX = 2 yes\nX = 3 yes\nX = 3 yes\nno\n"+
+		"no\n"+
+		"X = 1 yes\nX = 2 yes\nno\n"+
+		"no\n")
+}
+
+func TestClause(t *testing.T) {
+	expectOutput(t, `
+p(1).
+p(X) :- q(X), r.
+?- clause(p(A), B).
+`, "A = 1 B = true yes\nB = (q(A),r) yes\nno\n")
+}
+
+func TestDisjunction(t *testing.T) {
+	expectOutput(t, `
+p(X) :- (X = 1 ; X = 2 ; X = 3).
+q(X) :- (X = 1 ; X = 2), !.
+r(X) :- (X = 1, ! ; X = 2).
+r(3).
+?- p(X).
+?- q(X).
+?- r(X).
+?- (fail ; true).
+?- X = (Y = 1 ; Y = 2), call(X).
+`, "X = 1 yes\nX = 2 yes\nX = 3 yes\nno\n"+
+		"X = 1 yes\nno\n"+
+		"X = 1 yes\nno\n"+
+		"yes\nno\n"+
+		"X = (1=1;1=2) Y = 1 yes\nX = (2=1;2=2) Y = 2 yes\nno\n")
+}
+
+func TestIfThenElse(t *testing.T) {
+	expectOutput(t, `
+max(X, Y, Z) :- ( X >= Y -> Z = X ; Z = Y ).
+sign(X, S) :- ( X < 0 -> S = neg ; X =:= 0 -> S = zero ; S = pos ).
+first(X) :- ( member(X, [a, b, c]) -> true ; X = none ).
+cut_in_then(X) :- ( true -> member(X, [1, 2, 3]), ! ; X = 0 ).
+cut_in_then(4).
+cut_in_else(X) :- ( fail -> true ; member(X, [1, 2, 3]), ! ).
+cut_in_else(4).
+cut_in_cond(X) :- ( member(X, [1, 2, 3]), ! -> true ; true ).
+cut_in_cond(4).
+?- max(3, 5, Z).
+?- max(7, 5, Z).
+?- sign(-3, S), sign(0, T), sign(9, U).
+?- first(X).
+?- (fail -> X = 1).
+?- (true -> X = 1).
+?- cut_in_then(X).
+?- cut_in_else(X).
+?- cut_in_cond(X).
+`, "Z = 5 yes\nno\n"+
+		"Z = 7 yes\nno\n"+
+		"S = neg T = zero U = pos yes\nno\n"+
+		"X = a yes\nno\n"+
+		"no\n"+
+		"X = 1 yes\nno\n"+
+		"X = 1 yes\nno\n"+
+		"X = 1 yes\nno\n"+
+		"X = 1 yes\nX = 4 yes\nno\n")
+}
+
+func TestSoftCut(t *testing.T) {
+	expectOutput(t, `
+?- ( member(X, [1, 2, 3]) *-> Y = X ; Y = none ).
+?- ( fail *-> Y = some ; Y = none ).
+?- ( member(X, [1, 2]) *-> true ).
+`, "X = 1 Y = 1 yes\nX = 2 Y = 2 yes\nX = 3 Y = 3 yes\nno\n"+
+		"Y = none yes\nno\n"+
+		"X = 1 yes\nX = 2 yes\nno\n")
+}
+
+func TestNegation(t *testing.T) {
+	expectOutput(t, `
+p(1).
+p(2).
+?- \+ p(3).
+?- \+ p(1).
+?- \+ X = 1, X = 2.
+?- X = 2, \+ \+ X = 2.
+?- \+ (p(X), X > 1, !, fail).
+?- not(p(3)).
+`, "yes\nno\n"+
+		"no\n"+
+		"no\n"+
+		"X = 2 yes\nno\n"+
+		"yes\nno\n"+
+		"yes\nno\n")
+}
+
+func TestOnce(t *testing.T) {
+	expectOutput(t, `
+?- once(member(X, [a, b])).
+?- ignore(fail).
+`, "X = a yes\nno\n"+
+		"yes\nno\n")
+}
+
+func TestCatchThrow(t *testing.T) {
+	expectOutput(t, `
+p(1).
+p(2).
+p(3).
+q(X) :- p(X), X > 1, throw(found(X)).
+?- catch(q(X), found(Y), true).
+?- catch(throw(a), b, true).
+?- catch(catch(throw(a), b, true), E, true).
+?- catch(throw(f(X, Y, X)), E, true).
+?- catch(X is foo + 1, error(E, _), true).
+?- catch(p(X), _, true).
+?- catch(p(X), _, true), X > 1, throw(late).
+?- catch((member(X, [1, 2]), X > 1, throw(x)), x, Y = caught).
+?- catch(throw(a), E, throw(b(E))).
+?- throw(_).
+?- catch(!, _, true), fail ; true.
+?- catch(call(1), E, true).
+?- catch(call(foo, 1), error(_, C), true).
+?- G = (true, 1), catch(G, error(E, C), true).
+?- catch(X, error(E, C), true).
+`, "Y = 2 yes\nno\n"+
+		"error: a\n"+
+		"E = a yes\nno\n"+
+		"E = f(_A,_B,_A) yes\nno\n"+
+		"E = type_error(evaluable,foo/0) yes\nno\n"+
+		"X = 1 yes\nX = 2 yes\nX = 3 yes\nno\n"+
+		"error: late\n"+
+		"Y = caught yes\nno\n"+
+		"error: b(a)\n"+
+		"error: error(instantiation_error,context(throw/1,_A))\n"+
+		"yes\nno\n"+
+		"E = error(type_error(callable,1),context(call/1,_A)) yes\nno\n"+
+		"C = context(foo/1,_A) yes\nno\n"+
+		"G = (true,1) E = type_error(callable,1) C = context(call/1,_A) yes\nno\n"+
+		"E = instantiation_error C = context(catch/3,_A) yes\nno\n")
+}
+
+func TestExistenceError(t *testing.T) {
+	expectOutput(t, `
+:- dynamic(counter/1).
+?- counter(X).
+?- nothing(X).
+?- call(nothing).
+?- catch(nothing, error(existence_error(procedure, PI), _), true).
+?- set_prolog_flag(unknown, fail), nothing.
+?- current_prolog_flag(unknown, V).
+?- set_prolog_flag(unknown, maybe).
+?- set_prolog_flag(unknown, error), nothing.
+`, "no\n"+
+		"error: error(existence_error(procedure,nothing/1),context(nothing/1,_A))\n"+
+		"error: error(existence_error(procedure,nothing/0),context(nothing/0,_A))\n"+
+		"PI = nothing/0 yes\nno\n"+
+		"no\n"+
+		"V = fail yes\nno\n"+
+		"error: error(domain_error(flag_value,unknown+maybe),context(set_prolog_flag/2,_A))\n"+
+		"error: error(existence_error(procedure,nothing/0),context(nothing/0,_A))\n")
+}
+
+func TestTabling(t *testing.T) {
+	expectOutput(t, `
+:- table path/2.
+path(X, Y) :- path(X, Z), edge(Z, Y).
+path(X, Y) :- edge(X, Y).
+edge(a, b).
+edge(b, c).
+edge(c, a).
+edge(c, d).
+edge(e, e).
+?- findall(Y, path(a, Y), L), sort(L, S).
+?- aggregate_all(count, path(_, _), N).
+?- path(d, _).
+?- path(e, X).
+?- setof(X, path(X, d), L).
+:- table even/1, odd/1.
+even(0).
+even(N) :- odd(M), N is M + 1, N < 8.
+odd(N) :- even(M), N is M + 1, N < 8.
+?- findall(N, odd(N), L), sort(L, S).
+:- table fib/2.
+fib(0, 0).
+fib(1, 1).
+fib(N, F) :- N > 1, A is N - 1, B is N - 2, fib(A, FA), fib(B, FB), F is FA + FB.
+?- fib(80, F).
+:- table once_more/1, counted/1.
+once_more(0).
+once_more(X) :- once(once_more(Y)), X is Y + 1, X < 5.
+?- findall(X, once_more(X), L).
+counted(0).
+counted(X) :- findall(Y, counted(Y), L), length(L, N), N < 4, X = N.
+?- findall(X, counted(X), L).
+`, "L = [b,c,a,d] S = [a,b,c,d] yes\nno\n"+
+		"N = 13 yes\nno\n"+
+		"no\n"+
+		"X = e yes\nno\n"+
+		"L = [a,b,c] yes\nno\n"+
+		"L = [1,3,5,7] S = [1,3,5,7] yes\nno\n"+
+		"F = 23416728348467685 yes\nno\n"+
+		"L = [0,1] yes\nno\n"+
+		"L = [0,1,2,3] yes\nno\n")
+}
+
+func TestTablingErrors(t *testing.T) {
+	expectOutput(t, `
+:- table p/1.
+p(X) :- q(X).
+p(X) :- p(Y), X is Y + 1, X < 3.
+q(0).
+q(X) :- flag(yes), X = oops.
+:- dynamic(flag/1).
+?- findall(X, p(X), L).
+?- assert(flag(yes)), findall(X, p(X), L).
+?- retract(flag(yes)), findall(X, p(X), L).
+?- table(foo).
+?- table(call/1).
+`, "L = [0,1,2] yes\nno\n"+
+		"error: error(type_error(evaluable,oops/0),context((is)/2,_A))\n"+
+		"L = [0,1,2] yes\nno\n"+
+		"error: error(type_error(predicate_indicator,foo),context((table)/1,_A))\n"+
+		"error: error(permission_error(modify,static_procedure,call/1),context((table)/1,_A))\n")
+}
+
+// The answers of a left recursive table over a chain are found with a number of inferences that
+// is linear in the length of the chain, not quadratic as they would be if the clauses were run
+// again for every new answer.
+
+func TestTablingScales(t *testing.T) {
+	inferences := func(n int) int64 {
+		var b strings.Builder
+		b.WriteString(":- table path/2.\npath(X, Y) :- path(X, Z), edge(Z, Y).\npath(X, Y) :- edge(X, Y).\n")
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(&b, "edge(%d, %d).\n", i, i+1)
+		}
+		st := NewStore()
+		st.Load("test", strings.NewReader(b.String()), Callbacks{})
+		goals, names, err := st.parseQuery(fmt.Sprintf("aggregate_all(count, path(0, _), %d)", n))
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := st.NewQuery(goals, names)
+		defer q.Close()
+		if found, err := q.Next(); !found || err != nil {
+			t.Fatalf("path(0, _) over %d edges: %v %v", n, found, err)
+		}
+		return q.Inferences()
+	}
+	short, long := inferences(2000), inferences(8000)
+	if long > 5*short {
+		t.Errorf("%d inferences for 2000 edges but %d for 8000", short, long)
+	}
+}
+
+func TestOccursCheck(t *testing.T) {
+	expectOutput(t, `
+?- unify_with_occurs_check(X, f(X)).
+?- unify_with_occurs_check(f(X, Y), f(Y, g(X))).
+?- unify_with_occurs_check(f(X, Y), f(Y, g(Z))).
+?- set_prolog_flag(occurs_check, true), X = f(X).
+?- X = [a|X].
+?- set_prolog_flag(occurs_check, error), catch(X = f(X), error(E, _), true).
+?- set_prolog_flag(occurs_check, false), current_prolog_flag(occurs_check, F).
+`, "no\n"+
+		"no\n"+
+		"X = g(Z) Y = g(Z) yes\nno\n"+
+		"no\n"+
+		"no\n"+
+		"E = occurs_check(_A,f(_A)) yes\nno\n"+
+		"F = false yes\nno\n")
+}
+
+func TestCyclicTerms(t *testing.T) {
+	expectOutput(t, `
+?- X = f(X).
+?- X = [a, b|X].
+?- X = f(X, a), Y = f(Y, a), X = Y.
+?- X = f(X), Y = f(f(Y)), X == Y.
+?- X = f(X, a), Y = f(Y, b), compare(O, X, Y).
+?- X = f(X), cyclic_term(X), \+ acyclic_term(X).
+?- X = f(Y, Y), Y = g(a), acyclic_term(X).
+?- X = f(X, Y), copy_term(X, C), C = f(D, Z), D == C, Z \== Y.
+?- X = f(X, Y), findall(X, true, [C]), C = f(C, _).
+?- X = g(X, Y), term_variables(X, Vs).
+?- X = f(X), catch(throw(X), E, true).
+`, "X = f(...) yes\nno\n"+
+		"X = [a,b|...] yes\nno\n"+
+		"X = f(...,a) Y = f(...,a) yes\nno\n"+
+		"X = f(...) Y = f(f(...)) yes\nno\n"+
+		"X = f(...,a) Y = f(...,b) O = < yes\nno\n"+
+		"X = f(...) yes\nno\n"+
+		"X = f(g(a),g(a)) Y = g(a) yes\nno\n"+
+		"X = f(...,Y) C = f(...,Z) D = f(...,Z) yes\nno\n"+
+		"X = f(...,Y) C = f(...,_A) yes\nno\n"+
+		"X = g(...,Y) Vs = [Y] yes\nno\n"+
+		"X = f(...) E = f(...) yes\nno\n")
+}
+
+func TestConstraints(t *testing.T) {
+	expectOutput(t, `
+p(a).
+p(b).
+p(c).
+?- freeze(X, Y = done), var(Y), X = 1.
+?- freeze(X, fail), X = 1.
+?- freeze(X, Y = 1), member(X, [a, b]).
+?- freeze(X, L = [a|L1]), freeze(Z, L1 = [b]), X = Z, frozen(X, G), X = go.
+?- dif(X, a), p(X).
+?- dif(X, Y), X = Y.
+?- dif(f(X, Y), f(a, b)), X = a, Y = c.
+?- dif(f(X, Y), f(a, b)), X = a, Y = b.
+?- dif(X, a), dif(Y, b), X = Y, findall(X, p(X), L).
+?- dif(a, b), \+ dif(a, a).
+?- when(nonvar(X), Y = bound), X = f(_).
+?- when(ground(f(X, Z)), Y = ground), X = 1, var(Y), Z = 2.
+?- when(?=(X, Z), Y = decided), X = Z.
+?- when((nonvar(X) ; nonvar(Z)), Y = either), Z = 1.
+?- catch(when(foo, true), error(E, _), true).
+?- catch(when(_, true), error(E, _), true).
+?- unifiable(f(X, b), f(a, Y), U), var(X), var(Y).
+?- put_attr(X, m, 1), get_attr(X, m, V), del_attr(X, m), \+ attvar(X).
+?- put_attr(X, m, 1), ( put_attr(X, m, 2), fail ; get_attr(X, m, V) ).
+?- catch(put_attr(a, m, 1), error(E, _), true).
+even:attr_unify_hook(_, Y) :- 0 is Y mod 2.
+?- put_attr(X, even, true), member(X, [1, 2, 3, 4]).
+`, "X = 1 Y = done yes\nno\n"+
+		"no\n"+
+		"X = a Y = 1 yes\nX = b Y = 1 yes\nno\n"+
+		"X = go L = [a,b] L1 = [b] Z = go G = ([a,b]=[a,b],[b]=[b]) yes\nno\n"+
+		"X = b yes\nX = c yes\nno\n"+
+		"no\n"+
+		"X = a Y = c yes\nno\n"+
+		"no\n"+
+		"X = Y L = [c] yes\nno\n"+
+		"yes\nno\n"+
+		"X = f(_A) Y = bound yes\nno\n"+
+		"X = 1 Z = 2 Y = ground yes\nno\n"+
+		"X = Z Y = decided yes\nno\n"+
+		"Z = 1 Y = either yes\nno\n"+
+		"E = domain_error(when_condition,foo) yes\nno\n"+
+		"E = instantiation_error yes\nno\n"+
+		"U = [X=a,Y=b] yes\nno\n"+
+		"V = 1 yes\nno\n"+
+		"V = 1 yes\nno\n"+
+		"E = uninstantiation_error(a) yes\nno\n"+
+		"X = 2 yes\nX = 4 yes\nno\n")
+}
+
+// A tracer that records the events in the output and answers with the actions in turn, and
+// then creeps.
+
+type scriptedTracer struct {
+	out     *strings.Builder
+	actions []TraceAction
+}
+
+func (t *scriptedTracer) Trace(e TraceEvent) TraceAction {
+	t.out.WriteString(e.String() + "\n")
+	if len(t.actions) == 0 {
+		return Creep
+	}
+	action := t.actions[0]
+	t.actions = t.actions[1:]
+	return action
+}
+
+func traceProgram(program string, actions ...TraceAction) string {
+	var out strings.Builder
+	st := NewStore()
+	st.SetTracer(&scriptedTracer{&out, actions})
+	st.Load("test", strings.NewReader(program), recordOutput(st, &out))
+	return out.String()
+}
+
+const traced = `
+p(1).
+p(2).
+q(X) :- p(X), X > 1.
+r('håkon magnus').
+r((a :- b)).
+`
+
+func TestTrace(t *testing.T) {
+	for _, test := range []struct {
+		query    string
+		actions  []TraceAction
+		expected string
+	}{
+		{"trace, q(X), notrace", nil, `
+ Call: (1) q(_G1)
+ Call: (2) p(_G1)
+ Exit: (2) p(1)
+ Call: (2) 1>1
+ Fail: (2) 1>1
+ Redo: (2) p(_G1)
+ Exit: (2) p(2)
+ Call: (2) 2>1
+ Exit: (2) 2>1
+ Exit: (1) q(2)
+ Call: (1) notrace
+X = 2 yes
+no
+`},
+		{"trace, q(X), fail", []TraceAction{Skip}, `
+ Call: (1) q(_G1)
+ Exit: (1) q(2)
+no
+`},
+		{"spy(p/1), q(X), nospyall", []TraceAction{Leap, Leap, Leap, Leap}, `
+ Call: (2) p(_G1)
+ Exit: (2) p(1)
+ Redo: (2) p(_G1)
+ Exit: (2) p(2)
+X = 2 yes
+no
+`},
+		{"trace, catch(q(X), _, true)", []TraceAction{Creep, Abort}, `
+ Call: (1) q(_G1)
+ Call: (2) p(_G1)
+error: '$aborted'
+`},
+		{"spy(p/1), q(X), nospyall.\n?- Y = 1", nil, `
+ Call: (2) p(_G1)
+ Exit: (2) p(1)
+ Call: (2) 1>1
+ Fail: (2) 1>1
+ Redo: (2) p(_G1)
+ Exit: (2) p(2)
+ Call: (2) 2>1
+ Exit: (2) 2>1
+ Exit: (1) q(2)
+ Call: (1) nospyall
+ Exit: (1) nospyall
+X = 2 yes
+no
+Y = 1 yes
+no
+`},
+		{"spy(p/1), q(X).\n?- q(Y), nospyall", []TraceAction{Leap, Leap, Leap, Leap, Leap, Leap, Leap, Leap}, `
+ Call: (2) p(_G1)
+ Exit: (2) p(1)
+ Redo: (2) p(_G1)
+ Exit: (2) p(2)
+X = 2 yes
+no
+ Call: (2) p(_G1)
+ Exit: (2) p(1)
+ Redo: (2) p(_G1)
+ Exit: (2) p(2)
+Y = 2 yes
+no
+`},
+		{"trace, findall(X, r(X), L), notrace", nil, `
+ Call: (1) findall(_G1,r(_G1),_G2)
+ Exit: (1) findall(_G1,r(_G1),['håkon magnus',(a:-b)])
+ Call: (1) notrace
+L = ['håkon magnus',(a:-b)] yes
+no
+`},
+		{"trace, findall(X, q(X), L), notrace", nil, `
+ Call: (1) findall(_G1,q(_G1),_G2)
+ Exit: (1) findall(_G1,q(_G1),[2])
+ Call: (1) notrace
+L = [2] yes
+no
+`},
+	} {
+		got := traceProgram(traced+"?- "+test.query+".\n", test.actions...)
+		if got != test.expected[1:] {
+			t.Errorf("%s: got\n%s\nexpected\n%s", test.query, got, test.expected[1:])
+		}
+	}
+}
+
+const ages = `
+age(peter, 7).
+age(ann, 11).
+age(pat, 8).
+age(tom, 5).
+age(mike, 11).
+class(a, peter).
+class(b, ann).
+class(a, pat).
+class(b, tom).
+class(b, mike).
+`
+
+func TestFindall(t *testing.T) {
+	expectOutput(t, ages+`
+?- findall(N, age(N, _), L).
+?- findall(N-A, (age(N, A), A > 8), L).
+?- findall(X, fail, L).
+?- findall(X, member(X, [f(Y), g(Y, Z)]), L).
+?- findall(L, findall(X, member(X, [1, 2]), L), Ls).
+?- findall(X, (member(X, [1, 2, 3]), !), L).
+?- forall(age(_, A), A > 4).
+?- forall(age(_, A), A > 5).
+`, "L = [peter,ann,pat,tom,mike] yes\nno\n"+
+		"L = [ann-11,mike-11] yes\nno\n"+
+		"L = [] yes\nno\n"+
+		"L = [f(_A),g(_B,_C)] yes\nno\n"+
+		"Ls = [[1,2]] yes\nno\n"+
+		"L = [1] yes\nno\n"+
+		"yes\nno\n"+
+		"no\n")
+}
+
+func TestBagofSetof(t *testing.T) {
+	expectOutput(t, ages+`
+?- bagof(N, age(N, A), L).
+?- bagof(N, A^age(N, A), L).
+?- setof(A-N, age(N, A), L).
+?- setof(N, C^A^(class(C, N), age(N, A), A > 6), L).
+?- setof(C-Ns, setof(N, class(C, N), Ns), L).
+?- bagof(X, fail, L).
+?- bagof(X-Y, member(X-Y, [1-a, 2-b, 3-a]), L).
+?- bagof(X, member(X-Y, [1-a, 2-b, 3-a]), L).
+`, "A = 5 L = [tom] yes\nA = 7 L = [peter] yes\nA = 8 L = [pat] yes\nA = 11 L = [ann,mike] yes\nno\n"+
+		"L = [peter,ann,pat,tom,mike] yes\nno\n"+
+		"L = [5-tom,7-peter,8-pat,11-ann,11-mike] yes\nno\n"+
+		"L = [ann,mike,pat,peter] yes\nno\n"+
+		"L = [a-[pat,peter],b-[ann,mike,tom]] yes\nno\n"+
+		"no\n"+
+		"L = [1-a,2-b,3-a] yes\nno\n"+
+		"Y = a L = [1,3] yes\nY = b L = [2] yes\nno\n")
+}
+
+func TestAggregateAll(t *testing.T) {
+	expectOutput(t, ages+`
+?- aggregate_all(count, age(_, _), C).
+?- aggregate_all(sum(A), age(_, A), S).
+?- aggregate_all(max(A), age(_, A), M).
+?- aggregate_all(bag(C), class(C, _), B).
+?- aggregate_all(set(C), class(C, _), S).
+?- aggregate_all(count, fail, C).
+?- aggregate_all(max(X), fail, M).
+`, "C = 5 yes\nno\n"+
+		"S = 42 yes\nno\n"+
+		"M = 11 yes\nno\n"+
+		"B = [a,b,a,b,b] yes\nno\n"+
+		"S = [a,b] yes\nno\n"+
+		"C = 0 yes\nno\n"+
+		"no\n")
+}
+
+func TestSortAndCopy(t *testing.T) {
+	expectOutput(t, `
+?- sort([c, a, b, a, 1, f(x)], L).
+?- msort([c, a, b, a], L).
+?- keysort([b-1, a-2, b-0, a-1], L).
+?- copy_term(f(X, Y, X), C).
+?- term_variables(f(X, g(Y, X), _), Vs).
+?- f(A, B) =@= f(C, D).
+?- f(A, A) =@= f(C, D).
+`, "L = [1,a,b,c,f(x)] yes\nno\n"+
+		"L = [a,a,b,c] yes\nno\n"+
+		"L = [a-2,a-1,b-1,b-0] yes\nno\n"+
+		"C = f(_A,_B,_A) yes\nno\n"+
+		"Vs = [X,Y,_A] yes\nno\n"+
+		"yes\nno\n"+
+		"no\n")
+}
+
+func TestIndexing(t *testing.T) {
+	var program strings.Builder
+	for i := 0; i < 20; i++ {
+		fmt.Fprintf(&program, "p(%d, k%d).\n", i, i%3)
+		if i%5 == 0 {
+			fmt.Fprintf(&program, "p(X, any%d) :- X = %d.\n", i, i)
+		}
+	}
+	program.WriteString(`
+p(f(a), struct).
+?- p(5, X).
+?- p(7, X).
+?- p(f(Y), X).
+?- p(X, k2).
+?- p(X, any10).
+?- assertz(p(5, late)), p(5, X).
+?- p(X, late).
+?- asserta(p(5, early)), p(5, X).
+`)
+	expectOutput(t, program.String(),
+		"X = k2 yes\nX = any5 yes\nno\n"+
+			"X = k1 yes\nno\n"+
+			"Y = a X = struct yes\nno\n"+
+			"X = 2 yes\nX = 5 yes\nX = 8 yes\nX = 11 yes\nX = 14 yes\nX = 17 yes\nno\n"+
+			"X = 10 yes\nno\n"+
+			"X = k2 yes\nX = any5 yes\nX = late yes\nno\n"+
+			"X = 5 yes\nno\n"+
+			"X = early yes\nX = k2 yes\nX = any5 yes\nX = late yes\nno\n")
+}
+
+// A call leaves no choicepoint if no clause after the one that matched can match.
+
+func TestDeterminism(t *testing.T) {
+	st := NewStore()
+	st.Load("test", strings.NewReader(`
+color(red).
+color(green).
+color(blue).
+size(1, small).
+size(2, medium).
+size(3, large).
+`), Callbacks{})
+	for _, test := range []struct {
+		query       string
+		choicepoint bool
+	}{
+		{"color(red)", false},
+		{"color(blue)", false},
+		{"color(X)", true},
+		{"size(2, S)", false},
+		{"size(N, medium)", false},
+		{"size(N, small)", false},
+		{"size(N, S)", true},
+	} {
+		p := newReader(st, "test", strings.NewReader(test.query+"."))
+		goal, err := p.readClause()
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := st.NewQuery([]RuleTerm{goal}, p.varNames())
+		if found, err := q.Next(); !found || err != nil {
+			t.Fatalf("%s: no solution", test.query)
+		}
+		if got := len(q.m.chps) > 0; got != test.choicepoint {
+			t.Errorf("%s: choicepoint left is %v, expected %v", test.query, got, test.choicepoint)
+		}
+		q.Close()
+	}
+}
+
+func factBase(n int) string {
+	var program strings.Builder
+	for i := 0; i < n; i++ {
+		fmt.Fprintf(&program, "father(p%d, p%d).\n", i, i+1)
+	}
+	return program.String()
+}
+
+func benchmarkQuery(b *testing.B, program string, query string) {
+	st := NewStore()
+	st.Load("bench", strings.NewReader(program), Callbacks{})
+	p := newReader(st, "bench", strings.NewReader(query))
+	goal, err := p.readClause()
+	if err != nil {
+		b.Fatal(err)
+	}
+	names := p.varNames()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		q := st.NewQuery([]RuleTerm{goal}, names)
+		if found, err := q.Next(); !found || err != nil {
+			b.Fatal("No solution")
+		}
+		q.Close()
+	}
+}
+
+func BenchmarkFirstArgumentIndex(b *testing.B) {
+	benchmarkQuery(b, factBase(100000), "father(p99999, X).")
+}
+
+func BenchmarkSecondArgumentIndex(b *testing.B) {
+	benchmarkQuery(b, factBase(100000), "father(X, p99999).")
+}
+
+func BenchmarkJoin(b *testing.B) {
+	benchmarkQuery(b, factBase(100000)+"grandfather(X, Z) :- father(X, Y), father(Y, Z).\n",
+		"grandfather(p50000, X).")
+}
+
+// The classic benchmarks, each run on the virtual machine and by the interpreter, see compile.go
+// and vm.go.
+
+const nrev = `
+app([], L, L).
+app([X|Xs], L, [X|Ys]) :- app(Xs, L, Ys).
+nrev([], []).
+nrev([X|Xs], R) :- nrev(Xs, R0), app(R0, [X], R).
+range(N, N, [N]) :- !.
+range(I, N, [I|Is]) :- J is I+1, range(J, N, Is).
+bench :- range(1, 30, L), nrev(L, _).
+`
+
+const queens = `
+queens(N, Qs) :- numlist(1, N, Ns), permutation(Ns, Qs), safe(Qs).
+safe([]).
+safe([Q|Qs]) :- no_attack(Q, Qs, 1), safe(Qs).
+no_attack(_, [], _).
+no_attack(Q, [Q1|Qs], D) :- Q =\= Q1 + D, Q =\= Q1 - D, D1 is D+1, no_attack(Q, Qs, D1).
+numlist(N, N, [N]) :- !.
+numlist(I, N, [I|Is]) :- J is I+1, numlist(J, N, Is).
+permutation([], []).
+permutation(L, [X|Xs]) :- sel(X, L, R), permutation(R, Xs).
+sel(X, [X|Xs], Xs).
+sel(X, [Y|Ys], [Y|Zs]) :- sel(X, Ys, Zs).
+bench :- queens(6, _).
+`
+
+const zebra = `
+right_of(X, Y, [Y, X|_]).
+right_of(X, Y, [_|T]) :- right_of(X, Y, T).
+next_to(X, Y, L) :- right_of(X, Y, L).
+next_to(X, Y, L) :- right_of(Y, X, L).
+houses([h(_, norwegian, _, _, _), _, h(_, _, _, milk, _), _, _]).
+zebra(Owner) :-
+    houses(Hs),
+    member(h(red, english, _, _, _), Hs),
+    member(h(_, spanish, dog, _, _), Hs),
+    member(h(green, _, _, coffee, _), Hs),
+    member(h(_, ukrainian, _, tea, _), Hs),
+    right_of(h(green, _, _, _, _), h(ivory, _, _, _, _), Hs),
+    member(h(_, _, snails, _, oldgold), Hs),
+    member(h(yellow, _, _, _, kools), Hs),
+    next_to(h(_, _, _, _, chesterfield), h(_, _, fox, _, _), Hs),
+    next_to(h(_, _, _, _, kools), h(_, _, horse, _, _), Hs),
+    member(h(_, _, _, orange_juice, luckystrike), Hs),
+    member(h(_, japanese, _, _, parliament), Hs),
+    next_to(h(_, norwegian, _, _, _), h(blue, _, _, _, _), Hs),
+    member(h(_, Owner, zebra, _, _), Hs).
+bench :- zebra(japanese).
+`
+
+func benchmarkCompiled(b *testing.B, program string) {
+	for _, interpret := range []bool{false, true} {
+		name := "compiled"
+		if interpret {
+			name = "interpreted"
+		}
+		b.Run(name, func(b *testing.B) {
+			st := NewStore()
+			st.interpret = interpret
+			st.Load("bench", strings.NewReader(program), Callbacks{})
+			bench := []RuleTerm{st.NewAtom("bench")}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				q := st.NewQuery(bench, nil)
+				if found, err := q.Next(); !found || err != nil {
+					b.Fatal("No solution")
+				}
+				q.Close()
+			}
+		})
+	}
+}
+
+func BenchmarkNrev(b *testing.B) {
+	benchmarkCompiled(b, nrev)
+}
+
+func BenchmarkQueens(b *testing.B) {
+	benchmarkCompiled(b, queens)
+}
+
+func BenchmarkZebra(b *testing.B) {
+	benchmarkCompiled(b, zebra)
+}
+
+func TestCompiledClauses(t *testing.T) {
+	program := nrev + `
+p(X, f(X, Y), Y, _, a).
+q([X, Y|Z], g(h(X), [1.5, "s"|Z]), Y).
+?- range(1, 5, L), nrev(L, R).
+?- p(A, B, C, D, E).
+?- p(1, f(A, 2), B, _, a).
+?- p(1, f(2, _), _, _, _).
+?- p(A, A, _, _, _).
+?- q([a, b, c], G, B).
+?- q(L, g(H, [F, S]), b).
+?- q([a, b], g(h(a), [1.5, "t"]), _).
+`
+	expected := func(cyclic string) string {
+		return "L = [1,2,3,4,5] R = [5,4,3,2,1] yes\nno\n" +
+			"B = f(A,C) E = a yes\nno\n" +
+			"A = 1 B = 2 yes\nno\n" +
+			"no\n" +
+			cyclic +
+			"G = g(h(a),[1.5,\"s\",c]) B = b yes\nno\n" +
+			"L = [_A,b] H = h(_A) F = 1.5 S = \"s\" yes\nno\n" +
+			"no\n"
+	}
+	expectOutput(t, program, expected("A = f(...,_A) yes\nno\n"))
+	expectOutput(t, "?- set_prolog_flag(occurs_check, true).\n"+program, "yes\nno\n"+expected("no\n"))
+}
+
+func TestCompiledBodies(t *testing.T) {
+	program := `
+sign(X, Y) :- X > 0, !, Y = pos.
+sign(_, other).
+branch(X, Y) :- ( X = a -> Y = 1 ; Y = 2 ), \+ X = c.
+pairs(X, L) :- findall(Y, member(Y-X, [1-a, 2-b, 3-a]), L).
+woken(X, Y) :- freeze(X, Y = woken), X = go, atom(Y).
+caught(X) :- catch(thrown(X), E, X = caught(E)).
+thrown(X) :- call(atom_length, X, _), throw(oops).
+last(X, Y) :- Y is X * 2.
+deep(X, f(X, Z), W) :- Z = [X|W], length(W, 1).
+?- sign(1, Y).
+?- sign(-1, Y).
+?- branch(a, Y).
+?- branch(b, Y).
+?- branch(c, Y).
+?- pairs(a, L).
+?- woken(X, Y).
+?- caught(a).
+?- caught(X).
+?- last(3, Y).
+?- deep(1, T, W).
+`
+	expected := "Y = pos yes\nno\n" +
+		"Y = other yes\nno\n" +
+		"Y = 1 yes\nno\n" +
+		"Y = 2 yes\nno\n" +
+		"no\n" +
+		"L = [1,3] yes\nno\n" +
+		"X = go Y = woken yes\nno\n" +
+		"no\n" +
+		"X = caught(error(instantiation_error,context(atom_length/2,_A))) yes\nno\n" +
+		"Y = 6 yes\nno\n" +
+		"T = f(1,[1,_A]) W = [_A] yes\nno\n"
+	expectOutput(t, program, expected)
+	// The interpreter gives the same answers
+	var out strings.Builder
+	st := NewStore()
+	st.interpret = true
+	st.Load("test", strings.NewReader(program), recordOutput(st, &out))
+	if got := out.String(); got != expected {
+		t.Fatalf("Unexpected output when interpreted:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestResourceLimits(t *testing.T) {
+	program := `
+loop :- loop.
+grow :- grow, true.
+count(0) :- !.
+count(N) :- M is N-1, count(M).
+retry :- catch(loop, _, retry).
+`
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, test := range []struct {
+		limits   Limits
+		ctx      context.Context
+		query    string
+		expected string
+	}{
+		{Limits{MaxInferences: 1000}, nil, "loop", "error(resource_error(inferences),context(loop/0,_A))"},
+		{Limits{MaxAllocation: 10000}, nil, "grow", "error(resource_error(memory),context(grow/0,_A))"},
+		{Limits{MaxInferences: 1000}, nil, "count(100)", ""},
+		{Limits{MaxInferences: 1000}, nil, "count(1000)", "error(resource_error(inferences),context(count/1,_A))"},
+		// Allocation is given back on backtracking
+		{Limits{MaxAllocation: 1000}, nil, "member(X, [1, 2, 3, 4, 5]), count(100), X >= 5", ""},
+		// Allocation is given back when the error is caught
+		{Limits{MaxAllocation: 10000}, nil, "catch(grow, error(resource_error(R), _), true), R == memory", ""},
+		// A loop that runs in constant space still allocates on every iteration
+		{Limits{MaxAllocation: 10000}, nil, "count(10000)", "error(resource_error(memory),context((is)/2,_A))"},
+		// The recovery goal has headroom, and the error names the predicate that hit the limit
+		{Limits{MaxInferences: 1000}, nil, "catch(loop, E, true), E = error(resource_error(inferences), context(loop/0, _))", ""},
+		{Limits{}, cancelled, "catch(loop, error(resource_error(R), _), true), R == cancelled", ""},
+		// A recovery that uses up its headroom cannot be caught
+		{Limits{MaxInferences: 1000}, nil, "catch(loop, _, loop)", "error(resource_error(inferences),context(loop/0,_A))"},
+		{Limits{MaxInferences: 1000}, nil, "retry", "error(resource_error(inferences),context(loop/0,_A))"},
+		{Limits{}, cancelled, "catch(loop, _, loop)", "error(resource_error(cancelled),context(loop/0,_A))"},
+	} {
+		st := NewStore()
+		st.Load("test", strings.NewReader(program), Callbacks{})
+		st.SetLimits(test.limits)
+		// The query is run with NewQuery, since Query does not start one with a cancelled context
+		goals, names, err := st.parseQuery(test.query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		q := st.NewQuery(goals, names)
+		if test.ctx != nil {
+			q.SetContext(test.ctx)
+		}
+		got := ""
+		if _, err := q.Next(); err != nil {
+			got = err.Error()
+		}
+		q.Close()
+		if got != test.expected {
+			t.Errorf("%s: got %q, expected %q", test.query, got, test.expected)
+		}
+	}
+}
+
+func TestQueryTimeout(t *testing.T) {
+	st := NewStore()
+	st.Load("test", strings.NewReader("loop :- loop.\n"), Callbacks{})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	for _, err := range st.Query(ctx, "loop") {
+		if err == nil || !strings.HasPrefix(err.Error(), "error(resource_error(time_limit),") {
+			t.Fatalf("Unexpected %v", err)
+		}
+	}
+}
+
+func TestPersistent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "employees.db")
+	// Run the program in a store with the database, and close the database unless the process
+	// is meant to crash
+	run := func(program string, close bool) string {
+		var out strings.Builder
+		st := NewStore()
+		if err := st.OpenDatabase(path); err != nil {
+			t.Fatal(err)
+		}
+		st.SetOutput(&out)
+		st.Load("test", strings.NewReader(":- persistent employee/3.\n"+program), recordOutput(st, &out))
+		if close {
+			if err := st.CloseDatabase(); err != nil {
+				t.Fatal(err)
+			}
+		} else {
+			// The files are closed as by the death of the process, which releases the lock
+			st.database.log.Close()
+			if st.database.table != nil {
+				st.database.table.Close()
+			}
+		}
+		return out.String()
+	}
+	check := func(got, expected string) {
+		t.Helper()
+		if got != expected {
+			t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+		}
+	}
+
+	check(run(`
+employee(ann, sales, 100).
+:- assertz(employee(bob, it, 2.5)), asserta(employee(cid, it, f("x", [Y, Y]))).
+temps(0) :- !.
+temps(N) :- assertz(employee(N, temp, N)), M is N - 1, temps(M).
+:- temps(40).
+:- assertz((employee(Name, boss, 0) :- Name == eve)).
+?- retract(employee(5, _, _)).
+?- employee(X, it, Z).
+`, false), "yes\nno\nX = cid Z = f(\"x\",[_A,_A]) yes\nX = bob Z = 2.5 yes\nno\n")
+
+	// After a crash the log is replayed, without a batch that was torn
+	f, err := os.OpenFile(path+".wal", os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte{0, 0, 0, 40, 1, 2, 3, 4, 1, 5})
+	f.Close()
+	check(run(`
+?- employee(bob, D, S).
+?- aggregate_all(count, employee(_, temp, _), N).
+?- employee(eve, boss, S).
+?- employee(X, Y, Z), !.
+:- assertz(employee(dan, it, 1)).
+`, true), "D = it S = 2.5 yes\nno\nN = 39 yes\nno\nS = 0 yes\nno\nX = cid Y = it Z = f(\"x\",[_A,_A]) yes\nno\n")
+	if fi, err := os.Stat(path + ".wal"); err != nil || fi.Size() != 0 {
+		t.Fatalf("The log was not emptied: %v", err)
+	}
+
+	// A call reads the clauses for its first argument from the table
+	st := NewStore()
+	if err := st.OpenDatabase(path); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	st.Load("test", strings.NewReader(`
+:- persistent employee/3.
+?- employee(dan, D, _).
+?- employee(7, D, _).
+`), recordOutput(st, &out))
+	check(out.String(), "D = it yes\nno\nD = temp yes\nno\n")
+	// Each key has its clause and the clause for eve, whose first argument is a variable
+	ps := st.userModule.lookup(st.NewAtom("employee"), 3).persistent
+	if len(ps.buckets) != 2 || ps.cached != 4 {
+		t.Fatalf("Cached %d clauses for %d keys, expected 4 for 2", ps.cached, len(ps.buckets))
+	}
+	// Another process cannot open the database while it is open
+	if err := NewStore().OpenDatabase(path); err == nil || !strings.Contains(err.Error(), "in use") {
+		t.Fatalf("Opened the database twice: %v", err)
+	}
+	st.CloseDatabase()
+
+	check(run(`
+:- abolish(employee/3).
+:- persistent employee/3.
+?- employee(X, Y, Z).
+`, true), "no\n")
+	check(runProgram(t, ":- persistent employee/3.\nemployee(a, b, c).\n"),
+		"error: error(existence_error(database,employee/3),context((persistent)/1,_A))\n")
+}
+
+func TestPersistentCache(t *testing.T) {
+	st := NewStore()
+	if err := st.OpenDatabase(filepath.Join(t.TempDir(), "cache.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer st.CloseDatabase()
+	run := func(program, expected string) {
+		t.Helper()
+		var out strings.Builder
+		st.Load("test", strings.NewReader(program), recordOutput(st, &out))
+		if got := out.String(); got != expected {
+			t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+		}
+	}
+	run(`
+:- persistent item/2.
+fill(N, N) :- !.
+fill(I, N) :- assertz(item(I, x)), J is I + 1, fill(J, N).
+find(N, N) :- !.
+find(I, N) :- item(I, x), J is I + 1, find(J, N).
+:- fill(0, 5000).
+?- aggregate_all(count, item(_, _), N).
+`, "N = 5000 yes\nno\n")
+	// A call with an unbound first argument caches nothing
+	ps := st.userModule.lookup(st.NewAtom("item"), 2).persistent
+	if ps.cached != 0 {
+		t.Fatalf("Cached %d clauses", ps.cached)
+	}
+	// The cache holds the keys that were used last
+	run("?- find(0, 5000).\n", "yes\nno\n")
+	if ps.cached != persistCacheSize || ps.lru.Len() != persistCacheSize {
+		t.Fatalf("Cached %d clauses for %d keys", ps.cached, ps.lru.Len())
+	}
+	if _, ok := ps.buckets["i4999"]; !ok {
+		t.Fatal("The last key is not cached")
+	}
+	// Clauses that have been evicted can be retracted
+	run("?- retract(item(0, x)), retract(item(4999, x)), aggregate_all(count, item(_, _), N).\n",
+		"N = 4998 yes\nno\n")
+}
+
+func TestPersistentCheckpointError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "checkpoint.db")
+	st := NewStore()
+	if err := st.OpenDatabase(path); err != nil {
+		t.Fatal(err)
+	}
+	// The checkpoint cannot create its new table, but the clauses are written to the log
+	if err := os.Mkdir(path+".tmp", 0755); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	st.Load("test", strings.NewReader(`
+:- persistent item/2.
+fill(N, N) :- !.
+fill(I, N) :-
+    catch(assertz(item(x, I-'a long text that makes the log grow beyond the size of a checkpoint')),
+          error(system_error(_), _), true),
+    J is I + 1, fill(J, N).
+:- fill(0, 15000).
+?- aggregate_all(count, item(_, _), N).
+`), recordOutput(st, &out))
+	if err := os.Remove(path + ".tmp"); err != nil {
+		t.Fatal(err)
+	}
+	if err := st.CloseDatabase(); err != nil {
+		t.Fatal(err)
+	}
+	st = NewStore()
+	if err := st.OpenDatabase(path); err != nil {
+		t.Fatal(err)
+	}
+	defer st.CloseDatabase()
+	st.Load("test", strings.NewReader(":- persistent item/2.\n?- aggregate_all(count, item(_, _), N).\n"),
+		recordOutput(st, &out))
+	expected := "N = 15000 yes\nno\nN = 15000 yes\nno\n"
+	if got := out.String(); got != expected {
+		t.Fatalf("Unexpected output:\n%s\nExpected:\n%s", got, expected)
+	}
+}
+
+func TestPersistentSeeds(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "seeds.db")
+	program := ":- persistent emp/1.\nemp(a).\nemp(b).\nemp(b).\n"
+	expected := []string{
+		"L = [a,b,b] yes\nno\n",
+		"yes\nno\nL = [b,b] yes\nno\n",
+		// A seed that has been retracted is not added again
+		"L = [b,b] yes\nno\n",
+	}
+	for i, query := range []string{"", "?- retract(emp(a)).\n", ""} {
+		var out strings.Builder
+		st := NewStore()
+		if err := st.OpenDatabase(path); err != nil {
+			t.Fatal(err)
+		}
+		st.Load("test", strings.NewReader(program+query+"?- findall(X, emp(X), L).\n"), recordOutput(st, &out))
+		if err := st.CloseDatabase(); err != nil {
+			t.Fatal(err)
+		}
+		if got := out.String(); got != expected[i] {
+			t.Fatalf("Unexpected output of load %d:\n%s\nExpected:\n%s", i+1, got, expected[i])
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package engine
+
+// Exceptions.  An exception is represented by an `Exception` holding the ball, the term that was
+// thrown.  Errors raised by built-in predicates follow the ISO conventions: the ball is
+// error(Formal, context(Name/Arity, _)) where Formal describes the error and Name/Arity is the
+// predicate indicator of the built-in that raised it.
+//
+// Built-ins and throw/1 raise exceptions by panicking with an *Exception.  The machine recovers
+// the panic and looks for the most recent catch/3 whose goal is still running, see control.go.
+// The choicepoint of that catch/3 is restored, undoing the bindings made since the catch was
+// called, and if the catcher unifies with the ball then the machine continues with the recovery
+// goal; otherwise the search goes on with the catch/3 below it.  If no catch/3 catches the
+// exception then Query.Next undoes the bindings made by the query and returns the exception as
+// an error.
+//
+// The ball is copied when it is thrown, because undoing the bindings could otherwise change it.
+// The exception raised by abort/0 cannot be caught, nor can a resource error raised when a query
+// has no headroom left, see limits.go.
+
+type Exception struct {
+	term ValueTerm
+}
+
+func (e *Exception) Error() string {
+	return formatValue(e.term)
+}
+
+func (e *Exception) Term() ValueTerm {
+	return e.term
+}
+
+// True if the exception was raised by abort/0 or by the Abort action of a tracer.
+
+func (e *Exception) IsAbort() bool {
+	a, ok := e.term.(*Atom)
+	return ok && a.name == "$aborted"
+}
+
+// Raise error(Formal, context(Name/Arity, _)), where Name/Arity is the built-in or control
+// construct that is running.  The indicator is a variable if nothing has run yet.
+
+func (st *Store) raise(formal ValueTerm) {
+	var culprit ValueTerm = &Varslot{}
+	if st.current.functor != nil {
+		culprit = st.indicator(st.current.functor, st.current.arity)
+	}
+	context := newValueStruct(st.NewAtom("context"), []ValueTerm{culprit, &Varslot{}})
+	panic(&Exception{newValueStruct(st.NewAtom("error"), []ValueTerm{formal, context})})
+}
+
+func (st *Store) indicator(functor *Atom, arity int) ValueTerm {
+	return newValueStruct(st.NewAtom("/"), []ValueTerm{functor, st.NewNumber(int64(arity))})
+}
+
+func (st *Store) instantiationError() {
+	st.raise(st.NewAtom("instantiation_error"))
+}
+
+func (st *Store) typeError(typ string, culprit ValueTerm) {
+	st.raise(newValueStruct(st.NewAtom("type_error"), []ValueTerm{st.NewAtom(typ), culprit}))
+}
+
+func (st *Store) evaluationError(what string) {
+	st.raise(newValueStruct(st.NewAtom("evaluation_error"), []ValueTerm{st.NewAtom(what)}))
+}
+
+func (st *Store) domainError(domain string, culprit ValueTerm) {
+	st.raise(newValueStruct(st.NewAtom("domain_error"), []ValueTerm{st.NewAtom(domain), culprit}))
+}
+
+func (st *Store) representationError(what string) {
+	st.raise(newValueStruct(st.NewAtom("representation_error"), []ValueTerm{st.NewAtom(what)}))
+}
+
+func (st *Store) permissionError(action string, typ string, culprit ValueTerm) {
+	st.raise(newValueStruct(st.NewAtom("permission_error"),
+		[]ValueTerm{st.NewAtom(action), st.NewAtom(typ), culprit}))
+}
+
+func (st *Store) existenceError(typ string, culprit ValueTerm) {
+	st.raise(newValueStruct(st.NewAtom("existence_error"), []ValueTerm{st.NewAtom(typ), culprit}))
+}
+
+func (st *Store) initExceptionBuiltins() {
+	st.addBuiltin("throw", 1, func(m *machine, args []ValueTerm) bool {
+		if _, isVar := deref(args[0]).(*Varslot); isVar {
+			m.st.instantiationError()
+		}
+		panic(&Exception{copyTerm(args[0])})
+	})
+}
+
+// Unwind to the most recent catch/3 that is running and whose catcher unifies with the ball, and
+// continue with its recovery goal.  Returns false if there is no such catch/3.
+
+func (m *machine) handleException(e *Exception) bool {
+	ball := copyTerm(e.term)
+	if ball == ValueTerm(m.st.abortedAtom) || m.unrecoverable() {
+		return false
+	}
+	for i := len(m.chps) - 1; i >= 0; i-- {
+		c := m.chps[i].catch
+		if c == nil || c.exited.val != nil {
+			continue
+		}
+		cp := m.chps[i]
+		m.undoTrail(cp.trailMark)
+		m.allocated = cp.allocMark
+		m.cutTo(i)
+		if m.unify(c.catcher, ball) {
+			recovery := rib{Varslot{val: c.recovery}}
+			m.cont = &frame{goals: []RuleTerm{&Local{0}}, env: recovery, module: cp.module, next: cp.cont}
+			return true
+		}
+		m.undoTrail(cp.trailMark)
+	}
+	return false
+}
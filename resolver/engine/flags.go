@@ -0,0 +1,94 @@
+package engine
+
+import (
+	"sort"
+)
+
+// Prolog flags, which are read with current_prolog_flag/2 and changed with set_prolog_flag/2.
+// Every flag has an atom for its value, taken from a fixed set of values.
+//
+//   unknown        error or fail: what a call to a predicate that does not exist does
+//   occurs_check   false, true or error: whether unification fails or raises an error when a
+//                  variable would be bound to a term that contains it, see cyclic.go
+//   double_quotes  string, codes, chars or atom: what the reader makes of "text"
+
+type prologFlag struct {
+	value  *Atom
+	values []string
+
+	// Called when the value is set, if not nil.
+	set func(st *Store, value *Atom)
+}
+
+func (st *Store) initFlagBuiltins() {
+	st.flags = map[*Atom]*prologFlag{
+		st.NewAtom("unknown"): {value: st.NewAtom("error"), values: []string{"error", "fail"}},
+		st.NewAtom("double_quotes"): {
+			value:  st.NewAtom("string"),
+			values: []string{"string", "codes", "chars", "atom"},
+		},
+		st.NewAtom("occurs_check"): {
+			value:  st.NewAtom("false"),
+			values: []string{"false", "true", "error"},
+			set: func(st *Store, value *Atom) {
+				st.occursCheck = map[string]occursCheck{
+					"false": occursCheckFalse, "true": occursCheckTrue, "error": occursCheckError,
+				}[value.name]
+			},
+		},
+	}
+
+	st.addBuiltin("set_prolog_flag", 2, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		name, value := deref(args[0]), deref(args[1])
+		if _, isVar := name.(*Varslot); isVar {
+			st.instantiationError()
+		}
+		if _, isVar := value.(*Varslot); isVar {
+			st.instantiationError()
+		}
+		a, ok := name.(*Atom)
+		if !ok {
+			st.typeError("atom", name)
+		}
+		f, found := st.flags[a]
+		if !found {
+			st.domainError("prolog_flag", name)
+		}
+		if v, ok := value.(*Atom); ok {
+			for _, allowed := range f.values {
+				if v.name == allowed {
+					f.value = v
+					if f.set != nil {
+						f.set(st, v)
+					}
+					return true
+				}
+			}
+		}
+		st.domainError("flag_value", newValueStruct(st.NewAtom("+"), []ValueTerm{name, value}))
+		panic("Unreachable")
+	})
+
+	// '$prolog_flags'(L) unifies L with a list of Name-Value pairs, ordered by name.
+	st.addBuiltin("$prolog_flags", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		names := make([]*Atom, 0, len(st.flags))
+		for name := range st.flags {
+			names = append(names, name)
+		}
+		sort.Slice(names, func(i, j int) bool { return names[i].name < names[j].name })
+		pairs := make([]ValueTerm, len(names))
+		minus := st.NewAtom("-")
+		for i, name := range names {
+			pairs[i] = newValueStruct(minus, []ValueTerm{name, st.flags[name].value})
+		}
+		return m.unify(args[0], st.newList(pairs, st.nilAtom))
+	})
+}
+
+// The value of a flag.
+
+func (st *Store) flag(name string) *Atom {
+	return st.flags[st.NewAtom(name)].value
+}
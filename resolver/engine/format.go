@@ -0,0 +1,349 @@
+package engine
+
+import (
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Formatted output with format/1, format/2 and format/3.
+//
+// format(Format, Args) writes the text of Format, an atom, a string or a list of codes, to the
+// current output, with the directives in it replaced by the arguments.  Args is a list,
+// or a single argument that is not a list.  A directive is `~`, an optional numeric argument
+// N, and a letter:
+//
+//   ~w   write the next argument
+//   ~p   print the next argument, which quotes strings
+//   ~q   write the next argument quoted
+//   ~a   write the next argument, which must be atomic
+//   ~d   write the next argument, an integer, with a decimal point N digits from the right
+//   ~D   like ~d, with the digits before the decimal point grouped by threes with commas
+//   ~f   write the next argument, a number, as a float with N digits after the point (6)
+//   ~e   like ~f in exponential notation
+//   ~g   like ~f in the shorter of the two notations
+//   ~s   write the next argument, a string or a list of codes or characters
+//   ~c   write the next argument, a code, N times (1)
+//   ~r   write the next argument, an integer, in radix N
+//   ~R   like ~r with upper case letters
+//   ~i   skip the next argument
+//   ~n   write N newlines (1)
+//   ~~   write a tilde
+//
+// N is digits, `*` to take it from the next argument, or a backquote and a character, which
+// stands for the code of the character.
+//
+// The directives ~N| and ~N+ set column stops, at column N and at N columns past the previous
+// stop (8).  The text since the previous stop is padded to the column at the points marked by
+// ~Nt, with the character N (space), or at the end if there are none.  Columns are counted
+// from the start of the output of the format, or the last newline in it.
+//
+// format(Sink, Format, Args) writes to Sink, which is a stream, see stream.go, or unifies the
+// output with the argument of Sink if it is atom(A), string(S), codes(Cs) or chars(Cs).  Errors
+// in the format raise error(format(Message), _).
+
+func (st *Store) initFormatBuiltins() {
+	st.addBuiltin("format", 1, func(m *machine, args []ValueTerm) bool {
+		io.WriteString(m.st.output.output, m.st.format(args[0], m.st.nilAtom))
+		return true
+	})
+	st.addBuiltin("format", 2, func(m *machine, args []ValueTerm) bool {
+		io.WriteString(m.st.output.output, m.st.format(args[0], args[1]))
+		return true
+	})
+	st.addBuiltin("format", 3, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		switch sink := deref(args[0]).(type) {
+		case *Varslot:
+			st.instantiationError()
+		case *ValueStruct:
+			kind := sink.s.functor.name
+			if len(sink.s.subterms) == 1 &&
+				(kind == "atom" || kind == "string" || kind == "codes" || kind == "chars") {
+				s := st.format(args[1], args[2])
+				return m.unify(bind(sink.s.subterms[0], sink.env), st.makeText(kind, s))
+			}
+		}
+		io.WriteString(st.outputStream(args[0]).output, st.format(args[1], args[2]))
+		return true
+	})
+}
+
+type formatter struct {
+	st   *Store
+	b    strings.Builder
+	args []ValueTerm
+
+	// The start of the current line and of the text since the last column stop, and its column
+	lineStart    int
+	segmentStart int
+	stop         int
+
+	// The fill points of the text since the last column stop
+	fills []fillPoint
+}
+
+type fillPoint struct {
+	pos  int
+	fill rune
+}
+
+func (st *Store) format(format ValueTerm, args ValueTerm) string {
+	text, _ := st.text(format, "text", true)
+	f := &formatter{st: st}
+	if elements, ok := st.listElements(args); ok {
+		f.args = elements
+	} else {
+		f.args = []ValueTerm{args}
+	}
+	directive := []rune(text)
+	for i := 0; i < len(directive); i++ {
+		if directive[i] != '~' {
+			f.b.WriteRune(directive[i])
+			if directive[i] == '\n' {
+				f.newline()
+			}
+			continue
+		}
+		i++
+		if i == len(directive) {
+			f.error("truncated format directive")
+		}
+		// The numeric argument, -1 if there is none
+		n := -1
+		switch {
+		case directive[i] == '*':
+			n = f.intArg()
+			if n < 0 {
+				f.error("negative numeric argument")
+			}
+			i++
+		case directive[i] == '`':
+			if i+2 >= len(directive) {
+				f.error("truncated format directive")
+			}
+			n = int(directive[i+1])
+			i += 2
+		case isDigitChar(directive[i]):
+			n = 0
+			for i < len(directive) && isDigitChar(directive[i]) {
+				n = n*10 + int(directive[i]-'0')
+				i++
+			}
+		}
+		if i == len(directive) {
+			f.error("truncated format directive")
+		}
+		f.directive(directive[i], n)
+	}
+	if len(f.args) > 0 {
+		f.error("too many arguments")
+	}
+	return f.b.String()
+}
+
+func (f *formatter) error(message string) {
+	f.st.raise(newValueStruct(f.st.NewAtom("format"), []ValueTerm{f.st.NewAtom(message)}))
+}
+
+func (f *formatter) next() ValueTerm {
+	if len(f.args) == 0 {
+		f.error("not enough arguments")
+	}
+	arg := deref(f.args[0])
+	f.args = f.args[1:]
+	return arg
+}
+
+func (f *formatter) intArg() int {
+	n, ok := f.next().(*Number)
+	if !ok || n.big != nil {
+		f.error("integer expected")
+	}
+	return int(n.value)
+}
+
+func (f *formatter) integer() *Number {
+	arg := f.next()
+	n, ok := arg.(*Number)
+	if !ok {
+		if _, isVar := arg.(*Varslot); isVar {
+			f.st.instantiationError()
+		}
+		f.error("integer expected, found " + arg.String())
+	}
+	return n
+}
+
+func (f *formatter) write(t ValueTerm, quoted bool) {
+	w := f.st.newTermWriter(quoted, false, true)
+	w.writeValue(t)
+	f.b.WriteString(w.b.String())
+}
+
+func (f *formatter) directive(d rune, n int) {
+	st := f.st
+	switch d {
+	case 'w':
+		f.write(f.next(), false)
+	case 'p', 'q':
+		f.write(f.next(), true)
+	case 'a':
+		arg := f.next()
+		switch arg.(type) {
+		case *Atom, *String, *Number, *Float:
+			f.write(arg, false)
+		case *Varslot:
+			st.instantiationError()
+		default:
+			f.error("atomic expected, found " + arg.String())
+		}
+	case 'd', 'D':
+		digits := f.integer().String()
+		negative := strings.HasPrefix(digits, "-")
+		digits = strings.TrimPrefix(digits, "-")
+		fraction := ""
+		if n > 0 {
+			if len(digits) <= n {
+				digits = strings.Repeat("0", n-len(digits)+1) + digits
+			}
+			digits, fraction = digits[:len(digits)-n], "."+digits[len(digits)-n:]
+		}
+		if d == 'D' {
+			digits = groupDigits(digits)
+		}
+		if negative {
+			f.b.WriteRune('-')
+		}
+		f.b.WriteString(digits + fraction)
+	case 'f', 'e', 'g':
+		if n < 0 {
+			n = 6
+		}
+		arg := f.next()
+		switch x := arg.(type) {
+		case *Float:
+			f.b.WriteString(strconv.FormatFloat(x.value, byte(d), n, 64))
+		case *Number:
+			if d == 'f' && x.big != nil {
+				// Exactly, as a float would lose digits
+				f.b.WriteString(new(big.Float).SetInt(x.big).Text('f', n))
+			} else {
+				f.b.WriteString(strconv.FormatFloat(toFloat(st, x), byte(d), n, 64))
+			}
+		case *Varslot:
+			st.instantiationError()
+		default:
+			f.error("number expected, found " + arg.String())
+		}
+	case 's':
+		arg := f.next()
+		switch arg.(type) {
+		case *String, *ValueStruct, *Varslot:
+		default:
+			if arg != st.nilAtom {
+				f.error("string expected, found " + arg.String())
+			}
+		}
+		s, _ := st.textOfKind(arg, "codes", true)
+		f.b.WriteString(s)
+	case 'c':
+		code := st.code(f.next())
+		for i := 0; i < max(n, 1); i++ {
+			f.b.WriteRune(code)
+		}
+	case 'r', 'R':
+		if n < 2 || n > 36 {
+			f.error("radix must be between 2 and 36")
+		}
+		s := f.integer().bigValue().Text(n)
+		if d == 'R' {
+			s = strings.ToUpper(s)
+		}
+		f.b.WriteString(s)
+	case 'i':
+		f.next()
+	case 'n':
+		for i := 0; i < max(n, 1); i++ {
+			f.b.WriteRune('\n')
+			f.newline()
+		}
+	case '~':
+		f.b.WriteRune('~')
+	case 't':
+		fill := ' '
+		if n >= 0 {
+			fill = rune(n)
+		}
+		f.fills = append(f.fills, fillPoint{f.b.Len(), fill})
+	case '|':
+		column := f.column(f.b.Len())
+		if n >= 0 {
+			column = n
+		}
+		f.columnStop(column)
+	case '+':
+		if n < 0 {
+			n = 8
+		}
+		f.columnStop(f.stop + n)
+	default:
+		f.error("unknown directive ~" + string(d))
+	}
+}
+
+// Group the digits by threes from the right.
+
+func groupDigits(digits string) string {
+	var b strings.Builder
+	for i, r := range digits {
+		if i > 0 && (len(digits)-i)%3 == 0 {
+			b.WriteRune(',')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+func (f *formatter) newline() {
+	f.lineStart, f.segmentStart, f.stop, f.fills = f.b.Len(), f.b.Len(), 0, nil
+}
+
+// The column of a position in the output.
+
+func (f *formatter) column(pos int) int {
+	return utf8.RuneCountInString(f.b.String()[f.lineStart:pos])
+}
+
+// Pad the text since the last column stop to the column, at its fill points, and start a new
+// segment there.  Text that is past the column is left as it is.
+
+func (f *formatter) columnStop(column int) {
+	out := f.b.String()
+	pad := column - f.column(len(out))
+	if pad > 0 {
+		fills := f.fills
+		if len(fills) == 0 {
+			fills = []fillPoint{{len(out), ' '}}
+		}
+		// The padding is spread over the fill points, the remainder going to the last ones
+		var b strings.Builder
+		b.WriteString(out[:f.segmentStart])
+		pos := f.segmentStart
+		for i, fp := range fills {
+			b.WriteString(out[pos:fp.pos])
+			count := pad / len(fills)
+			if i >= len(fills)-pad%len(fills) {
+				count++
+			}
+			b.WriteString(strings.Repeat(string(fp.fill), count))
+			pos = fp.pos
+		}
+		b.WriteString(out[pos:])
+		f.b.Reset()
+		f.b.WriteString(b.String())
+	}
+	f.segmentStart, f.stop, f.fills = f.b.Len(), f.column(f.b.Len()), nil
+}
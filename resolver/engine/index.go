@@ -0,0 +1,257 @@
+package engine
+
+// Clause indexing.
+//
+// A call only tries the clauses whose heads can match its arguments.  For small predicates the
+// clauses are filtered one at a time by `mayMatch`, which compares the principal functors of the
+// arguments without unifying.  For large predicates an index is used: the clauses are bucketed by
+// the principal functor or atomic value, the key, of one argument, and a call picks the bucket
+// for the key of its argument.  Clauses that have a variable in the indexed position are in every
+// bucket, in their proper order.
+//
+// Indexes are built just in time.  A call uses the leftmost argument that is bound and whose
+// index is selective, that is, has at least one bucket, and the index for that position is built
+// the first time it is needed.  Typically this is the first argument, but a call with an unbound
+// first argument is indexed on another argument.
+//
+// A call is determinate if no clause after the one that matched can match.  This is checked
+// with `mayMatch` before the choicepoint is pushed, so that no choicepoint is left behind by the
+// last clause that can match.
+//
+// The slices in the index are shared with running calls like the slices of clauses, so they are
+// not modified in place, see database.go.  Adding a clause at the end appends to the buckets and
+// removing one copies its bucket, unless it has a variable in the position, which discards the
+// index, as do other changes.
+
+// Predicates with fewer clauses than this are not indexed.
+
+const indexThreshold = 8
+
+type predicate struct {
+	clauses []*rule
+
+	// Indexes by argument position, nil if not built.
+	indexes []*argIndex
+
+	// True if the predicate is tabled, see tabling.go.
+	tabled bool
+
+	// The module that the predicate belongs to, see module.go.
+	module *module
+
+	// The database of a persistent predicate, which holds its clauses instead of `clauses`, see
+	// persist.go.
+	persistent *persistence
+}
+
+type argIndex struct {
+	// Clauses by the key of the argument, each bucket including the clauses in `vars`.
+	buckets map[interface{}][]*rule
+
+	// Clauses with a variable in the position.
+	vars []*rule
+}
+
+func (p *predicate) add(r *rule) {
+	if p.persistent != nil {
+		p.persistent.add(r, false)
+		return
+	}
+	p.clauses = append(p.clauses, r)
+	for i, idx := range p.indexes {
+		if idx != nil {
+			idx.add(r, r.formals[i])
+		}
+	}
+}
+
+func (p *predicate) addFirst(r *rule) {
+	if p.persistent != nil {
+		p.persistent.add(r, true)
+		return
+	}
+	clauses := make([]*rule, 0, len(p.clauses)+4)
+	p.clauses = append(append(clauses, r), p.clauses...)
+	p.indexes = nil
+}
+
+// Remove the clause with the id, which has been unified with the actuals, returning false if
+// there is none.
+
+func (p *predicate) remove(id int64, actuals []ValueTerm) bool {
+	if p.persistent != nil {
+		return p.persistent.remove(id, actuals)
+	}
+	for i, r := range p.clauses {
+		if r.id == id {
+			p.clauses = without(p.clauses, i)
+			for j, idx := range p.indexes {
+				if idx != nil && !idx.remove(r, r.formals[j]) {
+					p.indexes[j] = nil
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// A copy of the clauses without the one at index i.
+
+func without(clauses []*rule, i int) []*rule {
+	remaining := make([]*rule, 0, len(clauses)-1)
+	remaining = append(remaining, clauses[:i]...)
+	return append(remaining, clauses[i+1:]...)
+}
+
+// The clauses that may match the actuals.
+
+func (p *predicate) candidates(actuals []ValueTerm) []*rule {
+	if p.persistent != nil {
+		return p.persistent.candidates(actuals)
+	}
+	if len(p.clauses) < indexThreshold {
+		return p.clauses
+	}
+	for i, a := range actuals {
+		key, ok := valueKey(a)
+		if !ok {
+			continue
+		}
+		if idx := p.index(i); len(idx.buckets) > 0 {
+			if bucket, found := idx.buckets[key]; found {
+				return bucket
+			}
+			return idx.vars
+		}
+	}
+	return p.clauses
+}
+
+func (p *predicate) index(i int) *argIndex {
+	if p.indexes == nil {
+		p.indexes = make([]*argIndex, len(p.clauses[0].formals))
+	}
+	if p.indexes[i] == nil {
+		idx := &argIndex{buckets: make(map[interface{}][]*rule), vars: []*rule{}}
+		for _, r := range p.clauses {
+			idx.add(r, r.formals[i])
+		}
+		p.indexes[i] = idx
+	}
+	return p.indexes[i]
+}
+
+func (idx *argIndex) add(r *rule, formal RuleTerm) {
+	key, ok := ruleKey(formal)
+	if !ok {
+		idx.vars = append(idx.vars, r)
+		for k, bucket := range idx.buckets {
+			idx.buckets[k] = append(bucket, r)
+		}
+		return
+	}
+	bucket, found := idx.buckets[key]
+	if !found {
+		bucket = append(make([]*rule, 0, len(idx.vars)+1), idx.vars...)
+	}
+	idx.buckets[key] = append(bucket, r)
+}
+
+// Remove the clause from its bucket.  Returns false if it has a variable in the position and so
+// is in every bucket, in which case the index has to be built again.
+
+func (idx *argIndex) remove(r *rule, formal RuleTerm) bool {
+	key, ok := ruleKey(formal)
+	if !ok {
+		return false
+	}
+	bucket := idx.buckets[key]
+	for i, b := range bucket {
+		if b == r {
+			idx.buckets[key] = without(bucket, i)
+			break
+		}
+	}
+	return true
+}
+
+// The key of a term is its atom, its number or text, or its functor and arity.  Unbound variables
+// have no key.  The keys of the different kinds of term have different types.
+
+type bigKey string
+
+type stringKey string
+
+func (n *Number) key() interface{} {
+	if n.big != nil {
+		return bigKey(n.big.String())
+	}
+	return n.value
+}
+
+func valueKey(t ValueTerm) (interface{}, bool) {
+	switch x := deref(t).(type) {
+	case *Atom:
+		return x, true
+	case *Number:
+		return x.key(), true
+	case *Float:
+		return x.value, true
+	case *String:
+		return stringKey(x.value), true
+	case *ValueStruct:
+		return predicateKey{x.s.functor, len(x.s.subterms)}, true
+	}
+	return nil, false
+}
+
+func ruleKey(t RuleTerm) (interface{}, bool) {
+	switch x := t.(type) {
+	case *Atom:
+		return x, true
+	case *Number:
+		return x.key(), true
+	case *Float:
+		return x.value, true
+	case *String:
+		return stringKey(x.value), true
+	case *RuleStruct:
+		return predicateKey{x.functor, len(x.subterms)}, true
+	}
+	return nil, false
+}
+
+// The keys of the actuals, nil for unbound variables.
+
+func actualKeys(actuals []ValueTerm) []interface{} {
+	keys := make([]interface{}, len(actuals))
+	for i, a := range actuals {
+		keys[i], _ = valueKey(a)
+	}
+	return keys
+}
+
+// False if the head of the rule cannot match actuals with the keys because some argument has a
+// different key.
+
+func mayMatch(keys []interface{}, r *rule) bool {
+	for i, fk := range r.formalKeys() {
+		if keys[i] != nil && fk != nil && fk != keys[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The keys of the formals of the rule, nil for variables, which are computed the first time.
+
+func (r *rule) formalKeys() []interface{} {
+	if r.keys == nil {
+		r.keys = make([]interface{}, len(r.formals))
+		for i, f := range r.formals {
+			r.keys[i], _ = ruleKey(f)
+		}
+	}
+	return r.keys
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package engine
+
+// There is no advisory locking on this platform, so the database is not protected against being
+// opened by two processes.
+
+func lockFile(f interface{ Fd() uintptr }) error {
+	return nil
+}
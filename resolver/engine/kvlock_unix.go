@@ -0,0 +1,19 @@
+//go:build unix
+
+package engine
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Take an exclusive advisory lock on the file, which is released when it is closed.  Fails at
+// once if another process holds the lock.
+
+func lockFile(f interface{ Fd() uintptr }) error {
+	err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if errors.Is(err, syscall.EWOULDBLOCK) {
+		return errors.New("the database is in use by another process")
+	}
+	return err
+}
@@ -0,0 +1,521 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// An on-disk key-value store, which holds the clauses of persistent predicates, see persist.go.
+//
+// The store is a table file and a write-ahead log next to it, `<path>.wal`.  The table holds the
+// records sorted by key, followed by a sparse index of every kvIndexInterval-th key with the
+// offset of its record.  Only the index is read when the store is opened; a scan looks up the
+// index entry before its prefix and reads the records from there.
+//
+// Changes are written to the log in batches, and a batch is synced before it takes effect.  The
+// changes in the log are kept in memory, by key and as a sorted list of their keys, where they
+// override the table, and they are replayed from the log when the store is opened.  When the log
+// has grown beyond kvCheckpointSize the table and the changes are merged into a new table and the
+// log is emptied.
+//
+// Only one process can have the store open: opening it takes an exclusive advisory lock on the
+// log, which is held until it is closed, see kvlock_unix.go.  The lock is taken before anything
+// else is read, so that the table and the log are not read while another process changes them.
+//
+// The store survives a crash at any point.  A batch in the log is its length, a checksum and the
+// operations, so a batch that a crash has torn fails the check and is cut off when the log is
+// replayed: a batch takes effect entirely or not at all.  A new table is written to
+// `<path>.tmp`, synced and renamed over the old one before the log is emptied, so if the
+// process dies in between the log is replayed onto the new table, which does no harm because
+// the operations set and delete keys.
+
+const (
+	kvIndexInterval  = 32
+	kvCheckpointSize = 1 << 20
+	kvMagic          = "RKV1"
+)
+
+type kvStore struct {
+	path string
+
+	// The table, nil if there is none yet, its sparse index, and the offset at which its records
+	// end.
+	table *os.File
+	index []kvIndexEntry
+	end   int64
+
+	// The log and its size.
+	log     *os.File
+	logSize int64
+
+	// The changes in the log by key, nil for a deletion, and their keys in order.
+	changes map[string][]byte
+	changed []string
+}
+
+type kvIndexEntry struct {
+	key    string
+	offset int64
+}
+
+// An operation in a batch: set the key to the value, or delete the key if the value is nil.
+
+type kvOp struct {
+	key   string
+	value []byte
+}
+
+func openKVStore(path string) (*kvStore, error) {
+	kv := &kvStore{path: path, changes: make(map[string][]byte)}
+	if err := kv.openLog(); err != nil {
+		return nil, err
+	}
+	// A table that was being written when the process died
+	err := os.Remove(path + ".tmp")
+	if err == nil || errors.Is(err, os.ErrNotExist) {
+		err = kv.openTable()
+	}
+	if err == nil {
+		err = kv.replayLog()
+	}
+	if err != nil {
+		if kv.table != nil {
+			kv.table.Close()
+		}
+		kv.log.Close()
+		return nil, err
+	}
+	return kv, nil
+}
+
+// Open the log, creating it if it does not exist, and lock it.
+
+func (kv *kvStore) openLog() error {
+	_, err := os.Stat(kv.path + ".wal")
+	created := errors.Is(err, os.ErrNotExist)
+	f, err := os.OpenFile(kv.path+".wal", os.O_RDWR|os.O_CREATE, 0o644)
+	if err != nil {
+		return err
+	}
+	if err := lockFile(f); err != nil {
+		f.Close()
+		return fmt.Errorf("%s: %w", kv.path, err)
+	}
+	if created {
+		// The log must not vanish with the batches that are synced to it
+		if err := syncDir(filepath.Dir(kv.path)); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	kv.log = f
+	return nil
+}
+
+func (kv *kvStore) openTable() error {
+	kv.table, kv.index, kv.end = nil, nil, 0
+	f, err := os.Open(kv.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	// The table ends with the offset of the index and the magic number
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	trailer := make([]byte, 8+len(kvMagic))
+	if fi.Size() < int64(len(kvMagic)+len(trailer)) {
+		f.Close()
+		return fmt.Errorf("%s: not a database", kv.path)
+	}
+	if _, err := f.ReadAt(trailer, fi.Size()-int64(len(trailer))); err != nil {
+		f.Close()
+		return err
+	}
+	end := int64(binary.BigEndian.Uint64(trailer))
+	if string(trailer[8:]) != kvMagic || end < int64(len(kvMagic)) || end > fi.Size()-int64(len(trailer)) {
+		f.Close()
+		return fmt.Errorf("%s: not a database", kv.path)
+	}
+	r := bufio.NewReader(io.NewSectionReader(f, end, fi.Size()-int64(len(trailer))-end))
+	n, err := binary.ReadUvarint(r)
+	for i := uint64(0); err == nil && i < n; i++ {
+		var e kvIndexEntry
+		var offset uint64
+		if e.key, err = readKVString(r); err == nil {
+			offset, err = binary.ReadUvarint(r)
+			e.offset = int64(offset)
+			kv.index = append(kv.index, e)
+		}
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("%s: bad index: %w", kv.path, err)
+	}
+	kv.table, kv.end = f, end
+	return nil
+}
+
+func (kv *kvStore) replayLog() error {
+	f := kv.log
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	r := bufio.NewReader(f)
+	var size int64
+	for {
+		var header [8]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF {
+				return err
+			}
+			break
+		}
+		n := int64(binary.BigEndian.Uint32(header[:4]))
+		if n > fi.Size()-size-int64(len(header)) {
+			break
+		}
+		payload := make([]byte, n)
+		if _, err := io.ReadFull(r, payload); err != nil {
+			if err != io.ErrUnexpectedEOF {
+				return err
+			}
+			break
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			break
+		}
+		ops, err := decodeKVBatch(payload)
+		if err != nil {
+			break
+		}
+		kv.apply(ops)
+		size += int64(len(header)) + n
+	}
+	// Cut off a batch that was torn by a crash, so that new batches follow the last whole one
+	if size < fi.Size() {
+		if err := f.Truncate(size); err != nil {
+			return err
+		}
+	}
+	if _, err := f.Seek(size, io.SeekStart); err != nil {
+		return err
+	}
+	kv.logSize = size
+	return nil
+}
+
+func (kv *kvStore) apply(ops []kvOp) {
+	for _, op := range ops {
+		if _, ok := kv.changes[op.key]; !ok {
+			i := sort.SearchStrings(kv.changed, op.key)
+			kv.changed = append(kv.changed, "")
+			copy(kv.changed[i+1:], kv.changed[i:])
+			kv.changed[i] = op.key
+		}
+		kv.changes[op.key] = op.value
+	}
+}
+
+// Write the batch to the log and apply it.  If it cannot be written then it has no effect and the
+// error is returned as `err`.  Once the batch has taken effect the log may be checkpointed, and
+// an error from that is returned as `checkpointErr`; the checkpoint is tried again by the next
+// write.
+
+func (kv *kvStore) write(ops []kvOp) (checkpointErr error, err error) {
+	payload := encodeKVBatch(ops)
+	record := make([]byte, 8, 8+len(payload))
+	binary.BigEndian.PutUint32(record[:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(record[4:], crc32.ChecksumIEEE(payload))
+	record = append(record, payload...)
+	_, err = kv.log.Write(record)
+	if err == nil {
+		err = kv.log.Sync()
+	}
+	if err != nil {
+		// Remove what may have been written, or else the next batch would follow a torn one
+		kv.log.Truncate(kv.logSize)
+		kv.log.Seek(kv.logSize, io.SeekStart)
+		return nil, err
+	}
+	kv.logSize += int64(len(record))
+	kv.apply(ops)
+	if kv.logSize > kvCheckpointSize {
+		return kv.checkpoint(), nil
+	}
+	return nil, nil
+}
+
+// The value of the key, or nil if there is none.
+
+func (kv *kvStore) get(key string) ([]byte, error) {
+	if value, ok := kv.changes[key]; ok {
+		return value, nil
+	}
+	var value []byte
+	err := kv.scanTable(key, func(k string, v []byte) bool {
+		if k == key {
+			value = v
+		}
+		return false
+	})
+	return value, err
+}
+
+// Call `f` with the keys that start with the prefix and their values, in the order of the keys,
+// until it returns false.
+
+func (kv *kvStore) scan(prefix string, f func(key string, value []byte) bool) error {
+	i := sort.SearchStrings(kv.changed, prefix)
+	j := i
+	for j < len(kv.changed) && strings.HasPrefix(kv.changed[j], prefix) {
+		j++
+	}
+	changed := kv.changed[i:j]
+	more := true
+	err := kv.scanTable(prefix, func(key string, value []byte) bool {
+		for len(changed) > 0 && changed[0] <= key {
+			k := changed[0]
+			changed = changed[1:]
+			if v := kv.changes[k]; v != nil && !f(k, v) {
+				more = false
+				return false
+			}
+			if k == key {
+				// The change overrides the table
+				return true
+			}
+		}
+		more = f(key, value)
+		return more
+	})
+	if err != nil || !more {
+		return err
+	}
+	for _, k := range changed {
+		if v := kv.changes[k]; v != nil && !f(k, v) {
+			break
+		}
+	}
+	return nil
+}
+
+func (kv *kvStore) scanTable(prefix string, f func(key string, value []byte) bool) error {
+	if kv.table == nil {
+		return nil
+	}
+	start := int64(len(kvMagic))
+	if i := sort.Search(len(kv.index), func(i int) bool { return kv.index[i].key >= prefix }); i > 0 {
+		start = kv.index[i-1].offset
+	}
+	r := bufio.NewReader(io.NewSectionReader(kv.table, start, kv.end-start))
+	for {
+		key, err := readKVString(r)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		value, err := readKVBytes(r)
+		if err != nil {
+			return err
+		}
+		if key < prefix {
+			continue
+		}
+		if !strings.HasPrefix(key, prefix) || !f(key, value) {
+			return nil
+		}
+	}
+}
+
+// Merge the table and the changes into a new table, and empty the log.
+
+func (kv *kvStore) checkpoint() error {
+	tmp := kv.path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(kvMagic)
+	offset := int64(len(kvMagic))
+	var index []kvIndexEntry
+	count := 0
+	err = kv.scan("", func(key string, value []byte) bool {
+		if count%kvIndexInterval == 0 {
+			index = append(index, kvIndexEntry{key, offset})
+		}
+		count++
+		offset += writeKVBytes(w, []byte(key)) + writeKVBytes(w, value)
+		return true
+	})
+	if err == nil {
+		writeUvarint(w, uint64(len(index)))
+		for _, e := range index {
+			writeKVBytes(w, []byte(e.key))
+			writeUvarint(w, uint64(e.offset))
+		}
+		var trailer [8]byte
+		binary.BigEndian.PutUint64(trailer[:], uint64(offset))
+		w.Write(trailer[:])
+		w.WriteString(kvMagic)
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, kv.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := syncDir(filepath.Dir(kv.path)); err != nil {
+		return err
+	}
+	if kv.table != nil {
+		kv.table.Close()
+	}
+	if err := kv.openTable(); err != nil {
+		return err
+	}
+	if err := kv.log.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := kv.log.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	kv.logSize = 0
+	kv.changes, kv.changed = make(map[string][]byte), nil
+	return kv.log.Sync()
+}
+
+func (kv *kvStore) close() error {
+	var err error
+	if kv.logSize > 0 {
+		err = kv.checkpoint()
+	}
+	if kv.table != nil {
+		kv.table.Close()
+	}
+	if cerr := kv.log.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Make a rename in the directory durable.
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// A batch is a sequence of operations, each a byte that is 1 for setting and 0 for deleting, the
+// key, and the value when setting.  Keys and values are preceded by their length.
+
+func encodeKVBatch(ops []kvOp) []byte {
+	var b bytes.Buffer
+	for _, op := range ops {
+		if op.value != nil {
+			b.WriteByte(1)
+			writeKVBytes(&b, []byte(op.key))
+			writeKVBytes(&b, op.value)
+		} else {
+			b.WriteByte(0)
+			writeKVBytes(&b, []byte(op.key))
+		}
+	}
+	return b.Bytes()
+}
+
+func decodeKVBatch(payload []byte) ([]kvOp, error) {
+	r := bytes.NewReader(payload)
+	var ops []kvOp
+	for r.Len() > 0 {
+		kind, _ := r.ReadByte()
+		key, err := readKVString(r)
+		if err != nil {
+			return nil, err
+		}
+		op := kvOp{key: key}
+		switch kind {
+		case 0:
+		case 1:
+			if op.value, err = readKVBytes(r); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, fmt.Errorf("bad operation %d", kind)
+		}
+		ops = append(ops, op)
+	}
+	return ops, nil
+}
+
+type kvWriter interface {
+	io.Writer
+	io.ByteWriter
+}
+
+func writeUvarint(w kvWriter, n uint64) int64 {
+	var buf [binary.MaxVarintLen64]byte
+	k := binary.PutUvarint(buf[:], n)
+	w.Write(buf[:k])
+	return int64(k)
+}
+
+// Write the bytes preceded by their length, returning the number of bytes written.
+
+func writeKVBytes(w kvWriter, b []byte) int64 {
+	n := writeUvarint(w, uint64(len(b)))
+	w.Write(b)
+	return n + int64(len(b))
+}
+
+type kvReader interface {
+	io.Reader
+	io.ByteReader
+}
+
+func readKVBytes(r kvReader) ([]byte, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	// Values are never nil, so that they are told from deletions
+	b := make([]byte, n)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return b, nil
+}
+
+func readKVString(r kvReader) (string, error) {
+	b, err := readKVBytes(r)
+	return string(b), err
+}
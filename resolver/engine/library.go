@@ -0,0 +1,23 @@
+package engine
+
+import (
+	_ "embed"
+	"strings"
+)
+
+// Predicates that are defined in Prolog rather than in Go are kept in Prolog source files that
+// are embedded in the engine and loaded into the module `system` of every new store.
+
+//go:embed system.pl
+var systemLibrary string
+
+//go:embed lists.pl
+var listsLibrary string
+
+// An error in the library is a bug in the engine, so it panics.
+
+func (st *Store) loadLibrary() {
+	cb := Callbacks{QueryError: func(err error) { panic(err.Error()) }}
+	st.loadIn(st.systemModule, "system.pl", strings.NewReader(systemLibrary), cb)
+	st.loadIn(st.systemModule, "lists.pl", strings.NewReader(listsLibrary), cb)
+}
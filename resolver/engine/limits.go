@@ -0,0 +1,102 @@
+package engine
+
+import (
+	"context"
+	"errors"
+)
+
+// Resource limits.  A query can be bounded by a context, by the number of inferences, and by the
+// number of cells it allocates.  When a bound is hit the query raises resource_error(R), where R
+// is `inferences`, `memory` for allocation, `time_limit` for a context whose deadline has passed,
+// or `cancelled` for a context that was cancelled.
+//
+// An inference is a call to a predicate.  Allocation is counted in cells: every variable slot of
+// a clause that is entered, its continuation frame, every attribute and every entry on the trail
+// is a cell.  The count is a budget for the branch of the search, not a measure of the memory in
+// use: the cells of a clause are counted when it is entered and stay counted after its frame is
+// dropped by the last call, so a loop allocates on every iteration even if it runs in constant
+// space.  The cells that are allocated after a choicepoint are given back when the machine
+// backtracks to it.
+//
+// The limits are checked on every inference and the context on every 1024th.
+//
+// The error can be caught, and the recovery goal of catch/3 must be able to run, so once the
+// limit on inferences or the context has been hit the query gets `recoveryInferences` more
+// inferences, during which they are not checked.  If it uses those up as well then the error is
+// raised again and cannot be caught, so that a program that catches the error and loops again
+// still stops.  Allocation needs no such headroom, since the cells allocated by the goal are
+// given back when the error is caught.
+
+const recoveryInferences = 10000
+
+type Limits struct {
+	// The maximum number of inferences, or 0 for no limit
+	MaxInferences int64
+
+	// The maximum number of cells that a branch of the search allocates, or 0 for no limit
+	MaxAllocation int64
+}
+
+// Set the limits for the queries that are created after this, including those of the loader and
+// the top level.
+
+func (st *Store) SetLimits(limits Limits) {
+	st.limits = limits
+}
+
+// Set the context of the query, which cancels it when it is done.
+
+func (q *Query) SetContext(ctx context.Context) {
+	q.m.ctx = ctx
+}
+
+// The number of inferences made by the query so far.
+
+func (q *Query) Inferences() int64 {
+	return q.m.inferences
+}
+
+func (m *machine) checkLimits(functor *Atom, arity int) {
+	m.inferences++
+	if m.exhausted != "" {
+		if m.inferences > m.recoveryEnd {
+			m.resourceError(functor, arity, m.exhausted)
+		}
+	} else {
+		if max := m.limits.MaxInferences; max > 0 && m.inferences > max {
+			m.exhaust(functor, arity, "inferences")
+		}
+		if m.ctx != nil && m.inferences%1024 == 0 {
+			switch err := m.ctx.Err(); {
+			case errors.Is(err, context.DeadlineExceeded):
+				m.exhaust(functor, arity, "time_limit")
+			case err != nil:
+				m.exhaust(functor, arity, "cancelled")
+			}
+		}
+	}
+	if max := m.limits.MaxAllocation; max > 0 && m.allocated+int64(len(m.trail)) > max {
+		m.resourceError(functor, arity, "memory")
+	}
+}
+
+// Raise the error for a limit on inferences or the context, leaving headroom for recovering.
+
+func (m *machine) exhaust(functor *Atom, arity int, resource string) {
+	m.exhausted = resource
+	m.recoveryEnd = m.inferences + recoveryInferences
+	m.resourceError(functor, arity, resource)
+}
+
+// True if the query has used up the headroom for recovering too, so that the error cannot be
+// caught.
+
+func (m *machine) unrecoverable() bool {
+	return m.exhausted != "" && m.inferences > m.recoveryEnd
+}
+
+func (m *machine) resourceError(functor *Atom, arity int, resource string) {
+	st := m.st
+	st.current = predicateKey{functor, arity}
+	st.raise(newValueStruct(st.NewAtom("resource_error"), []ValueTerm{st.NewAtom(resource)}))
+}
@@ -0,0 +1,79 @@
+/* List predicates.  This library is loaded into every new store.
+
+   Predicates whose names start with '$' are internal to the library. */
+
+append([], L, L).
+append([X|Xs], L, [X|Ys]) :- append(Xs, L, Ys).
+
+member(X, [X|_]).
+member(X, [_|T]) :- member(X, T).
+
+/* With a bound length the list is checked or created, otherwise lists of increasing length are
+   enumerated. */
+
+length(L, N) :- integer(N), !, N >= 0, '$length_bound'(L, N).
+length(L, N) :- var(N), '$length'(L, 0, N).
+
+'$length_bound'([], 0) :- !.
+'$length_bound'([_|T], N) :- N > 0, M is N-1, '$length_bound'(T, M).
+
+'$length'([], N, N).
+'$length'([_|T], K, N) :- K1 is K+1, '$length'(T, K1, N).
+
+reverse(L, R) :- '$reverse'(L, [], R).
+
+'$reverse'([], R, R).
+'$reverse'([X|Xs], Acc, R) :- '$reverse'(Xs, [X|Acc], R).
+
+/* With a bound index the element is selected, otherwise the elements are enumerated. */
+
+nth0(I, L, E) :- integer(I), !, I >= 0, '$nth0'(L, I, E).
+nth0(I, L, E) :- var(I), '$nth0_enum'(L, E, 0, I).
+
+'$nth0'([E|_], 0, E) :- !.
+'$nth0'([_|T], I, E) :- I > 0, I1 is I-1, '$nth0'(T, I1, E).
+
+'$nth0_enum'([E|_], E, B, B).
+'$nth0_enum'([_|T], E, B0, B) :- B1 is B0+1, '$nth0_enum'(T, E, B1, B).
+
+/* Merge sort in the standard order of terms, keeping duplicates.  The list is split by length
+   so that the sort is stable. */
+
+msort(L, S) :- length(L, N), '$msort'(N, L, S, []).
+
+'$msort'(0, L, [], L) :- !.
+'$msort'(1, [X|L], [X], L) :- !.
+'$msort'(N, L0, S, L) :-
+    A is N // 2, B is N - A,
+    '$msort'(A, L0, S1, L1), '$msort'(B, L1, S2, L),
+    '$merge'(S1, S2, S).
+
+'$merge'([], L, L) :- !.
+'$merge'(L, [], L) :- !.
+'$merge'([X|Xs], [Y|Ys], [X|Zs]) :- X @=< Y, !, '$merge'(Xs, [Y|Ys], Zs).
+'$merge'(Xs, [Y|Ys], [Y|Zs]) :- '$merge'(Xs, Ys, Zs).
+
+/* sort/2 sorts in the standard order of terms and removes duplicates, keysort/2 sorts Key-Value
+   pairs by key and keeps pairs with equal keys in their original order. */
+
+sort(L, S) :- msort(L, S0), '$dedup'(S0, S).
+
+'$dedup'([], []).
+'$dedup'([X|Xs], [X|Ys]) :- '$dedup'(Xs, X, Ys).
+
+'$dedup'([], _, []).
+'$dedup'([Y|Ys], X, Zs) :- ( X == Y -> '$dedup'(Ys, X, Zs) ; Zs = [Y|Zs1], '$dedup'(Ys, Y, Zs1) ).
+
+keysort(L, S) :- length(L, N), '$keysort'(N, L, S, []).
+
+'$keysort'(0, L, [], L) :- !.
+'$keysort'(1, [X|L], [X], L) :- !.
+'$keysort'(N, L0, S, L) :-
+    A is N // 2, B is N - A,
+    '$keysort'(A, L0, S1, L1), '$keysort'(B, L1, S2, L),
+    '$keymerge'(S1, S2, S).
+
+'$keymerge'([], L, L) :- !.
+'$keymerge'(L, [], L) :- !.
+'$keymerge'([K1-V1|Xs], [K2-V2|Ys], [K1-V1|Zs]) :- K1 @=< K2, !, '$keymerge'(Xs, [K2-V2|Ys], Zs).
+'$keymerge'(Xs, [Y|Ys], [Y|Zs]) :- '$keymerge'(Xs, Ys, Zs).
@@ -0,0 +1,419 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Loading programs.  A program is a sequence of clauses, each terminated by a period:
+//
+//   Head.              a fact
+//   Head :- Body.      a rule
+//   :- Goal.           a directive, which is evaluated once when it is read
+//   ?- Goal.           a query, whose outcome is reported through the callbacks
+//
+// Directives take effect immediately, so op/3 in a directive changes how the rest of the
+// program is read.  The clauses are added to the module `user`, or to the module that the file
+// declares with module/2, see module.go.
+//
+// Consulting a file again reloads it: the predicates that the file added clauses to the last
+// time lose their clauses before it is read, so that they end up with the clauses in the file
+// as it is now.  Persistent predicates keep their clauses, which are data rather than program,
+// see persist.go.
+//
+// Errors do not stop the loading.  A syntax error is reported and the reader skips to the end of
+// the clause; an error raised by a directive or a query is reported with the file name and the
+// line on which the clause starts.  Errors are reported through the QueryError callback, and are
+// ignored if there is none.
+
+type Callbacks struct {
+	// Called with each solution to a query, returns true if no more solutions are wanted.
+	QuerySuccess func(names []*Atom, vars []Varslot) bool
+
+	// Called when there are no more solutions to a query.
+	QueryFailure func()
+
+	// Called with syntax errors and errors raised by directives and queries, if not nil.
+	QueryError func(err error)
+}
+
+// Halt is the error that is returned when a program calls halt/0 or halt/1.  It ends the loading
+// of all files, including those that are being consulted.
+
+type Halt struct {
+	Code int
+}
+
+func (h *Halt) Error() string {
+	return fmt.Sprintf("halt(%d)", h.Code)
+}
+
+type loader struct {
+	st       *Store
+	p        *reader
+	filename string
+	cb       Callbacks
+
+	// If true then every clause is a query, as at the top level.
+	queries bool
+
+	// The module that the clauses are added to and that the directives and queries run in, the
+	// module that loads the file, and the module that the file declares, if any.
+	module   *module
+	context  *module
+	declared *module
+
+	// The number of times each clause of a persistent predicate has occurred, by its text.
+	seeds map[string]int
+
+	// The predicates that clauses have been added to, if the program is a consulted file.
+	defines map[*predicate]bool
+}
+
+// Read and process a program: clauses are added to the database, directives are evaluated, and
+// queries are evaluated with their outcomes reported through the callbacks.  The name of the
+// file is used in error messages.  Returns nil at the end of the input, or a *Halt.
+
+func (st *Store) Load(filename string, r io.RuneScanner, cb Callbacks) error {
+	return st.loadIn(st.userModule, filename, r, cb)
+}
+
+// Load a program into the module.
+
+func (st *Store) loadIn(md *module, filename string, r io.RuneScanner, cb Callbacks) error {
+	l := &loader{st: st, p: newReader(st, filename, r), filename: filename, cb: cb, module: md,
+		context: md}
+	return l.run()
+}
+
+// Read and evaluate queries, with or without a leading `?-`.  Returns nil at the end of the
+// input, or a *Halt.
+
+func (st *Store) LoadQueries(filename string, r io.RuneScanner, cb Callbacks) error {
+	l := &loader{st: st, p: newReader(st, filename, r), filename: filename, cb: cb, queries: true,
+		module: st.userModule, context: st.userModule}
+	return l.run()
+}
+
+// Load the program in a file.  If there is no file by that name and the name has no extension
+// then the name with ".pl" added is tried.
+
+func (st *Store) ConsultFile(filename string, cb Callbacks) error {
+	return st.consultFileIn(st.userModule, filename, cb)
+}
+
+func (st *Store) consultFileIn(md *module, filename string, cb Callbacks) error {
+	f, err := os.Open(filename)
+	if err != nil && errors.Is(err, os.ErrNotExist) && filepath.Ext(filename) == "" {
+		if g, err2 := os.Open(filename + ".pl"); err2 == nil {
+			f, err, filename = g, nil, filename+".pl"
+		}
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	path, err := filepath.Abs(filename)
+	if err != nil {
+		return err
+	}
+	st.unloadFile(path)
+	directory := st.directory
+	st.directory = filepath.Dir(path)
+	defer func() { st.directory = directory }()
+	l := &loader{st: st, p: newReader(st, filename, bufio.NewReader(f)), filename: filename, cb: cb,
+		module: md, context: md, defines: make(map[*predicate]bool)}
+	st.filePredicates[path] = l.defines
+	return l.run()
+}
+
+// Remove the clauses that the file added the last time it was consulted.
+
+func (st *Store) unloadFile(path string) {
+	defines, ok := st.filePredicates[path]
+	if !ok {
+		return
+	}
+	for p := range defines {
+		if p.persistent == nil {
+			p.clauses, p.indexes = nil, nil
+		}
+	}
+	delete(st.filePredicates, path)
+	st.invalidateTables()
+}
+
+func (l *loader) run() error {
+	// Consulting from a directive or a query reports through the callbacks of the program that
+	// is being loaded.
+	saved := l.st.callbacks
+	l.st.callbacks = l.cb
+	defer func() { l.st.callbacks = saved }()
+	for {
+		t, err := l.p.readClause()
+		if err != nil {
+			l.reportError(err)
+			continue
+		}
+		if t == nil {
+			l.importDeclared()
+			return nil
+		}
+		if err := l.processClause(t); err != nil {
+			var halt *Halt
+			if errors.As(err, &halt) {
+				return halt
+			}
+			l.reportError(fmt.Errorf("%s:%d: %w", l.filename, l.p.line, err))
+		}
+	}
+}
+
+func (l *loader) reportError(err error) {
+	if l.cb.QueryError != nil {
+		l.cb.QueryError(err)
+	}
+}
+
+func (l *loader) processClause(t RuleTerm) error {
+	if s, ok := t.(*RuleStruct); ok && s.functor.name == "?-" && len(s.subterms) == 1 {
+		return l.evalQuery(flattenConjunction(s.subterms[0]))
+	}
+	if l.queries {
+		return l.evalQuery(flattenConjunction(t))
+	}
+	if s, ok := t.(*RuleStruct); ok {
+		switch {
+		case s.functor.name == ":-" && len(s.subterms) == 2:
+			md, head, err := l.clauseHead(s.subterms[0])
+			if err != nil {
+				return err
+			}
+			return l.addClause(md, head, flattenConjunction(s.subterms[1]))
+		case s.functor.name == ":-" && len(s.subterms) == 1:
+			return l.evalDirective(s.subterms[0])
+		case s.functor.name == "-->" && len(s.subterms) == 2:
+			clause, invalid := l.st.translateGrammarRule(s.subterms[0], s.subterms[1], func() RuleTerm {
+				return l.p.makeVariable("_")
+			})
+			if invalid != nil {
+				l.p.getAndClearVars()
+				return fmt.Errorf("Invalid grammar rule: %s", invalid.String())
+			}
+			return l.processClause(clause)
+		}
+	}
+	md, head, err := l.clauseHead(t)
+	if err != nil {
+		return err
+	}
+	return l.addClause(md, head, []RuleTerm{})
+}
+
+// Add a clause of the program to the module.  The clauses of a persistent predicate are added
+// only the first time the program is loaded, see persist.go.
+
+func (l *loader) addClause(md *module, head *RuleStruct, body []RuleTerm) error {
+	locals := l.p.getAndClearVars()
+	p := md.lookup(head.functor, len(head.subterms))
+	if p == nil || p.persistent == nil {
+		l.st.addClause(md, locals, head, body)
+		if l.defines != nil {
+			l.defines[md.lookup(head.functor, len(head.subterms))] = true
+		}
+		return nil
+	}
+	r := &rule{module: md, locals: len(locals), arity: len(head.subterms), functor: head.functor,
+		formals: head.subterms, body: body}
+	if l.seeds == nil {
+		l.seeds = make(map[string]int)
+	}
+	text := string(encodeRule(r))
+	l.seeds[text]++
+	added, err := p.persistent.seed(r, l.seeds[text])
+	if added {
+		l.st.invalidateTables()
+	}
+	return err
+}
+
+// The module and the head of a clause, which is added to the module of the loader unless the
+// head is Module:Head.
+
+func (l *loader) clauseHead(t RuleTerm) (*module, *RuleStruct, error) {
+	md := l.module
+	for {
+		s, ok := t.(*RuleStruct)
+		if !ok || s.functor != l.st.colonAtom || len(s.subterms) != 2 {
+			break
+		}
+		name, ok := s.subterms[0].(*Atom)
+		if !ok {
+			l.p.getAndClearVars()
+			return nil, nil, fmt.Errorf("Module name is not an atom: %s", s.subterms[0].String())
+		}
+		md, t = l.st.module(name), s.subterms[1]
+	}
+	var head *RuleStruct
+	switch h := t.(type) {
+	case *RuleStruct:
+		head = h
+	case *Atom:
+		head = l.st.NewStruct(h, []RuleTerm{})
+	default:
+		l.p.getAndClearVars()
+		return nil, nil, fmt.Errorf("Clause head is not callable: %s", t.String())
+	}
+	if l.st.isStatic(md, head.functor, len(head.subterms)) {
+		l.p.getAndClearVars()
+		return nil, nil, fmt.Errorf("No permission to modify static procedure %s/%d",
+			head.functor.String(), len(head.subterms))
+	}
+	return md, head, nil
+}
+
+func flattenConjunction(t RuleTerm) []RuleTerm {
+	goals := make([]RuleTerm, 0, 4)
+	for {
+		s, ok := t.(*RuleStruct)
+		if !ok || s.functor.name != "," || len(s.subterms) != 2 {
+			return append(goals, t)
+		}
+		goals = append(goals, flattenConjunction(s.subterms[0])...)
+		t = s.subterms[1]
+	}
+}
+
+func (l *loader) evalQuery(query []RuleTerm) error {
+	names := l.p.varNames()
+	l.p.getAndClearVars()
+	if l.cb.QuerySuccess == nil {
+		return fmt.Errorf("Query in a program that has no top level")
+	}
+	return l.st.evaluateQuery(l.module, query, names, l.cb.QuerySuccess, l.cb.QueryFailure)
+}
+
+func (l *loader) evalDirective(goal RuleTerm) error {
+	names := l.p.varNames()
+	l.p.getAndClearVars()
+	// module/2 is checked by '$module', which creates the module, and then the rest of the file
+	// is loaded into the module
+	s, isModule := goal.(*RuleStruct)
+	isModule = isModule && s.functor.name == "module" && len(s.subterms) == 2
+	if isModule {
+		goal = l.st.NewStruct(l.st.NewAtom("$module"), s.subterms)
+	}
+	q := l.st.newQuery(l.module, []RuleTerm{goal}, names)
+	found, err := q.Next()
+	q.Close()
+	if err == nil && !found {
+		err = fmt.Errorf("Directive failed: %s", goal.String())
+	}
+	if err == nil && isModule {
+		l.module = l.st.module(s.subterms[0].(*Atom))
+		l.declared = l.module
+		if path, err := filepath.Abs(l.filename); err == nil {
+			l.st.moduleFiles[path] = l.module
+		}
+	}
+	return err
+}
+
+// Import the exports of the module that the file declares into the module that loaded it.
+
+func (l *loader) importDeclared() {
+	if l.declared == nil {
+		return
+	}
+	if key, ok := l.st.importModule(l.context, l.declared); !ok {
+		l.reportError(fmt.Errorf("%s: No permission to import %s/%d from %s, it is imported from %s",
+			l.filename, key.functor.String(), key.arity, l.declared.name.String(),
+			l.context.imports[key].name.String()))
+	}
+}
+
+// consult(File) and [File, ...] load the named files, where a file name is an atom.  halt/0 and
+// halt/1 end the loading, see Halt.
+
+func (st *Store) initLoadBuiltins() {
+	st.addBuiltin("consult", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		if l, ok := deref(args[0]).(*ValueStruct); ok && isListFunctor(l.s.functor, len(l.s.subterms)) {
+			st.consultFiles(m.module, args[0])
+		} else {
+			st.consult(m.module, args[0])
+		}
+		return true
+	})
+	st.addBuiltin(".", 2, func(m *machine, args []ValueTerm) bool {
+		m.st.consultFiles(m.module, newValueStruct(m.st.dotAtom, args))
+		return true
+	})
+	st.addBuiltin("halt", 0, func(m *machine, args []ValueTerm) bool {
+		panic(&Halt{0})
+	})
+	st.addBuiltin("halt", 1, func(m *machine, args []ValueTerm) bool {
+		code, ok := deref(args[0]).(*Number)
+		if !ok {
+			if _, isVar := deref(args[0]).(*Varslot); isVar {
+				m.st.instantiationError()
+			}
+			m.st.typeError("integer", deref(args[0]))
+		}
+		panic(&Halt{int(code.value)})
+	})
+}
+
+func (st *Store) consultFiles(md *module, files ValueTerm) {
+	for t := files; ; {
+		cell, ok := deref(t).(*ValueStruct)
+		if !ok || !isListFunctor(cell.s.functor, len(cell.s.subterms)) {
+			if deref(t) != ValueTerm(st.nilAtom) {
+				st.typeError("list", files)
+			}
+			return
+		}
+		st.consult(md, bind(cell.s.subterms[0], cell.env))
+		t = bind(cell.s.subterms[1], cell.env)
+	}
+}
+
+// The file name relative to the directory of the file that is being loaded, if any.
+
+func (st *Store) resolveFile(filename string) string {
+	if st.directory == "" || filepath.IsAbs(filename) {
+		return filename
+	}
+	return filepath.Join(st.directory, filename)
+}
+
+// Load a file into the module.
+
+func (st *Store) consult(md *module, file ValueTerm) {
+	name, ok := deref(file).(*Atom)
+	if !ok {
+		if _, isVar := deref(file).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		st.typeError("atom", deref(file))
+	}
+	// The queries in the file change the current built-in, which is needed for the errors below
+	current := st.current
+	err := st.consultFileIn(md, st.resolveFile(name.name), st.callbacks)
+	st.current = current
+	if err == nil {
+		return
+	}
+	if halt, ok := err.(*Halt); ok {
+		panic(halt)
+	}
+	if errors.Is(err, os.ErrNotExist) {
+		st.raise(newValueStruct(st.NewAtom("existence_error"),
+			[]ValueTerm{st.NewAtom("source_sink"), name}))
+	}
+	st.raise(newValueStruct(st.NewAtom("system_error"), []ValueTerm{st.NewAtom(err.Error())}))
+}
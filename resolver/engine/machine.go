@@ -0,0 +1,318 @@
+package engine
+
+import (
+	"context"
+)
+
+// The resolution machine.
+//
+// The success continuation is a linked list of frames, each holding the goals that remain to be
+// solved in some conjunction together with the rib they are bound in.  When the last goal of a
+// conjunction is solved its frame is no longer referenced from the continuation, so a recursive
+// call in the last position of a body does not grow the continuation (last-call optimization).
+// Frames are never mutated, they are shared between the continuation and the choicepoints.
+//
+// The failure continuation is the stack of choicepoints.  A choicepoint records the height of
+// the trail and the success continuation at the time the choice was made, together with the
+// alternatives that remain to be tried.  Backtracking unwinds the trail to the recorded height,
+// undoing the bindings made since the choice, and resumes with the next alternative.
+//
+// Every goal is solved with a cut barrier, which is the height of the choicepoint stack when the
+// predicate whose body contains the goal was called.  Cut pops the stack back to that height.
+//
+// Bindings only need to be undone if there is a choicepoint to backtrack into, so the trail is
+// emptied whenever a predicate is called with no choicepoints on the stack.  A built-in that
+// needs to undo its own bindings does so before it returns, see `\=`.
+
+type frame struct {
+	goals  []RuleTerm
+	env    rib
+	cutB   int
+	module *module
+	next   *frame
+
+	// If not nil then this frame has no goals and reports the exit of a traced call, see
+	// trace.go.
+	exit *traceCall
+
+	// If not nil then this frame has no goals and continues the compiled clause at `pc`, with
+	// the registers in `regs` if they are saved, see vm.go.
+	code *clauseCode
+	pc   int
+	regs []ValueTerm
+}
+
+type choicepoint struct {
+	trailMark int
+	allocMark int64
+	cont      *frame
+
+	// The context module to resume in, see module.go.
+	module *module
+
+	// If `clauses` is not empty then these are the remaining clauses to try for the call with
+	// the given actuals, and `cont` is the continuation of the call.  Otherwise `cont` is the
+	// alternative to resume with.
+	actuals []ValueTerm
+	clauses []*rule
+
+	// If not nil then this is the choicepoint of a foreign predicate, which is retried with its
+	// next solution, see api.go.
+	foreign *foreignCall
+
+	// If not nil then this is the choicepoint of '$clause', which is retried with the next
+	// clause, see database.go.
+	scan *clauseScan
+
+	// If not nil then this is the choicepoint of catch/3, which just fails when it is
+	// backtracked into, see control.go.
+	catch *catchFrame
+
+	// If not nil then this choicepoint reports Redo, if `redo` is set, or Fail for a traced
+	// call when it is backtracked into, and then fails, see trace.go.
+	trace *traceCall
+	redo  bool
+
+	// If not nil then this is the choicepoint of a call that consumes the answers of an
+	// incomplete table, which is retried with the next answer, see tabling.go.
+	consumer *consumer
+}
+
+type machine struct {
+	st    *Store
+	cont  *frame
+	chps  []choicepoint
+	trail []*Varslot
+
+	// The context module of the goal that is being solved, see module.go.
+	module *module
+
+	// True once the machine has been run and produced a solution, so that the next run must
+	// begin by backtracking into the last choicepoint.
+	started bool
+
+	// Resource accounting, see limits.go.
+	ctx        context.Context
+	limits     Limits
+	inferences int64
+	allocated  int64
+
+	// The limit that has been hit, if not empty, and the number of inferences at which the
+	// recovery from it runs out.
+	exhausted   string
+	recoveryEnd int64
+
+	// Solutions collected by findall/3, see solutions.go.
+	bags     map[int64][]copiedTerm
+	bagCount int64
+
+	// Attributed variables that have been bound and whose hooks have not yet been run, see
+	// attvar.go.
+	wakeups []wakeup
+
+	// The table whose clauses the machine evaluates, if any, see tabling.go.
+	owner *table
+
+	// The registers and heap of the virtual machine, and the keys of the arguments of the call
+	// being indexed, see vm.go.
+	regs []ValueTerm
+	heap rib
+	keys []interface{}
+}
+
+func (st *Store) newMachine(md *module, goals []RuleTerm, env rib) *machine {
+	m := &machine{
+		st:     st,
+		chps:   make([]choicepoint, 0, 16),
+		trail:  make([]*Varslot, 0, 64),
+		module: md,
+		limits: st.limits,
+	}
+	if len(goals) > 0 {
+		m.cont = &frame{goals: goals, env: env, cutB: 0, module: md, next: nil}
+	}
+	return m
+}
+
+// Run the machine until it finds a solution, returning true, or until it runs out of
+// alternatives, returning false.  If it finds a solution then running it again resumes the
+// search for the next solution.
+
+func (m *machine) run() bool {
+	resume := m.started
+	m.started = true
+	for {
+		if done, found := m.runUntilException(resume); done {
+			return found
+		}
+		resume = false
+	}
+}
+
+// Run the machine, returning (true, found) when it finds a solution or runs out of alternatives.
+// If an exception is raised and caught then returns (false, _) to be called again, see errors.go;
+// an exception that is not caught is raised again.
+
+func (m *machine) runUntilException(resume bool) (done bool, found bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			e, ok := x.(*Exception)
+			if !ok || !m.handleException(e) {
+				panic(x)
+			}
+			done = false
+		}
+	}()
+	if resume && !m.backtrack() {
+		return true, false
+	}
+	for {
+		if len(m.wakeups) > 0 {
+			m.wake()
+		}
+		if m.cont == nil {
+			break
+		}
+		f := m.cont
+		if f.exit != nil {
+			m.cont = f.next
+			m.traceExit(f.exit)
+			continue
+		}
+		if f.code != nil {
+			m.cont = f.next
+			m.module = f.module
+			m.restoreRegisters(f)
+			if !m.runCode(f.code, f.pc, f.env, f.cutB) && !m.backtrack() {
+				return true, false
+			}
+			continue
+		}
+		if len(f.goals) == 1 {
+			m.cont = f.next
+		} else {
+			m.cont = &frame{goals: f.goals[1:], env: f.env, cutB: f.cutB, module: f.module, next: f.next}
+		}
+		m.module = f.module
+		if !m.solve(f.goals[0], f.env, f.cutB) && !m.backtrack() {
+			return true, false
+		}
+	}
+	return true, true
+}
+
+// Resume with the most recent choicepoint, returning false if there is none.
+
+func (m *machine) backtrack() bool {
+	for len(m.chps) > 0 {
+		top := len(m.chps) - 1
+		cp := m.chps[top]
+		m.undoTrail(cp.trailMark)
+		m.allocated = cp.allocMark
+		m.module = cp.module
+		if cp.foreign != nil {
+			if m.retryForeign(top) {
+				m.cont = cp.cont
+				return true
+			}
+			continue
+		}
+		if cp.scan != nil {
+			if m.retryClause(top) {
+				m.cont = cp.cont
+				return true
+			}
+			continue
+		}
+		if cp.consumer != nil {
+			if m.retryConsumer(top) {
+				m.cont = cp.cont
+				return true
+			}
+			continue
+		}
+		if cp.catch != nil {
+			m.cutTo(top)
+			continue
+		}
+		if cp.trace != nil {
+			m.cutTo(top)
+			if cp.redo {
+				m.port(RedoPort, cp.trace)
+			} else {
+				m.port(FailPort, cp.trace)
+			}
+			continue
+		}
+		if len(cp.clauses) > 0 {
+			if m.tryClauses(cp.actuals, cp.clauses, cp.cont, top) {
+				return true
+			}
+			continue
+		}
+		m.cutTo(top)
+		m.cont = cp.cont
+		return true
+	}
+	m.wakeups = m.wakeups[:0]
+	return false
+}
+
+// A choicepoint that resumes with `cont`.
+
+func (m *machine) choicepoint(cont *frame) choicepoint {
+	return choicepoint{trailMark: len(m.trail), allocMark: m.allocated, cont: cont, module: m.module}
+}
+
+// Abandon the search, undoing all bindings.
+
+func (m *machine) reset() {
+	m.cutTo(0)
+	m.undoTrail(0)
+	m.cont = nil
+}
+
+func (m *machine) cutTo(height int) {
+	for i := height; i < len(m.chps); i++ {
+		if m.chps[i].foreign != nil {
+			m.chps[i].foreign.stop()
+		}
+		m.chps[i] = choicepoint{}
+	}
+	m.chps = m.chps[:height]
+}
+
+// Binding or linking a variable that has attributes schedules its hooks to run before the next
+// goal, see attvar.go.
+
+func (m *machine) bindVar(v *Varslot, val ValueTerm) {
+	assert(v.next == nil && v.val == nil)
+	if v.attrs != nil {
+		m.wakeups = append(m.wakeups, wakeup{v, val, len(m.trail)})
+	}
+	v.val = val
+	m.trail = append(m.trail, v)
+}
+
+func (m *machine) linkVar(v *Varslot, to *Varslot) {
+	assert(v.next == nil && v.val == nil)
+	if v.attrs != nil {
+		m.wakeups = append(m.wakeups, wakeup{v, to, len(m.trail)})
+	}
+	v.next = to
+	m.trail = append(m.trail, v)
+}
+
+func (m *machine) undoTrail(mark int) {
+	for i := len(m.trail) - 1; i >= mark; i-- {
+		v := m.trail[i]
+		v.next = nil
+		v.val = nil
+		m.trail[i] = nil
+	}
+	m.trail = m.trail[:mark]
+	// The hooks of bindings that have been undone must not run
+	for len(m.wakeups) > 0 && m.wakeups[len(m.wakeups)-1].mark >= mark {
+		m.wakeups = m.wakeups[:len(m.wakeups)-1]
+	}
+}
@@ -0,0 +1,230 @@
+package engine
+
+import (
+	"path/filepath"
+)
+
+// Modules.  Every predicate belongs to a module.  The library is the module `system`, and a
+// program is in the module `user` unless it says otherwise.  A file that begins with
+//
+//   :- module(Name, Exports).
+//
+// defines the module Name: the clauses that follow are added to it, and its directives and
+// queries run in it.  Exports is a list of Name/Arity, Name//Arity for a grammar rule, and
+// op(Priority, Type, Name), which is defined when the file is loaded.  When the file has been
+// loaded the exported predicates are imported into the module that loaded it, with consult/1 or
+// use_module/1; use_module/1 loads a file only once, and imports it again if it is used from
+// another module.  A clause `Module:Head :- Body` is added to Module.
+//
+// Every goal is called in a context module.  A goal in the body of a clause runs in the module
+// of the clause, and Module:Goal runs Goal in Module.  A predicate is looked up among the
+// built-ins, then in `system`, then in the context module, then among the predicates it has
+// imported, and then, if the context is another module, in `user`.  The predicates of the
+// library therefore cannot be redefined, and the predicates of a module that are not exported
+// can only be called from outside it as Module:Goal.
+//
+// The predicates of `system` run in the context module of their caller rather than in
+// `system`, so that the goals they call, as findall/3 and call/N do, are looked up where the
+// caller would look them up.  The database predicates and the declarations, assert/1, dynamic/1,
+// table/1 and the others, work on the context module, or on Module if their argument is
+// Module:Term.
+//
+// The context module is kept in the frames of the continuation and in the choicepoints, and
+// `m.module` is that of the goal being solved.
+
+type module struct {
+	name *Atom
+
+	// The predicates of the module, indexed like the built-ins.
+	rules map[*Atom]map[int]*predicate
+
+	// The exported predicates, and the imported predicates with the modules that export them.
+	exports map[predicateKey]bool
+	imports map[predicateKey]*module
+}
+
+// The module with the name, which is created if it does not exist.
+
+func (st *Store) module(name *Atom) *module {
+	md, ok := st.modules[name]
+	if !ok {
+		md = &module{name: name, rules: make(map[*Atom]map[int]*predicate),
+			exports: make(map[predicateKey]bool), imports: make(map[predicateKey]*module)}
+		st.modules[name] = md
+	}
+	return md
+}
+
+// The predicate, which is created with no clauses if it does not exist.
+
+func (md *module) predicate(functor *Atom, arity int) *predicate {
+	functorMap, ok := md.rules[functor]
+	if !ok {
+		functorMap = make(map[int]*predicate)
+		md.rules[functor] = functorMap
+	}
+	p, ok := functorMap[arity]
+	if !ok {
+		p = &predicate{clauses: []*rule{}, module: md}
+		functorMap[arity] = p
+	}
+	return p
+}
+
+// The predicate of the module, or nil if it does not exist.
+
+func (md *module) lookup(functor *Atom, arity int) *predicate {
+	return md.rules[functor][arity]
+}
+
+// The predicate that a call in the context module refers to, or nil if there is none.
+
+func (st *Store) lookupPredicate(md *module, functor *Atom, arity int) *predicate {
+	if p := st.systemModule.lookup(functor, arity); p != nil {
+		return p
+	}
+	if p := md.lookup(functor, arity); p != nil {
+		return p
+	}
+	if from, ok := md.imports[predicateKey{functor, arity}]; ok {
+		if p := from.lookup(functor, arity); p != nil {
+			return p
+		}
+	}
+	if md != st.userModule {
+		return st.userModule.lookup(functor, arity)
+	}
+	return nil
+}
+
+// The indicator of a predicate for error messages, qualified unless it is in `user`.
+
+func (st *Store) qualifiedIndicator(md *module, functor *Atom, arity int) ValueTerm {
+	pi := st.indicator(functor, arity)
+	if md == st.userModule {
+		return pi
+	}
+	return newValueStruct(st.colonAtom, []ValueTerm{md.name, pi})
+}
+
+// Strip the module qualifications from `t`, returning the innermost module, or `md` if there is
+// none, and the unqualified term.
+
+func (st *Store) stripModule(md *module, t ValueTerm) (*module, ValueTerm) {
+	for {
+		s, ok := deref(t).(*ValueStruct)
+		if !ok || s.s.functor != st.colonAtom || len(s.s.subterms) != 2 {
+			return md, deref(t)
+		}
+		switch name := deref(bind(s.s.subterms[0], s.env)).(type) {
+		case *Varslot:
+			st.instantiationError()
+		case *Atom:
+			md = st.module(name)
+		default:
+			st.typeError("module", name)
+		}
+		t = bind(s.s.subterms[1], s.env)
+	}
+}
+
+// Import the exports of `from` into `md`.  Returns false and the predicate if it is already
+// imported from another module.
+
+func (st *Store) importModule(md *module, from *module) (predicateKey, bool) {
+	if md == from {
+		return predicateKey{}, true
+	}
+	for key := range from.exports {
+		if other, ok := md.imports[key]; ok && other != from {
+			return key, false
+		}
+	}
+	for key := range from.exports {
+		md.imports[key] = from
+	}
+	return predicateKey{}, true
+}
+
+// The exports of `:- module(Name, Exports)`.
+
+func (st *Store) declareExports(md *module, exports ValueTerm) {
+	elements, ok := st.listElements(exports)
+	if !ok {
+		st.typeError("list", exports)
+	}
+	for _, e := range elements {
+		if s, ok := deref(e).(*ValueStruct); ok && s.s.functor.name == "op" && len(s.s.subterms) == 3 {
+			st.defineOp(bind_terms(s.s.subterms, s.env))
+			continue
+		}
+		if s, ok := deref(e).(*ValueStruct); ok && s.s.functor.name == "//" && len(s.s.subterms) == 2 {
+			functor, arity := st.predicateIndicator(newValueStruct(st.NewAtom("/"),
+				bind_terms(s.s.subterms, s.env)))
+			md.exports[predicateKey{functor, arity + 2}] = true
+			continue
+		}
+		functor, arity := st.predicateIndicator(e)
+		md.exports[predicateKey{functor, arity}] = true
+	}
+}
+
+func (st *Store) initModuleBuiltins() {
+	st.addBuiltin("use_module", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.useModule(m.module, args[0])
+		return true
+	})
+	// '$module'(Name, Exports) creates the module for the directive module/2, see load.go.
+	st.addBuiltin("$module", 2, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		switch name := deref(args[0]).(type) {
+		case *Varslot:
+			st.instantiationError()
+		case *Atom:
+			st.declareExports(st.module(name), args[1])
+		default:
+			st.typeError("atom", name)
+		}
+		return true
+	})
+	st.addBuiltin("module", 2, func(m *machine, args []ValueTerm) bool {
+		// A module can only be declared by a directive in the file that defines it, see load.go
+		m.st.permissionError("create", "module", deref(args[0]))
+		return false
+	})
+	// '$modules'(Names) unifies Names with the names of the modules, in no particular order.
+	st.addBuiltin("$modules", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		names := []ValueTerm{}
+		for name := range st.modules {
+			names = append(names, name)
+		}
+		return m.unify(args[0], st.newList(names, st.nilAtom))
+	})
+}
+
+// Load a file for use_module/1 unless it has been loaded already, and import its exports into
+// `md`.
+
+func (st *Store) useModule(md *module, file ValueTerm) {
+	name, ok := deref(file).(*Atom)
+	if !ok {
+		if _, isVar := deref(file).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		st.typeError("atom", deref(file))
+	}
+	for _, filename := range []string{name.name, name.name + ".pl"} {
+		path, err := filepath.Abs(st.resolveFile(filename))
+		if err != nil {
+			continue
+		}
+		if from, ok := st.moduleFiles[path]; ok {
+			if key, ok := st.importModule(md, from); !ok {
+				st.permissionError("import", "procedure", st.qualifiedIndicator(from, key.functor, key.arity))
+			}
+			return
+		}
+	}
+	st.consult(md, file)
+}
@@ -0,0 +1,185 @@
+package engine
+
+// The operator table.  Every store has its own table, initialized with the standard operators
+// and extended by op/3.
+//
+// An operator has a priority between 1 and 1200 and a type that gives its position and
+// associativity: `xfx`, `xfy` and `yfx` are infix, `fy` and `fx` are prefix, and `xf` and `yf`
+// are postfix.  An `x` argument must have strictly lower priority than the operator and a `y`
+// argument may have equal priority.  A name can be both a prefix operator and an infix or
+// postfix operator, but not both infix and postfix.
+
+type operator struct {
+	priority int
+	typ      string
+}
+
+type opTable struct {
+	prefix  map[string]operator
+	infix   map[string]operator
+	postfix map[string]operator
+}
+
+func newOpTable() *opTable {
+	ops := &opTable{
+		prefix:  make(map[string]operator),
+		infix:   make(map[string]operator),
+		postfix: make(map[string]operator),
+	}
+	for _, op := range standardOperators {
+		for _, name := range op.names {
+			ops.add(op.priority, op.typ, name)
+		}
+	}
+	return ops
+}
+
+var standardOperators = []struct {
+	priority int
+	typ      string
+	names    []string
+}{
+	{1200, "xfx", []string{":-", "-->"}},
+	{1200, "fx", []string{":-", "?-"}},
+	{1150, "fx", []string{"dynamic", "discontiguous", "initialization", "multifile", "persistent", "table"}},
+	{1100, "xfy", []string{";", "|"}},
+	{1050, "xfy", []string{"->", "*->"}},
+	{1000, "xfy", []string{","}},
+	{900, "fy", []string{"\\+"}},
+	{700, "xfx", []string{"=", "\\=", "==", "\\==", "@<", "@>", "@=<", "@>=", "=..", "is",
+		"=:=", "=\\=", "<", ">", "=<", ">=", "=@=", "\\=@="}},
+	{600, "xfy", []string{":"}},
+	{500, "yfx", []string{"+", "-", "/\\", "\\/", "xor"}},
+	{400, "yfx", []string{"*", "/", "//", "rem", "mod", "div", "<<", ">>"}},
+	{200, "xfx", []string{"**"}},
+	{200, "xfy", []string{"^"}},
+	{200, "fy", []string{"-", "+", "\\"}},
+}
+
+// Add an operator, or remove it if the priority is zero.  The caller has validated the
+// arguments.
+
+func (ops *opTable) add(priority int, typ string, name string) {
+	var table map[string]operator
+	switch typ {
+	case "fy", "fx":
+		table = ops.prefix
+	case "xfx", "xfy", "yfx":
+		table = ops.infix
+	default:
+		table = ops.postfix
+	}
+	if priority == 0 {
+		delete(table, name)
+	} else {
+		table[name] = operator{priority, typ}
+	}
+}
+
+// The maximum priorities of the left and right arguments of an operator.
+
+func (op operator) argPriorities() (left int, right int) {
+	left, right = op.priority-1, op.priority-1
+	switch op.typ {
+	case "yfx", "yf":
+		left = op.priority
+	case "xfy", "fy":
+		right = op.priority
+	}
+	return
+}
+
+// op(Priority, Type, Names) where Names is an atom or a list of atoms.
+
+func (st *Store) initOpBuiltins() {
+	st.addBuiltin("op", 3, func(m *machine, args []ValueTerm) bool {
+		m.st.defineOp(args)
+		return true
+	})
+	st.addBuiltin("$current_ops", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		ops := make([]ValueTerm, 0, 64)
+		for _, table := range []map[string]operator{st.ops.prefix, st.ops.infix, st.ops.postfix} {
+			for name, op := range table {
+				ops = append(ops, newValueStruct(st.NewAtom("op"), []ValueTerm{
+					st.NewNumber(int64(op.priority)), st.NewAtom(op.typ), st.NewAtom(name)}))
+			}
+		}
+		return m.unify(args[0], st.newList(ops, st.nilAtom))
+	})
+}
+
+// Define the operators of op/3, given its arguments.
+
+func (st *Store) defineOp(args []ValueTerm) {
+	priority, typ := deref(args[0]), deref(args[1])
+	if _, ok := priority.(*Varslot); ok {
+		st.instantiationError()
+	}
+	if _, ok := typ.(*Varslot); ok {
+		st.instantiationError()
+	}
+	p, ok := priority.(*Number)
+	if !ok {
+		st.typeError("integer", priority)
+	}
+	if p.big != nil || p.value < 0 || p.value > 1200 {
+		st.domainError("operator_priority", priority)
+	}
+	t, ok := typ.(*Atom)
+	if !ok {
+		st.typeError("atom", typ)
+	}
+	switch t.name {
+	case "xfx", "xfy", "yfx", "fy", "fx", "xf", "yf":
+	default:
+		st.domainError("operator_specifier", typ)
+	}
+	infix := len(t.name) == 3
+	postfix := t.name == "xf" || t.name == "yf"
+	for _, name := range st.opNames(args[2]) {
+		if name.name == "," {
+			st.permissionError("modify", "operator", name)
+		}
+		if name.name == "|" && (!infix || p.value > 0 && p.value < 1001) {
+			st.permissionError("create", "operator", name)
+		}
+		_, isInfix := st.ops.infix[name.name]
+		_, isPostfix := st.ops.postfix[name.name]
+		if p.value > 0 && (infix && isPostfix || postfix && isInfix) {
+			st.permissionError("create", "operator", name)
+		}
+		st.ops.add(int(p.value), t.name, name.name)
+	}
+}
+
+func (st *Store) opNames(t ValueTerm) []*Atom {
+	names := make([]*Atom, 0, 1)
+	switch x := deref(t).(type) {
+	case *Varslot:
+		st.instantiationError()
+	case *Atom:
+		if x != st.nilAtom {
+			names = append(names, x)
+		}
+	case *ValueStruct:
+		for t := ValueTerm(x); ; {
+			cell, ok := deref(t).(*ValueStruct)
+			if !ok || !isListFunctor(cell.s.functor, len(cell.s.subterms)) {
+				if deref(t) != ValueTerm(st.nilAtom) {
+					st.typeError("list", x)
+				}
+				break
+			}
+			name, ok := deref(bind(cell.s.subterms[0], cell.env)).(*Atom)
+			if !ok {
+				st.typeError("atom", deref(bind(cell.s.subterms[0], cell.env)))
+			}
+			names = append(names, name)
+			t = bind(cell.s.subterms[1], cell.env)
+		}
+	default:
+		st.typeError("list", x)
+	}
+	return names
+}
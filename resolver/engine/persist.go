@@ -0,0 +1,524 @@
+package engine
+
+import (
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Persistent predicates.  A predicate that is declared with `:- persistent Name/Arity.` keeps its
+// clauses in the database of the store, an on-disk key-value store opened with OpenDatabase, see
+// kvstore.go, so that they survive the process.  Clauses that are added to the predicate, by
+// assert or by loading a program, are written to the database and synced before the call
+// returns, and clauses that are retracted are deleted from it.  abolish/1 deletes them all.
+//
+// A program that declares a persistent predicate usually has clauses for it that seed the
+// database, and it is loaded again on every start.  A clause of a program is added only the first
+// time it is loaded: a marker with the text of the clause is written with it, and a clause with a
+// marker is not added again, even if it has been retracted since.  The markers count the clauses
+// with the same text, so that a program may repeat a clause.
+//
+// The clauses are read lazily.  A call reads the clauses that may match it through an index on
+// the first argument, which is the order of the keys in the database:
+//
+//   c <predicate> <key of the first argument> <sequence number>    a clause
+//   p <predicate>                                                  the sequence numbers in use
+//   l <predicate> <clause> <count>                                 a clause that has been loaded
+//
+// where the key of a variable is `v`, and the clauses for a key are those with the key and those
+// with `v`.  The sequence numbers order the clauses: asserta/1 numbers a clause below the others
+// and assertz/1 above them.  They are never used again, not even after abolish/1, and the
+// sequence number of a clause is its reference for retract/1 and clause/2, see database.go.
+//
+// Only some of the clauses are kept in memory.  The clauses that have been read for a key are
+// cached until the predicate changes, like the indexes of other predicates, see index.go, but
+// the cache holds at most persistCacheSize clauses and the keys that were used least recently
+// are evicted to make room.  A call with an unbound first argument reads all the clauses from the
+// table and does not cache them, so they are dropped when the call is done.
+
+type persistence struct {
+	st *Store
+	db *kvStore
+
+	// The predicate, and its name in the keys, Module:Name/Arity.
+	module  *module
+	functor *Atom
+	name    string
+
+	// The lowest and the highest sequence number that have been used.
+	first, last int64
+
+	// The clauses that have been read for calls by the key of the first argument, most recently
+	// used first, and the number of clauses in them.
+	buckets map[string]*list.Element
+	lru     list.List
+	cached  int
+}
+
+// The most clauses of a predicate that are kept in memory.
+
+const persistCacheSize = 4096
+
+type cachedBucket struct {
+	key     string
+	clauses []*rule
+}
+
+func (st *Store) initPersistentBuiltins() {
+	st.addBuiltin("persistent", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		st.forEachIndicator(m.module, args[0], func(md *module, functor *Atom, arity int) {
+			if st.isStatic(md, functor, arity) {
+				st.permissionError("modify", "static_procedure", st.indicator(functor, arity))
+			}
+			p := md.predicate(functor, arity)
+			if p.persistent != nil {
+				return
+			}
+			if st.database == nil {
+				st.existenceError("database", st.indicator(functor, arity))
+			}
+			if len(p.clauses) > 0 {
+				st.permissionError("modify", "procedure", st.indicator(functor, arity))
+			}
+			ps := &persistence{st: st, db: st.database, module: md, functor: functor,
+				name:    md.name.name + ":" + functor.name + "/" + strconv.Itoa(arity),
+				buckets: make(map[string]*list.Element)}
+			value, err := ps.db.get(kvKey("p", ps.name))
+			ps.check(err)
+			ps.first, ps.last = 1, 0
+			if value != nil {
+				r := bytes.NewReader(value)
+				first, err1 := binary.ReadVarint(r)
+				last, err2 := binary.ReadVarint(r)
+				ps.check(err1)
+				ps.check(err2)
+				ps.first, ps.last = first, last
+			}
+			p.persistent = ps
+		})
+		return true
+	})
+}
+
+// Open the database of persistent predicates, a file that is created if it does not exist, and
+// the log next to it with ".wal" added to the name.  An open database is closed first.
+
+func (st *Store) OpenDatabase(path string) error {
+	if err := st.CloseDatabase(); err != nil {
+		return err
+	}
+	db, err := openKVStore(path)
+	if err != nil {
+		return err
+	}
+	st.database = db
+	return nil
+}
+
+// Close the database, writing the log into the table.  Persistent predicates cannot be used
+// after this.
+
+func (st *Store) CloseDatabase() error {
+	if st.database == nil {
+		return nil
+	}
+	err := st.database.close()
+	st.database = nil
+	return err
+}
+
+// Raise a system error for an error of the database.
+
+func (ps *persistence) check(err error) {
+	if err != nil {
+		st := ps.st
+		st.raise(newValueStruct(st.NewAtom("system_error"), []ValueTerm{
+			st.NewAtom(fmt.Sprintf("database: %s: %v", ps.name, err))}))
+	}
+}
+
+// Write the rule to the database as the last clause, or the first.
+
+func (ps *persistence) add(r *rule, first bool) {
+	ps.check(ps.write(r, first))
+}
+
+// Write the `n`th occurrence of a clause of a program that is being loaded as the last clause,
+// unless it has been loaded before.  Returns false if it has.
+
+func (ps *persistence) seed(r *rule, n int) (bool, error) {
+	marker := kvKey("l", ps.name, string(encodeRule(r))) + strconv.Itoa(n)
+	value, err := ps.db.get(marker)
+	if err != nil || value != nil {
+		return false, err
+	}
+	return true, ps.write(r, false, kvOp{marker, []byte{}})
+}
+
+// Write the rule and the other operations in one batch.  If the batch takes effect then the
+// sequence numbers advance even if the checkpoint that follows it fails, since the rule has been
+// stored under its number.
+
+func (ps *persistence) write(r *rule, first bool, ops ...kvOp) error {
+	seq := ps.last + 1
+	if first {
+		seq = ps.first - 1
+	}
+	lo, hi := min(ps.first, seq), max(ps.last, seq)
+	ops = append(ops, kvOp{ps.ruleKey(r, seq), encodeRule(r)}, kvOp{kvKey("p", ps.name), encodeSeqs(lo, hi)})
+	checkpointErr, err := ps.db.write(ops)
+	if err != nil {
+		return err
+	}
+	ps.first, ps.last = lo, hi
+	r.id = seq
+	if first {
+		ps.clearCache()
+		return checkpointErr
+	}
+	// The clause goes last, so it can be added to the clauses that have been read
+	if k := ps.argKey(r); k != "v" {
+		if e, ok := ps.buckets[k]; ok {
+			ps.addToBucket(e, r)
+		}
+	} else {
+		for _, e := range ps.buckets {
+			ps.addToBucket(e, r)
+		}
+	}
+	ps.evict()
+	return checkpointErr
+}
+
+func encodeSeqs(first, last int64) []byte {
+	var meta []byte
+	meta = binary.AppendVarint(meta, first)
+	return binary.AppendVarint(meta, last)
+}
+
+// Delete the clause with the reference from the database, returning false if there is none.  The
+// clause has been unified with `head`, so its key is that of the first argument of `head` or `v`.
+
+func (ps *persistence) remove(ref int64, head []ValueTerm) bool {
+	keys := []string{"v"}
+	if len(head) > 0 {
+		if key, ok := valueKey(head[0]); ok {
+			keys = append(keys, diskKey(key))
+		}
+	}
+	for _, k := range keys {
+		key := kvKey("c", ps.name, k) + seqText(ref)
+		value, err := ps.db.get(key)
+		ps.check(err)
+		if value != nil {
+			checkpointErr, err := ps.db.write([]kvOp{{key, nil}})
+			ps.check(err)
+			ps.clearCache()
+			ps.check(checkpointErr)
+			return true
+		}
+	}
+	return false
+}
+
+// Delete all the clauses, and the markers of the loaded clauses.  The sequence numbers are kept,
+// so that they are not used again.
+
+func (ps *persistence) abolish() {
+	var ops []kvOp
+	for _, prefix := range []string{kvKey("c", ps.name), kvKey("l", ps.name)} {
+		ps.check(ps.db.scan(prefix, func(key string, value []byte) bool {
+			ops = append(ops, kvOp{key, nil})
+			return true
+		}))
+	}
+	checkpointErr, err := ps.db.write(ops)
+	ps.check(err)
+	ps.clearCache()
+	ps.check(checkpointErr)
+}
+
+// The clauses that may match the actuals.
+
+func (ps *persistence) candidates(actuals []ValueTerm) []*rule {
+	if len(actuals) == 0 {
+		return ps.read(kvKey("c", ps.name))
+	}
+	key, ok := valueKey(actuals[0])
+	if !ok {
+		return ps.read(kvKey("c", ps.name))
+	}
+	k := diskKey(key)
+	if e, ok := ps.buckets[k]; ok {
+		ps.lru.MoveToFront(e)
+		return e.Value.(*cachedBucket).clauses
+	}
+	bucket := ps.read(kvKey("c", ps.name, k), kvKey("c", ps.name, "v"))
+	if len(bucket) <= persistCacheSize {
+		ps.buckets[k] = ps.lru.PushFront(&cachedBucket{k, bucket})
+		ps.cached += len(bucket)
+		ps.evict()
+	}
+	return bucket
+}
+
+func (ps *persistence) addToBucket(e *list.Element, r *rule) {
+	b := e.Value.(*cachedBucket)
+	b.clauses = append(b.clauses, r)
+	ps.cached++
+}
+
+// Evict the buckets that were used least recently until the cache is within its size.
+
+func (ps *persistence) evict() {
+	for ps.cached > persistCacheSize {
+		b := ps.lru.Remove(ps.lru.Back()).(*cachedBucket)
+		delete(ps.buckets, b.key)
+		ps.cached -= len(b.clauses)
+	}
+}
+
+func (ps *persistence) clearCache() {
+	ps.buckets = make(map[string]*list.Element)
+	ps.lru.Init()
+	ps.cached = 0
+}
+
+// Read the clauses whose keys start with the prefixes, in order.
+
+func (ps *persistence) read(prefixes ...string) []*rule {
+	var rules []*rule
+	for _, prefix := range prefixes {
+		var err error
+		ps.check(ps.db.scan(prefix, func(key string, value []byte) bool {
+			var r *rule
+			if r, err = ps.decodeRule(value); err != nil {
+				return false
+			}
+			if r.id, err = parseSeq(key); err != nil {
+				return false
+			}
+			rules = append(rules, r)
+			return true
+		}))
+		ps.check(err)
+	}
+	sort.Slice(rules, func(i, j int) bool { return rules[i].id < rules[j].id })
+	return rules
+}
+
+// The key of a clause.
+
+func (ps *persistence) ruleKey(r *rule, seq int64) string {
+	return kvKey("c", ps.name, ps.argKey(r)) + seqText(seq)
+}
+
+func seqText(seq int64) string {
+	// The sign bit is flipped so that the keys of negative numbers sort first
+	return fmt.Sprintf("%016x", uint64(seq)^1<<63)
+}
+
+func parseSeq(key string) (int64, error) {
+	if len(key) < 16 {
+		return 0, fmt.Errorf("bad key %q", key)
+	}
+	n, err := strconv.ParseUint(key[len(key)-16:], 16, 64)
+	return int64(n ^ 1<<63), err
+}
+
+// The key of the first argument of the clause.
+
+func (ps *persistence) argKey(r *rule) string {
+	if r.arity == 0 {
+		return "v"
+	}
+	key, ok := ruleKey(r.formals[0])
+	if !ok {
+		return "v"
+	}
+	return diskKey(key)
+}
+
+// The index key of a term, see index.go, as text.
+
+func diskKey(key interface{}) string {
+	switch k := key.(type) {
+	case *Atom:
+		return "a" + k.name
+	case int64:
+		return "i" + strconv.FormatInt(k, 10)
+	case bigKey:
+		return "i" + string(k)
+	case float64:
+		if k == 0 {
+			// -0.0 and 0.0 are the same key
+			k = 0
+		}
+		return "f" + strconv.FormatFloat(k, 'g', -1, 64)
+	case stringKey:
+		return "s" + string(k)
+	case predicateKey:
+		return "t" + strconv.Itoa(k.arity) + "/" + k.functor.name
+	}
+	panic("Unknown key")
+}
+
+// A key made of the parts, each preceded by its length, so that no key of some parts is a prefix
+// of the key of other parts.
+
+func kvKey(parts ...string) string {
+	var b strings.Builder
+	for _, p := range parts {
+		b.WriteString(strconv.Itoa(len(p)) + ":" + p)
+	}
+	return b.String()
+}
+
+// A clause is written as the number of its locals, its formals and its body goals, each list
+// preceded by its length.  A term is a tag byte and its contents:
+//
+//   v slot    a local
+//   a name    an atom
+//   i n       an integer that fits in 64 bits
+//   b digits  another integer
+//   f bits    a float
+//   s text    a string
+//   c name n  a structure with n subterms, which follow
+
+func encodeRule(r *rule) []byte {
+	var b bytes.Buffer
+	writeUvarint(&b, uint64(r.locals))
+	encodeTerms(&b, r.formals)
+	encodeTerms(&b, r.body)
+	return b.Bytes()
+}
+
+func encodeTerms(b *bytes.Buffer, ts []RuleTerm) {
+	writeUvarint(b, uint64(len(ts)))
+	for _, t := range ts {
+		encodeTerm(b, t)
+	}
+}
+
+func encodeTerm(b *bytes.Buffer, t RuleTerm) {
+	switch x := t.(type) {
+	case *Local:
+		b.WriteByte('v')
+		writeUvarint(b, uint64(x.slot))
+	case *Atom:
+		b.WriteByte('a')
+		writeKVBytes(b, []byte(x.name))
+	case *Number:
+		if x.big != nil {
+			b.WriteByte('b')
+			writeKVBytes(b, []byte(x.big.String()))
+		} else {
+			b.WriteByte('i')
+			b.Write(binary.AppendVarint(nil, x.value))
+		}
+	case *Float:
+		b.WriteByte('f')
+		b.Write(binary.BigEndian.AppendUint64(nil, math.Float64bits(x.value)))
+	case *String:
+		b.WriteByte('s')
+		writeKVBytes(b, []byte(x.value))
+	case *RuleStruct:
+		b.WriteByte('c')
+		writeKVBytes(b, []byte(x.functor.name))
+		encodeTerms(b, x.subterms)
+	default:
+		panic("Unknown term")
+	}
+}
+
+func (ps *persistence) decodeRule(value []byte) (*rule, error) {
+	r := bytes.NewReader(value)
+	locals, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	formals, err := ps.decodeTerms(r)
+	if err != nil {
+		return nil, err
+	}
+	body, err := ps.decodeTerms(r)
+	if err != nil {
+		return nil, err
+	}
+	return &rule{module: ps.module, locals: int(locals), arity: len(formals), functor: ps.functor,
+		formals: formals, body: body}, nil
+}
+
+func (ps *persistence) decodeTerms(r *bytes.Reader) ([]RuleTerm, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil {
+		return nil, err
+	}
+	if n > uint64(r.Len()) {
+		return nil, io.ErrUnexpectedEOF
+	}
+	ts := make([]RuleTerm, n)
+	for i := range ts {
+		if ts[i], err = ps.decodeTerm(r); err != nil {
+			return nil, err
+		}
+	}
+	return ts, nil
+}
+
+func (ps *persistence) decodeTerm(r *bytes.Reader) (RuleTerm, error) {
+	st := ps.st
+	tag, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	switch tag {
+	case 'v':
+		slot, err := binary.ReadUvarint(r)
+		return st.NewLocal(int(slot)), err
+	case 'a':
+		name, err := readKVString(r)
+		return st.NewAtom(name), err
+	case 'i':
+		n, err := binary.ReadVarint(r)
+		return st.NewNumber(n), err
+	case 'b':
+		digits, err := readKVString(r)
+		if err != nil {
+			return nil, err
+		}
+		n, ok := new(big.Int).SetString(digits, 10)
+		if !ok {
+			return nil, fmt.Errorf("bad integer %q", digits)
+		}
+		return st.NewBigNumber(n), nil
+	case 'f':
+		var bits [8]byte
+		if _, err := io.ReadFull(r, bits[:]); err != nil {
+			return nil, err
+		}
+		return st.NewFloat(math.Float64frombits(binary.BigEndian.Uint64(bits[:]))), nil
+	case 's':
+		text, err := readKVString(r)
+		return st.NewString(text), err
+	case 'c':
+		name, err := readKVString(r)
+		if err != nil {
+			return nil, err
+		}
+		subterms, err := ps.decodeTerms(r)
+		if err != nil {
+			return nil, err
+		}
+		return st.NewStruct(st.NewAtom(name), subterms), nil
+	}
+	return nil, fmt.Errorf("bad term tag %q", tag)
+}
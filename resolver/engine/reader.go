@@ -0,0 +1,426 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// Reading terms.
+//
+// Terms are read by an operator precedence parser driven by the operator table of the store.
+// `parse(max)` reads a term whose priority is at most `max` and returns it with its priority:
+// it reads a primary term, which may be a prefix operator application, and then extends it to
+// the left with infix and postfix operators for as long as their priorities allow.  A comma is
+// the operator ','/2 except in argument lists and lists, where arguments are read at priority
+// 999, and a bar is the operator ';'/2 except in lists.
+//
+// The reader produces rule terms in which variables are represented by locals, numbered in
+// order of appearance in the clause.
+
+type reader struct {
+	st *Store
+	t  *tokenizer
+
+	// One token of lookahead
+	peeked bool
+	tok    token
+
+	// The token most recently returned by next
+	last token
+
+	// The line on which the current clause starts
+	line int
+
+	// Next index for a variable in the clause
+	varIndex int
+
+	// All unique variables in the current clause.
+	vars []*Local
+
+	nameMap map[string]int
+}
+
+func newReader(st *Store, filename string, r io.RuneScanner) *reader {
+	return &reader{
+		st:       st,
+		t:        newTokenizer(filename, r),
+		varIndex: 0,
+		vars:     make([]*Local, 0),
+		nameMap:  make(map[string]int, 0),
+	}
+}
+
+func (p *reader) next() token {
+	if p.peeked {
+		p.peeked = false
+	} else {
+		p.tok = p.t.get()
+	}
+	p.last = p.tok
+	return p.tok
+}
+
+func (p *reader) peek() token {
+	if !p.peeked {
+		p.tok = p.t.get()
+		p.peeked = true
+	}
+	return p.tok
+}
+
+func (p *reader) expect(punct string) {
+	if tok := p.next(); tok.kind != tokPunct || tok.text != punct {
+		p.t.syntaxErrorAt(tok, fmt.Sprintf("expected %s, found %s", punct, describeToken(tok)))
+	}
+}
+
+func describeToken(tok token) string {
+	switch tok.kind {
+	case tokEOF:
+		return "end of file"
+	case tokEnd:
+		return "end of clause"
+	case tokString:
+		return `"` + tok.text + `"`
+	default:
+		return tok.text
+	}
+}
+
+// Read a term that is terminated by a period, returning nil at the end of the input.  After a
+// syntax error the rest of the clause is skipped, unless the error was at its end, the
+// variables are cleared, and the error is returned, so that reading can continue with the next
+// clause.
+
+func (p *reader) readClause() (t RuleTerm, err error) {
+	defer func() {
+		if x := recover(); x != nil {
+			serr, ok := x.(*SyntaxError)
+			if !ok {
+				panic(x)
+			}
+			if p.peeked || p.last.kind != tokEnd {
+				p.skipClause()
+			}
+			p.getAndClearVars()
+			t, err = nil, serr
+		}
+	}()
+	p.last = token{}
+	if p.peek().kind == tokEOF {
+		return nil, nil
+	}
+	p.line = p.t.lineno
+	t, _ = p.parse(1200)
+	if tok := p.next(); tok.kind != tokEnd {
+		p.t.syntaxErrorAt(tok, "operator expected, found "+describeToken(tok))
+	}
+	return t, nil
+}
+
+func (p *reader) skipClause() {
+	for {
+		tok, ok := p.skipToken()
+		if ok && (tok.kind == tokEnd || tok.kind == tokEOF) {
+			return
+		}
+	}
+}
+
+func (p *reader) skipToken() (tok token, ok bool) {
+	defer func() {
+		if x := recover(); x != nil {
+			if _, isSyntaxError := x.(*SyntaxError); !isSyntaxError {
+				panic(x)
+			}
+			ok = false
+		}
+	}()
+	return p.next(), true
+}
+
+func (p *reader) parse(max int) (RuleTerm, int) {
+	left, priority := p.parsePrimary(max)
+	return p.parseOperators(left, priority, max)
+}
+
+func (p *reader) parsePrimary(max int) (RuleTerm, int) {
+	tok := p.next()
+	switch tok.kind {
+	case tokNumber:
+		return p.makeNumber(tok.text), 0
+	case tokFloat:
+		return p.makeFloat(tok.text), 0
+	case tokString:
+		return p.makeString(tok.text), 0
+	case tokVar:
+		return p.makeVariable(tok.text), 0
+	case tokPunct:
+		switch tok.text {
+		case "(":
+			t, _ := p.parse(1200)
+			p.expect(")")
+			return t, 0
+		case "[":
+			if next := p.peek(); next.kind == tokPunct && next.text == "]" {
+				p.next()
+				return p.makeAtom("[]"), 0
+			}
+			return p.parseList(), 0
+		case "{":
+			if next := p.peek(); next.kind == tokPunct && next.text == "}" {
+				p.next()
+				return p.makeAtom("{}"), 0
+			}
+			t, _ := p.parse(1200)
+			p.expect("}")
+			return p.makeStruct("{}", []RuleTerm{t}), 0
+		}
+	case tokName:
+		next := p.peek()
+		if next.kind == tokPunct && next.text == "(" && !next.layout {
+			p.next()
+			return p.makeStruct(tok.text, p.parseArguments()), 0
+		}
+		if tok.text == "-" && next.kind == tokNumber && !next.layout {
+			p.next()
+			return p.makeNumber("-" + next.text), 0
+		}
+		if tok.text == "-" && next.kind == tokFloat && !next.layout {
+			p.next()
+			return p.makeFloat("-" + next.text), 0
+		}
+		if op, ok := p.st.ops.prefix[tok.text]; ok && !p.isOperand(next) {
+			priority := op.priority
+			_, right := op.argPriorities()
+			if priority > max {
+				priority, right = max, max
+			}
+			arg, _ := p.parse(right)
+			return p.makeStruct(tok.text, []RuleTerm{arg}), priority
+		}
+		return p.makeAtom(tok.text), 0
+	}
+	p.t.syntaxErrorAt(tok, "unexpected "+describeToken(tok))
+	panic("Unreachable")
+}
+
+// A prefix operator is an atom rather than an operator if it is followed by something that
+// cannot start its argument.
+
+func (p *reader) isOperand(next token) bool {
+	switch next.kind {
+	case tokEnd, tokEOF:
+		return true
+	case tokPunct:
+		return next.text != "(" && next.text != "[" && next.text != "{"
+	case tokName:
+		_, isPrefix := p.st.ops.prefix[next.text]
+		_, isInfix := p.st.ops.infix[next.text]
+		_, isPostfix := p.st.ops.postfix[next.text]
+		return (isInfix || isPostfix) && !isPrefix
+	}
+	return false
+}
+
+func (p *reader) parseOperators(left RuleTerm, priority int, max int) (RuleTerm, int) {
+	for {
+		tok := p.peek()
+		if tok.kind != tokName && !(tok.kind == tokPunct && (tok.text == "," || tok.text == "|")) {
+			return left, priority
+		}
+		if op, ok := p.st.ops.infix[tok.text]; ok {
+			leftMax, rightMax := op.argPriorities()
+			if op.priority <= max && priority <= leftMax {
+				p.next()
+				right, _ := p.parse(rightMax)
+				name := tok.text
+				if name == "|" {
+					name = ";"
+				}
+				left, priority = p.makeStruct(name, []RuleTerm{left, right}), op.priority
+				continue
+			}
+		}
+		if op, ok := p.st.ops.postfix[tok.text]; ok {
+			leftMax, _ := op.argPriorities()
+			if op.priority <= max && priority <= leftMax {
+				p.next()
+				left, priority = p.makeStruct(tok.text, []RuleTerm{left}), op.priority
+				continue
+			}
+		}
+		return left, priority
+	}
+}
+
+func (p *reader) parseArguments() []RuleTerm {
+	args := make([]RuleTerm, 0, 4)
+	for {
+		arg, _ := p.parse(999)
+		args = append(args, arg)
+		tok := p.next()
+		if tok.kind == tokPunct && tok.text == ")" {
+			return args
+		}
+		if tok.kind != tokPunct || tok.text != "," {
+			p.t.syntaxErrorAt(tok, "expected , or ) in arguments, found "+describeToken(tok))
+		}
+	}
+}
+
+func (p *reader) parseList() RuleTerm {
+	elements := make([]RuleTerm, 0, 4)
+	for {
+		element, _ := p.parse(999)
+		elements = append(elements, element)
+		tok := p.next()
+		if tok.kind == tokPunct && tok.text == "," {
+			continue
+		}
+		var tail RuleTerm = p.makeAtom("[]")
+		if tok.kind == tokPunct && tok.text == "|" {
+			tail, _ = p.parse(999)
+			tok = p.next()
+		}
+		if tok.kind != tokPunct || tok.text != "]" {
+			p.t.syntaxErrorAt(tok, "expected , | or ] in list, found "+describeToken(tok))
+		}
+		return p.makeList(elements, tail)
+	}
+}
+
+func (p *reader) makeVariable(name string) *Local {
+	// Previously seen variable?
+	if index, found := p.nameMap[name]; found {
+		return p.st.NewLocal(index)
+	}
+
+	// Fresh variable
+	index := p.varIndex
+	p.varIndex++
+	if name != "_" {
+		p.nameMap[name] = index
+	}
+	v := p.st.NewLocal(index)
+	p.vars = append(p.vars, v)
+	return v
+}
+
+func (p *reader) getAndClearVars() []*Local {
+	vs := p.vars
+	p.varIndex = 0
+	p.vars = make([]*Local, 0)
+	for k := range p.nameMap {
+		delete(p.nameMap, k)
+	}
+	return vs
+}
+
+// The names of the variables of the current clause, indexed by variable number.  Anonymous
+// variables have no name.
+
+func (p *reader) varNames() []*Atom {
+	names := make([]*Atom, p.varIndex)
+	for k, v := range p.nameMap {
+		names[v] = p.st.NewAtom(k)
+	}
+	return names
+}
+
+func (p *reader) makeStruct(functor string, terms []RuleTerm) *RuleStruct {
+	return p.st.NewStruct(p.st.NewAtom(functor), terms)
+}
+
+func (p *reader) makeNumber(text string) *Number {
+	n, ok := parseInteger(text)
+	if !ok {
+		p.t.syntaxErrorAt(p.last, fmt.Sprintf("Bad number: %s", text))
+	}
+	return n
+}
+
+func (p *reader) makeFloat(text string) *Float {
+	f, ok := parseFloat(text)
+	if !ok {
+		p.t.syntaxErrorAt(p.last, fmt.Sprintf("Float overflow: %s", text))
+	}
+	return f
+}
+
+// The values of the text of number tokens, with an optional minus sign.  Integers may have a
+// base prefix 0x, 0o or 0b.
+
+func parseInteger(text string) (*Number, bool) {
+	sign, digits, base := "", text, 10
+	if strings.HasPrefix(digits, "-") {
+		sign, digits = "-", digits[1:]
+	}
+	if len(digits) > 2 && digits[0] == '0' {
+		switch digits[1] {
+		case 'x':
+			base = 16
+		case 'o':
+			base = 8
+		case 'b':
+			base = 2
+		}
+		if base != 10 {
+			digits = digits[2:]
+		}
+	}
+	if val, err := strconv.ParseInt(sign+digits, base, 64); err == nil {
+		return &Number{value: val}, true
+	}
+	val, ok := new(big.Int).SetString(sign+digits, base)
+	if !ok {
+		return nil, false
+	}
+	return newInteger(val), true
+}
+
+func parseFloat(text string) (*Float, bool) {
+	val, err := strconv.ParseFloat(text, 64)
+	if err != nil {
+		return nil, false
+	}
+	return &Float{value: val}, true
+}
+
+// Double-quoted text is read as a string, a list of codes, a list of characters or an atom,
+// according to the flag double_quotes.
+
+func (p *reader) makeString(text string) RuleTerm {
+	switch p.st.flag("double_quotes").name {
+	case "codes":
+		codes := []RuleTerm{}
+		for _, r := range text {
+			codes = append(codes, p.st.NewNumber(int64(r)))
+		}
+		return p.makeList(codes, p.st.nilAtom)
+	case "chars":
+		chars := []RuleTerm{}
+		for _, r := range text {
+			chars = append(chars, p.st.NewAtom(string(r)))
+		}
+		return p.makeList(chars, p.st.nilAtom)
+	case "atom":
+		return p.st.NewAtom(text)
+	default:
+		return p.st.NewString(text)
+	}
+}
+
+func (p *reader) makeAtom(name string) *Atom {
+	return p.st.NewAtom(name)
+}
+
+func (p *reader) makeList(elements []RuleTerm, tail RuleTerm) RuleTerm {
+	for i := len(elements) - 1; i >= 0; i-- {
+		tail = p.st.NewStruct(p.st.dotAtom, []RuleTerm{elements[i], tail})
+	}
+	return tail
+}
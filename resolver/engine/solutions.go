@@ -0,0 +1,135 @@
+package engine
+
+// Support for the all-solutions predicates, which are defined in system.pl.
+//
+// findall/3 is a failure-driven loop over the goal that adds a copy of the template to a bag for
+// every solution:
+//
+//   findall(T, G, L) :- '$bag'(B), ( call(G), '$bag_add'(B, T), fail ; '$bag_collect'(B, L) ).
+//
+// The copy is made in rule form, with locals for the unbound variables, because the bindings of
+// the template are undone when the loop backtracks.  The bags are kept on the machine and are
+// identified by number, so that nested and interleaved loops do not interfere.
+//
+// bagof/3 and setof/3 collect Witness-Template pairs with findall, where the witness is the
+// list of the free variables of the goal, and then group the pairs by witness.
+
+// A term copied out of its ribs: `locals` is the number of distinct variables in `t`.  If the
+// term is cyclic then some of the locals are bound to terms that contain them, see database.go.
+
+type copiedTerm struct {
+	t        RuleTerm
+	locals   int
+	bindings []localBinding
+}
+
+func copyOut(t ValueTerm) copiedTerm {
+	c := &ruleConverter{locals: make(map[*Varslot]*Local)}
+	rt := c.convert(t)
+	if len(c.bindings) > 0 {
+		// The term is cyclic, so convert it again looking for cycles from the root, which makes
+		// the copy as small as it can be
+		c = &ruleConverter{locals: make(map[*Varslot]*Local), exact: true}
+		rt = c.convert(t)
+	}
+	return copiedTerm{rt, c.count(), c.bindings}
+}
+
+func (c copiedTerm) instantiate() ValueTerm {
+	env := make(rib, c.locals)
+	for _, b := range c.bindings {
+		env[b.slot].val = bind(b.t, env)
+	}
+	return bind(c.t, env)
+}
+
+func copyTerm(t ValueTerm) ValueTerm {
+	return copyOut(t).instantiate()
+}
+
+func (st *Store) initSolutionsBuiltins() {
+	st.addBuiltin("$bag", 1, func(m *machine, args []ValueTerm) bool {
+		if m.bags == nil {
+			m.bags = make(map[int64][]copiedTerm)
+		}
+		m.bagCount++
+		m.bags[m.bagCount] = []copiedTerm{}
+		return m.unify(args[0], m.st.NewNumber(m.bagCount))
+	})
+	st.addBuiltin("$bag_add", 2, func(m *machine, args []ValueTerm) bool {
+		id := deref(args[0]).(*Number).value
+		m.bags[id] = append(m.bags[id], copyOut(args[1]))
+		return true
+	})
+	st.addBuiltin("$bag_collect", 2, func(m *machine, args []ValueTerm) bool {
+		id := deref(args[0]).(*Number).value
+		bag := m.bags[id]
+		delete(m.bags, id)
+		elements := make([]ValueTerm, len(bag))
+		for i, c := range bag {
+			elements[i] = c.instantiate()
+		}
+		return m.unify(args[1], m.st.newList(elements, m.st.nilAtom))
+	})
+	st.addBuiltin("copy_term", 2, func(m *machine, args []ValueTerm) bool {
+		return m.unify(args[1], copyTerm(args[0]))
+	})
+	st.addBuiltin("term_variables", 2, func(m *machine, args []ValueTerm) bool {
+		vars := termVariables(args[0], nil, map[*Varslot]bool{})
+		return m.unify(args[1], m.st.newList(vars, m.st.nilAtom))
+	})
+
+	// '$free_variables'(Template, Goal, Witness, Goal1): Witness is the list of the variables
+	// of Goal that are not in Template or quantified by ^, and Goal1 is Goal without the ^.
+	st.addBuiltin("$free_variables", 4, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		bound := map[*Varslot]bool{}
+		termVariables(args[0], nil, bound)
+		goal := deref(args[1])
+		for {
+			s, ok := goal.(*ValueStruct)
+			if !ok || s.s.functor.name != "^" || len(s.s.subterms) != 2 {
+				break
+			}
+			termVariables(bind(s.s.subterms[0], s.env), nil, bound)
+			goal = deref(bind(s.s.subterms[1], s.env))
+		}
+		free := termVariables(goal, nil, bound)
+		return m.unify(args[2], st.newList(free, st.nilAtom)) && m.unify(args[3], goal)
+	})
+}
+
+// Append the variables of `t` that are not in `seen` to `vars`, in depth-first left-to-right
+// order, and add them to `seen`.
+
+func termVariables(t ValueTerm, vars []ValueTerm, seen map[*Varslot]bool) []ValueTerm {
+	var g varGuard
+	return termVariablesGuarded(t, vars, seen, &g)
+}
+
+func termVariablesGuarded(t ValueTerm, vars []ValueTerm, seen map[*Varslot]bool, g *varGuard) []ValueTerm {
+	for {
+		if g.seenBefore(t) {
+			return vars
+		}
+		switch x := deref(t).(type) {
+		case *Varslot:
+			if !seen[x] {
+				seen[x] = true
+				vars = append(vars, x)
+			}
+			return vars
+		case *ValueStruct:
+			n := len(x.s.subterms)
+			if n == 0 {
+				return vars
+			}
+			for i := 0; i < n-1; i++ {
+				vars = termVariablesGuarded(bind(x.s.subterms[i], x.env), vars, seen, g)
+			}
+			t = bind(x.s.subterms[n-1], x.env)
+		default:
+			return vars
+		}
+	}
+}
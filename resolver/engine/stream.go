@@ -0,0 +1,383 @@
+package engine
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+)
+
+// Streams.  A stream is a source of text that terms are read from or a sink that text is
+// written to: the standard input, output and error of the store, or a file opened by open/3.
+// A stream is referred to by the term '$stream'(N) that open/3 returns, or, for the standard
+// streams, by the aliases user_input, user_output and user_error.
+//
+// The predicates without a stream argument, read/1, write/1, nl/0, format/2 and the others, use
+// the current input or output, which are the standard streams until set_input/1 or set_output/1
+// changes them.  Closing a standard stream does nothing, and closing the current input or output
+// makes the standard stream current again.
+//
+// Terms are read by the reader that loads programs, so they are terminated by a period and may
+// use the operators of the store.  An input stream keeps its reader, which may have read ahead,
+// for the next term.  At the end of the input the term is end_of_file.  The options of
+// read_term/2 are variable_names(Vs), which gives Name = Var for each named variable, and
+// variables(Vs), which gives the variables in the order in which they appear.
+//
+// Terms are written by write_term/2 with the options quoted(Bool), ignore_ops(Bool) and
+// numbervars(Bool), see write.go:
+//
+//   write/1             operators, '$VAR'(N) as a variable name
+//   print/1, writeq/1   as write/1, and atoms and strings quoted so they can be read back
+//   write_canonical/1   quoted, without operators or variable names
+
+type stream struct {
+	id    int64
+	alias *Atom
+
+	// The name of the file, for syntax errors
+	filename string
+
+	// The source of an input stream and the sink of an output stream
+	input  io.RuneScanner
+	output io.Writer
+
+	// The reader of an input stream, which is created when a term is first read
+	p *reader
+
+	// The file of a stream that was opened by open/3
+	file *os.File
+}
+
+// The stream term for the stream.
+
+func (st *Store) streamTerm(s *stream) ValueTerm {
+	if s.alias != nil {
+		return s.alias
+	}
+	return newValueStruct(st.NewAtom("$stream"), []ValueTerm{st.NewNumber(s.id)})
+}
+
+func (st *Store) initStreams() {
+	st.streams = make(map[int64]*stream)
+	st.userInput = st.addStream(&stream{alias: st.NewAtom("user_input"), filename: "user_input",
+		input: bufio.NewReader(os.Stdin)})
+	st.userOutput = st.addStream(&stream{alias: st.NewAtom("user_output"), output: os.Stdout})
+	st.userError = st.addStream(&stream{alias: st.NewAtom("user_error"), output: os.Stderr})
+	st.input, st.output = st.userInput, st.userOutput
+}
+
+// Numbers are not reused, so the term of a closed stream never refers to a stream opened later.
+
+func (st *Store) addStream(s *stream) *stream {
+	s.id = st.streamCount
+	st.streamCount++
+	st.streams[s.id] = s
+	return s
+}
+
+// Set the reader for the standard input of the store, which is os.Stdin by default.
+
+func (st *Store) SetInput(r io.RuneScanner) {
+	st.userInput.input = r
+	st.userInput.p = nil
+}
+
+// Set the writer for the standard output of the store, which is os.Stdout by default.
+
+func (st *Store) SetOutput(w io.Writer) {
+	st.userOutput.output = w
+}
+
+// The stream that a stream term or an alias refers to.
+
+func (st *Store) lookupStream(t ValueTerm) *stream {
+	switch x := deref(t).(type) {
+	case *Varslot:
+		st.instantiationError()
+	case *Atom:
+		for _, s := range []*stream{st.userInput, st.userOutput, st.userError} {
+			if s.alias == x {
+				return s
+			}
+		}
+		st.existenceError("stream", x)
+	case *ValueStruct:
+		if x.s.functor.name == "$stream" && len(x.s.subterms) == 1 {
+			if n, ok := deref(bind(x.s.subterms[0], x.env)).(*Number); ok {
+				if s, ok := st.streams[n.value]; ok {
+					return s
+				}
+				st.existenceError("stream", x)
+			}
+		}
+	}
+	st.domainError("stream_or_alias", deref(t))
+	panic("Unreachable")
+}
+
+func (st *Store) inputStream(t ValueTerm) *stream {
+	s := st.lookupStream(t)
+	if s.input == nil {
+		st.permissionError("input", "stream", deref(t))
+	}
+	return s
+}
+
+func (st *Store) outputStream(t ValueTerm) *stream {
+	s := st.lookupStream(t)
+	if s.output == nil {
+		st.permissionError("output", "stream", deref(t))
+	}
+	return s
+}
+
+func (st *Store) initStreamBuiltins() {
+	st.addBuiltin("open", 3, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		if _, ok := deref(args[2]).(*Varslot); !ok {
+			st.raise(newValueStruct(st.NewAtom("uninstantiation_error"), []ValueTerm{deref(args[2])}))
+		}
+		s := st.open(args[0], args[1])
+		return m.unify(args[2], st.streamTerm(st.addStream(s)))
+	})
+	st.addBuiltin("close", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.close(m.st.lookupStream(args[0]))
+		return true
+	})
+	st.addBuiltin("current_input", 1, func(m *machine, args []ValueTerm) bool {
+		return m.unify(args[0], m.st.streamTerm(m.st.input))
+	})
+	st.addBuiltin("current_output", 1, func(m *machine, args []ValueTerm) bool {
+		return m.unify(args[0], m.st.streamTerm(m.st.output))
+	})
+	st.addBuiltin("set_input", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.input = m.st.inputStream(args[0])
+		return true
+	})
+	st.addBuiltin("set_output", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.output = m.st.outputStream(args[0])
+		return true
+	})
+
+	st.addBuiltin("read_term", 2, func(m *machine, args []ValueTerm) bool {
+		return m.readTerm(m.st.input, args[0], args[1])
+	})
+	st.addBuiltin("read_term", 3, func(m *machine, args []ValueTerm) bool {
+		return m.readTerm(m.st.inputStream(args[0]), args[1], args[2])
+	})
+	st.addBuiltin("read", 1, func(m *machine, args []ValueTerm) bool {
+		return m.readTerm(m.st.input, args[0], m.st.nilAtom)
+	})
+	st.addBuiltin("read", 2, func(m *machine, args []ValueTerm) bool {
+		return m.readTerm(m.st.inputStream(args[0]), args[1], m.st.nilAtom)
+	})
+
+	writers := []struct {
+		name                          string
+		quoted, ignoreOps, numberVars bool
+	}{
+		{"write", false, false, true},
+		{"print", true, false, true},
+		{"writeq", true, false, true},
+		{"write_canonical", true, true, false},
+	}
+	for _, w := range writers {
+		st.addBuiltin(w.name, 1, func(m *machine, args []ValueTerm) bool {
+			m.st.write(m.st.output, args[0], m.st.newTermWriter(w.quoted, w.ignoreOps, w.numberVars))
+			return true
+		})
+		st.addBuiltin(w.name, 2, func(m *machine, args []ValueTerm) bool {
+			st := m.st
+			st.write(st.outputStream(args[0]), args[1], st.newTermWriter(w.quoted, w.ignoreOps, w.numberVars))
+			return true
+		})
+	}
+	st.addBuiltin("write_term", 2, func(m *machine, args []ValueTerm) bool {
+		m.st.write(m.st.output, args[0], m.st.writeOptions(args[1]))
+		return true
+	})
+	st.addBuiltin("write_term", 3, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		st.write(st.outputStream(args[0]), args[1], st.writeOptions(args[2]))
+		return true
+	})
+	st.addBuiltin("nl", 0, func(m *machine, args []ValueTerm) bool {
+		io.WriteString(m.st.output.output, "\n")
+		return true
+	})
+	st.addBuiltin("nl", 1, func(m *machine, args []ValueTerm) bool {
+		io.WriteString(m.st.outputStream(args[0]).output, "\n")
+		return true
+	})
+	st.addBuiltin("flush_output", 0, func(m *machine, args []ValueTerm) bool {
+		m.st.flush(m.st.output)
+		return true
+	})
+	st.addBuiltin("flush_output", 1, func(m *machine, args []ValueTerm) bool {
+		m.st.flush(m.st.outputStream(args[0]))
+		return true
+	})
+}
+
+// Open a file in the mode read, write or append.
+
+func (st *Store) open(file ValueTerm, mode ValueTerm) *stream {
+	name, ok := deref(file).(*Atom)
+	if !ok {
+		if _, isVar := deref(file).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		st.domainError("source_sink", deref(file))
+	}
+	modeAtom, ok := deref(mode).(*Atom)
+	if !ok {
+		if _, isVar := deref(mode).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		st.typeError("atom", deref(mode))
+	}
+	var f *os.File
+	var err error
+	switch modeAtom.name {
+	case "read":
+		f, err = os.Open(name.name)
+	case "write":
+		f, err = os.Create(name.name)
+	case "append":
+		f, err = os.OpenFile(name.name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	default:
+		st.domainError("io_mode", modeAtom)
+	}
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			st.existenceError("source_sink", name)
+		}
+		st.permissionError("open", "source_sink", name)
+	}
+	s := &stream{filename: name.name, file: f}
+	if modeAtom.name == "read" {
+		s.input = bufio.NewReader(f)
+	} else {
+		s.output = f
+	}
+	return s
+}
+
+func (st *Store) close(s *stream) {
+	if s.file == nil {
+		return
+	}
+	s.file.Close()
+	delete(st.streams, s.id)
+	if st.input == s {
+		st.input = st.userInput
+	}
+	if st.output == s {
+		st.output = st.userOutput
+	}
+}
+
+func (st *Store) flush(s *stream) {
+	if f, ok := s.output.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
+
+// Read a term from the stream and unify it with `term`, and the variables with the options.
+
+func (m *machine) readTerm(s *stream, term ValueTerm, options ValueTerm) bool {
+	st := m.st
+	elements, ok := st.listElements(options)
+	if !ok {
+		if _, isVar := deref(options).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		st.typeError("list", deref(options))
+	}
+	for _, o := range elements {
+		if opt, ok := deref(o).(*ValueStruct); !ok || len(opt.s.subterms) != 1 ||
+			opt.s.functor.name != "variable_names" && opt.s.functor.name != "variables" {
+			st.domainError("read_option", deref(o))
+		}
+	}
+	if s.p == nil {
+		s.p = newReader(st, s.filename, s.input)
+	}
+	t, err := s.p.readClause()
+	if err != nil {
+		message := err.(*SyntaxError).Message
+		st.raise(newValueStruct(st.NewAtom("syntax_error"), []ValueTerm{st.NewAtom(message)}))
+	}
+	if t == nil {
+		return m.unify(term, st.NewAtom("end_of_file"))
+	}
+	names := s.p.varNames()
+	env := make(rib, len(s.p.getAndClearVars()))
+	if !m.unify(term, bind(t, env)) {
+		return false
+	}
+	for _, o := range elements {
+		opt := deref(o).(*ValueStruct)
+		var values []ValueTerm
+		for i := range env {
+			switch {
+			case opt.s.functor.name == "variables":
+				values = append(values, &env[i])
+			case names[i] != nil:
+				values = append(values, newValueStruct(st.NewAtom("="), []ValueTerm{names[i], &env[i]}))
+			}
+		}
+		if !m.unify(bind(opt.s.subterms[0], opt.env), st.newList(values, st.nilAtom)) {
+			return false
+		}
+	}
+	return true
+}
+
+// A writer for write_term/2 with the options.
+
+func (st *Store) newTermWriter(quoted bool, ignoreOps bool, numberVars bool) *termWriter {
+	w := &termWriter{quoted: quoted, quoteAtoms: quoted, numberVars: numberVars}
+	if !ignoreOps {
+		w.ops = st.ops
+	}
+	return w
+}
+
+// The writer for the options of write_term/2.  An option that is not given is false.
+
+func (st *Store) writeOptions(options ValueTerm) *termWriter {
+	elements, ok := st.listElements(options)
+	if !ok {
+		if _, isVar := deref(options).(*Varslot); isVar {
+			st.instantiationError()
+		}
+		st.typeError("list", deref(options))
+	}
+	values := make(map[string]bool)
+	for _, o := range elements {
+		opt, ok := deref(o).(*ValueStruct)
+		if !ok || len(opt.s.subterms) != 1 {
+			st.domainError("write_option", deref(o))
+		}
+		switch name := opt.s.functor.name; name {
+		case "quoted", "ignore_ops", "numbervars":
+			switch deref(bind(opt.s.subterms[0], opt.env)) {
+			case ValueTerm(st.trueAtom):
+				values[name] = true
+			case ValueTerm(st.NewAtom("false")):
+				values[name] = false
+			default:
+				st.domainError("write_option", opt)
+			}
+		default:
+			st.domainError("write_option", opt)
+		}
+	}
+	return st.newTermWriter(values["quoted"], values["ignore_ops"], values["numbervars"])
+}
+
+func (st *Store) write(s *stream, t ValueTerm, w *termWriter) {
+	w.writeValue(t)
+	io.WriteString(s.output, w.b.String())
+}
@@ -0,0 +1,156 @@
+/* Built-in predicates that are defined in Prolog.  This library is loaded into the module
+   `system` of every new store, and its predicates run in the context module of their caller,
+   see module.go.
+
+   Predicates whose names start with '$' are internal to the library. */
+
+current_op(P, T, N) :- '$current_ops'(L), member(op(P, T, N), L).
+
+current_prolog_flag(F, V) :- '$prolog_flags'(L), member(F-V, L).
+
+current_module(M) :- '$modules'(L), member(M, L).
+
+/* The dynamic database, see database.go.  retract/1 and clause/2 work on a snapshot of the
+   clauses of the predicate, taken when they are called. */
+
+retract((H :- B)) :- !, '$clause'(H, B, Ref), '$erase'(H, Ref).
+retract(H) :- '$clause'(H, true, Ref), '$erase'(H, Ref).
+
+retractall(H) :- retract((H :- _)), fail.
+retractall(_).
+
+clause(H, B) :- '$clause'(H, B, _).
+
+/* Control predicates that are defined in terms of the control constructs, see control.go. */
+
+once(G) :- call(G), !.
+ignore(G) :- (call(G) -> true ; true).
+not(G) :- \+ G.
+
+/* Text predicates, see text.go.  The solutions of sub_atom/5 and sub_string/5 are computed at
+   once by '$sub_text'/7. */
+
+sub_atom(T, B, L, A, S) :- '$sub_text'(atom, T, B, L, A, S, Xs), member(s(B, L, A, S), Xs).
+sub_string(T, B, L, A, S) :- '$sub_text'(string, T, B, L, A, S, Xs), member(s(B, L, A, S), Xs).
+
+atom_concat(A, B, C) :- nonvar(A), nonvar(B), !, '$text_concat'(atom, A, B, C).
+atom_concat(A, B, C) :- sub_atom(C, 0, _, N, A), sub_atom(C, _, N, 0, B).
+
+string_concat(A, B, C) :- nonvar(A), nonvar(B), !, '$text_concat'(string, A, B, C).
+string_concat(A, B, C) :- sub_string(C, 0, _, N, A), sub_string(C, _, N, 0, B).
+
+/* Grammar rules, see dcg.go. */
+
+phrase(G, L) :- '$dcg_body'(G, S0, S, Goal, 2), S0 = L, S = [], call(Goal).
+phrase(G, L, R) :- '$dcg_body'(G, S0, S, Goal, 3), S0 = L, S = R, call(Goal).
+
+/* All-solutions predicates, see solutions.go. */
+
+findall(T, G, L) :- '$bag'(B), ( call(G), '$bag_add'(B, T), fail ; '$bag_collect'(B, L) ).
+
+forall(C, A) :- \+ ( call(C), \+ call(A) ).
+
+/* bagof/3 groups the solutions by the bindings of the free variables of the goal, the witness.
+   The groups are produced in the standard order of their witnesses, and the witnesses of the
+   solutions in a group are unified. */
+
+bagof(T, G, L) :-
+    '$free_variables'(T, G, W, G1),
+    ( W == [] ->
+        findall(T, G1, L), L \== []
+    ;   findall(W-T, G1, Pairs), Pairs \== [],
+        keysort(Pairs, Sorted),
+        '$bagof_group'(Sorted, W, L)
+    ).
+
+'$bagof_group'([W0-T|Pairs], W, L) :-
+    '$bagof_partition'(Pairs, W0, Group, Rest),
+    ( W = W0, L = [T|Group]
+    ; Rest \== [], '$bagof_group'(Rest, W, L)
+    ).
+
+'$bagof_partition'([], _, [], []).
+'$bagof_partition'([W1-T|Pairs], W0, Group, Rest) :-
+    ( W1 =@= W0 ->
+        W1 = W0, Group = [T|Group1], '$bagof_partition'(Pairs, W0, Group1, Rest)
+    ;   Rest = [W1-T|Rest1], '$bagof_partition'(Pairs, W0, Group, Rest1)
+    ).
+
+setof(T, G, S) :- bagof(T, G, L), sort(L, S).
+
+aggregate_all(count, G, C) :- !, findall(x, G, L), length(L, C).
+aggregate_all(sum(E), G, S) :- !, findall(E, G, L), '$sum'(L, 0, S).
+aggregate_all(max(E), G, M) :- !, findall(E, G, [X|L]), '$max'(L, X, M).
+aggregate_all(min(E), G, M) :- !, findall(E, G, [X|L]), '$min'(L, X, M).
+aggregate_all(bag(E), G, L) :- !, findall(E, G, L).
+aggregate_all(set(E), G, S) :- !, findall(E, G, L), sort(L, S).
+
+'$sum'([], S, S).
+'$sum'([X|Xs], S0, S) :- S1 is S0 + X, '$sum'(Xs, S1, S).
+
+'$max'([], M, M).
+'$max'([X|Xs], M0, M) :- M1 is max(M0, X), '$max'(Xs, M1, M).
+
+'$min'([], M, M).
+'$min'([X|Xs], M0, M) :- M1 is min(M0, X), '$min'(Xs, M1, M).
+
+/* Coroutining, see attvar.go.  '$attr_unify_hook'/3 is called when a variable with attributes
+   is bound, once for each attribute.  The attributes of freeze/2 and when/2 hold the delayed
+   goals, and that of dif/2 the pairs of terms that must stay different.  A dif/2 or when/2 is
+   put on the variables whose bindings may decide it, and is checked again when one of them is
+   bound. */
+
+'$attr_unify_hook'(freeze, G, Y) :- !,
+    ( attvar(Y), get_attr(Y, freeze, G1) -> put_attr(Y, freeze, (G1, G))
+    ; var(Y) -> put_attr(Y, freeze, G)
+    ; call(G)
+    ).
+'$attr_unify_hook'(dif, Ps, _) :- !, '$dif_all'(Ps).
+'$attr_unify_hook'(when, Ws, _) :- !, '$when_wake'(Ws).
+'$attr_unify_hook'(M, A, Y) :- M:attr_unify_hook(A, Y).
+
+'$suspend'([], _, _).
+'$suspend'([V|Vs], M, X) :-
+    ( get_attr(V, M, Xs) -> put_attr(V, M, [X|Xs]) ; put_attr(V, M, [X]) ),
+    '$suspend'(Vs, M, X).
+
+freeze(X, G) :- var(X), !, ( get_attr(X, freeze, G0) -> put_attr(X, freeze, (G0, G)) ; put_attr(X, freeze, G) ).
+freeze(_, G) :- call(G).
+
+frozen(X, G) :- ( get_attr(X, freeze, G0) -> G = G0 ; G = true ).
+
+dif(X, Y) :- X \== Y, ( unifiable(X, Y, Us) -> term_variables(Us, Vs), '$suspend'(Vs, dif, X-Y) ; true ).
+
+'$dif_all'([]).
+'$dif_all'([X-Y|Ps]) :- dif(X, Y), '$dif_all'(Ps).
+
+?=(X, Y) :- \+ unifiable(X, Y, [_|_]).
+
+when(C, G) :-
+    '$when_condition'(C),
+    ( '$when_triggers'(C, Vs) -> '$suspend'(Vs, when, '$when'(_, C, G)) ; call(G) ).
+
+'$when_condition'(C) :- var(C), !, throw(error(instantiation_error, context(when/2, _))).
+'$when_condition'(nonvar(_)) :- !.
+'$when_condition'(ground(_)) :- !.
+'$when_condition'(?=(_, _)) :- !.
+'$when_condition'((C1, C2)) :- !, '$when_condition'(C1), '$when_condition'(C2).
+'$when_condition'((C1 ; C2)) :- !, '$when_condition'(C1), '$when_condition'(C2).
+'$when_condition'(C) :- throw(error(domain_error(when_condition, C), context(when/2, _))).
+
+/* '$when_triggers'(C, Vs) fails if the condition is true, and otherwise gives the variables
+   whose bindings may make it true. */
+
+'$when_triggers'(nonvar(X), [X]) :- var(X).
+'$when_triggers'(ground(X), [V]) :- term_variables(X, [V|_]).
+'$when_triggers'(?=(X, Y), Vs) :- unifiable(X, Y, [U|Us]), term_variables([U|Us], Vs).
+'$when_triggers'((C1, C2), Vs) :- ( '$when_triggers'(C1, Vs) -> true ; '$when_triggers'(C2, Vs) ).
+'$when_triggers'((C1 ; C2), Vs) :- '$when_triggers'(C1, Vs1), '$when_triggers'(C2, Vs2), append(Vs1, Vs2, Vs).
+
+/* A suspended when/2 is on several variables; the first of them to be bound marks it as done
+   and checks it again. */
+
+'$when_wake'([]).
+'$when_wake'(['$when'(Done, C, G)|Ws]) :-
+    ( var(Done) -> Done = true, when(C, G) ; true ),
+    '$when_wake'(Ws).
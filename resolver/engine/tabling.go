@@ -0,0 +1,483 @@
+package engine
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Tabling.  A predicate that is declared with `:- table Name/Arity.` is evaluated with
+// memoization: the answers to a call are computed once, all of them, and kept in a table for the
+// variant of the call, from which the call and later variant calls take their answers.  A variant
+// call that is made while the table is being evaluated consumes the answers of the table instead
+// of evaluating the clauses again, so left recursion terminates.
+//
+// The evaluation is local scheduling, as in SLG resolution.  The clauses of a table are run to
+// exhaustion in a machine of their own, the generator, whose solutions are added to the table as
+// answers.  A consumer takes the answers of its table one at a time, including those that are
+// added while it runs.  When it has taken all of them and the table is not complete, it is
+// suspended: the bindings on the trail below its choicepoint and the choicepoints themselves are
+// saved with the table that is being evaluated in the machine.  When the table gets new answers
+// the consumer is resumed in a new machine with the bindings and the choicepoints restored, and
+// continues from the first answer that it has not taken.  The choicepoints below it are restored
+// only for their heights and catches: their alternatives have been run already.
+//
+// Tables that are being evaluated are on the tabling stack.  When a call consumes the answers of
+// a table on the stack, the tables above it depend on it and cannot be complete before it is, so
+// their leader is lowered to its position.  A table whose leader is below it is left incomplete
+// in the strongly connected component of its leader, with its suspended consumers.  The leader
+// resumes the consumers of its component until none of them has answers left to take, and then
+// the whole component is complete.
+//
+// A consumer cannot be resumed if its continuation commits to the answers it has taken: a cut,
+// the condition of if-then-else or negation, findall/3, or the exit of a traced call.  If the
+// table of such a consumer got answers after it had last looked at them then the leader
+// evaluates its component again, from its clauses, until that no longer happens.
+//
+// The answers of a table are kept as facts for the predicate, so that they are returned by
+// tryClauses like clauses.  Tables are discarded when the database changes, unless a table is
+// being evaluated, and by abolish_all_tables/0.
+
+type tableStatus int
+
+const (
+	tableEvaluating tableStatus = iota
+	tableIncomplete
+	tableComplete
+
+	// Incomplete, and to be evaluated again when it is called, because its leader evaluates
+	// its component again or its evaluation was abandoned.
+	tableStale
+)
+
+type table struct {
+	status  tableStatus
+	answers []*rule
+
+	// The variant keys of the answers.
+	keys map[string]bool
+
+	// The key of the table, the call, its predicate and the context module of the call.
+	key    string
+	call   copiedTerm
+	pred   *predicate
+	module *module
+
+	// The instance of the call that the current evaluation solves.
+	goal ValueTerm
+
+	// While the table is being evaluated, its position on the tabling stack and the lowest
+	// position of a table that it depends on.
+	height int
+	leader int
+
+	// The incomplete tables whose leader this is.
+	component []*table
+
+	// The consumers in the evaluation of the table that have taken all the answers of their
+	// tables, or that cannot be resumed.
+	suspensions []*consumer
+}
+
+// A call that consumes the answers of an incomplete table.
+
+type consumer struct {
+	producer *table
+	actuals  []ValueTerm
+
+	// The number of answers that have been taken, and the number that there were when the
+	// consumer last looked.
+	next int
+	seen int
+
+	// False if the continuation commits to the answers that have been taken.
+	resumable bool
+
+	// Once the consumer is suspended, the bindings on the trail below its choicepoint, and the
+	// choicepoints up to and including its own.
+	bindings []savedBinding
+	chps     []choicepoint
+}
+
+type savedBinding struct {
+	v    *Varslot
+	val  ValueTerm
+	next *Varslot
+}
+
+func (st *Store) initTablingBuiltins() {
+	st.addBuiltin("table", 1, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		st.forEachIndicator(m.module, args[0], func(md *module, functor *Atom, arity int) {
+			if st.isStatic(md, functor, arity) {
+				st.permissionError("modify", "static_procedure", st.indicator(functor, arity))
+			}
+			md.predicate(functor, arity).tabled = true
+		})
+		return true
+	})
+	st.addBuiltin("abolish_all_tables", 0, func(m *machine, args []ValueTerm) bool {
+		m.st.tables = nil
+		return true
+	})
+}
+
+// Discard the tables, because the database has changed.
+
+func (st *Store) invalidateTables() {
+	if len(st.tables) > 0 && len(st.tableStack) == 0 {
+		st.tables = nil
+	}
+}
+
+func (st *Store) discardTable(t *table) {
+	t.status = tableStale
+	t.suspensions = nil
+	if st.tables[t.key] == t {
+		delete(st.tables, t.key)
+	}
+}
+
+func (m *machine) callTabled(functor *Atom, actuals []ValueTerm, p *predicate) bool {
+	st := m.st
+	var goal ValueTerm = functor
+	if len(actuals) > 0 {
+		goal = newValueStruct(functor, actuals)
+	}
+	call := copyOut(goal)
+	// Predicates with the same name in different modules have different tables
+	key := p.module.name.name + ":" + call.variantKey()
+	t := st.tables[key]
+	switch {
+	case t == nil:
+		if st.tables == nil {
+			st.tables = make(map[string]*table)
+		}
+		t = &table{answers: []*rule{}, keys: make(map[string]bool), key: key, call: call, pred: p,
+			module: m.module}
+		st.tables[key] = t
+		m.evaluateTable(t)
+	case t.status == tableStale:
+		m.evaluateTable(t)
+	case t.status == tableEvaluating:
+		st.lowerLeaders(t.height)
+	case t.status == tableIncomplete:
+		st.lowerLeaders(t.leader)
+	}
+	if t.status == tableComplete || m.owner == nil {
+		// A machine that evaluates no table, as that of a foreign predicate, cannot be
+		// suspended and takes the answers that have been found so far
+		return m.tryClauses(actuals, t.answers, m.cont, len(m.chps))
+	}
+	return m.consume(t, actuals)
+}
+
+// The tables above the position on the tabling stack depend on the table there.
+
+func (st *Store) lowerLeaders(position int) {
+	for _, u := range st.tableStack[position+1:] {
+		u.leader = min(u.leader, position)
+	}
+}
+
+func (m *machine) evaluateTable(t *table) {
+	st := m.st
+	t.status = tableEvaluating
+	t.height = len(st.tableStack)
+	t.leader = t.height
+	t.component, t.suspensions = nil, nil
+	st.tableStack = append(st.tableStack, t)
+	defer func() {
+		if x := recover(); x != nil {
+			// The answers that have been found are right, but the consumers that were
+			// suspended are lost, so the tables are evaluated again when they are called
+			for _, u := range st.tableStack[t.height:] {
+				st.discardTable(u)
+				for _, v := range u.component {
+					st.discardTable(v)
+				}
+			}
+			st.tableStack = st.tableStack[:t.height]
+			panic(x)
+		}
+	}()
+	m.evaluateClauses(t)
+	for m.schedule(t) {
+		for _, u := range t.component {
+			u.status = tableStale
+			u.suspensions = nil
+		}
+		t.component, t.suspensions = nil, nil
+		m.evaluateClauses(t)
+	}
+	st.tableStack = st.tableStack[:t.height]
+	if t.leader < t.height {
+		t.status = tableIncomplete
+		for _, u := range t.component {
+			u.leader = t.leader
+		}
+		leader := st.tableStack[t.leader]
+		leader.component = append(append(leader.component, t), t.component...)
+	} else {
+		for _, u := range append(t.component, t) {
+			u.status = tableComplete
+			u.goal, u.suspensions = nil, nil
+		}
+	}
+	t.component = nil
+}
+
+// Resume the suspended consumers of the table and its component that have answers left to take
+// until there are none.  Returns true if the table is the leader of its component and a consumer
+// that cannot be resumed has missed answers, so that the component must be evaluated again.
+
+func (m *machine) schedule(t *table) bool {
+	for resumed := true; resumed; {
+		resumed = false
+		// Resuming a consumer can add suspensions and tables to the component
+		for i := -1; i < len(t.component); i++ {
+			u := t
+			if i >= 0 {
+				u = t.component[i]
+			}
+			for j := 0; j < len(u.suspensions); j++ {
+				c := u.suspensions[j]
+				if c.resumable && c.next < len(c.producer.answers) {
+					m.resume(u, c)
+					resumed = true
+				}
+			}
+		}
+	}
+	if t.leader < t.height {
+		return false
+	}
+	for _, u := range append(t.component, t) {
+		for _, c := range u.suspensions {
+			if !c.resumable && c.seen < len(c.producer.answers) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Run the clauses of the predicate for the call to exhaustion, adding the new answers to the
+// table.
+
+func (m *machine) evaluateClauses(t *table) {
+	t.goal = t.call.instantiate()
+	var actuals []ValueTerm
+	if s, ok := t.goal.(*ValueStruct); ok {
+		actuals = bind_terms(s.s.subterms, s.env)
+	}
+	sub := m.tableMachine(t)
+	defer m.releaseTableMachine(sub)
+	// The bottom choicepoint just fails, and keeps the trail from being emptied, since a
+	// consumer saves the bindings on it
+	sub.chps = append(sub.chps, sub.choicepoint(&frame{goals: []RuleTerm{m.st.failAtom},
+		module: t.module}))
+	if sub.tryClauses(actuals, t.pred.candidates(actuals), nil, 1) {
+		sub.collectAnswers()
+	}
+}
+
+// Resume the suspended consumer, which is in the evaluation of the table.
+
+func (m *machine) resume(t *table, c *consumer) {
+	sub := m.tableMachine(t)
+	defer m.releaseTableMachine(sub)
+	for _, b := range c.bindings {
+		assert(b.v.val == nil && b.v.next == nil)
+		b.v.val, b.v.next = b.val, b.next
+		sub.trail = append(sub.trail, b.v)
+	}
+	sub.chps = append(sub.chps, c.chps...)
+	sub.allocated = c.chps[len(c.chps)-1].allocMark
+	// Running the machine begins by backtracking into the consumer
+	sub.started = true
+	sub.collectAnswers()
+}
+
+// A machine that evaluates the table, whose resources are accounted to `m`, see limits.go.
+
+func (m *machine) tableMachine(t *table) *machine {
+	sub := m.st.newMachine(t.module, nil, nil)
+	sub.owner = t
+	sub.ctx, sub.limits, sub.inferences, sub.allocated = m.ctx, m.limits, m.inferences, m.allocated
+	sub.exhausted, sub.recoveryEnd = m.exhausted, m.recoveryEnd
+	return sub
+}
+
+func (m *machine) releaseTableMachine(sub *machine) {
+	m.inferences, m.exhausted, m.recoveryEnd = sub.inferences, sub.exhausted, sub.recoveryEnd
+	sub.reset()
+}
+
+// Run the machine to exhaustion, adding its solutions to its table as answers.
+
+func (m *machine) collectAnswers() {
+	st, t := m.st, m.owner
+	for m.run() {
+		answer := copyOut(t.goal)
+		if len(answer.bindings) > 0 {
+			st.typeError("acyclic_term", t.goal)
+		}
+		key := answer.variantKey()
+		if t.keys[key] {
+			continue
+		}
+		t.keys[key] = true
+		r := &rule{locals: answer.locals}
+		if s, ok := answer.t.(*RuleStruct); ok {
+			r.functor, r.formals, r.arity = s.functor, s.subterms, len(s.subterms)
+		} else {
+			r.functor = answer.t.(*Atom)
+		}
+		t.answers = append(t.answers, r)
+	}
+}
+
+// Consume the answers of the incomplete table.
+
+func (m *machine) consume(t *table, actuals []ValueTerm) bool {
+	c := &consumer{producer: t, actuals: actuals, resumable: m.st.resumable(m.cont)}
+	if !c.resumable {
+		m.owner.suspensions = append(m.owner.suspensions, c)
+	}
+	cp := m.choicepoint(m.cont)
+	cp.consumer = c
+	m.chps = append(m.chps, cp)
+	return m.retryConsumer(len(m.chps) - 1)
+}
+
+// Take the next answer of the table for the consumer whose choicepoint is at `top`, or suspend
+// it if there is none.
+
+func (m *machine) retryConsumer(top int) bool {
+	cp := m.chps[top]
+	c := cp.consumer
+	c.seen = len(c.producer.answers)
+	for c.next < len(c.producer.answers) {
+		r := c.producer.answers[c.next]
+		c.next++
+		m.allocated = cp.allocMark + int64(r.locals) + 1
+		if m.unifyHead(r, c.actuals) {
+			return true
+		}
+		m.undoTrail(cp.trailMark)
+	}
+	if c.resumable && c.chps == nil && c.producer.status != tableComplete {
+		m.suspend(top)
+	}
+	m.cutTo(top)
+	return false
+}
+
+// Save the consumer whose choicepoint is at `top` with the table of the machine.  Once it is
+// saved, a resumed consumer is the same as when it was suspended, so it is saved only once.
+
+func (m *machine) suspend(top int) {
+	cp := m.chps[top]
+	c := cp.consumer
+	c.bindings = make([]savedBinding, cp.trailMark)
+	for i, v := range m.trail[:cp.trailMark] {
+		c.bindings[i] = savedBinding{v: v, val: v.val, next: v.next}
+	}
+	c.chps = make([]choicepoint, top+1)
+	failed := &frame{goals: []RuleTerm{m.st.failAtom}, module: m.module}
+	for i, b := range m.chps[:top] {
+		c.chps[i] = choicepoint{trailMark: b.trailMark, allocMark: b.allocMark, cont: failed,
+			module: b.module}
+		if b.catch != nil {
+			c.chps[i].cont, c.chps[i].catch = b.cont, b.catch
+		}
+	}
+	c.chps[top] = cp
+	m.owner.suspensions = append(m.owner.suspensions, c)
+}
+
+// True if a consumer with the continuation can be resumed, see above.
+
+func (st *Store) resumable(cont *frame) bool {
+	for f := cont; f != nil; f = f.next {
+		if f.exit != nil {
+			return false
+		}
+		for _, g := range f.goals {
+			if st.commits(g) {
+				return false
+			}
+		}
+		if f.code != nil && st.commitsCode(f.code, f.pc) {
+			return false
+		}
+	}
+	return true
+}
+
+// True if the compiled clause commits from `pc` on, as st.commits.
+
+func (st *Store) commitsCode(c *clauseCode, pc int) bool {
+	for _, in := range c.code[pc:] {
+		switch {
+		case in.op == cut,
+			in.op == solve && st.commits(in.goal),
+			(in.op == call || in.op == execute) && in.functor == st.bagAddAtom:
+			return true
+		}
+	}
+	return false
+}
+
+func (st *Store) commits(g RuleTerm) bool {
+	switch g := g.(type) {
+	case *Atom:
+		return g == st.cutAtom
+	case *RuleStruct:
+		switch g.functor {
+		case st.cutToAtom, st.softCutAtom, st.bagAddAtom:
+			return true
+		case st.commaAtom, st.semicolonAtom, st.ifAtom, st.softIfAtom:
+			for _, s := range g.subterms {
+				if st.commits(s) {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// A key that is the same for two copied terms if and only if they are variants, given that their
+// locals are numbered in the order of their first occurrence, as by copyOut.
+
+func (c copiedTerm) variantKey() string {
+	var b strings.Builder
+	writeVariantKey(&b, c.t)
+	for _, lb := range c.bindings {
+		b.WriteString("=" + strconv.Itoa(lb.slot) + ";")
+		writeVariantKey(&b, lb.t)
+	}
+	return b.String()
+}
+
+func writeVariantKey(b *strings.Builder, t RuleTerm) {
+	switch x := t.(type) {
+	case *Local:
+		b.WriteString("_" + strconv.Itoa(x.slot) + ";")
+	case *Atom:
+		b.WriteString("a" + strconv.Itoa(len(x.name)) + ":" + x.name)
+	case *Number:
+		b.WriteString("n" + x.String() + ";")
+	case *Float:
+		b.WriteString("f" + x.String() + ";")
+	case *String:
+		b.WriteString("t" + strconv.Itoa(len(x.value)) + ":" + x.value)
+	case *RuleStruct:
+		b.WriteString("s" + strconv.Itoa(len(x.functor.name)) + ":" + x.functor.name +
+			strconv.Itoa(len(x.subterms)) + "(")
+		for _, s := range x.subterms {
+			writeVariantKey(b, s)
+		}
+	}
+}
@@ -0,0 +1,369 @@
+package engine
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Text built-ins: conversions between atoms, strings, numbers and lists of codes or characters,
+// and the predicates that take text apart.
+//
+// Where a predicate expects text it accepts an atom, a string, a number, which stands for the
+// text it is written as, or a list of codes or characters.  Lengths and offsets count characters,
+// not bytes.  The nondeterministic predicates sub_atom/5, sub_string/5, atom_concat/3 and
+// string_concat/3 are defined in system.pl on top of '$sub_text'/7, which computes all the
+// solutions at once.
+
+func (st *Store) initTextBuiltins() {
+	st.addBuiltin("atom_codes", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertText(args[0], "atom", args[1], "codes")
+	})
+	st.addBuiltin("atom_chars", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertText(args[0], "atom", args[1], "chars")
+	})
+	st.addBuiltin("atom_string", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertText(args[0], "atom", args[1], "string")
+	})
+	st.addBuiltin("string_codes", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertText(args[0], "string", args[1], "codes")
+	})
+	st.addBuiltin("string_chars", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertText(args[0], "string", args[1], "chars")
+	})
+	st.addBuiltin("string_to_atom", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertText(args[0], "string", args[1], "atom")
+	})
+	st.addBuiltin("number_codes", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertNumber(args[0], args[1], "codes", true)
+	})
+	st.addBuiltin("number_chars", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertNumber(args[0], args[1], "chars", true)
+	})
+	st.addBuiltin("number_string", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertNumber(args[0], args[1], "string", true)
+	})
+	st.addBuiltin("atom_number", 2, func(m *machine, args []ValueTerm) bool {
+		return m.convertNumber(args[1], args[0], "atom", false)
+	})
+	st.addBuiltin("char_code", 2, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		if c, ok := deref(args[0]).(*Atom); ok {
+			if utf8.RuneCountInString(c.name) != 1 {
+				st.typeError("character", c)
+			}
+			r, _ := utf8.DecodeRuneInString(c.name)
+			return m.unify(args[1], st.NewNumber(int64(r)))
+		}
+		if _, isVar := deref(args[0]).(*Varslot); !isVar {
+			st.typeError("character", deref(args[0]))
+		}
+		return m.unify(args[0], st.NewAtom(string(st.code(args[1]))))
+	})
+	st.addBuiltin("atom_length", 2, func(m *machine, args []ValueTerm) bool {
+		return m.textLength(args[0], "atom", args[1])
+	})
+	st.addBuiltin("string_length", 2, func(m *machine, args []ValueTerm) bool {
+		return m.textLength(args[0], "string", args[1])
+	})
+	st.addBuiltin("$sub_text", 7, func(m *machine, args []ValueTerm) bool {
+		return m.subText(args)
+	})
+	st.addBuiltin("$text_concat", 4, func(m *machine, args []ValueTerm) bool {
+		st := m.st
+		kind := deref(args[0]).(*Atom).name
+		s1, _ := st.text(args[1], kind, true)
+		s2, _ := st.text(args[2], kind, true)
+		return m.unify(args[3], st.makeText(kind, s1+s2))
+	})
+}
+
+// The text of `t`, where text of the type `typ` is expected.  If `t` is unbound then this raises
+// an instantiation error if `required`, and otherwise returns false.  A compound term that is
+// not a list is a type error for `typ`.
+
+func (st *Store) text(t ValueTerm, typ string, required bool) (string, bool) {
+	switch x := deref(t).(type) {
+	case *Varslot:
+		if required {
+			st.instantiationError()
+		}
+		return "", false
+	case *Atom:
+		return x.name, true
+	case *String:
+		return x.value, true
+	case *Number, *Float:
+		return x.String(), true
+	case *ValueStruct:
+		if !isListFunctor(x.s.functor, len(x.s.subterms)) {
+			st.typeError(typ, x)
+		}
+		if s, ok := st.listText(x); ok {
+			return s, true
+		}
+		if required {
+			st.instantiationError()
+		}
+		return "", false
+	}
+	panic("Unknown term type")
+}
+
+// The text of a list of codes or characters.  Returns false if the list is partial or has
+// unbound elements, and raises a type error if it is not a list of codes or characters.
+
+func (st *Store) listText(t ValueTerm) (string, bool) {
+	var b strings.Builder
+	for {
+		switch x := deref(t).(type) {
+		case *Varslot:
+			return "", false
+		case *Atom:
+			if x != st.nilAtom {
+				st.typeError("list", t)
+			}
+			return b.String(), true
+		case *ValueStruct:
+			if !isListFunctor(x.s.functor, len(x.s.subterms)) {
+				st.typeError("list", t)
+			}
+			switch e := deref(bind(x.s.subterms[0], x.env)).(type) {
+			case *Varslot:
+				return "", false
+			case *Number:
+				b.WriteRune(st.code(e))
+			case *Atom:
+				if utf8.RuneCountInString(e.name) != 1 {
+					st.typeError("character", e)
+				}
+				b.WriteString(e.name)
+			default:
+				st.typeError("character_code", e)
+			}
+			t = bind(x.s.subterms[1], x.env)
+		default:
+			st.typeError("list", t)
+		}
+	}
+}
+
+// The character of a code.
+
+func (st *Store) code(t ValueTerm) rune {
+	switch c := deref(t).(type) {
+	case *Varslot:
+		st.instantiationError()
+	case *Number:
+		if c.big != nil || c.value < 0 || c.value > unicode.MaxRune {
+			st.representationError("character_code")
+		}
+		return rune(c.value)
+	default:
+		st.typeError("integer", c)
+	}
+	panic("Unreachable")
+}
+
+// The text as a term of the kind: an atom, a string, or a list of codes or characters.
+
+func (st *Store) makeText(kind string, s string) ValueTerm {
+	switch kind {
+	case "atom":
+		return st.NewAtom(s)
+	case "string":
+		return st.NewString(s)
+	case "codes":
+		codes := []ValueTerm{}
+		for _, r := range s {
+			codes = append(codes, st.NewNumber(int64(r)))
+		}
+		return st.newList(codes, st.nilAtom)
+	case "chars":
+		chars := []ValueTerm{}
+		for _, r := range s {
+			chars = append(chars, st.NewAtom(string(r)))
+		}
+		return st.newList(chars, st.nilAtom)
+	}
+	panic("Unknown text kind")
+}
+
+// Convert between two representations of a text.  The first is converted to the second unless
+// it is unbound.
+
+func (m *machine) convertText(t1 ValueTerm, kind1 string, t2 ValueTerm, kind2 string) bool {
+	st := m.st
+	if s, ok := st.textOfKind(t1, kind1, false); ok {
+		return m.unify(t2, st.makeText(kind2, s))
+	}
+	s, _ := st.textOfKind(t2, kind2, true)
+	return m.unify(t1, st.makeText(kind1, s))
+}
+
+// The text of `t`, where [] is the empty list if the kind is a list and otherwise the atom.
+
+func (st *Store) textOfKind(t ValueTerm, kind string, required bool) (string, bool) {
+	if kind == "codes" || kind == "chars" {
+		if deref(t) == ValueTerm(st.nilAtom) {
+			return "", true
+		}
+		return st.text(t, "list", required)
+	}
+	return st.text(t, kind, required)
+}
+
+// Convert between a number and its text.  If the text is bound then it is parsed; text that is
+// not a number is a syntax error if `strict` and otherwise fails.
+
+func (m *machine) convertNumber(num ValueTerm, t ValueTerm, kind string, strict bool) bool {
+	st := m.st
+	if s, ok := st.textOfKind(t, kind, false); ok {
+		n, ok := st.parseNumber(s)
+		if !ok {
+			if strict {
+				st.raise(newValueStruct(st.NewAtom("syntax_error"), []ValueTerm{st.NewAtom("illegal_number")}))
+			}
+			return false
+		}
+		return m.unify(num, n)
+	}
+	switch n := deref(num).(type) {
+	case *Varslot:
+		st.instantiationError()
+	case *Number, *Float:
+		return m.unify(t, st.makeText(kind, n.String()))
+	default:
+		st.typeError("number", n)
+	}
+	panic("Unreachable")
+}
+
+// The number that is written as `text`, which may have leading layout and a minus sign.
+
+func (st *Store) parseNumber(text string) (n ValueTerm, ok bool) {
+	s := strings.TrimLeftFunc(text, unicode.IsSpace)
+	sign := ""
+	if strings.HasPrefix(s, "-") {
+		s, sign = s[1:], "-"
+	}
+	if s == "" || !isDigitChar(rune(s[0])) {
+		return nil, false
+	}
+	t := newTokenizer("", strings.NewReader(s))
+	defer func() {
+		if x := recover(); x != nil {
+			if _, isSyntaxError := x.(*SyntaxError); !isSyntaxError {
+				panic(x)
+			}
+			n, ok = nil, false
+		}
+	}()
+	tok := t.get()
+	if t.get().kind != tokEOF {
+		return nil, false
+	}
+	switch tok.kind {
+	case tokNumber:
+		return parseInteger(sign + tok.text)
+	case tokFloat:
+		return parseFloat(sign + tok.text)
+	}
+	return nil, false
+}
+
+func (m *machine) textLength(t ValueTerm, typ string, length ValueTerm) bool {
+	st := m.st
+	s, _ := st.text(t, typ, true)
+	switch n := deref(length).(type) {
+	case *Varslot:
+	case *Number:
+		if sign(n) < 0 {
+			st.domainError("not_less_than_zero", n)
+		}
+	default:
+		st.typeError("integer", n)
+	}
+	return m.unify(length, st.NewNumber(int64(utf8.RuneCountInString(s))))
+}
+
+// '$sub_text'(Kind, Text, B, L, A, Sub, Solutions) unifies Solutions with a list of s(B, L, A,
+// Sub) for the substrings Sub of Text that have B characters before them, L characters, and A
+// characters after them, for the values of B, L, A and Sub that are bound.  Sub is of the kind
+// atom or string.
+
+func (m *machine) subText(args []ValueTerm) bool {
+	st := m.st
+	kind := deref(args[0]).(*Atom).name
+	s, _ := st.text(args[1], kind, true)
+	runes := []rune(s)
+	n := len(runes)
+	bound := func(t ValueTerm) (int, bool) {
+		switch x := deref(t).(type) {
+		case *Varslot:
+			return 0, false
+		case *Number:
+			if x.big != nil || x.value < 0 {
+				return -1, true
+			}
+			return int(min(x.value, int64(n)+1)), true
+		default:
+			st.typeError("integer", x)
+		}
+		panic("Unreachable")
+	}
+	b, hasB := bound(args[2])
+	l, hasL := bound(args[3])
+	a, hasA := bound(args[4])
+	sub, hasSub := st.text(args[5], kind, false)
+	subRunes := []rune(sub)
+
+	s4 := st.NewAtom("s")
+	solutions := []ValueTerm{}
+	add := func(b, l int) {
+		if b < 0 || l < 0 || b+l > n || hasA && n-b-l != a {
+			return
+		}
+		text := string(runes[b : b+l])
+		if hasSub && text != sub {
+			return
+		}
+		solutions = append(solutions, newValueStruct(s4, []ValueTerm{
+			st.NewNumber(int64(b)), st.NewNumber(int64(l)), st.NewNumber(int64(n - b - l)),
+			st.makeText(kind, text)}))
+	}
+	switch {
+	case hasSub:
+		// Only the occurrences of Sub
+		for i := 0; i+len(subRunes) <= n; i++ {
+			if !hasB || i == b {
+				add(i, len(subRunes))
+			}
+		}
+	case hasB && hasL:
+		add(b, l)
+	case hasB && hasA:
+		add(b, n-b-a)
+	case hasL && hasA:
+		add(n-l-a, l)
+	case hasB:
+		for i := 0; b+i <= n; i++ {
+			add(b, i)
+		}
+	case hasL:
+		for i := 0; i+l <= n; i++ {
+			add(i, l)
+		}
+	case hasA:
+		for i := 0; i <= n-a; i++ {
+			add(i, n-a-i)
+		}
+	default:
+		for i := 0; i <= n; i++ {
+			for j := 0; i+j <= n; j++ {
+				add(i, j)
+			}
+		}
+	}
+	return m.unify(args[6], st.newList(solutions, st.nilAtom))
+}
@@ -0,0 +1,506 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// The tokenizer reads Unicode text.  Names start with a lower case letter, or with any letter
+// that has no case, and variables with an upper case letter or `_`; both continue with letters,
+// digits and `_`.  Symbol names are made of the ASCII symbol characters and the Unicode
+// symbols.  Layout is any white space, `%` to the end of the line, and `/* ... */`.  A line ends
+// with \n, \r\n or \r.
+//
+// Quoted atoms and strings may contain the quote written twice, which stands for itself, and
+// the escape sequences \n, \t, \r, \a, \b, \f, \v, \e, \0 to \7 followed by octal digits and
+// a backslash, \x followed by hex digits and a backslash, \uXXXX, \UXXXXXXXX, and a backslash
+// before a backslash, a quote or a newline, which is skipped.  Numbers are decimal, hexadecimal
+// with 0x, octal with 0o, binary with 0b, or 0' followed by a character or an escape sequence,
+// which is the code of the character.
+//
+// Syntax errors are reported with the line and the column, counted in characters from 1.
+
+type tokenizer struct {
+	input    io.RuneScanner
+	filename string
+	lineno   int
+
+	// The column of the character that was read last, 0 at the start of a line
+	column int
+
+	// True if the end of the previous clause was followed by a newline, which has been read but
+	// is counted only when the next token is read, so that errors at the end are on the right line.
+	endOfLine bool
+
+	// Characters that have been read ahead and pushed back, the last one first.
+	pushback []rune
+}
+
+// Tokens are classified coarsely, the reader decides whether a name is an operator.  `layout`
+// is true if the token was preceded by whitespace or a comment, which matters for telling
+// f(x), a call in functional notation, from the prefix operator application - (x).
+
+type token struct {
+	kind   int
+	text   string
+	layout bool
+
+	// Where the token starts
+	line   int
+	column int
+}
+
+const (
+	tokEOF = iota
+	tokName
+	tokVar
+	tokNumber
+	tokFloat
+	tokString // the text between double quotes
+	tokPunct  // ( ) [ ] { } , |
+	tokEnd    // the period that ends a clause
+)
+
+func newTokenizer(filename string, r io.RuneScanner) *tokenizer {
+	return &tokenizer{
+		input:    r,
+		filename: filename,
+		lineno:   1,
+	}
+}
+
+// Syntax errors are raised by panicking with a *SyntaxError, which the reader recovers from and
+// returns as an error, see readClause.
+
+type SyntaxError struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s:%d:%d: syntax error: %s", e.File, e.Line, e.Column, e.Message)
+}
+
+// A syntax error at the character that was read last.
+
+func (t *tokenizer) syntaxError(s string) {
+	panic(&SyntaxError{t.filename, t.lineno, max(t.column, 1), s})
+}
+
+// A syntax error at the start of a token.
+
+func (t *tokenizer) syntaxErrorAt(tok token, s string) {
+	if tok.kind == tokEOF {
+		t.syntaxError(s)
+	}
+	panic(&SyntaxError{t.filename, tok.line, tok.column, s})
+}
+
+func (t *tokenizer) peekChar() rune {
+	if n := len(t.pushback); n > 0 {
+		return t.pushback[n-1]
+	}
+	r, _, err := t.input.ReadRune()
+	if err == io.EOF {
+		return -1
+	}
+	if err != nil {
+		t.syntaxError("Bad input: " + err.Error())
+	}
+	t.input.UnreadRune()
+	return r
+}
+
+func (t *tokenizer) getChar() rune {
+	if n := len(t.pushback); n > 0 {
+		r := t.pushback[n-1]
+		t.pushback = t.pushback[:n-1]
+		t.column++
+		return r
+	}
+	r, _, err := t.input.ReadRune()
+	if err == io.EOF {
+		return -1
+	}
+	if err != nil {
+		t.syntaxError("Bad input: " + err.Error())
+	}
+	if r == '\n' {
+		t.column = 0
+	} else {
+		t.column++
+	}
+	return r
+}
+
+// Push back characters that have been read, so that they are read again in the same order.
+// They are not line breaks.
+
+func (t *tokenizer) unget(rs ...rune) {
+	for i := len(rs) - 1; i >= 0; i-- {
+		t.pushback = append(t.pushback, rs[i])
+	}
+	t.column -= len(rs)
+}
+
+func (t *tokenizer) get() (tok token) {
+	if t.endOfLine {
+		t.lineno++
+		t.column = 0
+		t.endOfLine = false
+	}
+outer:
+	for {
+		r := t.getChar()
+		tok.line, tok.column = t.lineno, t.column
+		if r == -1 {
+			tok.kind = tokEOF
+			return
+		}
+		if r == '\n' || r == '\r' {
+			t.newline(r)
+			tok.layout = true
+			continue
+		}
+		if unicode.IsSpace(r) {
+			tok.layout = true
+			continue
+		}
+		if r == '%' {
+			for r := t.peekChar(); r != -1 && r != '\n' && r != '\r'; r = t.peekChar() {
+				t.getChar()
+			}
+			tok.layout = true
+			continue
+		}
+		if r == '/' && t.peekChar() == '*' {
+			t.getChar()
+			tok.layout = true
+			for {
+				r := t.getChar()
+				if r == -1 {
+					t.syntaxError("EOF in comment")
+				}
+				if r == '*' && t.peekChar() == '/' {
+					t.getChar()
+					continue outer
+				}
+				if r == '\n' || r == '\r' {
+					t.newline(r)
+				}
+			}
+		}
+		if r == '(' || r == ')' || r == '[' || r == ']' || r == '{' || r == '}' || r == ',' || r == '|' {
+			tok.kind = tokPunct
+			tok.text = string(r)
+			return
+		}
+		if r == '.' {
+			// The layout character that follows the end is consumed with it, so that the top
+			// level does not read past the end of the line.  The line is counted when the next
+			// token is read, so that errors at the end are on the right line.
+			if next := t.peekChar(); next == -1 || next == '%' || unicode.IsSpace(next) {
+				if next == '\n' || next == '\r' {
+					column := t.column
+					if t.getChar() == '\r' && t.peekChar() == '\n' {
+						t.getChar()
+					}
+					t.endOfLine, t.column = true, column
+				} else if next != -1 && next != '%' {
+					t.getChar()
+				}
+				tok.kind = tokEnd
+				return
+			}
+		}
+		if r == '!' || r == ';' {
+			tok.kind = tokName
+			tok.text = string(r)
+			return
+		}
+		if r == '\'' {
+			tok.text = t.lexQuoted(r, "unterminated quoted atom")
+			tok.kind = tokName
+			return
+		}
+		if r == '"' {
+			tok.text = t.lexQuoted(r, "unterminated string")
+			tok.kind = tokString
+			return
+		}
+		if isSymbolChar(r) {
+			tok.text = t.lexWhile(isSymbolChar, string(r))
+			tok.kind = tokName
+			return
+		}
+		if isDigitChar(r) {
+			tok.kind = tokNumber
+			if r == '0' && t.lexSpecialNumber(&tok) {
+				return
+			}
+			tok.text = t.lexWhile(isDigitChar, string(r))
+			t.lexFloat(&tok)
+			return
+		}
+		if isVarFirstChar(r) {
+			tok.text = t.lexWhile(isAtomNextChar, string(r))
+			tok.kind = tokVar
+			return
+		}
+		if isAtomFirstChar(r) {
+			tok.text = t.lexWhile(isAtomNextChar, string(r))
+			tok.kind = tokName
+			return
+		}
+		t.syntaxError(fmt.Sprintf("bad character: %q", r))
+	}
+}
+
+// Count a line break, which has been read.  \r\n is one line break.
+
+func (t *tokenizer) newline(r rune) {
+	if r == '\r' && t.peekChar() == '\n' {
+		t.getChar()
+	}
+	t.lineno++
+	t.column = 0
+}
+
+// The text of a quoted atom or string, after the opening quote.  An error in an escape sequence
+// is raised once the closing quote has been read, so that the reader skips the rest of the clause
+// from after the quoted text rather than from inside it.
+
+func (t *tokenizer) lexQuoted(quote rune, unterminated string) string {
+	var b strings.Builder
+	var escapeErr *SyntaxError
+	for {
+		r := t.getChar()
+		switch r {
+		case -1, '\n', '\r':
+			if escapeErr != nil {
+				panic(escapeErr)
+			}
+			t.syntaxError(unterminated)
+		case quote:
+			if t.peekChar() != quote {
+				if escapeErr != nil {
+					panic(escapeErr)
+				}
+				return b.String()
+			}
+			t.getChar()
+			b.WriteRune(quote)
+		case '\\':
+			if next := t.peekChar(); next == '\n' || next == '\r' {
+				t.newline(t.getChar())
+				continue
+			}
+			b.WriteRune(t.lexEscapeIn(&escapeErr))
+		default:
+			b.WriteRune(r)
+		}
+	}
+}
+
+// The character of an escape sequence in quoted text.  If the sequence is bad then the error is
+// kept in `escapeErr`, unless there is one already.
+
+func (t *tokenizer) lexEscapeIn(escapeErr **SyntaxError) rune {
+	defer func() {
+		if x := recover(); x != nil {
+			serr, ok := x.(*SyntaxError)
+			if !ok {
+				panic(x)
+			}
+			if *escapeErr == nil {
+				*escapeErr = serr
+			}
+		}
+	}()
+	return t.lexEscape()
+}
+
+// The character of an escape sequence, after the backslash.
+
+func (t *tokenizer) lexEscape() rune {
+	r := t.getChar()
+	switch r {
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case 'r':
+		return '\r'
+	case 'a':
+		return '\a'
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'v':
+		return '\v'
+	case 'e':
+		return 0x1b
+	case '\\', '\'', '"', '`':
+		return r
+	case 'x':
+		return t.lexCode(t.lexWhile(isHexDigit, ""), 16, true)
+	case 'u':
+		return t.lexCode(t.lexCount(isHexDigit, 4), 16, false)
+	case 'U':
+		return t.lexCode(t.lexCount(isHexDigit, 8), 16, false)
+	}
+	if r >= '0' && r <= '7' {
+		return t.lexCode(t.lexWhile(isOctalDigit, string(r)), 8, true)
+	}
+	if r == -1 {
+		t.syntaxError("unterminated escape sequence")
+	}
+	t.syntaxError(fmt.Sprintf("undefined escape sequence \\%c", r))
+	panic("Unreachable")
+}
+
+// The character with the code in the digits, which are followed by a backslash if `closed`.
+
+func (t *tokenizer) lexCode(digits string, base int, closed bool) rune {
+	code, err := strconv.ParseInt(digits, base, 32)
+	if digits == "" || err != nil || code > unicode.MaxRune {
+		t.syntaxError("bad character code in escape sequence")
+	}
+	if closed {
+		// The character is not read unless it is the backslash, since it may be the closing quote
+		if t.peekChar() != '\\' {
+			t.syntaxError("escape sequence must end with a backslash")
+		}
+		t.getChar()
+	}
+	return rune(code)
+}
+
+// Exactly `n` characters for which isChar is true.
+
+func (t *tokenizer) lexCount(isChar func(r rune) bool, n int) string {
+	s := ""
+	for i := 0; i < n; i++ {
+		if !isChar(t.peekChar()) {
+			t.syntaxError("bad character code in escape sequence")
+		}
+		s += string(t.getChar())
+	}
+	return s
+}
+
+// A number that starts with 0 and a letter, after the 0: 0'c, 0x, 0o or 0b.  Returns false if
+// it is not one of those, having read nothing more.  The text of the token is the decimal code
+// of 0'c and otherwise the text of the number, see parseInteger.
+
+func (t *tokenizer) lexSpecialNumber(tok *token) bool {
+	switch t.peekChar() {
+	case '\'':
+		t.getChar()
+		r := t.getChar()
+		switch r {
+		case -1, '\n', '\r':
+			t.syntaxError("character expected after 0'")
+		case '\\':
+			r = t.lexEscape()
+		case '\'':
+			// The quote may be written twice
+			if t.peekChar() == '\'' {
+				t.getChar()
+			}
+		}
+		tok.text = strconv.Itoa(int(r))
+		return true
+	case 'x', 'o', 'b':
+		isDigit := map[rune]func(r rune) bool{'x': isHexDigit, 'o': isOctalDigit, 'b': isBinaryDigit}
+		prefix := t.getChar()
+		if !isDigit[prefix](t.peekChar()) {
+			t.unget(prefix)
+			return false
+		}
+		tok.text = t.lexWhile(isDigit[prefix], "0"+string(prefix))
+		return true
+	}
+	return false
+}
+
+// A float is an integer followed by a fraction, an exponent, or both: 1.5, 1.0e10, 1e-3.  A
+// period that is not followed by a digit ends the clause.
+
+func (t *tokenizer) lexFloat(tok *token) {
+	if t.peekChar() == '.' {
+		t.getChar()
+		if !isDigitChar(t.peekChar()) {
+			t.unget('.')
+			return
+		}
+		tok.text = t.lexWhile(isDigitChar, tok.text+".")
+		tok.kind = tokFloat
+	}
+	if r := t.peekChar(); r == 'e' || r == 'E' {
+		t.getChar()
+		exponent := []rune{r}
+		if r := t.peekChar(); r == '+' || r == '-' {
+			exponent = append(exponent, t.getChar())
+		}
+		if !isDigitChar(t.peekChar()) {
+			t.unget(exponent...)
+			return
+		}
+		tok.text = t.lexWhile(isDigitChar, tok.text+string(exponent))
+		tok.kind = tokFloat
+	}
+}
+
+// This depends on isChar() being false for -1 and newlines
+func (t *tokenizer) lexWhile(isChar func(r rune) bool, s string) string {
+	for isChar(t.peekChar()) {
+		s = s + string(t.getChar())
+	}
+	return s
+}
+
+// Symbol characters make up names like `:-`, `=..` and `\+`.  Whether such a name is an
+// operator is determined by the operator table in the store, not by the tokenizer.
+
+func isSymbolChar(r rune) bool {
+	switch r {
+	case '+', '-', '*', '/', '\\', '^', '<', '>', '=', '~', ':', '.', '?', '@', '#', '&', '$':
+		return true
+	}
+	return r > unicode.MaxASCII && unicode.IsSymbol(r)
+}
+
+func isDigitChar(r rune) bool {
+	return r >= '0' && r <= '9'
+}
+
+func isHexDigit(r rune) bool {
+	return isDigitChar(r) || r >= 'a' && r <= 'f' || r >= 'A' && r <= 'F'
+}
+
+func isOctalDigit(r rune) bool {
+	return r >= '0' && r <= '7'
+}
+
+func isBinaryDigit(r rune) bool {
+	return r == '0' || r == '1'
+}
+
+func isAtomFirstChar(r rune) bool {
+	return unicode.IsLower(r) || unicode.IsLetter(r) && !unicode.IsUpper(r) && !unicode.IsTitle(r)
+}
+
+func isVarFirstChar(r rune) bool {
+	return unicode.IsUpper(r) || unicode.IsTitle(r) || r == '_'
+}
+
+func isAtomNextChar(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '_'
+}
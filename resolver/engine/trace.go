@@ -0,0 +1,313 @@
+package engine
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// The tracer.  trace/0 turns on tracing, and spy/1 sets a spy point on a predicate.  While
+// either is on, every call is followed through the four ports of the box model:
+//
+//   Call    the goal is called
+//   Exit    the goal succeeds
+//   Redo    the machine backtracks into a goal that has succeeded, to find another solution
+//   Fail    the goal has no more solutions
+//
+// Each event is given to the Tracer of the store, with the depth of the call, the number of the
+// invocation, and the goal with its current bindings.  The tracer answers with an action:
+//
+//   Creep   show the next event
+//   Skip    at Call or Redo, do not show the events inside the goal, only its Exit or Fail
+//   Leap    do not show events until a predicate with a spy point is called
+//   Abort   abandon the query
+//
+// While tracing every event is shown, otherwise only the events of predicates that have a spy
+// point; reaching one turns on tracing.  Tracing lasts until the end of the query, so trace/0
+// is called in the query that is to be traced.  Predicates whose names start with '$' are not shown,
+// and the predicates of the library are shown but the calls inside them are not.
+//
+// A traced call to a predicate pushes a choicepoint that reports Fail when it is backtracked
+// into, and a frame on the continuation that reports Exit when it is reached.  If the goal leaves
+// choicepoints when it exits then a choicepoint that reports Redo is pushed on top of them;
+// otherwise the Fail choicepoint is removed, since the goal cannot be backtracked into.  The
+// frames of the traced calls are on the continuation until the calls exit, so the depth of a call
+// is one more than that of the closest one on the continuation.  Built-ins report Call and then
+// Exit or Fail.
+
+type Port int
+
+const (
+	CallPort Port = iota
+	ExitPort
+	RedoPort
+	FailPort
+)
+
+func (p Port) String() string {
+	return [...]string{"Call", "Exit", "Redo", "Fail"}[p]
+}
+
+type TraceAction int
+
+const (
+	Creep TraceAction = iota
+	Skip
+	Leap
+	Abort
+)
+
+type TraceEvent struct {
+	Port       Port
+	Depth      int
+	Invocation int64
+	Goal       ValueTerm
+
+	text string
+}
+
+// The event as ` Call: (Depth) Goal`, with the goal written as by writeq/1 and the variables
+// named _G1, _G2, ... in the order in which the tracer has seen them in the query.
+
+func (e TraceEvent) String() string {
+	return e.text
+}
+
+// A Tracer receives the events of traced calls.
+
+type Tracer interface {
+	Trace(e TraceEvent) TraceAction
+}
+
+// Set the tracer, which is nil by default, in which case the events are not shown.
+
+func (st *Store) SetTracer(t Tracer) {
+	st.debugger.tracer = t
+}
+
+// A tracer that writes the events, one per line, and always creeps.
+
+func NewPrintTracer(w io.Writer) Tracer {
+	return printTracer{w}
+}
+
+type printTracer struct {
+	w io.Writer
+}
+
+func (t printTracer) Trace(e TraceEvent) TraceAction {
+	fmt.Fprintln(t.w, e.String())
+	return Creep
+}
+
+type debugger struct {
+	tracer  Tracer
+	tracing bool
+	spies   map[predicateKey]bool
+
+	// The invocation that is being skipped, or 0.
+	skip int64
+
+	invocations int64
+
+	// Names for the variables in the events of the current query.  Every query starts with no
+	// names and gives back those of the query it was made in when it is closed, see engine.go.
+	varNames map[*Varslot]string
+}
+
+func (d *debugger) active() bool {
+	return d.tracing || len(d.spies) > 0
+}
+
+// Set whether the tracer is tracing, which invocation it is skipping, and the names of the
+// variables.
+
+func (d *debugger) restore(tracing bool, skip int64, varNames map[*Varslot]string) {
+	d.tracing, d.skip, d.varNames = tracing, skip, varNames
+}
+
+// A call that is being traced.
+
+type traceCall struct {
+	invocation int64
+	depth      int
+	key        predicateKey
+	goal       ValueTerm
+
+	// The height of the stack below the Fail choicepoint.
+	height int
+
+	// True if the calls inside the goal are not traced.
+	hidden bool
+}
+
+func (st *Store) initTraceBuiltins() {
+	st.addBuiltin("trace", 0, func(m *machine, args []ValueTerm) bool {
+		m.st.debugger.tracing = true
+		return true
+	})
+	st.addBuiltin("notrace", 0, func(m *machine, args []ValueTerm) bool {
+		d := &m.st.debugger
+		d.tracing, d.skip = false, 0
+		return true
+	})
+	st.addBuiltin("spy", 1, func(m *machine, args []ValueTerm) bool {
+		d := &m.st.debugger
+		if d.spies == nil {
+			d.spies = make(map[predicateKey]bool)
+		}
+		for _, key := range m.st.spySpec(args[0]) {
+			d.spies[key] = true
+		}
+		return true
+	})
+	st.addBuiltin("nospy", 1, func(m *machine, args []ValueTerm) bool {
+		for _, key := range m.st.spySpec(args[0]) {
+			delete(m.st.debugger.spies, key)
+		}
+		return true
+	})
+	st.addBuiltin("nospyall", 0, func(m *machine, args []ValueTerm) bool {
+		m.st.debugger.spies = nil
+		return true
+	})
+	st.addBuiltin("abort", 0, func(m *machine, args []ValueTerm) bool {
+		panic(&Exception{m.st.abortedAtom})
+	})
+}
+
+// The predicates of a spy specification, which is Name/Arity or Name for all the predicates with
+// that name.
+
+func (st *Store) spySpec(spec ValueTerm) []predicateKey {
+	if name, ok := deref(spec).(*Atom); ok {
+		keys := []predicateKey{}
+		arities := make(map[int]bool)
+		for _, md := range st.modules {
+			for arity := range md.rules[name] {
+				arities[arity] = true
+			}
+		}
+		for arity := range arities {
+			keys = append(keys, predicateKey{name, arity})
+		}
+		if len(keys) == 0 {
+			st.existenceError("procedure", name)
+		}
+		return keys
+	}
+	functor, arity := st.predicateIndicator(spec)
+	return []predicateKey{{functor, arity}}
+}
+
+// Call a predicate with tracing.
+
+func (m *machine) traceCall(functor *Atom, actuals []ValueTerm) bool {
+	st := m.st
+	parent := m.tracedParent()
+	if parent != nil && parent.hidden || strings.HasPrefix(functor.name, "$") {
+		return m.callPredicate(functor, actuals)
+	}
+	d := &st.debugger
+	d.invocations++
+	c := &traceCall{invocation: d.invocations, depth: 1, key: predicateKey{functor, len(actuals)},
+		goal: functor}
+	if parent != nil {
+		c.depth = parent.depth + 1
+	}
+	if len(actuals) > 0 {
+		c.goal = newValueStruct(functor, actuals)
+	}
+	if b := st.lookupBuiltin(functor, len(actuals)); b != nil {
+		m.port(CallPort, c)
+		if m.callPredicate(functor, actuals) {
+			m.port(ExitPort, c)
+			return true
+		}
+		m.port(FailPort, c)
+		return false
+	}
+	if p := st.lookupPredicate(m.module, functor, len(actuals)); p != nil && p.module == st.systemModule {
+		c.hidden = true
+	}
+	m.port(CallPort, c)
+	c.height = len(m.chps)
+	cp := m.choicepoint(nil)
+	cp.trace = c
+	m.chps = append(m.chps, cp)
+	m.cont = &frame{exit: c, next: m.cont}
+	return m.callPredicate(functor, actuals)
+}
+
+// The closest traced call on the continuation, or nil.
+
+func (m *machine) tracedParent() *traceCall {
+	for f := m.cont; f != nil; f = f.next {
+		if f.exit != nil {
+			return f.exit
+		}
+	}
+	return nil
+}
+
+func (m *machine) traceExit(c *traceCall) {
+	m.port(ExitPort, c)
+	if len(m.chps) == c.height+1 {
+		m.cutTo(c.height)
+		return
+	}
+	// The bindings are undone to the choicepoint below, so that Redo shows the goal as it is
+	// retried
+	below := m.chps[len(m.chps)-1]
+	cp := choicepoint{trailMark: below.trailMark, allocMark: below.allocMark, trace: c, redo: true}
+	m.chps = append(m.chps, cp)
+}
+
+// Report an event to the tracer if it is to be shown, and act on the answer.
+
+func (m *machine) port(p Port, c *traceCall) {
+	d := &m.st.debugger
+	if d.skip != 0 {
+		if c.invocation != d.skip || p == CallPort || p == RedoPort {
+			return
+		}
+		d.skip = 0
+	} else if !d.tracing && !d.spies[c.key] {
+		return
+	}
+	d.tracing = true
+	if d.tracer == nil {
+		return
+	}
+	e := TraceEvent{Port: p, Depth: c.depth, Invocation: c.invocation, Goal: c.goal}
+	e.text = fmt.Sprintf("%5s: (%d) %s", p, c.depth, m.st.formatTraced(c.goal))
+	switch d.tracer.Trace(e) {
+	case Skip:
+		if p == CallPort || p == RedoPort {
+			d.skip = c.invocation
+		}
+	case Leap:
+		d.tracing = false
+	case Abort:
+		d.tracing, d.skip = false, 0
+		panic(&Exception{m.st.abortedAtom})
+	}
+}
+
+func (st *Store) formatTraced(goal ValueTerm) string {
+	d := &st.debugger
+	if d.varNames == nil {
+		d.varNames = make(map[*Varslot]string)
+	}
+	w := termWriter{quoted: true, quoteAtoms: true, ops: st.ops, varName: func(v *Varslot) string {
+		name, found := d.varNames[v]
+		if !found {
+			name = "_G" + strconv.Itoa(len(d.varNames)+1)
+			d.varNames[v] = name
+		}
+		return name
+	}}
+	w.writeValue(goal)
+	return w.b.String()
+}
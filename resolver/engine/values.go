@@ -2,48 +2,158 @@ package engine
 
 import (
 	"fmt"
+	"math/big"
+	"strconv"
 	"strings"
 )
 
-// `Store`: Global background state for evaluation
+// `Store`: Global background state for evaluation.  A store is not safe for concurrent use, see
+// api.go.
 
 type Store struct {
 	// Interned atoms.
 	atoms map[string]*Atom
 
-	// Database of rules.  This is indexed by the functor and arity of the head.
-	rules map[*Atom]map[int][]*rule
+	// The modules by name, `user` and `system`, and the modules by the absolute names of the
+	// files that define them.  See module.go.
+	modules      map[*Atom]*module
+	userModule   *module
+	systemModule *module
+	moduleFiles  map[string]*module
+
+	// The predicates that each consulted file has added clauses to, by the absolute name of the
+	// file.  See load.go.
+	filePredicates map[string]map[*predicate]bool
+
+	// The number of clauses that have been added, for numbering them.
+	clauseCount int64
+
+	// Built-in predicates, indexed like the rules.  See builtins.go.
+	builtins map[*Atom]map[int]builtin
+
+	// The built-in that is currently executing, for error reporting.
+	current predicateKey
+
+	// Operators known to the reader.  See ops.go.
+	ops *opTable
+
+	// The limits for new queries, see limits.go.
+	limits Limits
+
+	// The callbacks of the program that is being loaded, for consult/1, and the directory of the
+	// file that is being loaded, if any, which relative file names are resolved against.  See
+	// load.go.
+	callbacks Callbacks
+	directory string
+
+	// Prolog flags, see flags.go.
+	flags map[*Atom]*prologFlag
+
+	// The value of the occurs_check flag, see cyclic.go.
+	occursCheck occursCheck
+
+	// The open streams by number, the number of the next stream to open, the standard streams,
+	// and the current input and output.  See stream.go.
+	streams                          map[int64]*stream
+	streamCount                      int64
+	userInput, userOutput, userError *stream
+	input, output                    *stream
+
+	// The state of the tracer, see trace.go.
+	debugger debugger
+
+	// If true then clauses are interpreted rather than run by the virtual machine, see
+	// compile.go.
+	interpret bool
+
+	// Tables by the variant key of the call, and the tables that are being evaluated.  See
+	// tabling.go.
+	tables     map[string]*table
+	tableStack []*table
+
+	// The database of persistent predicates, nil if none is open.  See persist.go.
+	database *kvStore
+
+	// Atoms that are known to the evaluator.
+	cutAtom  *Atom
+	trueAtom *Atom
+	failAtom *Atom
+	callAtom *Atom
+	dotAtom  *Atom
+	nilAtom  *Atom
+
+	// Control constructs, see control.go.
+	commaAtom     *Atom
+	semicolonAtom *Atom
+	ifAtom        *Atom
+	softIfAtom    *Atom
+	notAtom       *Atom
+	cutToAtom     *Atom
+	softCutAtom   *Atom
+	catchAtom     *Atom
+	catchExitAtom *Atom
+	colonAtom     *Atom
+
+	// The ball of abort/0, which cannot be caught.
+	abortedAtom *Atom
+
+	// The dispatcher of the hooks of attributed variables, see attvar.go.
+	attrHookAtom *Atom
+
+	// The goal that adds a solution to a bag of findall/3, see tabling.go.
+	bagAddAtom *Atom
 }
 
 func NewStore() *Store {
-	return &Store{
-		atoms: make(map[string]*Atom),
-		rules: make(map[*Atom]map[int][]*rule),
+	st := &Store{
+		atoms:          make(map[string]*Atom),
+		modules:        make(map[*Atom]*module),
+		moduleFiles:    make(map[string]*module),
+		filePredicates: make(map[string]map[*predicate]bool),
+		builtins:       make(map[*Atom]map[int]builtin),
+		ops:            newOpTable(),
 	}
+	st.cutAtom = st.NewAtom("!")
+	st.trueAtom = st.NewAtom("true")
+	st.failAtom = st.NewAtom("fail")
+	st.callAtom = st.NewAtom("call")
+	st.dotAtom = st.NewAtom(".")
+	st.nilAtom = st.NewAtom("[]")
+	st.commaAtom = st.NewAtom(",")
+	st.semicolonAtom = st.NewAtom(";")
+	st.ifAtom = st.NewAtom("->")
+	st.softIfAtom = st.NewAtom("*->")
+	st.notAtom = st.NewAtom("\\+")
+	st.cutToAtom = st.NewAtom("$cut")
+	st.softCutAtom = st.NewAtom("$softcut")
+	st.catchAtom = st.NewAtom("catch")
+	st.catchExitAtom = st.NewAtom("$catch_exit")
+	st.colonAtom = st.NewAtom(":")
+	st.userModule = st.module(st.NewAtom("user"))
+	st.systemModule = st.module(st.NewAtom("system"))
+	st.abortedAtom = st.NewAtom("$aborted")
+	st.attrHookAtom = st.NewAtom("$attr_unify_hook")
+	st.bagAddAtom = st.NewAtom("$bag_add")
+	st.initStreams()
+	st.initBuiltins()
+	st.loadLibrary()
+	return st
 }
+
 func (st *Store) addRule(r *rule) {
-	functorMap, ok := st.rules[r.functor]
-	if !ok {
-		functorMap = make(map[int][]*rule)
-		st.rules[r.functor] = functorMap
-	}
-	aritySlice, ok := functorMap[r.arity]
-	if !ok {
-		aritySlice = make([]*rule, 0, 4)
-	}
-	functorMap[r.arity] = append(aritySlice, r)
+	st.clauseCount++
+	r.id = st.clauseCount
+	r.module.predicate(r.functor, r.arity).add(r)
+	st.invalidateTables()
 }
 
-func (st *Store) lookupRule(functor *Atom, arity int) []*rule {
-	functorMap, ok := st.rules[functor]
-	if !ok {
-		return []*rule{}
-	}
-	aritySlice, ok := functorMap[arity]
-	if !ok {
-		return []*rule{}
-	}
-	return aritySlice
+// Add a rule before the other rules for its predicate.
+
+func (st *Store) addRuleFirst(r *rule) {
+	st.clauseCount++
+	r.id = st.clauseCount
+	r.module.predicate(r.functor, r.arity).addFirst(r)
+	st.invalidateTables()
 }
 
 // Values: A term value has two flavors, unbound (the `RuleTerm`) and bound (the `ValueTerm`),
@@ -54,7 +164,7 @@ func (st *Store) lookupRule(functor *Atom, arity int) []*rule {
 //
 // The `ruleTermTag` and `valueTermTag` methods on RuleTerm and ValueTerm serve to distinguish
 // the types and make sure that unbound terms do not flow into resolution code.  The atomic
-// types Atom and Number are both RuleTerms and ValueTerms, but Locals are only RuleTerms and
+// types Atom, Number, Float and String are both RuleTerms and ValueTerms, but Locals are only RuleTerms and
 // for structures there are two kinds, RuleStruct and ValueStruct.  Binding operations transform
 // a value from one domain to another.
 
@@ -79,6 +189,10 @@ func bind(t RuleTerm, e rib) ValueTerm {
 		return x
 	case *Number:
 		return x
+	case *Float:
+		return x
+	case *String:
+		return x
 	case *Local:
 		return &e[x.slot]
 	default:
@@ -100,18 +214,20 @@ func bind_terms(ts []RuleTerm, e rib) []ValueTerm {
 // If `val` is not nil then it is the value held in this slot.  Otherwise, `next` is either nil,
 // in which case this is the canonical varslot for a variable, or it points to another varslot
 // that this varslot has been unified with.
+//
+// `attrs` are the attributes of the variable, see attvar.go.  They are set when the varslot is
+// created and never change, so that putting an attribute on a variable is a binding that is
+// undone on backtracking like any other.
 
 type Varslot struct {
-	next *Varslot
-	val  ValueTerm
+	next  *Varslot
+	val   ValueTerm
+	attrs *attribute
 }
 
 func (v *Varslot) String() string {
 	assert(v != nil)
-	if v.val != nil {
-		return "[value " + v.val.String() + "]"
-	}
-	return "[varslot]"
+	return formatValue(v)
 }
 
 func (v *Varslot) valueTermTag() string {
@@ -131,6 +247,19 @@ func (v *Varslot) resolve() (ValueTerm, *Varslot) {
 	return nil, v
 }
 
+// Dereferencing a term yields either a non-variable value or the canonical unbound varslot.
+
+func deref(t ValueTerm) ValueTerm {
+	if v, ok := t.(*Varslot); ok {
+		val, canon := v.resolve()
+		if canon != nil {
+			return canon
+		}
+		return val
+	}
+	return t
+}
+
 // `Atom`: a name with object identity.
 
 type Atom struct {
@@ -158,18 +287,43 @@ func (a *Atom) valueTermTag() string {
 	return "atom"
 }
 
-// `Number`: an i64 value, for now
+// `Number`: an integer.  Integers that fit in an int64 are held in `value`, larger ones in
+// `big`, so that the representation of an integer is unique.
 
 type Number struct {
 	value int64
+	big   *big.Int
 }
 
 func (st *Store) NewNumber(num int64) *Number {
 	return &Number{value: num}
 }
 
+func (st *Store) NewBigNumber(num *big.Int) *Number {
+	return newInteger(num)
+}
+
+func newInteger(num *big.Int) *Number {
+	if num.IsInt64() {
+		return &Number{value: num.Int64()}
+	}
+	return &Number{big: num}
+}
+
+// The value as a big.Int, which must not be modified.
+
+func (a *Number) bigValue() *big.Int {
+	if a.big != nil {
+		return a.big
+	}
+	return big.NewInt(a.value)
+}
+
 func (a *Number) String() string {
-	return fmt.Sprint(a.value)
+	if a.big != nil {
+		return a.big.String()
+	}
+	return strconv.FormatInt(a.value, 10)
 }
 
 func (a *Number) ruleTermTag() string {
@@ -180,6 +334,60 @@ func (a *Number) valueTermTag() string {
 	return "number"
 }
 
+// `Float`: an IEEE double.  Arithmetic never produces infinities or NaNs, see arith.go.
+
+type Float struct {
+	value float64
+}
+
+func (st *Store) NewFloat(num float64) *Float {
+	return &Float{value: num}
+}
+
+// A float is written with a fraction, so that it reads back as a float: 1.0, 2.5e-7, 1.0e22.
+
+func (a *Float) String() string {
+	s := strconv.FormatFloat(a.value, 'g', -1, 64)
+	mantissa, exponent, hasExponent := strings.Cut(s, "e")
+	if !strings.ContainsAny(mantissa, ".") {
+		mantissa += ".0"
+	}
+	if hasExponent {
+		return mantissa + "e" + strings.TrimPrefix(exponent, "+")
+	}
+	return mantissa
+}
+
+func (a *Float) ruleTermTag() string {
+	return "float"
+}
+
+func (a *Float) valueTermTag() string {
+	return "float"
+}
+
+// `String`: a text that is not an atom, written in double quotes.  Strings are not interned.
+
+type String struct {
+	value string
+}
+
+func (st *Store) NewString(s string) *String {
+	return &String{value: s}
+}
+
+func (a *String) String() string {
+	return a.value
+}
+
+func (a *String) ruleTermTag() string {
+	return "string"
+}
+
+func (a *String) valueTermTag() string {
+	return "string"
+}
+
 // `Local`: a term that holds an index into a rib of variables for the current rule.
 
 type Local struct {
@@ -210,19 +418,9 @@ func (st *Store) NewStruct(functor *Atom, subterms []RuleTerm) *RuleStruct {
 }
 
 func (v *RuleStruct) String() string {
-	var b strings.Builder
-	b.WriteString(v.functor.String())
-	if len(v.subterms) > 0 {
-		b.WriteRune('(')
-		for i, a := range v.subterms {
-			if i > 0 {
-				b.WriteRune(',')
-			}
-			b.WriteString(a.String())
-		}
-		b.WriteRune(')')
-	}
-	return b.String()
+	var w termWriter
+	w.writeRule(v)
+	return w.b.String()
 }
 
 func (a *RuleStruct) ruleTermTag() string {
@@ -239,38 +437,109 @@ func (v *ValueStruct) valueTermTag() string {
 }
 
 func (v *ValueStruct) String() string {
-	var b strings.Builder
-	b.WriteString(v.s.functor.String())
-	if len(v.s.subterms) > 0 {
-		b.WriteRune('(')
-		for i, a := range v.s.subterms {
-			if i > 0 {
-				b.WriteRune(',')
+	return formatValue(v)
+}
+
+// Structures that are created during evaluation have no rule to close over.  They are
+// represented as a ValueStruct whose subterms are locals that reference a fresh rib, with the
+// slots of the rib holding the argument values.
+
+func newValueStruct(functor *Atom, args []ValueTerm) *ValueStruct {
+	subterms := make([]RuleTerm, len(args))
+	env := make(rib, len(args))
+	for i, a := range args {
+		subterms[i] = &Local{i}
+		if v, ok := a.(*Varslot); ok {
+			env[i].next = v
+		} else {
+			env[i].val = a
+		}
+	}
+	return &ValueStruct{env: env, s: &RuleStruct{functor, subterms}}
+}
+
+// Lists created during evaluation.
+
+func (st *Store) newList(elements []ValueTerm, tail ValueTerm) ValueTerm {
+	for i := len(elements) - 1; i >= 0; i-- {
+		tail = newValueStruct(st.dotAtom, []ValueTerm{elements[i], tail})
+	}
+	return tail
+}
+
+// The elements of a proper list, or false if `t` is not one.
+
+func (st *Store) listElements(t ValueTerm) ([]ValueTerm, bool) {
+	elements := []ValueTerm{}
+	for {
+		switch x := deref(t).(type) {
+		case *Atom:
+			return elements, x == st.nilAtom
+		case *ValueStruct:
+			if !isListFunctor(x.s.functor, len(x.s.subterms)) {
+				return nil, false
 			}
-			b.WriteString(bind(a, v.env).String())
+			elements = append(elements, bind(x.s.subterms[0], x.env))
+			t = bind(x.s.subterms[1], x.env)
+		default:
+			return nil, false
 		}
-		b.WriteRune(')')
 	}
-	return b.String()
+}
+
+// Append extra arguments to a callable term, as for call/N.  The arguments of Module:Goal are
+// added to Goal.
+
+func addArguments(goal ValueTerm, extra []ValueTerm) ValueTerm {
+	if len(extra) == 0 {
+		return goal
+	}
+	switch g := deref(goal).(type) {
+	case *Atom:
+		return newValueStruct(g, extra)
+	case *ValueStruct:
+		if g.s.functor.name == ":" && len(g.s.subterms) == 2 {
+			return newValueStruct(g.s.functor, []ValueTerm{bind(g.s.subterms[0], g.env),
+				addArguments(bind(g.s.subterms[1], g.env), extra)})
+		}
+		args := append(bind_terms(g.s.subterms, g.env), extra...)
+		return newValueStruct(g.s.functor, args)
+	default:
+		return g
+	}
 }
 
 // Rules represent rules in the database or queries.  The head may be any term, and for ease
 // of processing we've broken it out into its components.  For a query, the head is just a
 // fact, we use true/0.  Rules are compiled.  The `locals` member is the number of varslots to
-// allocate for the rib, representing the number of variables in the rule.
+// allocate for the rib, representing the number of variables in the rule.  The `id` identifies
+// the rule in the database.
 
 type rule struct {
+	id      int64
+	module  *module
 	locals  int
 	arity   int
 	functor *Atom
 	formals []RuleTerm
 	body    []RuleTerm
+
+	// The compiled clause, see compile.go, and the keys of the formals, see index.go.
+	code *clauseCode
+	keys []interface{}
 }
 
 func (st *Store) AssertFact(fact *RuleStruct) {
-	st.addRule(&rule{0, len(fact.subterms), fact.functor, fact.subterms, []RuleTerm{}})
+	st.AssertRule([]*Local{}, fact, []RuleTerm{})
 }
 
 func (st *Store) AssertRule(locals []*Local, head *RuleStruct, subterms []RuleTerm) {
-	st.addRule(&rule{len(locals), len(head.subterms), head.functor, head.subterms, subterms})
+	st.addClause(st.userModule, locals, head, subterms)
+}
+
+// Add a clause to the predicate in the module.
+
+func (st *Store) addClause(md *module, locals []*Local, head *RuleStruct, subterms []RuleTerm) {
+	st.addRule(&rule{module: md, locals: len(locals), arity: len(head.subterms), functor: head.functor,
+		formals: head.subterms, body: subterms})
 }
@@ -0,0 +1,478 @@
+package engine
+
+// The virtual machine that runs compiled clauses, see compile.go.
+//
+// The machine has registers, a heap of cells from which structures and environments are
+// allocated, and the trail and choicepoints of machine.go.  Continuations are frames, as for the
+// interpreter: a frame with code continues at an instruction of a clause, with its environment.
+// The frames are allocated by the call instructions rather than by allocate, because they are
+// immutable and shared with choicepoints, but the environment they share is allocated once.
+// The registers do not survive a call, since a temporary variable lives within one chunk, so the
+// instructions after a call only use the environment.
+//
+// A call to a predicate in the database chooses among the clauses that the index finds for the
+// arguments, see index.go, in the manner of the WAM choice instructions:
+//
+//   try     the first clause whose head matches is entered, and if a clause after it may match
+//           then a choicepoint is pushed that saves the arguments and the remaining clauses
+//   retry   backtracking into the choicepoint restores the arguments and enters the next
+//           clause that matches, leaving the choicepoint with the clauses after it
+//   trust   the last clause that may match is entered after removing the choicepoint
+//
+// The clauses are those of the index when the predicate is called, so that a running call does
+// not see changes to the database, like the slices of tryClauses.
+//
+// Goals that are not calls of predicates in the database leave the virtual machine: built-in
+// predicates are called with a copy of the argument registers, and control constructs, call/N,
+// catch/3, tabled predicates and traced calls are solved as by the interpreter, continuing with
+// a frame for the rest of the clause.  The hooks of attributed variables that have been bound
+// run before the next goal, as in the interpreter, and a frame that saves the registers resumes
+// the clause after them.
+
+// The number of cells that the heap grows by.
+
+const heapChunk = 4096
+
+// Allocate `n` fresh cells on the heap.
+
+func (m *machine) cells(n int) rib {
+	if len(m.heap)+n > cap(m.heap) {
+		m.heap = make(rib, 0, max(heapChunk, n))
+	}
+	h := len(m.heap)
+	m.heap = m.heap[:h+n]
+	return m.heap[h : h+n : h+n]
+}
+
+// The registers, with at least `n` of them.
+
+func (m *machine) registers(n int) []ValueTerm {
+	if len(m.regs) < n {
+		regs := make([]ValueTerm, max(n, 2*len(m.regs), 16))
+		copy(regs, m.regs)
+		m.regs = regs
+	}
+	return m.regs
+}
+
+// Try the clauses for the call whose `n` arguments are in the registers: try, retry and trust.
+// `saved` holds the arguments if they have been saved already.  The choicepoint for the
+// remaining clauses is at index `cutB`.  Returns the clause whose head matched and its
+// environment.
+
+func (m *machine) tryCode(clauses []*rule, n int, saved []ValueTerm, cont *frame, cutB int) (*rule, rib, bool) {
+	if len(m.chps) == 0 {
+		// There are no choicepoints so nothing will ever be undone, see machine.go
+		m.trail = m.trail[:0]
+	}
+	mark, allocMark := len(m.trail), m.allocated
+	// The keys are computed before unification binds the arguments
+	m.keys = m.keys[:0]
+	for _, a := range m.regs[:n] {
+		key, _ := valueKey(a)
+		m.keys = append(m.keys, key)
+	}
+	for i, r := range clauses {
+		assert(n == r.arity)
+		if !mayMatch(m.keys, r) {
+			continue
+		}
+		c := m.st.clauseCode(r)
+		m.registers(c.registers)
+		m.allocated = allocMark + int64(r.locals) + 1
+		env, matched := m.matchHead(c)
+		if !matched {
+			m.undoTrail(mark)
+			continue
+		}
+		next := i + 1
+		for next < len(clauses) && !mayMatch(m.keys, clauses[next]) {
+			next++
+		}
+		if next < len(clauses) {
+			if len(m.chps) == cutB {
+				if saved == nil {
+					saved = append([]ValueTerm(nil), m.regs[:n]...)
+				}
+				m.chps = append(m.chps, choicepoint{trailMark: mark, allocMark: allocMark, cont: cont,
+					module: m.module, actuals: saved})
+			}
+			m.chps[cutB].clauses = clauses[next:]
+		} else {
+			m.cutTo(cutB)
+		}
+		return r, env, true
+	}
+	m.cutTo(cutB)
+	return nil, nil, false
+}
+
+// Try the clauses for the actuals, as tryClauses, continuing with the body of the clause that
+// matched in a frame.
+
+func (m *machine) tryCompiled(actuals []ValueTerm, clauses []*rule, cont *frame, cutB int) bool {
+	copy(m.registers(len(actuals)), actuals)
+	r, env, ok := m.tryCode(clauses, len(actuals), actuals, cont, cutB)
+	if !ok {
+		return false
+	}
+	c := r.code
+	if c.code[c.body].op == proceed {
+		m.cont = cont
+		return true
+	}
+	m.cont = &frame{code: c, pc: c.body, env: env, cutB: cutB, module: m.clauseModule(r), next: cont}
+	return true
+}
+
+// The context module of the body of the clause: the predicates of the library run in the context
+// of their caller, see module.go.
+
+func (m *machine) clauseModule(r *rule) *module {
+	if r.module == m.st.systemModule {
+		return m.module
+	}
+	return r.module
+}
+
+// Unify the actuals with the head of the clause, without running its body.
+
+func (m *machine) unifyHead(r *rule, actuals []ValueTerm) bool {
+	if m.st.interpret {
+		return m.unifyTerms(actuals, bind_terms(r.formals, make(rib, r.locals)))
+	}
+	copy(m.registers(len(actuals)), actuals)
+	c := m.st.clauseCode(r)
+	m.registers(c.registers)
+	_, matched := m.matchHead(c)
+	return matched
+}
+
+// Run the head instructions of the clause against the arguments in the registers.  Like unify,
+// this does not undo its bindings when it fails.  Returns the environment of the clause.
+
+func (m *machine) matchHead(c *clauseCode) (rib, bool) {
+	u := unifier{m: m, check: m.st.occursCheck}
+	regs := m.regs
+	var env rib
+	code := c.code[:c.body]
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+		switch in.op {
+		case allocate:
+			env = m.cells(c.permanent)
+		case getArguments:
+			env = m.cells(c.permanent)
+			for i, t := range in.s.subterms {
+				if !u.unify(regs[i], bind(t, env)) {
+					return nil, false
+				}
+			}
+		case getVariable:
+			if in.permanent {
+				setSlot(env, in.slot, regs[in.arg])
+			} else {
+				regs[in.slot] = regs[in.arg]
+			}
+		case getValue:
+			if !u.unify(regs[in.arg], m.variable(in, env)) {
+				return nil, false
+			}
+		case getConstant:
+			if !u.unifyConstant(regs[in.arg], in.constant) {
+				return nil, false
+			}
+		case getStructure:
+			args := code[pc+1 : pc+1+in.skip]
+			pc += in.skip
+			switch x := deref(regs[in.arg]).(type) {
+			case *Varslot:
+				if !u.bind(x, m.build(in.s, args, env)) {
+					return nil, false
+				}
+			case *ValueStruct:
+				if x.s.functor != in.s.functor || len(x.s.subterms) != len(in.s.subterms) ||
+					!u.matchArguments(args, x.s, x.env, env) {
+					return nil, false
+				}
+			default:
+				return nil, false
+			}
+		}
+	}
+	return env, true
+}
+
+// Run the unify instructions of a structure against the arguments of `s`, bound in `senv`.
+
+func (u *unifier) matchArguments(code []instruction, s *RuleStruct, senv rib, env rib) bool {
+	m := u.m
+	i := 0
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+		t := s.subterms[i]
+		i++
+		switch in.op {
+		case unifyVoid:
+		case unifyVariable:
+			if in.permanent {
+				setSlot(env, in.slot, bind(t, senv))
+			} else {
+				m.regs[in.slot] = bind(t, senv)
+			}
+		case unifyValue:
+			if !u.unify(bind(t, senv), m.variable(in, env)) {
+				return false
+			}
+		case unifyConstant:
+			if !u.unifyConstant(bind(t, senv), in.constant) {
+				return false
+			}
+		case unifyStructure:
+			args := code[pc+1 : pc+1+in.skip]
+			pc += in.skip
+			switch x := t.(type) {
+			case *RuleStruct:
+				if x.functor != in.s.functor || len(x.subterms) != len(in.s.subterms) ||
+					!u.matchArguments(args, x, senv, env) {
+					return false
+				}
+			case *Local:
+				switch y := deref(&senv[x.slot]).(type) {
+				case *Varslot:
+					if !u.bind(y, m.build(in.s, args, env)) {
+						return false
+					}
+				case *ValueStruct:
+					if y.s.functor != in.s.functor || len(y.s.subterms) != len(in.s.subterms) ||
+						!u.matchArguments(args, y.s, y.env, env) {
+						return false
+					}
+				default:
+					return false
+				}
+			default:
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// A new structure on the heap with the skeleton `s`, whose arguments are set by the unify or set
+// instructions (write mode).
+
+func (m *machine) build(s *RuleStruct, code []instruction, env rib) *ValueStruct {
+	cells := m.cells(len(s.subterms))
+	i := 0
+	for pc := 0; pc < len(code); pc++ {
+		in := &code[pc]
+		cell := &cells[i]
+		i++
+		switch in.op {
+		case unifyVoid, setVoid:
+		case unifyVariable, setVariable:
+			if in.permanent {
+				cell.next = &env[in.slot]
+			} else {
+				m.regs[in.slot] = cell
+			}
+		case unifyValue, setValue:
+			setSlot(cells, i-1, m.variable(in, env))
+		case unifyConstant, setConstant:
+			cell.val = in.constant
+		case unifyStructure, setStructure:
+			cell.val = m.build(in.s, code[pc+1:pc+1+in.skip], env)
+			pc += in.skip
+		}
+	}
+	return &ValueStruct{env: cells, s: s}
+}
+
+// The value of the variable of a variable or value instruction.
+
+func (m *machine) variable(in *instruction, env rib) ValueTerm {
+	if in.permanent {
+		return &env[in.slot]
+	}
+	return m.regs[in.slot]
+}
+
+// Store the value of the first occurrence of a variable in its fresh slot.
+
+func setSlot(env rib, slot int, val ValueTerm) {
+	switch x := deref(val).(type) {
+	case *Varslot:
+		env[slot].next = x
+	default:
+		env[slot].val = x
+	}
+}
+
+func (u *unifier) unifyConstant(val ValueTerm, constant ValueTerm) bool {
+	switch x := deref(val).(type) {
+	case *Varslot:
+		return u.bind(x, constant)
+	case *Atom:
+		return x == constant
+	default:
+		return u.unify(x, constant)
+	}
+}
+
+// The code of a clause that just proceeds, which continues a call that has left the virtual
+// machine as its last goal.
+
+var proceedCode = &clauseCode{code: []instruction{{op: proceed}}}
+
+// Run the body of a clause from `pc`, with the environment `env`, in the context module m.module
+// and with m.cont as the continuation of the clause.  Calls of predicates in the database are run
+// in the same loop.  Returns false if a goal failed, in which case the machine must backtrack,
+// and true when the machine must continue with m.cont.
+
+func (m *machine) runCode(c *clauseCode, pc int, env rib, cutB int) bool {
+	st := m.st
+	m.registers(c.registers)
+	for {
+		in := &c.code[pc]
+		switch in.op {
+		case putVariable:
+			cell := &m.cells(1)[0]
+			m.regs[in.slot], m.regs[in.arg] = cell, cell
+		case putValue:
+			m.regs[in.arg] = m.variable(in, env)
+		case putVoid:
+			m.regs[in.arg] = &m.cells(1)[0]
+		case putConstant:
+			m.regs[in.arg] = in.constant
+		case putStructure:
+			m.regs[in.arg] = m.build(in.s, c.code[pc+1:pc+1+in.skip], env)
+			pc += in.skip
+		case deallocate:
+			env = nil
+		case cut, succeed, fail:
+			if len(m.wakeups) > 0 {
+				m.suspendCode(c, pc, env, cutB)
+				return true
+			}
+			switch in.op {
+			case cut:
+				m.checkLimits(st.cutAtom, 0)
+				m.cutTo(cutB)
+			case succeed:
+				m.checkLimits(st.trueAtom, 0)
+			case fail:
+				m.checkLimits(st.failAtom, 0)
+				return false
+			}
+		case solve:
+			if len(m.wakeups) > 0 {
+				m.suspendCode(c, pc, env, cutB)
+				return true
+			}
+			if !c.tail(pc) {
+				m.cont = &frame{code: c, pc: pc + 1, env: env, cutB: cutB, module: m.module, next: m.cont}
+			}
+			m.cont = &frame{goals: []RuleTerm{in.goal}, env: env, cutB: cutB, module: m.module,
+				next: m.cont}
+			return true
+		case call, execute:
+			if len(m.wakeups) > 0 {
+				m.suspendCode(c, pc, env, cutB)
+				return true
+			}
+			m.checkLimits(in.functor, in.arity)
+			cont := m.cont
+			if in.op == call {
+				cont = &frame{code: c, pc: pc + 1, env: env, cutB: cutB, module: m.module, next: m.cont}
+			}
+			p := m.lookupCode(in)
+			if p == nil {
+				// The goal leaves the virtual machine
+				actuals := append([]ValueTerm(nil), m.regs[:in.arity]...)
+				m.cont = cont
+				if b := st.lookupBuiltin(in.functor, in.arity); b != nil && !st.debugger.active() {
+					st.current = predicateKey{in.functor, in.arity}
+					if !b(m, actuals) {
+						return false
+					}
+					if m.cont != cont {
+						return true
+					}
+					// The built-in predicate did not add to the continuation, so the clause
+					// continues here
+					if in.op == execute {
+						c, pc = proceedCode, 0
+					} else {
+						m.cont = cont.next
+						pc++
+					}
+					continue
+				}
+				return m.dispatch(in.functor, actuals, cutB)
+			}
+			cutB = len(m.chps)
+			r, renv, ok := m.tryCode(p.candidates(m.regs[:in.arity]), in.arity, nil, cont, cutB)
+			if !ok {
+				return false
+			}
+			m.cont = cont
+			m.module = m.clauseModule(r)
+			c, pc, env = r.code, r.code.body, renv
+			continue
+		case proceed:
+			f := m.cont
+			if f == nil || f.code == nil || len(m.wakeups) > 0 {
+				return true
+			}
+			// Continue with the clause that called this one
+			m.cont = f.next
+			m.module = f.module
+			m.restoreRegisters(f)
+			c, pc, env, cutB = f.code, f.pc, f.env, f.cutB
+			m.registers(c.registers)
+			continue
+		}
+		pc++
+	}
+}
+
+// True if the instruction at `pc` is followed only by proceed.
+
+func (c *clauseCode) tail(pc int) bool {
+	pc++
+	if c.code[pc].op == deallocate {
+		pc++
+	}
+	return c.code[pc].op == proceed
+}
+
+// Leave the virtual machine so that the hooks of attributed variables run before the goal at
+// `pc`, saving the registers with the frame that resumes the clause there.
+
+func (m *machine) suspendCode(c *clauseCode, pc int, env rib, cutB int) {
+	m.cont = &frame{code: c, pc: pc, env: env, cutB: cutB, module: m.module, next: m.cont,
+		regs: append([]ValueTerm(nil), m.regs[:c.registers]...)}
+}
+
+func (m *machine) restoreRegisters(f *frame) {
+	if f.regs != nil {
+		copy(m.registers(len(f.regs)), f.regs)
+	}
+}
+
+// The predicate in the database that a call or execute instruction calls, or nil if the call
+// leaves the virtual machine.
+
+func (m *machine) lookupCode(in *instruction) *predicate {
+	st := m.st
+	if st.debugger.active() || in.functor == st.callAtom || in.functor == st.catchAtom && in.arity == 3 ||
+		st.lookupBuiltin(in.functor, in.arity) != nil {
+		return nil
+	}
+	p := st.lookupPredicate(m.module, in.functor, in.arity)
+	if p == nil || p.tabled {
+		return nil
+	}
+	return p
+}
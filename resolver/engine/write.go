@@ -0,0 +1,481 @@
+package engine
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Writing terms.  Values are written with variables dereferenced and lists in list syntax.
+// Unbound variables are written as `_` followed by a number that identifies the variable,
+// unless the writer has been given names for them.  Where a cyclic term refers back to itself
+// the writer writes `...`, so X = f(X) is written as f(...).  Strings are written as their text,
+// or in double quotes if the writer quotes, so that they can be told from atoms.
+//
+// Structures are written in functional notation, f(A, B), unless the writer has an operator
+// table, in which case a structure whose functor is an operator is written in operator notation
+// with as few parentheses as the priorities allow, and {}(T) is written as {T}.  Tokens that
+// would run together, as in 1- -1 and X is Y, are separated by a space.  If the writer quotes
+// atoms then an atom that would not be read back as itself is written in single quotes, with
+// escapes for quotes, backslashes and layout.  The writer for write/1 and its relatives is set
+// up by newTermWriter, see stream.go.
+
+type termWriter struct {
+	b strings.Builder
+
+	// True if strings are written in double quotes
+	quoted bool
+
+	// True if atoms are quoted where necessary
+	quoteAtoms bool
+
+	// The operators, if operator notation is used
+	ops *opTable
+
+	// True if '$VAR'(N) is written as a variable name, A for 0, B for 1, ... Z1 for 51, ...
+	numberVars bool
+
+	// Names for unbound variables, if not nil
+	varName func(v *Varslot) string
+
+	// The structures on the path to the term being written, see cyclic.go.
+	path map[structKey]bool
+}
+
+// Enter the structure `s`, returning false if it is already on the path.
+
+func (w *termWriter) enter(s *ValueStruct) (structKey, bool) {
+	if len(s.env) == 0 {
+		return structKey{}, true
+	}
+	key := structKey{s.s, &s.env[0]}
+	if w.path == nil {
+		w.path = make(map[structKey]bool)
+	}
+	if w.path[key] {
+		return key, false
+	}
+	w.path[key] = true
+	return key, true
+}
+
+func (w *termWriter) writeValue(t ValueTerm) {
+	w.writeTerm(t, 1200)
+}
+
+// Write a term whose priority must be at most `max` for it to be written without parentheses.
+
+func (w *termWriter) writeTerm(t ValueTerm, max int) {
+	switch v := deref(t).(type) {
+	case *Varslot:
+		if w.varName != nil {
+			w.token(w.varName(v))
+		} else {
+			w.token(fmt.Sprintf("_G%d", reflect.ValueOf(v).Pointer()))
+		}
+	case *ValueStruct:
+		key, ok := w.enter(v)
+		if !ok {
+			w.token("...")
+			return
+		}
+		defer delete(w.path, key)
+		if isListFunctor(v.s.functor, len(v.s.subterms)) {
+			w.b.WriteRune('[')
+			var tails []structKey
+			for {
+				w.writeTerm(bind(v.s.subterms[0], v.env), 999)
+				tail := deref(bind(v.s.subterms[1], v.env))
+				next, ok := tail.(*ValueStruct)
+				if !ok || !isListFunctor(next.s.functor, len(next.s.subterms)) {
+					if !isNil(tail) {
+						w.b.WriteRune('|')
+						w.writeTerm(tail, 999)
+					}
+					break
+				}
+				key, ok := w.enter(next)
+				if !ok {
+					w.b.WriteString("|...")
+					break
+				}
+				tails = append(tails, key)
+				w.b.WriteRune(',')
+				v = next
+			}
+			for _, key := range tails {
+				delete(w.path, key)
+			}
+			w.b.WriteRune(']')
+			return
+		}
+		if w.numberVars && w.writeVarName(v) {
+			return
+		}
+		if w.ops != nil && v.s.functor.name == "{}" && len(v.s.subterms) == 1 {
+			w.token("{")
+			w.writeTerm(bind(v.s.subterms[0], v.env), 1200)
+			w.b.WriteRune('}')
+			return
+		}
+		if w.ops != nil && w.priority(v) > 0 {
+			if w.priority(v) > max {
+				w.b.WriteRune('(')
+				w.writeOperation(v)
+				w.b.WriteRune(')')
+			} else {
+				w.writeOperation(v)
+			}
+			return
+		}
+		w.writeAtom(v.s.functor)
+		if len(v.s.subterms) > 0 {
+			w.b.WriteRune('(')
+			for i, a := range v.s.subterms {
+				if i > 0 {
+					w.b.WriteRune(',')
+				}
+				w.writeTerm(bind(a, v.env), 999)
+			}
+			w.b.WriteRune(')')
+		}
+	case *Atom:
+		w.writeAtom(v)
+	case *String:
+		w.writeString(v.value)
+	default:
+		w.token(v.String())
+	}
+}
+
+// Write a string, separated from what precedes it by a space if the two would otherwise be read
+// as one token.
+
+func (w *termWriter) token(s string) {
+	if w.b.Len() > 0 && s != "" {
+		last, _ := utf8.DecodeLastRuneInString(w.b.String())
+		first, _ := utf8.DecodeRuneInString(s)
+		if isSymbolChar(last) && isSymbolChar(first) || isAtomNextChar(last) && isAtomNextChar(first) {
+			w.b.WriteRune(' ')
+		}
+	}
+	w.b.WriteString(s)
+}
+
+func (w *termWriter) writeAtom(a *Atom) {
+	if w.quoteAtoms && atomNeedsQuotes(a.name) {
+		w.token(quoteAtom(a.name))
+	} else {
+		w.token(a.name)
+	}
+}
+
+// Whether an atom must be quoted to be read as itself.
+
+func atomNeedsQuotes(name string) bool {
+	switch name {
+	case "[]", "{}", "!", ";":
+		return false
+	case "", ",", "|", ".":
+		return true
+	}
+	first, _ := utf8.DecodeRuneInString(name)
+	switch {
+	case isAtomFirstChar(first):
+		for _, r := range name {
+			if !isAtomNextChar(r) {
+				return true
+			}
+		}
+		return false
+	case isSymbolChar(first):
+		for _, r := range name {
+			if !isSymbolChar(r) {
+				return true
+			}
+		}
+		// A name that starts a comment cannot be read as a name
+		return strings.HasPrefix(name, "/*")
+	}
+	return true
+}
+
+func quoteAtom(name string) string {
+	return quoteText(name, '\'')
+}
+
+// Write text between quotes, with escapes for the quote, backslashes and layout.
+
+func quoteText(text string, quote rune) string {
+	var b strings.Builder
+	b.WriteRune(quote)
+	for _, r := range text {
+		switch r {
+		case quote, '\\':
+			b.WriteRune('\\')
+			b.WriteRune(r)
+		case '\n':
+			b.WriteString("\\n")
+		case '\t':
+			b.WriteString("\\t")
+		case '\r':
+			b.WriteString("\\r")
+		default:
+			if unicode.IsControl(r) {
+				fmt.Fprintf(&b, "\\x%x\\", r)
+			} else {
+				b.WriteRune(r)
+			}
+		}
+	}
+	b.WriteRune(quote)
+	return b.String()
+}
+
+// Write '$VAR'(N), where N is a non-negative integer, as a variable name.  Returns false if the
+// structure is something else.
+
+func (w *termWriter) writeVarName(s *ValueStruct) bool {
+	if s.s.functor.name != "$VAR" || len(s.s.subterms) != 1 {
+		return false
+	}
+	n, ok := deref(bind(s.s.subterms[0], s.env)).(*Number)
+	if !ok || n.big != nil || n.value < 0 {
+		return false
+	}
+	name := string(rune('A' + n.value%26))
+	if n.value >= 26 {
+		name += fmt.Sprint(n.value / 26)
+	}
+	w.token(name)
+	return true
+}
+
+// The priority of a structure in operator notation, or 0 if it is written in functional
+// notation.
+
+func (w *termWriter) priority(s *ValueStruct) int {
+	name := s.s.functor.name
+	switch len(s.s.subterms) {
+	case 1:
+		if op, ok := w.ops.prefix[name]; ok {
+			return op.priority
+		}
+		if op, ok := w.ops.postfix[name]; ok {
+			return op.priority
+		}
+	case 2:
+		if op, ok := w.ops.infix[name]; ok {
+			return op.priority
+		}
+	}
+	return 0
+}
+
+// Write a structure in operator notation.
+
+func (w *termWriter) writeOperation(s *ValueStruct) {
+	name := s.s.functor.name
+	args := bind_terms(s.s.subterms, s.env)
+	if len(args) == 2 {
+		left, right := w.ops.infix[name].argPriorities()
+		w.operand(args[0], left, "")
+		if name == "," {
+			w.b.WriteRune(',')
+		} else {
+			w.writeAtom(s.s.functor)
+		}
+		w.operand(args[1], right, "")
+		return
+	}
+	if op, ok := w.ops.prefix[name]; ok {
+		_, right := op.argPriorities()
+		w.writeAtom(s.s.functor)
+		w.operand(args[0], right, name)
+		return
+	}
+	left, _ := w.ops.postfix[name].argPriorities()
+	w.operand(args[0], left, "")
+	w.writeAtom(s.s.functor)
+}
+
+// Write the argument of an operator, in parentheses if its priority is above `max` or if it is
+// an atom that is an operator.  After a prefix operator, `prefix`, an argument in parentheses
+// is separated from the operator by a space, because -(a,b) is a structure with two arguments,
+// and so is an argument that starts with a number after - or +, because - 1 is -(1) while -1
+// is a number.
+
+func (w *termWriter) operand(t ValueTerm, max int, prefix string) {
+	parenthesize := false
+	switch x := deref(t).(type) {
+	case *Atom:
+		parenthesize = w.isOperator(x.name)
+	case *ValueStruct:
+		parenthesize = w.priority(x) > max
+	}
+	if parenthesize {
+		if prefix != "" {
+			w.b.WriteRune(' ')
+		}
+		w.b.WriteRune('(')
+		w.writeTerm(t, 1200)
+		w.b.WriteRune(')')
+		return
+	}
+	if (prefix == "-" || prefix == "+") && w.startsWithNumber(t) {
+		w.b.WriteRune(' ')
+	}
+	w.writeTerm(t, max)
+}
+
+// Whether a term is written starting with a number.
+
+func (w *termWriter) startsWithNumber(t ValueTerm) bool {
+	for {
+		switch x := deref(t).(type) {
+		case *Number, *Float:
+			return true
+		case *ValueStruct:
+			if w.priority(x) == 0 || len(x.s.subterms) == 1 && w.ops.prefix[x.s.functor.name].priority > 0 {
+				return false
+			}
+			t = bind(x.s.subterms[0], x.env)
+		default:
+			return false
+		}
+	}
+}
+
+func (w *termWriter) isOperator(name string) bool {
+	_, isPrefix := w.ops.prefix[name]
+	_, isInfix := w.ops.infix[name]
+	_, isPostfix := w.ops.postfix[name]
+	return isPrefix || isInfix || isPostfix
+}
+
+func (w *termWriter) writeString(s string) {
+	if !w.quoted {
+		w.b.WriteString(s)
+		return
+	}
+	w.b.WriteString(quoteText(s, '"'))
+}
+
+func (w *termWriter) writeRule(t RuleTerm) {
+	if s, ok := t.(*String); ok {
+		w.writeString(s.value)
+		return
+	}
+	v, ok := t.(*RuleStruct)
+	if !ok {
+		w.b.WriteString(t.String())
+		return
+	}
+	if isListFunctor(v.functor, len(v.subterms)) {
+		w.b.WriteRune('[')
+		for {
+			w.writeRule(v.subterms[0])
+			next, ok := v.subterms[1].(*RuleStruct)
+			if !ok || !isListFunctor(next.functor, len(next.subterms)) {
+				if !isNil(v.subterms[1]) {
+					w.b.WriteRune('|')
+					w.writeRule(v.subterms[1])
+				}
+				break
+			}
+			w.b.WriteRune(',')
+			v = next
+		}
+		w.b.WriteRune(']')
+		return
+	}
+	w.b.WriteString(v.functor.String())
+	if len(v.subterms) > 0 {
+		w.b.WriteRune('(')
+		for i, a := range v.subterms {
+			if i > 0 {
+				w.b.WriteRune(',')
+			}
+			w.writeRule(a)
+		}
+		w.b.WriteRune(')')
+	}
+}
+
+// Lists are built from '.'/2 and the empty list is the atom '[]'.
+
+func isListFunctor(functor *Atom, arity int) bool {
+	return arity == 2 && functor.name == "."
+}
+
+func isNil(t interface{}) bool {
+	a, ok := t.(*Atom)
+	return ok && a.name == "[]"
+}
+
+// Format the bindings of the named variables of a query solution as `Name = Value`, with the
+// values written as by writeq/1.  An unbound variable is not shown unless it is the same as an
+// earlier one, which is shown as `Earlier = Name`.  In values, unbound variables are written as
+// the name of the first query variable they are the same as, or otherwise as _A, _B, and so on.
+
+func (st *Store) FormatBindings(names []*Atom, vars []Varslot) []string {
+	varNames := make(map[*Varslot]string)
+	w := termWriter{quoted: true, quoteAtoms: true, ops: st.ops, varName: freshVarNames(varNames)}
+	for i, n := range names {
+		if v, ok := deref(&vars[i]).(*Varslot); ok && n != nil {
+			if _, found := varNames[v]; !found {
+				varNames[v] = n.name
+			}
+		}
+	}
+	bindings := make([]string, 0, len(names))
+	for i, n := range names {
+		if n == nil {
+			continue
+		}
+		if v, ok := deref(&vars[i]).(*Varslot); ok {
+			if varNames[v] != n.name {
+				bindings = append(bindings, varNames[v]+" = "+n.name)
+			}
+			continue
+		}
+		w.b.Reset()
+		w.writeTerm(&vars[i], 699)
+		bindings = append(bindings, n.name+" = "+w.b.String())
+	}
+	return bindings
+}
+
+// Name unbound variables _A, _B, ... _Z, _A1, ... in the order they are first written, and
+// remember the names in `varNames`, which may hold names given beforehand.
+
+func freshVarNames(varNames map[*Varslot]string) func(v *Varslot) string {
+	fresh := 0
+	return func(v *Varslot) string {
+		if name, found := varNames[v]; found {
+			return name
+		}
+		name := "_" + string(rune('A'+fresh%26))
+		if fresh >= 26 {
+			name += fmt.Sprint(fresh / 26)
+		}
+		fresh++
+		varNames[v] = name
+		return name
+	}
+}
+
+// The operators that values are written with when there is no store at hand.
+
+var standardOps = newOpTable()
+
+// Write a value as writeq/1 does with the standard operators, for the String methods of values
+// and the text of exceptions.
+
+func formatValue(t ValueTerm) string {
+	w := termWriter{quoted: true, quoteAtoms: true, ops: standardOps, varName: freshVarNames(make(map[*Varslot]string))}
+	w.writeValue(t)
+	return w.b.String()
+}
@@ -0,0 +1,11 @@
+/* The Norwegian royal family, a small example program.
+
+   $ resolver examples/family.pl
+   ?- grandfather(harald, X).  */
+
+father(haakon, olav).
+father(olav, harald).
+father(harald, 'håkon magnus').
+father('håkon magnus', 'ingrid alexandra').
+
+grandfather(X, Y) :- father(X, Z), father(Z, Y).
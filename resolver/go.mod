@@ -1,5 +1,3 @@
 module resolver
 
-go 1.18
-
-require golang.org/x/tools v0.1.12 // indirect
+go 1.23
@@ -1,29 +1,65 @@
+// resolver [options] file.pl ...
+//
+// Consult the files and then read queries from stdin.
+
 package main
 
 import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
 	"resolver/engine"
 	"resolver/repl"
-	"strings"
 )
 
-var input string = `
-
-:- father(haakon, olav).
-
-:- father(olav, harald).
-:- father(harald, 'håkon magnus').
-:- father('håkon magnus', 'ingrid alexandra').
-
-
-?- father(X, harald).
-
-grandfather(X, Y) :- father(X, Z), father(Z, Y).
+func main() {
+	all := flag.Bool("all", false, "Print all solutions to each query in batch mode")
+	n := flag.Int("n", 1, "Print at most this many solutions to each query in batch mode")
+	maxInferences := flag.Int64("max-inferences", 0, "Limit the number of inferences of each query (0 for no limit)")
+	maxAllocation := flag.Int64("max-allocation", 0,
+		"Limit the cells that each branch of a query allocates (0 for no limit)")
+	db := flag.String("db", "", "Keep the clauses of persistent predicates in this database file")
+	flag.Parse()
 
-?- grandfather(harald, X).
-`
+	opts := repl.Options{MaxSolutions: *n}
+	if *all {
+		opts.MaxSolutions = 0
+	}
+	if fi, err := os.Stdin.Stat(); err == nil && fi.Mode()&os.ModeCharDevice != 0 {
+		opts.Interactive = true
+	}
 
-func main() {
 	st := engine.NewStore()
+	st.SetLimits(engine.Limits{MaxInferences: *maxInferences, MaxAllocation: *maxAllocation})
+	if *db != "" {
+		if err := st.OpenDatabase(*db); err != nil {
+			exit(err)
+		}
+	}
+	tl := repl.NewToplevel(st, opts)
+	for _, filename := range flag.Args() {
+		if err := tl.Consult(filename); err != nil {
+			exit(err)
+		}
+	}
+	err := tl.Run()
+	// The database is safe without this, which only makes the next start faster
+	if cerr := st.CloseDatabase(); err == nil {
+		err = cerr
+	}
+	exit(err)
+}
 
-	repl.Repl(st, strings.NewReader(input))
+func exit(err error) {
+	var halt *engine.Halt
+	switch {
+	case err == nil:
+		os.Exit(0)
+	case errors.As(err, &halt):
+		os.Exit(halt.Code)
+	default:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
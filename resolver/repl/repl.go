@@ -1,34 +1,200 @@
 package repl
 
 import (
+	"bufio"
+	"errors"
+	"io"
 	"os"
 	"resolver/engine"
+	"strings"
 )
 
-type reader interface {
-	ReadRune() (rune, int, error)
-	UnreadRune() error
+// The top level consults program files and then reads queries from stdin, one at a time, and
+// evaluates each as soon as it has been read.  In interactive mode it prompts with `?- ` for a
+// query and `|    ` for its continuation lines.
+//
+// The top level prints the bindings of each solution to a query.  In interactive mode it then
+// waits for a line from stdin: `;` asks for the next solution and anything else accepts the
+// current one.  In batch mode it prints up to MaxSolutions solutions, separated by `;`.  The
+// outcome of the query is printed as `yes` if a solution was accepted and `no` if there were
+// no more solutions.  Errors are printed and the top level continues with the next query.
+//
+// The top level is the tracer of the store.  It prints the events, and in interactive mode it
+// then waits for a command: `c` or an empty line to creep, `s` to skip, `l` to leap and `a` to
+// abort.
+
+type Options struct {
+	// Prompt on stdin for queries and more solutions
+	Interactive bool
+
+	// The maximum number of solutions to print in batch mode, or 0 for all
+	MaxSolutions int
+}
+
+type Toplevel struct {
+	st     *engine.Store
+	opts   Options
+	stdin  *bufio.Reader
+	stdout io.Writer
+
+	// Queries are read through this, which prints the prompts
+	queries *promptReader
+
+	// Number of solutions printed for the current query
+	count int
+}
+
+func NewToplevel(st *engine.Store, opts Options) *Toplevel {
+	return newToplevel(st, opts, os.Stdin, os.Stdout)
+}
+
+// A top level that reads from `in` and writes to `out` instead of stdin and stdout.
+
+func newToplevel(st *engine.Store, opts Options, in io.Reader, out io.Writer) *Toplevel {
+	stdin := bufio.NewReader(in)
+	tl := &Toplevel{
+		st:     st,
+		opts:   opts,
+		stdin:  stdin,
+		stdout: out,
+		queries: &promptReader{r: stdin, w: out, interactive: opts.Interactive, atLineStart: true,
+			fresh: true},
+	}
+	st.SetTracer(tl)
+	// Terms that the program reads from user_input come from the same input as the queries, and
+	// those it writes to user_output go to the same output as the answers
+	st.SetInput(stdin)
+	st.SetOutput(out)
+	return tl
+}
+
+func (tl *Toplevel) callbacks() engine.Callbacks {
+	return engine.Callbacks{
+		QuerySuccess: tl.processQuerySuccess,
+		QueryFailure: tl.processQueryFailure,
+		QueryError:   tl.processQueryError,
+	}
+}
+
+// Load a program file.  Errors in the program are printed; the error that is returned is an
+// error opening the file or an *engine.Halt.
+
+func (tl *Toplevel) Consult(filename string) error {
+	return tl.st.ConsultFile(filename, tl.callbacks())
+}
+
+// Read and evaluate queries from stdin until the end of the input, returning nil, or until a
+// query halts, returning the *engine.Halt.
+
+func (tl *Toplevel) Run() error {
+	err := tl.st.LoadQueries("user", tl.queries, tl.callbacks())
+	if err == nil && tl.opts.Interactive {
+		io.WriteString(tl.stdout, "\n")
+	}
+	return err
 }
 
-func processQuerySuccess(names []*engine.Atom, vars []engine.Varslot) bool {
-	for i, n := range names {
-		if n != nil {
-			os.Stdout.WriteString(n.String() + "=" + vars[i].String() + "\n")
+func (tl *Toplevel) processQuerySuccess(names []*engine.Atom, vars []engine.Varslot) bool {
+	tl.count++
+	if bindings := tl.st.FormatBindings(names, vars); len(bindings) > 0 {
+		io.WriteString(tl.stdout, strings.Join(bindings, ",\n"))
+	} else {
+		io.WriteString(tl.stdout, "true")
+	}
+	if tl.opts.Interactive {
+		io.WriteString(tl.stdout, " ")
+		line, err := tl.stdin.ReadString('\n')
+		if err == nil && strings.TrimSpace(line) == ";" {
+			return false
+		}
+		if err != nil {
+			io.WriteString(tl.stdout, "\n")
+		}
+	} else {
+		if tl.opts.MaxSolutions == 0 || tl.count < tl.opts.MaxSolutions {
+			io.WriteString(tl.stdout, " ;\n")
+			return false
 		}
+		io.WriteString(tl.stdout, "\n")
 	}
-	os.Stdout.WriteString("yes\n")
-	// But here we could return false if we want to induce failure and look for another result
+	tl.count = 0
+	tl.queries.fresh = true
+	io.WriteString(tl.stdout, "yes\n")
 	return true
 }
 
-func processQueryFailure() {
-	os.Stdout.WriteString("no\n")
+func (tl *Toplevel) processQueryFailure() {
+	tl.count = 0
+	tl.queries.fresh = true
+	io.WriteString(tl.stdout, "no\n")
+}
+
+func (tl *Toplevel) processQueryError(err error) {
+	tl.count = 0
+	tl.queries.fresh = true
+	var exn *engine.Exception
+	if errors.As(err, &exn) && exn.IsAbort() {
+		io.WriteString(tl.stdout, "% Execution aborted\n")
+		return
+	}
+	io.WriteString(tl.stdout, "error: "+err.Error()+"\n")
 }
 
-func Repl(st *engine.Store, r reader) {
-	ctx := newParser(st, processQuerySuccess, processQueryFailure)
-	t := newTokenizer(r, ctx)
-	if yyParse(t) != 0 {
-		panic("Parse failed")
+var traceCommands = map[string]engine.TraceAction{
+	"":  engine.Creep,
+	"c": engine.Creep,
+	"s": engine.Skip,
+	"l": engine.Leap,
+	"a": engine.Abort,
+}
+
+func (tl *Toplevel) Trace(e engine.TraceEvent) engine.TraceAction {
+	if !tl.opts.Interactive {
+		io.WriteString(tl.stdout, e.String()+"\n")
+		return engine.Creep
+	}
+	for {
+		io.WriteString(tl.stdout, e.String()+" ? ")
+		line, err := tl.stdin.ReadString('\n')
+		if err != nil {
+			io.WriteString(tl.stdout, "\n")
+			return engine.Abort
+		}
+		if action, ok := traceCommands[strings.TrimSpace(line)]; ok {
+			return action
+		}
+		io.WriteString(tl.stdout, "c: creep, s: skip, l: leap, a: abort\n")
 	}
 }
+
+// A promptReader prints a prompt when it reads the first character of a line in interactive
+// mode.  The prompt is for a new query if `fresh` is set, which it is after every query.
+
+type promptReader struct {
+	r           *bufio.Reader
+	w           io.Writer
+	interactive bool
+	atLineStart bool
+	fresh       bool
+}
+
+func (p *promptReader) ReadRune() (rune, int, error) {
+	if p.interactive && p.atLineStart {
+		if p.fresh {
+			io.WriteString(p.w, "?- ")
+		} else {
+			io.WriteString(p.w, "|    ")
+		}
+	}
+	r, size, err := p.r.ReadRune()
+	p.atLineStart = err == nil && r == '\n'
+	p.fresh = false
+	return r, size, err
+}
+
+func (p *promptReader) UnreadRune() error {
+	p.atLineStart = false
+	return p.r.UnreadRune()
+}
+
+var _ io.RuneScanner = (*promptReader)(nil)
@@ -0,0 +1,73 @@
+package repl
+
+import (
+	"resolver/engine"
+	"strings"
+	"testing"
+)
+
+const program = `
+p(1).
+p(2).
+p(3).
+`
+
+// Run the top level on the input with the program loaded and return what it printed.
+
+func runToplevel(t *testing.T, opts Options, input string) string {
+	t.Helper()
+	st := engine.NewStore()
+	if err := st.Consult(strings.NewReader(program)); err != nil {
+		t.Fatal(err)
+	}
+	var out strings.Builder
+	tl := newToplevel(st, opts, strings.NewReader(input), &out)
+	if err := tl.Run(); err != nil {
+		t.Fatal(err)
+	}
+	return out.String()
+}
+
+func TestInteractive(t *testing.T) {
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		// Enter accepts the solution
+		{"p(X).\n\n", "?- X = 1 yes\n?- \n"},
+		// ; asks for the next one, until there are no more
+		{"p(X).\n;\n\n", "?- X = 1 X = 2 yes\n?- \n"},
+		{"p(X).\n;\n;\n;\n", "?- X = 1 X = 2 X = 3 no\n?- \n"},
+		// The end of the input accepts the solution
+		{"p(X).\n", "?- X = 1 \nyes\n?- \n"},
+		{"p(4).\np(\nX).\n\n", "?- no\n?- |    X = 1 yes\n?- \n"},
+		{"true.\n\n", "?- true yes\n?- \n"},
+		{"X is foo.\n", "?- error: user:1: error(type_error(evaluable,foo/0),context((is)/2,_A))\n?- \n"},
+	} {
+		got := runToplevel(t, Options{Interactive: true}, test.input)
+		if got != test.expected {
+			t.Errorf("%q: got\n%s\nexpected\n%s", test.input, got, test.expected)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	for _, test := range []struct {
+		maxSolutions int
+		input        string
+		expected     string
+	}{
+		{1, "p(X).\n", "X = 1\nyes\n"},
+		// -n 2
+		{2, "p(X).\np(4).\n", "X = 1 ;\nX = 2\nyes\nno\n"},
+		// -all
+		{0, "p(X).\n", "X = 1 ;\nX = 2 ;\nX = 3 ;\nno\n"},
+		{0, "X = a ; X = 'B'.\n", "X = a ;\nX = 'B' ;\nno\n"},
+		{1, "true.\nfail.\n", "true\nyes\nno\n"},
+	} {
+		got := runToplevel(t, Options{MaxSolutions: test.maxSolutions}, test.input)
+		if got != test.expected {
+			t.Errorf("%d, %q: got\n%s\nexpected\n%s", test.maxSolutions, test.input, got, test.expected)
+		}
+	}
+}